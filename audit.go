@@ -0,0 +1,109 @@
+package migrate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/vickxxx/migrate/source"
+)
+
+// Outcomes of a migration in an AuditRecord.
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// AuditRecord describes a single migration run against the database.
+// See SetAuditWriter.
+type AuditRecord struct {
+	Time      time.Time        `json:"time"`
+	Version   uint             `json:"version"`
+	Direction source.Direction `json:"direction"`
+	SQL       string           `json:"sql"`
+	// Duration is the run time of the migration in milliseconds.
+	Duration int64  `json:"duration_ms"`
+	Outcome  string `json:"outcome"`
+	Error    string `json:"error,omitempty"`
+	// DeployID is the id set with SetDeployID.
+	DeployID string `json:"deploy_id,omitempty"`
+}
+
+// ErrAudit is returned when a migration ran, but its AuditRecord couldn't
+// be written, see SetAuditWriter.
+type ErrAudit struct {
+	Version uint
+	Err     error
+}
+
+// Error implements the error interface.
+func (e ErrAudit) Error() string {
+	return fmt.Sprintf("migration %v ran, but its audit record couldn't be written: %v", e.Version, e.Err)
+}
+
+// SetAuditWriter makes Migrate write an AuditRecord for each migration it
+// runs to w, as newline-delimited JSON, i.e. to retain the executed DDL
+// in a file. Unlike Log it records the full body of each migration.
+// Failing to write a record fails the migration run with ErrAudit. The
+// migration is applied nonetheless, so its version is left dirty, to be
+// checked and forced by hand instead of running it again.
+func (m *Migrate) SetAuditWriter(w io.Writer) {
+	m.auditWriter = w
+}
+
+// runAudited runs the body of migr like runBody
+// and writes an AuditRecord if an audit writer is set.
+func (m *Migrate) runAudited(migr *Migration) error {
+	if m.auditWriter == nil {
+		return m.runBody(migr)
+	}
+
+	runErr, err := m.runAndAudit(migr)
+	if err == nil {
+		return runErr
+	}
+	if runErr == nil {
+		return ErrAudit{Version: migr.Version, Err: err}
+	}
+	return NewMultiError(runErr, err)
+}
+
+// runAndAudit runs the body of migr like runBody and writes its
+// AuditRecord, returning the errors of both.
+func (m *Migrate) runAndAudit(migr *Migration) (runErr error, err error) {
+
+	var body bytes.Buffer
+	migr.BufferedBody = io.TeeReader(migr.BufferedBody, &body)
+
+	recorded := m.clock()
+	start := time.Now()
+	runErr = m.runBody(migr)
+	duration := time.Since(start)
+	// record the full migration, even if the database stopped reading early
+	if _, err := io.Copy(ioutil.Discard, migr.BufferedBody); err != nil {
+		return runErr, err
+	}
+	record := AuditRecord{
+		Time:      recorded,
+		Version:   migr.Version,
+		Direction: migr.direction(),
+		SQL:       body.String(),
+		Duration:  int64(duration / time.Millisecond),
+		Outcome:   AuditSuccess,
+		DeployID:  m.deployID,
+	}
+	if runErr != nil {
+		record.Outcome = AuditFailure
+		record.Error = runErr.Error()
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return runErr, err
+	}
+	_, err = m.auditWriter.Write(append(line, '\n'))
+	return runErr, err
+}
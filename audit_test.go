@@ -0,0 +1,178 @@
+package migrate
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	dStub "github.com/vickxxx/migrate/database/stub"
+	"github.com/vickxxx/migrate/source"
+	sStub "github.com/vickxxx/migrate/source/stub"
+)
+
+func TestSetAuditWriter(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE TABLE a (a INT)"})
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Down, Identifier: "DROP TABLE a"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "CREATE TABLE b (b INT)"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Down, Identifier: "DROP TABLE b"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+
+	var audit bytes.Buffer
+	m.SetAuditWriter(&audit)
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Steps(-1); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []AuditRecord{
+		{Version: 1, Direction: source.Up, SQL: "CREATE TABLE a (a INT)", Outcome: AuditSuccess},
+		{Version: 2, Direction: source.Up, SQL: "CREATE TABLE b (b INT)", Outcome: AuditSuccess},
+		{Version: 2, Direction: source.Down, SQL: "DROP TABLE b", Outcome: AuditSuccess},
+	}
+
+	records := readAudit(t, &audit)
+	if len(records) != len(expected) {
+		t.Fatalf("expected %v records, got %v", len(expected), records)
+	}
+	for i, r := range records {
+		if r.Time.IsZero() {
+			t.Errorf("expected time in record %v", i)
+		}
+		r.Time, r.Duration = expected[i].Time, expected[i].Duration
+		if r != expected[i] {
+			t.Errorf("expected %+v, got %+v", expected[i], r)
+		}
+	}
+}
+
+func TestSetAuditWriterFailure(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE TABLE a (a INT)"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	var audit bytes.Buffer
+	m.SetAuditWriter(&audit)
+
+	runErr := errors.New("syntax error")
+	m.databaseDrv = &failingStub{Stub: dbDrv, err: runErr}
+	if err := m.Up(); err != runErr {
+		t.Fatalf("expected %v, got %v", runErr, err)
+	}
+
+	records := readAudit(t, &audit)
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %v", records)
+	}
+	if records[0].Outcome != AuditFailure || records[0].Error != runErr.Error() || records[0].SQL != "CREATE TABLE a (a INT)" {
+		t.Fatalf("expected failure with %v, got %+v", runErr, records[0])
+	}
+}
+
+// failingWriter fails every write with err.
+type failingWriter struct {
+	err error
+}
+
+func (w failingWriter) Write(p []byte) (int, error) {
+	return 0, w.err
+}
+
+func TestSetAuditWriterWriteFailure(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE TABLE a (a INT)"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "CREATE TABLE b (b INT)"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+	// the version isn't marked dirty before a migration
+	// with transactional DDL
+	m.databaseDrv = &transactionalStub{Stub: dbDrv, transactional: true}
+
+	writeErr := errors.New("disk full")
+	m.SetAuditWriter(failingWriter{writeErr})
+
+	err := m.Up()
+	if e, ok := err.(ErrAudit); !ok || e.Version != 1 || e.Err != writeErr {
+		t.Fatalf("expected ErrAudit for version 1, got %v", err)
+	}
+	// applied, but not audited
+	if !dbDrv.EqualSequence([]string{"CREATE TABLE a (a INT)"}) {
+		t.Fatalf("expected only version 1 to run, got %v", dbDrv.MigrationSequence)
+	}
+	if dbDrv.CurrentVersion != 1 || !dbDrv.IsDirty {
+		t.Fatalf("expected dirty version 1, got %v, %v", dbDrv.CurrentVersion, dbDrv.IsDirty)
+	}
+}
+
+// clockStub records the clock set by SetClock.
+type clockStub struct {
+	*dStub.Stub
+	clock func() time.Time
+}
+
+func (s *clockStub) SetClock(clock func() time.Time) {
+	s.clock = clock
+}
+
+func TestSetClock(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE TABLE a (a INT)"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	dbDrv := &clockStub{Stub: m.databaseDrv.(*dStub.Stub)}
+	m.databaseDrv = dbDrv
+
+	appliedAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	m.SetClock(func() time.Time { return appliedAt })
+	if dbDrv.clock == nil || !dbDrv.clock().Equal(appliedAt) {
+		t.Fatal("expected the clock to be set on the database driver")
+	}
+
+	var audit bytes.Buffer
+	m.SetAuditWriter(&audit)
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	records := readAudit(t, &audit)
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %v", records)
+	}
+	if !records[0].Time.Equal(appliedAt) {
+		t.Fatalf("expected time %v, got %v", appliedAt, records[0].Time)
+	}
+}
+
+// failingStub fails every migration with err.
+type failingStub struct {
+	*dStub.Stub
+	err error
+}
+
+func (s *failingStub) Run(migration io.Reader) error {
+	return s.err
+}
+
+func readAudit(t *testing.T, audit *bytes.Buffer) []AuditRecord {
+	records := make([]AuditRecord, 0)
+	s := bufio.NewScanner(audit)
+	for s.Scan() {
+		var r AuditRecord
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
@@ -0,0 +1,7 @@
+// +build consul
+
+package main
+
+import (
+	_ "github.com/vickxxx/migrate/source/consul"
+)
@@ -0,0 +1,7 @@
+// +build couchbase
+
+package main
+
+import (
+	_ "github.com/vickxxx/migrate/database/couchbase"
+)
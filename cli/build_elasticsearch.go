@@ -0,0 +1,7 @@
+// +build elasticsearch
+
+package main
+
+import (
+	_ "github.com/vickxxx/migrate/database/elasticsearch"
+)
@@ -0,0 +1,7 @@
+// +build exec
+
+package main
+
+import (
+	_ "github.com/vickxxx/migrate/database/exec"
+)
@@ -0,0 +1,7 @@
+// +build redis
+
+package main
+
+import (
+	_ "github.com/vickxxx/migrate/database/redis"
+)
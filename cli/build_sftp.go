@@ -0,0 +1,7 @@
+// +build sftp
+
+package main
+
+import (
+	_ "github.com/vickxxx/migrate/source/sftp"
+)
@@ -0,0 +1,7 @@
+// +build yugabyte
+
+package main
+
+import (
+	_ "github.com/vickxxx/migrate/database/yugabyte"
+)
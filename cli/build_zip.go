@@ -0,0 +1,7 @@
+// +build zip
+
+package main
+
+import (
+	_ "github.com/vickxxx/migrate/source/zip"
+)
@@ -1,11 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"github.com/vickxxx/migrate"
+	"github.com/vickxxx/migrate/database"
 	_ "github.com/vickxxx/migrate/database/stub" // TODO remove again
+	"github.com/vickxxx/migrate/source"
 	_ "github.com/vickxxx/migrate/source/file"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"fmt"
+	"strings"
 )
 
 func createCmd(dir string, timestamp int64, name string, ext string) {
@@ -21,6 +29,65 @@ func createFile(fname string) {
   }
 }
 
+// findMigration returns the latest version of the migrations titled name in dir.
+func findMigration(dir string, name string) (version uint, ok bool) {
+	if dir == "" {
+		dir = "."
+	}
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, false
+	} else if err != nil {
+		log.fatalErr(err)
+	}
+	for _, fi := range infos {
+		m, err := source.DefaultParse(fi.Name())
+		if err != nil || m.Identifier != name {
+			continue
+		}
+		if !ok || m.Version > version {
+			version, ok = m.Version, true
+		}
+	}
+	return version, ok
+}
+
+// verifyCmd migrates the scratch database to the version before v,
+// then runs the up and down migration of v in a rolled back transaction.
+func verifyCmd(dir string, v uint, databaseUrl string) {
+	if dir == "" {
+		dir = "."
+	}
+	sourceUrl := fmt.Sprintf("file://%v", dir)
+
+	d, err := source.Open(sourceUrl)
+	if err != nil {
+		log.fatalErr(err)
+	}
+	prev, prevErr := d.Prev(v)
+	d.Close()
+
+	m, err := migrate.New(sourceUrl, databaseUrl)
+	if err != nil {
+		log.fatalErr(err)
+	}
+	defer m.Close()
+	m.Log = log
+
+	if prevErr == nil {
+		if err := m.Migrate(prev); err != nil && err != migrate.ErrNoChange {
+			log.fatalErr(err)
+		}
+	}
+
+	if err := m.RoundTrip(v); err == migrate.ErrNoRoundTrip {
+		log.fatal("error: the database of -verify can't roll back migrations, use a database with transactional DDL")
+	} else if err != nil {
+		log.fatalErr(err)
+	}
+	log.Printf("Verified up and down migration of version %v\n", v)
+}
+
 func gotoCmd(m *migrate.Migrate, v uint) {
 	if err := m.Migrate(v); err != nil {
 		if err != migrate.ErrNoChange {
@@ -51,7 +118,22 @@ func upCmd(m *migrate.Migrate, limit int) {
 	}
 }
 
-func downCmd(m *migrate.Migrate, limit int) {
+// downCmd asks before rolling back the versions
+// of the down plan, unless confirmed with -f.
+func downCmd(m *migrate.Migrate, limit int, confirmed bool) {
+	if !confirmed {
+		versions, err := m.DownPlan(limit)
+		if err == migrate.ErrNoChange {
+			log.Println(err)
+			return
+		} else if err != nil {
+			log.fatalErr(err)
+		}
+		if !downPrompt(versions) {
+			log.fatal("error: down migrations aborted, confirm with -f to skip the prompt")
+		}
+	}
+
 	if limit >= 0 {
 		if err := m.Steps(-limit); err != nil {
 			if err != migrate.ErrNoChange {
@@ -77,12 +159,230 @@ func dropCmd(m *migrate.Migrate) {
 	}
 }
 
+// confirmPrompt asks on the terminal before a down migration
+// with a `-- migrate:confirm` directive runs.
+func confirmPrompt(version uint, message string) bool {
+	fmt.Fprintf(os.Stderr, "%v\nRun down migration %v? [y/N] ", message, version)
+	return readYes()
+}
+
+// downPrompt asks on the terminal before the down command rolls back versions.
+func downPrompt(versions []uint) bool {
+	list := make([]string, len(versions))
+	for i, v := range versions {
+		list[i] = fmt.Sprint(v)
+	}
+	fmt.Fprintf(os.Stderr, "About to roll back versions %v. Continue? [y/N] ", strings.Join(list, ", "))
+	return readYes()
+}
+
+// readYes reads the answer to a prompt, anything but yes is no.
+func readYes() bool {
+	var answer string
+	fmt.Scanln(&answer)
+	return answer == "y" || answer == "Y" || answer == "yes"
+}
+
+// isTerminal reports whether f is a terminal rather than a pipe or file.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
 func forceCmd(m *migrate.Migrate, v int) {
 	if err := m.Force(v); err != nil {
 		log.fatalErr(err)
 	}
 }
 
+func unlockCmd(m *migrate.Migrate, confirmed bool) {
+	log.Println("warning: unlock releases the lock even if another migration is running")
+	if !confirmed {
+		log.fatal("error: please confirm with -f that no migration is running")
+	}
+	if err := m.ForceUnlock(); err != nil {
+		log.fatalErr(err)
+	}
+}
+
+// squashCmd squashes the migrations up to v. Against a database at
+// version v, the migrations up to v in dir are replaced by its schema first,
+// and m is opened again by reopen to read them.
+func squashCmd(m *migrate.Migrate, v uint, dir string, reopen func() (*migrate.Migrate, error)) {
+	// the schema only matches the squashed migration at version v
+	curVersion, dirty, err := m.Version()
+	if err == nil && !dirty && curVersion == v && dir != "" {
+		dump, err := m.Dump()
+		if err != nil {
+			log.fatalErr(err)
+		}
+		name, err := squashFiles(dir, v, dump)
+		if err != nil {
+			log.fatalErr(err)
+		}
+		log.Printf("Replaced the migrations up to %v with %v\n", v, name)
+
+		if m, err = reopen(); err != nil {
+			log.fatalErr(err)
+		}
+		defer m.Close()
+	}
+
+	if err := m.Squash(v); err != nil {
+		log.fatalErr(err)
+	}
+}
+
+// squashFiles replaces the migrations up to v in dir with a single up
+// migration of v, <v>_squashed.up with the extension of the up migration
+// of v, and returns its name.
+func squashFiles(dir string, v uint, migration []byte) (string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	up, ext := false, ""
+	squashed := make([]string, 0)
+	for _, fi := range infos {
+		m, err := source.DefaultParse(fi.Name())
+		if err != nil || m.Version > v {
+			continue
+		}
+		if m.Version == v && m.Direction == source.Up {
+			up = true
+			if parts := source.Regex.FindStringSubmatch(fi.Name()); parts != nil {
+				ext = "." + parts[4]
+			}
+		}
+		squashed = append(squashed, fi.Name())
+	}
+	if !up {
+		return "", fmt.Errorf("no up migration %v in %v", v, dir)
+	}
+
+	// written aside first, so that the migrations are only removed
+	// once the squashed one is complete
+	name := fmt.Sprintf("%v_squashed.up%v", v, ext)
+	tmp := filepath.Join(dir, "."+name+".tmp")
+	if err := ioutil.WriteFile(tmp, migration, 0644); err != nil {
+		return "", err
+	}
+	for _, f := range squashed {
+		if err := os.Remove(filepath.Join(dir, f)); err != nil {
+			return "", err
+		}
+	}
+	return name, os.Rename(tmp, filepath.Join(dir, name))
+}
+
+// sqlCmd prints the migration of version v in direction as it
+// would run, without running it, i.e. to review it before a deploy.
+func sqlCmd(m *migrate.Migrate, v uint, direction string) {
+	if err := writeSQL(os.Stdout, m, v, source.Direction(direction)); os.IsNotExist(err) {
+		log.fatal(fmt.Sprintf("error: no %v migration for version %v", direction, v))
+	} else if err != nil {
+		log.fatalErr(err)
+	}
+}
+
+// writeSQL writes the body m reads for version v in direction to w.
+func writeSQL(w io.Writer, m *migrate.Migrate, v uint, direction source.Direction) error {
+	body, err := m.Read(v, direction)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+func manifestCmd(sourceUrl string, path string, verify bool) {
+	d, err := source.Open(sourceUrl)
+	if err != nil {
+		log.fatalErr(err)
+	}
+	defer d.Close()
+
+	name := filepath.Join(path, migrate.ManifestFile)
+	if verify {
+		f, err := os.Open(name)
+		if err != nil {
+			log.fatalErr(err)
+		}
+		defer f.Close()
+		if err := migrate.VerifyManifest(f, d); err != nil {
+			log.fatalErr(err)
+		}
+		log.Println("migrations match", name)
+		return
+	}
+
+	var manifest bytes.Buffer
+	if err := migrate.WriteManifest(&manifest, d); err != nil {
+		log.fatalErr(err)
+	}
+	if err := ioutil.WriteFile(name, manifest.Bytes(), 0644); err != nil {
+		log.fatalErr(err)
+	}
+}
+
+func validateCmd(sourceUrl string, path string, config migrate.LintConfig) {
+	problems := make([]string, 0)
+
+	// the file source skips files it can't parse, look at them first
+	files := 0
+	if path != "" {
+		infos, err := ioutil.ReadDir(path)
+		if err != nil {
+			log.fatalErr(err)
+		}
+		for _, fi := range infos {
+			if fi.IsDir() || fi.Name() == migrate.ManifestFile {
+				continue
+			}
+			files++
+			if _, err := source.DefaultParse(fi.Name()); err != nil {
+				problems = append(problems, fmt.Sprintf("%v is not a migration file", fi.Name()))
+			}
+		}
+	}
+
+	// fails for duplicate versions
+	d, err := source.Open(sourceUrl)
+	if err != nil {
+		log.fatalErr(err)
+	}
+	defer d.Close()
+
+	versions, err := migrate.Lint(d, config)
+	if e, ok := err.(migrate.ErrLint); ok {
+		problems = append(problems, e.Problems...)
+	} else if err != nil {
+		log.fatalErr(err)
+	}
+
+	for _, p := range problems {
+		log.Println("error:", p)
+	}
+	// without -require-down they are only reported
+	if !config.RequireDown {
+		missing, err := source.MissingDowns(d)
+		if err != nil {
+			log.fatalErr(err)
+		}
+		for _, v := range missing {
+			log.Printf("warning: version %v has no down migration\n", v)
+		}
+	}
+	if path != "" {
+		log.Printf("Checked %v files, %v versions, %v problems\n", files, len(versions), len(problems))
+	} else {
+		log.Printf("Checked %v versions, %v problems\n", len(versions), len(problems))
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
+
 func versionCmd(m *migrate.Migrate) {
 	v, dirty, err := m.Version()
 	if err != nil {
@@ -94,3 +394,62 @@ func versionCmd(m *migrate.Migrate) {
 		log.Println(v)
 	}
 }
+
+func statusCmd(m *migrate.Migrate, asJSON bool) {
+	status, err := m.Status()
+	if err != nil {
+		log.fatalErr(err)
+	}
+
+	if asJSON {
+		if err := json.NewEncoder(os.Stdout).Encode(status); err != nil {
+			log.fatalErr(err)
+		}
+		return
+	}
+
+	if status.Version == database.NilVersion {
+		fmt.Println("version: none")
+	} else if status.Dirty {
+		fmt.Printf("version: %v (dirty)\n", status.Version)
+	} else {
+		fmt.Printf("version: %v\n", status.Version)
+	}
+	fmt.Printf("applied: %v\n", status.Applied)
+	fmt.Printf("pending: %v\n", status.Pending)
+	fmt.Printf("orphans: %v\n", status.Orphans)
+	if len(status.Gaps) > 0 {
+		fmt.Printf("WARNING: versions %v were never applied\n", status.Gaps)
+	}
+}
+
+func planCmd(m *migrate.Migrate, format string) {
+	steps, err := m.Plan()
+	if err != nil {
+		log.fatalErr(err)
+	}
+
+	switch format {
+	case "dot":
+		if err := migrate.WritePlanDot(os.Stdout, steps); err != nil {
+			log.fatalErr(err)
+		}
+	case "text":
+		for _, s := range steps {
+			status := "pending"
+			switch {
+			case s.Dirty:
+				status = "dirty"
+			case s.Applied:
+				status = "applied"
+			}
+			after := ""
+			if len(s.After) > 0 {
+				after = fmt.Sprintf(" (after %v)", s.After)
+			}
+			fmt.Printf("%v\t%v\t%v%v\n", s.Version, status, s.Identifier, after)
+		}
+	default:
+		log.fatal("error: unknown format " + format + ", expected text or dot")
+	}
+}
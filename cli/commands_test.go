@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/vickxxx/migrate"
+	"github.com/vickxxx/migrate/source"
+	"github.com/vickxxx/migrate/source/memory"
+)
+
+func TestWriteSQL(t *testing.T) {
+	sourceDrv, err := memory.WithInstance([]migrate.MemoryMigration{
+		{Version: 1, Direction: source.Up, Body: "CREATE TABLE a (id INT);"},
+		{Version: 1, Direction: source.Down, Body: "DROP TABLE a;"},
+		{Version: 2, Direction: source.Up, Body: "\xef\xbb\xbfCREATE TABLE b (id INT);"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := migrate.NewWithSourceInstance("memory", sourceDrv, "stub://")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		version   uint
+		direction source.Direction
+		expect    string
+	}{
+		{1, source.Up, "CREATE TABLE a (id INT);"},
+		{1, source.Down, "DROP TABLE a;"},
+		// the byte order mark is stripped, as it is before running
+		{2, source.Up, "CREATE TABLE b (id INT);"},
+	}
+	for i, v := range tt {
+		var buf bytes.Buffer
+		if err := writeSQL(&buf, m, v.version, v.direction); err != nil {
+			t.Fatalf("expected err to be nil, got %v, in %v", err, i)
+		}
+		if buf.String() != v.expect {
+			t.Errorf("expected %q, got %q, in %v", v.expect, buf.String(), i)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := writeSQL(&buf, m, 2, source.Down); !os.IsNotExist(err) {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+	if err := writeSQL(&buf, m, 3, source.Up); !os.IsNotExist(err) {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("expected nothing to be written, got %q", buf.String())
+	}
+
+	// nothing ran against the database
+	if version, _, err := m.Version(); err != migrate.ErrNilVersion {
+		t.Fatalf("expected ErrNilVersion, got %v, %v", version, err)
+	}
+}
+
+func TestSquashFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "squash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"1_init.up.sql", "1_init.down.sql", "2_users.up.sql", "2_users.down.sql", "3_posts.up.sql", "3_posts.down.sql", "README.md"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := squashFiles(dir, 4, []byte("CREATE TABLE users ();")); err == nil {
+		t.Fatal("expected err for a version without up migration")
+	}
+
+	name, err := squashFiles(dir, 2, []byte("CREATE TABLE users ();"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "2_squashed.up.sql" {
+		t.Fatalf("expected 2_squashed.up.sql, got %v", name)
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0)
+	for _, fi := range infos {
+		names = append(names, fi.Name())
+	}
+	expected := []string{"2_squashed.up.sql", "3_posts.down.sql", "3_posts.up.sql", "README.md"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+	if body, _ := ioutil.ReadFile(filepath.Join(dir, name)); string(body) != "CREATE TABLE users ();" {
+		t.Fatalf("expected the schema, got %q", body)
+	}
+}
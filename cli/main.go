@@ -20,11 +20,13 @@ func main() {
 	helpPtr := flag.Bool("help", false, "")
 	versionPtr := flag.Bool("version", false, "")
 	verbosePtr := flag.Bool("verbose", false, "")
-	prefetchPtr := flag.Uint("prefetch", 10, "")
-	lockTimeoutPtr := flag.Uint("lock-timeout", 15, "")
+	prefetchPtr := flag.Uint("prefetch", migrate.DefaultPrefetchMigrations, "")
+	lockTimeoutPtr := flag.String("lock-timeout", migrate.DefaultLockTimeout.String(), "")
 	pathPtr := flag.String("path", "", "")
 	databasePtr := flag.String("database", "", "")
 	sourcePtr := flag.String("source", "", "")
+	deployIDPtr := flag.String("deploy-id", "", "")
+	strictPtr := flag.Bool("strict", false, "")
 
 	flag.Usage = func() {
 		fmt.Fprint(os.Stderr,
@@ -36,19 +38,51 @@ Options:
   -path            Shorthand for -source=file://path 
   -database        Run migrations against this database (driver://url)
   -prefetch N      Number of migrations to load in advance before executing (default 10)
-  -lock-timeout N  Allow N seconds to acquire database lock (default 15)
+  -lock-timeout D  Allow duration D to acquire database lock, e.g. 1m30s, or D seconds (default 15s)
+  -deploy-id ID    Record ID, i.e. the release, with each version applied, if the database supports it
+  -strict          Fail before migrating if an applied migration was changed since it was applied,
+                   if the database records checksums
   -verbose         Print verbose logging
   -version         Print version
   -help            Print usage
 
 Commands:
-  create [-ext E] [-dir D] NAME
-               Create a set of timestamped up/down migrations titled NAME, in directory D with extension E
-  goto V       Migrate to version V
+  create [-ext E] [-dir D] [-verify DSN] NAME
+               Create a set of timestamped up/down migrations titled NAME, in directory D with extension E.
+               With -verify, run the up and down migration titled NAME in a rolled back transaction
+               against the scratch database DSN, after migrating it to the previous version.
+               An existing set titled NAME is verified instead of creating a new one
+  goto V       Migrate to version V, or to the last version of the source with V latest
   up [N]       Apply all or N up migrations
-  down [N]     Apply all or N down migrations
+  down [-f] [N]
+               Apply all or N down migrations, after asking to roll back the versions
+               they revert. With -f, don't ask, i.e. in scripts
+  sql N [-direction D]
+               Print the up (default) or with -direction down the down migration
+               of version N as it would run, without running it
   drop         Drop everyting inside database
   force V      Set version V but don't run migration (ignores dirty state)
+  unlock -f    Release the lock left behind by a crashed migration, even if the database is dirty.
+               Make sure no migration is running
+  plan [-format F]
+               Print all migrations and whether they are applied, as text (default)
+               or with -format dot as a graphviz DOT graph of their dependencies
+  status [-json]
+               Print the current version and the applied, pending and orphaned versions,
+               with -json including checksums, i.e. for CI to check pending migrations,
+               and warn about versions that were never applied between applied ones
+  squash -to V Squash the migrations up to V into a single migration V. Against a database
+               at version V, the migrations up to V in -path are replaced by V_squashed.up
+               with its schema. Against databases beyond V, once the source is squashed,
+               record the squashed migration in place of the squashed ones
+  manifest [-path P] [-verify]
+               Write the name and SHA-256 of every migration to P/migrations.sum
+               With -verify, fail if a migration was modified, added or removed since
+               the manifest was written
+  validate [-path P] [-require-down=false] [-contiguous=false]
+               Check that all migrations parse, versions are unique and contiguous
+               and each up migration has a down migration, without a database.
+               With -require-down=false up migrations without down migration are warnings
   version      Print current migration version
 `)
 	}
@@ -70,6 +104,11 @@ Commands:
 		os.Exit(0)
 	}
 
+	lockTimeout, err := parseLockTimeout(*lockTimeoutPtr)
+	if err != nil {
+		log.fatal("error: " + err.Error())
+	}
+
 	// translate -path into -source if given
 	if *sourcePtr == "" && *pathPtr != "" {
 		*sourcePtr = fmt.Sprintf("file://%v", *pathPtr)
@@ -86,8 +125,24 @@ Commands:
 	}()
 	if migraterErr == nil {
 		migrater.Log = log
-		migrater.PrefetchMigrations = *prefetchPtr
-		migrater.LockTimeout = time.Duration(int64(*lockTimeoutPtr)) * time.Second
+		configure(migrater, *prefetchPtr, lockTimeout)
+
+		if *deployIDPtr != "" {
+			if err := migrater.SetDeployID(*deployIDPtr); err != nil {
+				log.fatalErr(err)
+			}
+		}
+
+		if *strictPtr {
+			if err := migrater.SetStrict(true); err != nil {
+				log.fatalErr(err)
+			}
+		}
+
+		// ask before destructive down migrations, unless run by scripts
+		if isTerminal(os.Stdin) {
+			migrater.SetConfirm(confirmPrompt)
+		}
 
 		// handle Ctrl+c
 		signals := make(chan os.Signal, 1)
@@ -110,6 +165,7 @@ Commands:
 		createFlagSet := flag.NewFlagSet("create", flag.ExitOnError)
 		extPtr := createFlagSet.String("ext", "", "File extension")
 		dirPtr := createFlagSet.String("dir", "", "Directory to place file in (default: current working directory)")
+		verifyPtr := createFlagSet.String("verify", "", "Scratch database to verify that the migrations are reversible in (driver://url)")
 		createFlagSet.Parse(args)
 
 		if createFlagSet.NArg() == 0 {
@@ -126,7 +182,17 @@ Commands:
 
 		timestamp := startTime.Unix()
 
-		createCmd(*dirPtr, timestamp, name, *extPtr)
+		if *verifyPtr == "" {
+			createCmd(*dirPtr, timestamp, name, *extPtr)
+			break
+		}
+
+		version, ok := findMigration(*dirPtr, name)
+		if !ok {
+			createCmd(*dirPtr, timestamp, name, *extPtr)
+			version = uint(timestamp)
+		}
+		verifyCmd(*dirPtr, version, *verifyPtr)
 
 	case "goto":
 		if migraterErr != nil {
@@ -137,12 +203,16 @@ Commands:
 			log.fatal("error: please specify version argument V")
 		}
 
-		v, err := strconv.ParseUint(flag.Arg(1), 10, 64)
-		if err != nil {
-			log.fatal("error: can't read version argument V")
+		v := migrate.Latest
+		if flag.Arg(1) != "latest" {
+			n, err := strconv.ParseUint(flag.Arg(1), 10, 64)
+			if err != nil {
+				log.fatal("error: can't read version argument V")
+			}
+			v = uint(n)
 		}
 
-		gotoCmd(migrater, uint(v))
+		gotoCmd(migrater, v)
 
 		if log.verbose {
 			log.Println("Finished after", time.Now().Sub(startTime))
@@ -173,21 +243,58 @@ Commands:
 			log.fatalErr(migraterErr)
 		}
 
+		args := flag.Args()[1:]
+
+		downFlagSet := flag.NewFlagSet("down", flag.ExitOnError)
+		forcePtr := downFlagSet.Bool("f", false, "Roll back without asking")
+		downFlagSet.Parse(args)
+
 		limit := -1
-		if flag.Arg(1) != "" {
-			n, err := strconv.ParseUint(flag.Arg(1), 10, 64)
+		if downFlagSet.Arg(0) != "" {
+			n, err := strconv.ParseUint(downFlagSet.Arg(0), 10, 64)
 			if err != nil {
 				log.fatal("error: can't read limit argument N")
 			}
 			limit = int(n)
 		}
 
-		downCmd(migrater, limit)
+		downCmd(migrater, limit, *forcePtr)
 
 		if log.verbose {
 			log.Println("Finished after", time.Now().Sub(startTime))
 		}
 
+	case "sql":
+		if migraterErr != nil {
+			log.fatalErr(migraterErr)
+		}
+
+		args := flag.Args()[1:]
+
+		sqlFlagSet := flag.NewFlagSet("sql", flag.ExitOnError)
+		directionPtr := sqlFlagSet.String("direction", "up", "Direction of the migration, up or down")
+
+		// the version may come before the flags, i.e. sql 3 -direction down
+		version := ""
+		if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+			version, args = args[0], args[1:]
+		}
+		sqlFlagSet.Parse(args)
+		if version == "" {
+			version = sqlFlagSet.Arg(0)
+		}
+
+		if version == "" {
+			log.fatal("error: please specify version argument N")
+		}
+
+		v, err := strconv.ParseUint(version, 10, 64)
+		if err != nil {
+			log.fatal("error: can't read version argument N")
+		}
+
+		sqlCmd(migrater, uint(v), *directionPtr)
+
 	case "drop":
 		if migraterErr != nil {
 			log.fatalErr(migraterErr)
@@ -223,6 +330,123 @@ Commands:
 			log.Println("Finished after", time.Now().Sub(startTime))
 		}
 
+	case "unlock":
+		if migraterErr != nil {
+			log.fatalErr(migraterErr)
+		}
+
+		args := flag.Args()[1:]
+
+		unlockFlagSet := flag.NewFlagSet("unlock", flag.ExitOnError)
+		forcePtr := unlockFlagSet.Bool("f", false, "Confirm that no migration is running")
+		unlockFlagSet.Parse(args)
+
+		unlockCmd(migrater, *forcePtr)
+
+	case "plan":
+		if migraterErr != nil {
+			log.fatalErr(migraterErr)
+		}
+
+		args := flag.Args()[1:]
+
+		planFlagSet := flag.NewFlagSet("plan", flag.ExitOnError)
+		formatPtr := planFlagSet.String("format", "text", "Output format, text or dot")
+		planFlagSet.Parse(args)
+
+		planCmd(migrater, *formatPtr)
+
+	case "status":
+		if migraterErr != nil {
+			log.fatalErr(migraterErr)
+		}
+
+		args := flag.Args()[1:]
+
+		statusFlagSet := flag.NewFlagSet("status", flag.ExitOnError)
+		jsonPtr := statusFlagSet.Bool("json", false, "Print the status as JSON")
+		statusFlagSet.Parse(args)
+
+		statusCmd(migrater, *jsonPtr)
+
+	case "squash":
+		if migraterErr != nil {
+			log.fatalErr(migraterErr)
+		}
+
+		args := flag.Args()[1:]
+
+		squashFlagSet := flag.NewFlagSet("squash", flag.ExitOnError)
+		toPtr := squashFlagSet.String("to", "", "Last version of the squashed range")
+		squashFlagSet.Parse(args)
+
+		if *toPtr == "" {
+			log.fatal("error: please specify version argument -to V")
+		}
+
+		v, err := strconv.ParseUint(*toPtr, 10, 64)
+		if err != nil {
+			log.fatal("error: can't read version argument V")
+		}
+
+		// the migrations are read again once they are replaced
+		reopen := func() (*migrate.Migrate, error) {
+			m, err := migrate.New(*sourcePtr, *databasePtr)
+			if err != nil {
+				return nil, err
+			}
+			m.Log = log
+			configure(m, *prefetchPtr, lockTimeout)
+			if *deployIDPtr != "" {
+				if err := m.SetDeployID(*deployIDPtr); err != nil {
+					m.Close()
+					return nil, err
+				}
+			}
+			return m, nil
+		}
+		squashCmd(migrater, uint(v), *pathPtr, reopen)
+
+		if log.verbose {
+			log.Println("Finished after", time.Now().Sub(startTime))
+		}
+
+	case "manifest":
+		args := flag.Args()[1:]
+
+		manifestFlagSet := flag.NewFlagSet("manifest", flag.ExitOnError)
+		manifestPathPtr := manifestFlagSet.String("path", *pathPtr, "Directory of the migrations and the manifest")
+		verifyPtr := manifestFlagSet.Bool("verify", false, "Check the migrations against the manifest instead")
+		manifestFlagSet.Parse(args)
+
+		if *manifestPathPtr == "" {
+			log.fatal("error: please specify -path")
+		}
+
+		manifestCmd(fmt.Sprintf("file://%v", *manifestPathPtr), *manifestPathPtr, *verifyPtr)
+
+	case "validate":
+		args := flag.Args()[1:]
+
+		validateFlagSet := flag.NewFlagSet("validate", flag.ExitOnError)
+		validatePathPtr := validateFlagSet.String("path", *pathPtr, "Shorthand for -source=file://path")
+		requireDownPtr := validateFlagSet.Bool("require-down", true, "Require a down migration for every up migration")
+		contiguousPtr := validateFlagSet.Bool("contiguous", true, "Require versions without gaps")
+		validateFlagSet.Parse(args)
+
+		sourceUrl := *sourcePtr
+		if *validatePathPtr != *pathPtr {
+			sourceUrl = fmt.Sprintf("file://%v", *validatePathPtr)
+		}
+		if sourceUrl == "" {
+			log.fatal("error: please specify -path or -source")
+		}
+
+		validateCmd(sourceUrl, *validatePathPtr, migrate.LintConfig{
+			RequireDown: *requireDownPtr,
+			Contiguous:  *contiguousPtr,
+		})
+
 	case "version":
 		if migraterErr != nil {
 			log.fatalErr(migraterErr)
@@ -235,3 +459,23 @@ Commands:
 		os.Exit(0)
 	}
 }
+
+// parseLockTimeout parses the -lock-timeout flag, a duration like 1m30s.
+// A number without unit is seconds, as in earlier versions. Either has to
+// be positive.
+func parseLockTimeout(s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if seconds, serr := strconv.ParseUint(s, 10, 64); serr == nil {
+		d, err = time.Duration(seconds)*time.Second, nil
+	}
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid lock timeout %q, expected a duration like 30s", s)
+	}
+	return d, nil
+}
+
+// configure applies the global flags to m.
+func configure(m *migrate.Migrate, prefetch uint, lockTimeout time.Duration) {
+	m.PrefetchMigrations = prefetch
+	m.LockTimeout = lockTimeout
+}
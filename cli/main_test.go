@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/vickxxx/migrate"
+	_ "github.com/vickxxx/migrate/source/stub"
+)
+
+func TestParseLockTimeout(t *testing.T) {
+	tt := []struct {
+		flag      string
+		expect    time.Duration
+		expectErr bool
+	}{
+		{flag: "15s", expect: 15 * time.Second},
+		{flag: "1m30s", expect: 90 * time.Second},
+		{flag: "500ms", expect: 500 * time.Millisecond},
+		// seconds without unit, as in earlier versions
+		{flag: "15", expect: 15 * time.Second},
+		{flag: "0", expectErr: true},
+		{flag: "0s", expectErr: true},
+		{flag: "-1s", expectErr: true},
+		{flag: "-1", expectErr: true},
+		{flag: "", expectErr: true},
+		{flag: "soon", expectErr: true},
+	}
+
+	for i, v := range tt {
+		d, err := parseLockTimeout(v.flag)
+		if v.expectErr {
+			if err == nil {
+				t.Errorf("expected err for %q, got %v, in %v", v.flag, d, i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expected err to be nil for %q, got %v, in %v", v.flag, err, i)
+			continue
+		}
+		if d != v.expect {
+			t.Errorf("expected %v for %q, got %v, in %v", v.expect, v.flag, d, i)
+		}
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	tt := []struct {
+		prefetch    uint
+		lockTimeout time.Duration
+	}{
+		{prefetch: migrate.DefaultPrefetchMigrations, lockTimeout: migrate.DefaultLockTimeout},
+		{prefetch: 1, lockTimeout: 90 * time.Second},
+		{prefetch: 0, lockTimeout: time.Millisecond},
+	}
+
+	for i, v := range tt {
+		m, err := migrate.New("stub://", "stub://")
+		if err != nil {
+			t.Fatal(err)
+		}
+		configure(m, v.prefetch, v.lockTimeout)
+		if m.PrefetchMigrations != v.prefetch {
+			t.Errorf("expected prefetch %v, got %v, in %v", v.prefetch, m.PrefetchMigrations, i)
+		}
+		if m.LockTimeout != v.lockTimeout {
+			t.Errorf("expected lock timeout %v, got %v, in %v", v.lockTimeout, m.LockTimeout, i)
+		}
+	}
+}
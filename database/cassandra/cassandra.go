@@ -40,6 +40,11 @@ type Cassandra struct {
 }
 
 func (p *Cassandra) Open(url string) (database.Driver, error) {
+	url, err := database.RewriteURL(url)
+	if err != nil {
+		return nil, err
+	}
+
 	u, err := nurl.Parse(url)
 	if err != nil {
 		return nil, err
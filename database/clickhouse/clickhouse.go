@@ -19,6 +19,12 @@ var ErrNilConfig = fmt.Errorf("no config")
 type Config struct {
 	DatabaseName    string
 	MigrationsTable string
+
+	// PingAttempts is the number of times WithInstance pings the database
+	// before giving up, waiting PingInterval in between, see
+	// database.PingWithRetry. Defaults to a single ping.
+	PingAttempts int
+	PingInterval time.Duration
 }
 
 func init() {
@@ -30,7 +36,7 @@ func WithInstance(conn *sql.DB, config *Config) (database.Driver, error) {
 		return nil, ErrNilConfig
 	}
 
-	if err := conn.Ping(); err != nil {
+	if err := database.PingWithRetry(conn, config.PingAttempts, config.PingInterval); err != nil {
 		return nil, err
 	}
 
@@ -52,6 +58,11 @@ type ClickHouse struct {
 }
 
 func (ch *ClickHouse) Open(dsn string) (database.Driver, error) {
+	dsn, err := database.RewriteURL(dsn)
+	if err != nil {
+		return nil, err
+	}
+
 	purl, err := url.Parse(dsn)
 	if err != nil {
 		return nil, err
@@ -1,18 +1,24 @@
 package cockroachdb
 
 import (
+	"bytes"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
 	"io"
 	"io/ioutil"
 	nurl "net/url"
+	"time"
 
 	"github.com/cockroachdb/cockroach-go/crdb"
 	"github.com/lib/pq"
 	"github.com/vickxxx/migrate"
 	"github.com/vickxxx/migrate/database"
+	"github.com/vickxxx/migrate/database/multistmt"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"context"
 )
 
@@ -25,23 +31,219 @@ func init() {
 
 var DefaultMigrationsTable = "schema_migrations"
 var DefaultLockTable = "schema_lock"
+var DefaultVersionColumnType = "INT"
+
+var DefaultLockRetryBaseDelay = 100 * time.Millisecond
+var DefaultLockRetryMaxDelay = 5 * time.Second
+
+// DefaultTxRetries is the number of times a transaction is run again
+// after an error Config.Retryable reports as retryable.
+var DefaultTxRetries = 3
+
+// DefaultMaintenanceDatabase is the database Open connects to
+// when it has to create the target database first.
+var DefaultMaintenanceDatabase = "defaultdb"
+
+// restartSavepoint is the savepoint of the transaction retry protocol of
+// CockroachDB, which crdb.ExecuteTx uses. Rolling back to it restarts the
+// whole transaction instead of undoing part of it.
+const restartSavepoint = "cockroach_restart"
+
+// restartSavepointStatement matches a statement creating restartSavepoint.
+var restartSavepointStatement = regexp.MustCompile(`(?i)^SAVEPOINT\s+"?` + restartSavepoint + `"?$`)
+
+// versionColumnTypes lists the types allowed for the version column.
+// All of them are 64-bit integers in CockroachDB, so versions derived
+// from unix timestamps fit.
+var versionColumnTypes = map[string]bool{
+	"INT":     true,
+	"INT8":    true,
+	"INT64":   true,
+	"INTEGER": true,
+	"BIGINT":  true,
+}
+
+// Ways Version reads the version from the migrations table,
+// see Config.VersionSelect.
+const (
+	VersionSelectSingle = "single"
+	VersionSelectMax    = "max"
+)
 
 var (
-	ErrNilConfig      = fmt.Errorf("no config")
-	ErrNoDatabaseName = fmt.Errorf("no database name")
+	ErrNilConfig         = fmt.Errorf("no config")
+	ErrNoDatabaseName    = fmt.Errorf("no database name")
+	ErrReservedSavepoint = fmt.Errorf("savepoint " + restartSavepoint + " is reserved for transaction retries, use another name")
+	ErrFollowerReads     = fmt.Errorf("follower reads can't be used with a version query or state format " + StateFormatJSON)
+	ErrLockStaleAfter    = fmt.Errorf("lock stale after needs a lock heartbeat interval and must be longer")
 )
 
+// ErrInvalidVersionColumnType is returned when Config.VersionColumnType
+// is not one of the supported integer types.
+type ErrInvalidVersionColumnType struct {
+	Type string
+}
+
+func (e ErrInvalidVersionColumnType) Error() string {
+	return fmt.Sprintf("invalid version column type %v, must be an integer type", e.Type)
+}
+
+// ErrInvalidVersionSelect is returned when Config.VersionSelect is
+// unknown, or set to VersionSelectMax with a version query or JSON state.
+type ErrInvalidVersionSelect struct {
+	VersionSelect string
+	Reason        string
+}
+
+func (e ErrInvalidVersionSelect) Error() string {
+	return fmt.Sprintf("invalid version select %q: %v", e.VersionSelect, e.Reason)
+}
+
+// ErrInvalidVersionQuery is returned when Config.VersionQuery doesn't
+// return an integer version and a boolean dirty flag.
+type ErrInvalidVersionQuery struct {
+	Query  string
+	Reason string
+}
+
+func (e ErrInvalidVersionQuery) Error() string {
+	return fmt.Sprintf("invalid version query %q: %v", e.Query, e.Reason)
+}
+
+// ErrUnmanagedObjects is returned by Drop with Config.DropOnlyManaged
+// when the schema has Objects no migration created.
+type ErrUnmanagedObjects struct {
+	Objects []string
+}
+
+func (e ErrUnmanagedObjects) Error() string {
+	return fmt.Sprintf("refusing to drop, not created by migrations: %v", strings.Join(e.Objects, ", "))
+}
+
 type Config struct {
 	MigrationsTable string
 	LockTable		string
 	ForceLock		bool
 	DatabaseName    string
+	// VersionDatabase keeps the migrations table in another database
+	// than DatabaseName, i.e. a tracking database shared by several
+	// databases, each with a migrations table of its own. Its schema is
+	// public unless MigrationsTable is qualified. Version and SetVersion
+	// use it, while migrations run in DatabaseName, and so does the lock
+	// table. The database has to exist.
+	VersionDatabase string
+	// VersionColumnType is the integer type of the version column.
+	// Defaults to DefaultVersionColumnType.
+	VersionColumnType string
+	// CreateDatabaseIfNotExists creates the database in Open before
+	// connecting to it. WithInstance expects an existing database.
+	CreateDatabaseIfNotExists bool
+	// LockRetries is the number of times Lock tries again if the
+	// lock is held. Defaults to 0, failing right away.
+	LockRetries int
+	// LockRetryBaseDelay is the wait before the first retry and doubles
+	// with every retry up to LockRetryMaxDelay.
+	// Defaults to DefaultLockRetryBaseDelay and DefaultLockRetryMaxDelay.
+	LockRetryBaseDelay time.Duration
+	LockRetryMaxDelay  time.Duration
+	// LockHeartbeatInterval updates the heartbeat_at column of the lock
+	// row at this interval while the lock is held, next to acquired_at.
+	// Both columns are added to the lock table if it lacks them.
+	// Defaults to 0, no heartbeat.
+	LockHeartbeatInterval time.Duration
+	// LockStaleAfter makes Lock take over a lock whose heartbeat is older,
+	// i.e. of a process that crashed while migrating. It has to be
+	// several times LockHeartbeatInterval, so that a slow heartbeat of a
+	// live process isn't mistaken for a crash. Defaults to 0, never.
+	LockStaleAfter time.Duration
+	// FreshConnectionPerMigration runs every migration on its own
+	// connection, isolating session state like SET statements.
+	FreshConnectionPerMigration bool
+	// DisableTriggers runs every migration with session_replication_role
+	// set to replica, so that triggers don't fire, i.e. during bulk data
+	// migrations. It needs admin privileges and a CockroachDB version
+	// with triggers.
+	DisableTriggers bool
+	// InjectVersionComment prepends /* migrate:version=N */ to every
+	// statement of a migration, to find them in the statement diagnostics.
+	InjectVersionComment bool
+	// MultiStatementEnabled runs the statements of a migration one by
+	// one instead of in a single implicit transaction. Errors name the
+	// line of the failing statement.
+	MultiStatementEnabled bool
+	// StateFormat is either StateFormatColumns or StateFormatJSON,
+	// which keeps the full history. Defaults to StateFormatColumns.
+	// It can't be changed once the migrations table exists.
+	StateFormat string
+	// VersionQuery replaces the query reading the version and dirty flag
+	// from the migrations table in Version, i.e. to read them from a view.
+	// It has to return an integer and a boolean column, and no row if no
+	// migration has been applied. SetVersion still writes the migrations
+	// table. It can't be used with StateFormatJSON.
+	VersionQuery string
+	// ErrorClassifier tells missing tables and retryable errors by their
+	// codes. Defaults to DefaultErrorClassifier.
+	ErrorClassifier *CodeClassifier
+	// DropSchemaEnabled makes Drop drop and recreate the schema instead
+	// of dropping its tables one by one, if the search path consists
+	// of a single schema other than public. Needs CockroachDB 20.2.
+	DropSchemaEnabled bool
+	// DropOnlyManaged records the tables, views, sequences and enum types
+	// each migration creates, and makes Drop refuse with
+	// ErrUnmanagedObjects if the schema has any other objects than these
+	// and the tables of migrate, i.e. when pointed at a shared database
+	// by mistake. Objects created before it was set count as unmanaged.
+	DropOnlyManaged bool
+	// FollowerReads makes Version read the version with
+	// AS OF SYSTEM TIME follower_read_timestamp(), a few seconds stale but
+	// served by the nearest replica, i.e. for dashboards polling the
+	// version. A stale version must never decide which migrations to run,
+	// so Version reads the current version while the lock is held.
+	// Needs CockroachDB 19.1 and can't be used with VersionQuery or
+	// StateFormatJSON.
+	FollowerReads bool
+	// KeepAliveInterval pings a separate connection at this interval
+	// while a migration runs, so that proxies and load balancers don't
+	// close idle connections during long migrations. The pool has to
+	// allow at least two open connections. Defaults to 0, no pings.
+	KeepAliveInterval time.Duration
+	// VersionSelect is either VersionSelectSingle, reading the single
+	// row of the migrations table, or VersionSelectMax, reading the row
+	// with the highest version, i.e. of a legacy table of another tool
+	// with a row per applied migration. SetVersion still replaces all
+	// rows with the current one. Defaults to VersionSelectSingle.
+	VersionSelect string
+	// Clock returns the times recorded in the history with
+	// StateFormatJSON. Defaults to time.Now.
+	Clock func() time.Time
+	// DeployID is recorded in the history with StateFormatJSON,
+	// i.e. the release running the migrations.
+	DeployID string
+	// PingAttempts is the number of times WithInstance pings the database
+	// before giving up, waiting PingInterval in between, see
+	// database.PingWithRetry. Defaults to a single ping.
+	PingAttempts int
+	PingInterval time.Duration
+	// Retryable reports errors after which the transactions of SetVersion
+	// are run again, up to DefaultTxRetries times with the backoff of
+	// Lock, i.e. errors of a connection pooler in between. crdb.ExecuteTx
+	// retries the restart errors of CockroachDB regardless. Defaults to
+	// nil, no further retries.
+	Retryable func(error) bool
 }
 
 type CockroachDb struct {
 	db       *sql.DB
 	isLocked bool
 
+	// stopHeartbeat stops updating the heartbeat of the lock we hold,
+	// see Config.LockHeartbeatInterval
+	stopHeartbeat func()
+
+	// lastChecksum is the checksum of the last migration run,
+	// recorded in the history with StateFormatJSON
+	lastChecksum string
+
 	// Open and WithInstance need to guarantee that config is never nil
 	config *Config
 }
@@ -51,7 +253,42 @@ func WithInstance(instance *sql.DB, config *Config) (database.Driver, error) {
 		return nil, ErrNilConfig
 	}
 
-	if err := instance.Ping(); err != nil {
+	if len(config.VersionColumnType) == 0 {
+		config.VersionColumnType = DefaultVersionColumnType
+	}
+	config.VersionColumnType = strings.ToUpper(config.VersionColumnType)
+	if !versionColumnTypes[config.VersionColumnType] {
+		return nil, ErrInvalidVersionColumnType{config.VersionColumnType}
+	}
+
+	if len(config.StateFormat) == 0 {
+		config.StateFormat = StateFormatColumns
+	}
+	if config.StateFormat != StateFormatColumns && config.StateFormat != StateFormatJSON {
+		return nil, ErrInvalidStateFormat{config.StateFormat}
+	}
+	if len(config.VersionQuery) > 0 && config.StateFormat == StateFormatJSON {
+		return nil, ErrInvalidVersionQuery{config.VersionQuery, "can't be used with state format " + StateFormatJSON}
+	}
+	if len(config.VersionSelect) == 0 {
+		config.VersionSelect = VersionSelectSingle
+	}
+	switch {
+	case config.VersionSelect != VersionSelectSingle && config.VersionSelect != VersionSelectMax:
+		return nil, ErrInvalidVersionSelect{config.VersionSelect, "must be " + VersionSelectSingle + " or " + VersionSelectMax}
+	case config.VersionSelect == VersionSelectMax && len(config.VersionQuery) > 0:
+		return nil, ErrInvalidVersionSelect{config.VersionSelect, "can't be used with a version query"}
+	case config.VersionSelect == VersionSelectMax && config.StateFormat == StateFormatJSON:
+		return nil, ErrInvalidVersionSelect{config.VersionSelect, "can't be used with state format " + StateFormatJSON}
+	}
+	if config.FollowerReads && (len(config.VersionQuery) > 0 || config.StateFormat == StateFormatJSON) {
+		return nil, ErrFollowerReads
+	}
+	if config.LockStaleAfter > 0 && (config.LockHeartbeatInterval <= 0 || config.LockStaleAfter <= config.LockHeartbeatInterval) {
+		return nil, ErrLockStaleAfter
+	}
+
+	if err := database.PingWithRetry(instance, config.PingAttempts, config.PingInterval); err != nil {
 		return nil, err
 	}
 
@@ -72,7 +309,23 @@ func WithInstance(instance *sql.DB, config *Config) (database.Driver, error) {
 	}
 
 	if len(config.LockTable) == 0 {
-		config.LockTable = DefaultLockTable
+		config.LockTable = defaultLockTable(config.MigrationsTable)
+	}
+
+	if config.LockRetryBaseDelay <= 0 {
+		config.LockRetryBaseDelay = DefaultLockRetryBaseDelay
+	}
+
+	if config.LockRetryMaxDelay <= 0 {
+		config.LockRetryMaxDelay = DefaultLockRetryMaxDelay
+	}
+
+	if config.ErrorClassifier == nil {
+		config.ErrorClassifier = DefaultErrorClassifier
+	}
+
+	if config.Clock == nil {
+		config.Clock = time.Now
 	}
 
 	px := &CockroachDb{
@@ -88,10 +341,53 @@ func WithInstance(instance *sql.DB, config *Config) (database.Driver, error) {
 		return nil, err
 	}
 
+	if config.DropOnlyManaged {
+		if err := px.ensureObjectsTable(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(config.VersionQuery) > 0 {
+		if err := px.validateVersionQuery(); err != nil {
+			return nil, err
+		}
+	}
+
 	return px, nil
 }
 
+// validateVersionQuery checks that Config.VersionQuery returns
+// an integer version column and a boolean dirty column.
+func (c *CockroachDb) validateVersionQuery() error {
+	query := c.config.VersionQuery
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	defer rows.Close()
+
+	columns, err := rows.ColumnTypes()
+	if err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	if len(columns) != 2 {
+		return ErrInvalidVersionQuery{query, fmt.Sprintf("expected 2 columns (version, dirty), got %v", len(columns))}
+	}
+	if t := columns[0].DatabaseTypeName(); !strings.HasPrefix(t, "INT") {
+		return ErrInvalidVersionQuery{query, fmt.Sprintf("expected integer version column, got %v", t)}
+	}
+	if t := columns[1].DatabaseTypeName(); t != "BOOL" {
+		return ErrInvalidVersionQuery{query, fmt.Sprintf("expected boolean dirty column, got %v", t)}
+	}
+	return nil
+}
+
 func (c *CockroachDb) Open(url string) (database.Driver, error) {
+	url, err := database.RewriteURL(url)
+	if err != nil {
+		return nil, err
+	}
+
 	purl, err := nurl.Parse(url)
 	if err != nil {
 		return nil, err
@@ -102,10 +398,94 @@ func (c *CockroachDb) Open(url string) (database.Driver, error) {
 	re := regexp.MustCompile("^(cockroach(db)?|crdb-postgres)")
 	connectString := re.ReplaceAllString(migrate.FilterCustomQuery(purl).String(), "postgres")
 
+	lockRetriesQuery := purl.Query().Get("x-lock-retries")
+	lockRetries, err := strconv.Atoi(lockRetriesQuery)
+	if err != nil {
+		lockRetries = 0
+	}
+
+	freshConnectionQuery := purl.Query().Get("x-fresh-connection-per-migration")
+	freshConnection, err := strconv.ParseBool(freshConnectionQuery)
+	if err != nil {
+		freshConnection = false
+	}
+
+	disableTriggers, err := strconv.ParseBool(purl.Query().Get("x-disable-triggers"))
+	if err != nil {
+		disableTriggers = false
+	}
+
+	injectVersionCommentQuery := purl.Query().Get("x-inject-version-comment")
+	injectVersionComment, err := strconv.ParseBool(injectVersionCommentQuery)
+	if err != nil {
+		injectVersionComment = false
+	}
+
+	multiStatementQuery := purl.Query().Get("x-multi-statement")
+	multiStatement, err := strconv.ParseBool(multiStatementQuery)
+	if err != nil {
+		multiStatement = false
+	}
+
+	dropSchemaQuery := purl.Query().Get("x-drop-schema")
+	dropSchema, err := strconv.ParseBool(dropSchemaQuery)
+	if err != nil {
+		dropSchema = false
+	}
+
+	dropOnlyManaged, err := strconv.ParseBool(purl.Query().Get("x-drop-only-managed"))
+	if err != nil {
+		dropOnlyManaged = false
+	}
+
+	followerReadsQuery := purl.Query().Get("x-follower-reads")
+	followerReads, err := strconv.ParseBool(followerReadsQuery)
+	if err != nil {
+		followerReads = false
+	}
+
+	keepAliveInterval, err := time.ParseDuration(purl.Query().Get("x-keep-alive-interval"))
+	if err != nil {
+		keepAliveInterval = 0
+	}
+
+	lockHeartbeatInterval, err := time.ParseDuration(purl.Query().Get("x-lock-heartbeat-interval"))
+	if err != nil {
+		lockHeartbeatInterval = 0
+	}
+
+	lockStaleAfter, err := time.ParseDuration(purl.Query().Get("x-lock-stale-after"))
+	if err != nil {
+		lockStaleAfter = 0
+	}
+
+	pingAttempts, err := strconv.Atoi(purl.Query().Get("x-ping-attempts"))
+	if err != nil {
+		pingAttempts = 0
+	}
+
+	pingInterval, err := time.ParseDuration(purl.Query().Get("x-ping-interval"))
+	if err != nil {
+		pingInterval = 0
+	}
+
+	createDatabaseQuery := purl.Query().Get("x-create-database")
+	createDatabase, err := strconv.ParseBool(createDatabaseQuery)
+	if err != nil {
+		createDatabase = false
+	}
+
+	if createDatabase {
+		if err := createDatabaseIfNotExists(connectString, strings.TrimPrefix(purl.Path, "/")); err != nil {
+			return nil, err
+		}
+	}
+
 	db, err := sql.Open("postgres", connectString)
 	if err != nil {
 		return nil, err
 	}
+	setPool(db, purl.Query())
 
 	migrationsTable := purl.Query().Get("x-migrations-table")
 	if len(migrationsTable) == 0 {
@@ -113,9 +493,6 @@ func (c *CockroachDb) Open(url string) (database.Driver, error) {
 	}
 
 	lockTable := purl.Query().Get("x-lock-table")
-	if len(lockTable) == 0 {
-		lockTable = DefaultLockTable
-	}
 
 	forceLockQuery := purl.Query().Get("x-force-lock")
 	forceLock, err := strconv.ParseBool(forceLockQuery)
@@ -126,8 +503,28 @@ func (c *CockroachDb) Open(url string) (database.Driver, error) {
 	px, err := WithInstance(db, &Config{
 		DatabaseName:    purl.Path,
 		MigrationsTable: migrationsTable,
+		VersionDatabase: purl.Query().Get("x-version-database"),
 		LockTable: lockTable,
 		ForceLock: forceLock,
+		VersionColumnType: purl.Query().Get("x-version-column-type"),
+		CreateDatabaseIfNotExists: createDatabase,
+		LockRetries: lockRetries,
+		LockHeartbeatInterval: lockHeartbeatInterval,
+		LockStaleAfter: lockStaleAfter,
+		FreshConnectionPerMigration: freshConnection,
+		DisableTriggers: disableTriggers,
+		InjectVersionComment: injectVersionComment,
+		MultiStatementEnabled: multiStatement,
+		DropSchemaEnabled: dropSchema,
+		DropOnlyManaged: dropOnlyManaged,
+		FollowerReads: followerReads,
+		KeepAliveInterval: keepAliveInterval,
+		StateFormat: purl.Query().Get("x-state-format"),
+		DeployID: purl.Query().Get("x-deploy-id"),
+		VersionQuery: purl.Query().Get("x-version-query"),
+		VersionSelect: purl.Query().Get("x-version-select"),
+		PingAttempts: pingAttempts,
+		PingInterval: pingInterval,
 	})
 	if err != nil {
 		return nil, err
@@ -136,20 +533,98 @@ func (c *CockroachDb) Open(url string) (database.Driver, error) {
 	return px, nil
 }
 
+// setPool applies x-max-open-conns, x-max-idle-conns and x-conn-max-lifetime
+// to the pool opened in Open. Missing or invalid values keep the
+// database/sql defaults.
+func setPool(db *sql.DB, query nurl.Values) {
+	if maxOpenConns, err := strconv.Atoi(query.Get("x-max-open-conns")); err == nil {
+		db.SetMaxOpenConns(maxOpenConns)
+	}
+	if maxIdleConns, err := strconv.Atoi(query.Get("x-max-idle-conns")); err == nil {
+		db.SetMaxIdleConns(maxIdleConns)
+	}
+	if connMaxLifetime, err := time.ParseDuration(query.Get("x-conn-max-lifetime")); err == nil {
+		db.SetConnMaxLifetime(connMaxLifetime)
+	}
+}
+
+// createDatabaseIfNotExists connects to DefaultMaintenanceDatabase on the
+// cluster behind connectString and creates the database name there.
+func createDatabaseIfNotExists(connectString string, name string) error {
+	if len(name) == 0 {
+		return ErrNoDatabaseName
+	}
+
+	u, err := nurl.Parse(connectString)
+	if err != nil {
+		return err
+	}
+	u.Path = "/" + DefaultMaintenanceDatabase
+
+	db, err := sql.Open("postgres", u.String())
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	query := `CREATE DATABASE IF NOT EXISTS ` + database.QuoteIdentifier("cockroachdb", name)
+	if _, err := db.Exec(query); err != nil {
+		return &database.Error{OrigErr: err, Err: "failed to create database", Query: []byte(query)}
+	}
+	return nil
+}
+
 func (c *CockroachDb) Close() error {
+	if c.stopHeartbeat != nil {
+		c.stopHeartbeat()
+		c.stopHeartbeat = nil
+	}
 	return c.db.Close()
 }
 
 // Locking is done manually with a separate lock table.  Implementing advisory locks in CRDB is being discussed
 // See: https://github.com/cockroachdb/cockroach/issues/13546
+// If the lock is held by someone else, or the attempt failed with a retryable error,
+// Lock retries up to Config.LockRetries times, waiting with exponential backoff and
+// jitter in between.
 func (c *CockroachDb) Lock() error {
-	err := crdb.ExecuteTx(context.Background(), c.db, nil, func(tx *sql.Tx) error {
-		aid, err := database.GenerateAdvisoryLockId(c.config.DatabaseName)
+	backoff := database.NewBackoff(c.config.LockRetryBaseDelay, c.config.LockRetryMaxDelay)
+	for attempt := 0; ; attempt++ {
+		held, err := c.tryLock()
+		if err == nil || !(held || c.IsRetryable(err)) || attempt >= c.config.LockRetries {
+			return err
+		}
+		time.Sleep(backoff.Next())
+	}
+}
+
+// TryLock implements database.TryLocker. Unlike Lock it neither retries
+// nor fails if the lock is already held, but returns false.
+func (c *CockroachDb) TryLock() (acquired bool, err error) {
+	if c.isLocked {
+		return false, nil
+	}
+	held, err := c.tryLock()
+	if held {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// tryLock makes a single attempt to acquire the lock.
+// held reports whether it failed because the lock is already taken.
+func (c *CockroachDb) tryLock() (held bool, err error) {
+	err = crdb.ExecuteTx(context.Background(), c.db, nil, func(tx *sql.Tx) error {
+		held = false
+
+		aid, err := c.lockId()
 		if err != nil {
 			return err
 		}
 
-		query := "SELECT * FROM " + c.config.LockTable + " WHERE lock_id = $1"
+		query := "SELECT * FROM " + database.QuoteQualifiedIdentifier("cockroachdb", c.config.LockTable) + " WHERE lock_id = $1"
 		rows, err := tx.Query(query, aid)
 		if err != nil {
 			return database.Error{OrigErr: err, Err: "failed to fetch migration lock", Query: []byte(query)}
@@ -158,11 +633,23 @@ func (c *CockroachDb) Lock() error {
 
 		// If row exists at all, lock is present
 		locked := rows.Next()
+		rows.Close()
+		if locked && c.config.LockStaleAfter > 0 {
+			stale, err := c.takeOverStaleLock(tx, aid)
+			if err != nil {
+				return err
+			}
+			locked = !stale
+		}
 		if locked && !c.config.ForceLock {
+			held = true
 			return database.Error{Err: "lock could not be acquired; already locked", Query: []byte(query)}
 		}
 
-		query = "INSERT INTO " + c.config.LockTable + " (lock_id) VALUES ($1)"
+		query = "INSERT INTO " + database.QuoteQualifiedIdentifier("cockroachdb", c.config.LockTable) + " (lock_id) VALUES ($1)"
+		if c.config.LockHeartbeatInterval > 0 {
+			query = "INSERT INTO " + database.QuoteQualifiedIdentifier("cockroachdb", c.config.LockTable) + " (lock_id, acquired_at, heartbeat_at) VALUES ($1, now(), now())"
+		}
 		if _, err := tx.Exec(query, aid) ; err != nil {
 			return database.Error{OrigErr: err, Err: "failed to set migration lock", Query: []byte(query)}
 		}
@@ -171,33 +658,79 @@ func (c *CockroachDb) Lock() error {
 	})
 
 	if err != nil {
-		return err
+		return held, err
 	} else {
 		c.isLocked = true
-		return nil
+		if c.config.LockHeartbeatInterval > 0 {
+			c.startHeartbeat()
+		}
+		return false, nil
+	}
+}
+
+// takeOverStaleLock deletes the lock row of aid if its heartbeat is older
+// than Config.LockStaleAfter, and reports whether it did.
+func (c *CockroachDb) takeOverStaleLock(tx *sql.Tx, aid string) (stale bool, err error) {
+	var heartbeat pq.NullTime
+	var now time.Time
+	query := "SELECT heartbeat_at, now() FROM " + database.QuoteQualifiedIdentifier("cockroachdb", c.config.LockTable) + " WHERE lock_id = $1"
+	if err := tx.QueryRow(query, aid).Scan(&heartbeat, &now); err != nil {
+		return false, database.Error{OrigErr: err, Err: "failed to fetch migration lock", Query: []byte(query)}
+	}
+	if !lockStale(heartbeat, now, c.config.LockStaleAfter) {
+		return false, nil
+	}
+
+	query = "DELETE FROM " + database.QuoteQualifiedIdentifier("cockroachdb", c.config.LockTable) + " WHERE lock_id = $1"
+	if _, err := tx.Exec(query, aid); err != nil {
+		return false, database.Error{OrigErr: err, Err: "failed to take over stale migration lock", Query: []byte(query)}
+	}
+	return true, nil
+}
+
+// lockStale reports whether a lock with the heartbeat is stale at now.
+// A lock without heartbeat, i.e. set by a process without
+// Config.LockHeartbeatInterval, is never stale.
+func lockStale(heartbeat pq.NullTime, now time.Time, staleAfter time.Duration) bool {
+	return heartbeat.Valid && now.Sub(heartbeat.Time) > staleAfter
+}
+
+// startHeartbeat updates the heartbeat of the lock row every
+// Config.LockHeartbeatInterval until Unlock or Close.
+func (c *CockroachDb) startHeartbeat() {
+	query := "UPDATE " + database.QuoteQualifiedIdentifier("cockroachdb", c.config.LockTable) + " SET heartbeat_at = now() WHERE lock_id = $1"
+	aid, err := c.lockId()
+	if err != nil {
+		return
 	}
+	c.stopHeartbeat = keepAlive(pingFunc(func(ctx context.Context) error {
+		_, err := c.db.ExecContext(ctx, query, aid)
+		return err
+	}), c.config.LockHeartbeatInterval)
 }
 
+
 // Locking is done manually with a separate lock table.  Implementing advisory locks in CRDB is being discussed
 // See: https://github.com/cockroachdb/cockroach/issues/13546
 func (c *CockroachDb) Unlock() error {
-	aid, err := database.GenerateAdvisoryLockId(c.config.DatabaseName)
+	if c.stopHeartbeat != nil {
+		c.stopHeartbeat()
+		c.stopHeartbeat = nil
+	}
+
+	aid, err := c.lockId()
 	if err != nil {
 		return err
 	}
 
 	// In the event of an implementation (non-migration) error, it is possible for the lock to not be released.  Until
 	// a better locking mechanism is added, a manual purging of the lock table may be required in such circumstances
-	query := "DELETE FROM " + c.config.LockTable + " WHERE lock_id = $1"
+	query := "DELETE FROM " + database.QuoteQualifiedIdentifier("cockroachdb", c.config.LockTable) + " WHERE lock_id = $1"
 	if _, err := c.db.Exec(query, aid); err != nil {
-		if e, ok := err.(*pq.Error); ok {
-			// 42P01 is "UndefinedTableError" in CockroachDB
-			// https://github.com/cockroachdb/cockroach/blob/master/pkg/sql/pgwire/pgerror/codes.go
-			if e.Code == "42P01" {
-				// On drops, the lock table is fully removed;  This is fine, and is a valid "unlocked" state for the schema
-				c.isLocked = false
-				return nil
-			}
+		if c.IsUndefinedTable(err) {
+			// On drops, the lock table is fully removed;  This is fine, and is a valid "unlocked" state for the schema
+			c.isLocked = false
+			return nil
 		}
 		return database.Error{OrigErr: err, Err: "failed to release migration lock", Query: []byte(query)}
 	}
@@ -206,29 +739,240 @@ func (c *CockroachDb) Unlock() error {
 	return nil
 }
 
+// ForceUnlock implements database.ForceUnlocker. It deletes the lock row
+// of the database, which a crashed process may have left behind.
+func (c *CockroachDb) ForceUnlock() error {
+	return c.Unlock()
+}
+
 func (c *CockroachDb) Run(migration io.Reader) error {
+	return c.run(context.Background(), migration, -1)
+}
+
+// RunVersion implements database.VersionRunner.
+func (c *CockroachDb) RunVersion(version uint, migration io.Reader) error {
+	return c.run(context.Background(), migration, int(version))
+}
+
+// RunContext implements database.ContextRunner. The running
+// statement is canceled when ctx is done.
+func (c *CockroachDb) RunContext(ctx context.Context, version uint, migration io.Reader) error {
+	return c.run(ctx, migration, int(version))
+}
+
+// run runs a migration until ctx is done. version is -1 if it's unknown.
+func (c *CockroachDb) run(ctx context.Context, migration io.Reader, version int) error {
 	migr, err := ioutil.ReadAll(migration)
 	if err != nil {
 		return err
 	}
 
+	if usesRestartSavepoint(migr) {
+		return ErrReservedSavepoint
+	}
+
+	if c.config.KeepAliveInterval > 0 {
+		stop, err := c.startKeepAlive()
+		if err != nil {
+			return err
+		}
+		defer stop()
+	}
+
+	var before []string
+	if c.config.DropOnlyManaged {
+		if before, err = c.schemaObjectNames(); err != nil {
+			return err
+		}
+	}
+
 	// run migration
-	query := string(migr[:])
-	if _, err := c.db.Exec(query); err != nil {
-		return database.Error{OrigErr: err, Err: "migration failed", Query: migr}
+	switch {
+	case c.config.FreshConnectionPerMigration:
+		err = c.runOnFreshConnection(ctx, migr, version)
+	case c.config.DisableTriggers:
+		err = c.runWithoutTriggers(ctx, migr, version)
+	default:
+		err = c.runStatements(ctx, c.db, migr, version)
+	}
+	// a failed migration may have created objects outside of a transaction
+	if c.config.DropOnlyManaged {
+		if rerr := c.recordCreated(before, version); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	c.lastChecksum = checksum(migr)
+	return nil
+}
+
+// usesRestartSavepoint returns true if a statement of migr creates
+// restartSavepoint. Savepoints of other names roll back part of a
+// transaction, as a migration using them expects.
+func usesRestartSavepoint(migr []byte) bool {
+	for _, stmt := range multistmt.Split(migr) {
+		if restartSavepointStatement.Match(bytes.TrimSpace(stmt.Query)) {
+			return true
+		}
+	}
+	return false
+}
+
+// runOnFreshConnection runs migr on a dedicated connection, which is
+// discarded afterwards instead of going back to the pool, so that session
+// settings made by the migration can't leak into later ones.
+func (c *CockroachDb) runOnFreshConnection(ctx context.Context, migr []byte, version int) error {
+	conn, err := c.db.Conn(ctx)
+	if err != nil {
+		return &database.Error{OrigErr: err, Err: "failed to acquire connection"}
+	}
+	defer conn.Close()
+
+	// returning driver.ErrBadConn makes the pool close the connection
+	defer conn.Raw(func(interface{}) error {
+		return driver.ErrBadConn
+	})
+
+	return c.runConn(ctx, conn, migr, version)
+}
+
+// runWithoutTriggers runs migr on a single connection, which
+// goes back to the pool afterwards, see runConn.
+func (c *CockroachDb) runWithoutTriggers(ctx context.Context, migr []byte, version int) error {
+	conn, err := c.db.Conn(ctx)
+	if err != nil {
+		return &database.Error{OrigErr: err, Err: "failed to acquire connection"}
+	}
+	defer conn.Close()
+	return c.runConn(ctx, conn, migr, version)
+}
+
+// runConn runs migr on conn. With DisableTriggers, session_replication_role
+// is set to replica before and reset afterwards, even if ctx is done.
+func (c *CockroachDb) runConn(ctx context.Context, conn *sql.Conn, migr []byte, version int) (err error) {
+	if !c.config.DisableTriggers {
+		return c.runStatements(ctx, conn, migr, version)
 	}
 
+	query := `SET session_replication_role = replica`
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return &database.Error{OrigErr: err, Err: "failed to disable triggers", Query: []byte(query)}
+	}
+	defer func() {
+		query := `RESET session_replication_role`
+		if _, rerr := conn.ExecContext(context.Background(), query); rerr != nil {
+			// the connection must not go back to the pool with triggers disabled
+			conn.Raw(func(interface{}) error {
+				return driver.ErrBadConn
+			})
+			if err == nil {
+				err = &database.Error{OrigErr: rerr, Err: "failed to enable triggers", Query: []byte(query)}
+			}
+		}
+	}()
+	return c.runStatements(ctx, conn, migr, version)
+}
+
+// execer is implemented by *sql.DB, *sql.Conn and *sql.Tx.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// runStatements runs migr as a whole, or statement by statement
+// if MultiStatementEnabled is set. Statements that can't run in a
+// transaction block, i.e. CREATE INDEX CONCURRENTLY, run on their own
+// between the batches of the other statements, see multistmt.Batches.
+// With InjectVersionComment every statement is tagged with version,
+// unless it's -1.
+func (c *CockroachDb) runStatements(ctx context.Context, e execer, migr []byte, version int) error {
+	inject := c.config.InjectVersionComment && version >= 0
+
+	if !c.config.MultiStatementEnabled {
+		batches := multistmt.Batches(migr)
+		for _, b := range batches {
+			query := b.Query
+			if inject {
+				query = injectVersionComment(query, version)
+			}
+			if _, err := e.ExecContext(ctx, string(query)); err != nil {
+				if len(batches) == 1 {
+					return database.Error{OrigErr: err, Err: "migration failed", Query: query}
+				}
+				return database.Error{OrigErr: err, Err: "migration failed", Query: query, Line: uint(b.Line)}
+			}
+		}
+		return nil
+	}
+
+	committed := make([]int, 0)
+	for n, stmt := range multistmt.Split(migr) {
+		query := stmt.Query
+		if inject {
+			query = append([]byte(versionComment(version)), query...)
+		}
+		if _, err := e.ExecContext(ctx, string(query)); err != nil {
+			err = ErrStatementFailed{Committed: committed, Failed: n, Err: err}
+			return database.Error{OrigErr: err, Err: "migration failed", Query: query, Line: uint(stmt.Line)}
+		}
+		committed = append(committed, n)
+	}
 	return nil
 }
 
+// ErrStatementFailed is the OrigErr of the database.Error returned by
+// a migration run statement by statement with MultiStatementEnabled.
+// Every statement commits on its own, so the database is left with the
+// Committed statements applied, and none after Failed.
+type ErrStatementFailed struct {
+	// Committed are the indices of the applied statements, from 0.
+	Committed []int
+	// Failed is the index of the failed statement.
+	Failed int
+	Err    error
+}
+
+func (e ErrStatementFailed) Error() string {
+	return fmt.Sprintf("statement %v failed, statements %v committed: %v", e.Failed, e.Committed, e.Err)
+}
+
+// Unwrap returns Err, i.e. a *pq.Error.
+func (e ErrStatementFailed) Unwrap() error {
+	return e.Err
+}
+
+// versionComment returns the comment tagging statements of version.
+func versionComment(version int) string {
+	return fmt.Sprintf("/* migrate:version=%v */ ", version)
+}
+
+// injectVersionComment tags every statement of migr with version.
+// The statements are split first, so that semicolons in strings
+// and comments are left alone.
+func injectVersionComment(migr []byte, version int) []byte {
+	var query bytes.Buffer
+	for _, stmt := range multistmt.Split(migr) {
+		query.WriteString(versionComment(version))
+		query.Write(stmt.Query)
+		query.WriteString(";\n")
+	}
+	return query.Bytes()
+}
+
 func (c *CockroachDb) SetVersion(version int, dirty bool) error {
-	return crdb.ExecuteTx(context.Background(), c.db, nil, func(tx *sql.Tx) error {
-		if _, err := tx.Exec(`DELETE FROM "` + c.config.MigrationsTable + `"`); err != nil {
+	if c.config.StateFormat == StateFormatJSON {
+		return c.setStateVersion(version, dirty)
+	}
+
+	return c.executeTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM ` + c.versionTable(c.config.MigrationsTable)); err != nil {
 			return err
 		}
 
 		if version >= 0 {
-			if _, err := tx.Exec(`INSERT INTO "` + c.config.MigrationsTable + `" (version, dirty) VALUES ($1, $2)`, version, dirty); err != nil {
+			if _, err := tx.Exec(`INSERT INTO ` + c.versionTable(c.config.MigrationsTable) + ` (version, dirty) VALUES ($1, $2)`, version, dirty); err != nil {
 				return err
 			}
 		}
@@ -237,8 +981,34 @@ func (c *CockroachDb) SetVersion(version int, dirty bool) error {
 	})
 }
 
+// executeTx runs fn in a transaction with crdb.ExecuteTx,
+// retried as Config.Retryable tells.
+func (c *CockroachDb) executeTx(fn func(*sql.Tx) error) error {
+	return c.retryTx(func() error {
+		return crdb.ExecuteTx(context.Background(), c.db, nil, fn)
+	})
+}
+
+// retryTx calls run until it succeeds, fails with an error
+// Config.Retryable doesn't report as retryable, or DefaultTxRetries
+// retries are used up.
+func (c *CockroachDb) retryTx(run func() error) error {
+	backoff := database.NewBackoff(c.config.LockRetryBaseDelay, c.config.LockRetryMaxDelay)
+	for attempt := 0; ; attempt++ {
+		err := run()
+		if err == nil || c.config.Retryable == nil || !c.config.Retryable(err) || attempt >= DefaultTxRetries {
+			return err
+		}
+		time.Sleep(backoff.Next())
+	}
+}
+
 func (c *CockroachDb) Version() (version int, dirty bool, err error) {
-	query := `SELECT version, dirty FROM "` + c.config.MigrationsTable + `" LIMIT 1`
+	if c.config.StateFormat == StateFormatJSON {
+		return c.stateVersion()
+	}
+
+	query := c.versionQuery()
 	err = c.db.QueryRow(query).Scan(&version, &dirty)
 
 	switch {
@@ -246,12 +1016,8 @@ func (c *CockroachDb) Version() (version int, dirty bool, err error) {
 		return database.NilVersion, false, nil
 
 	case err != nil:
-		if e, ok := err.(*pq.Error); ok {
-			// 42P01 is "UndefinedTableError" in CockroachDB
-			// https://github.com/cockroachdb/cockroach/blob/master/pkg/sql/pgwire/pgerror/codes.go
-			if e.Code == "42P01" {
-				return database.NilVersion, false, nil
-			}
+		if c.IsUndefinedTable(err) {
+			return database.NilVersion, false, nil
 		}
 		return 0, false, &database.Error{OrigErr: err, Query: []byte(query)}
 
@@ -260,31 +1026,148 @@ func (c *CockroachDb) Version() (version int, dirty bool, err error) {
 	}
 }
 
+// versionQuery returns the query reading the version and dirty flag.
+func (c *CockroachDb) versionQuery() string {
+	if len(c.config.VersionQuery) > 0 {
+		return c.config.VersionQuery
+	}
+	query := `SELECT version, dirty FROM ` + c.versionTable(c.config.MigrationsTable)
+	if c.config.FollowerReads && !c.isLocked {
+		query += ` AS OF SYSTEM TIME follower_read_timestamp()`
+	}
+	if c.config.VersionSelect == VersionSelectMax {
+		query += ` ORDER BY version DESC`
+	}
+	return query + ` LIMIT 1`
+}
+
+// QueryBool implements database.Querier. The condition is selected as
+// SELECT (<condition>), so that it's either a boolean expression, or a
+// query returning a single boolean. NULL is false.
+func (c *CockroachDb) QueryBool(condition string) (bool, error) {
+	query := `SELECT (` + condition + `)`
+	var result sql.NullBool
+	if err := c.db.QueryRow(query).Scan(&result); err != nil {
+		return false, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return result.Valid && result.Bool, nil
+}
+
+// TransactionalDDL implements database.Transactional. A multi-statement
+// migration runs in a single implicit transaction, unless its statements
+// run one by one with MultiStatementEnabled.
+func (c *CockroachDb) TransactionalDDL() bool {
+	return !c.config.MultiStatementEnabled
+}
+
+// TransactionalMigration implements database.MigrationTransactional.
+// A migration with statements that can't run in a transaction block
+// runs in several batches, see multistmt.Batches, and one with BEGIN or
+// COMMIT statements of its own isn't atomic either.
+func (c *CockroachDb) TransactionalMigration(migration []byte) bool {
+	return multistmt.Atomic(migration)
+}
+
+// RoundTrip implements database.RoundTripper.
+func (c *CockroachDb) RoundTrip(up io.Reader, down io.Reader) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return &database.Error{OrigErr: err, Err: "transaction start failed"}
+	}
+	defer tx.Rollback()
+
+	for _, r := range []io.Reader{up, down} {
+		migr, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if err := c.runStatements(context.Background(), tx, migr, -1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check implements database.Checker.
+func (c *CockroachDb) Check(migrations []io.Reader) (failed int, err error) {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return -1, &database.Error{OrigErr: err, Err: "transaction start failed"}
+	}
+	defer tx.Rollback()
+
+	for i, r := range migrations {
+		migr, err := ioutil.ReadAll(r)
+		if err != nil {
+			return i, err
+		}
+		if err := c.runStatements(context.Background(), tx, migr, -1); err != nil {
+			return i, err
+		}
+	}
+	return -1, nil
+}
+
+// Drop drops the views, tables, sequences and enum types of the current
+// schema, or the schema as a whole with Config.DropSchemaEnabled.
 func (c *CockroachDb) Drop() error {
-	// select all tables in current schema
-	query := `SELECT table_name FROM information_schema.tables WHERE table_schema=(SELECT current_schema())`
+	if c.config.DropOnlyManaged {
+		if err := c.checkManaged(); err != nil {
+			return err
+		}
+	}
+
+	if c.config.DropSchemaEnabled {
+		query := `SELECT current_schemas(false)`
+		var schemas []string
+		if err := c.db.QueryRow(query).Scan(pq.Array(&schemas)); err != nil {
+			return &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+		if schema, ok := schemaToDrop(schemas); ok {
+			return c.dropSchema(schema)
+		}
+	}
+
+	// select all tables, views and sequences in current schema
+	query := `SELECT table_name, table_type FROM information_schema.tables WHERE table_schema=(SELECT current_schema())`
 	tables, err := c.db.Query(query)
 	if err != nil {
 		return &database.Error{OrigErr: err, Query: []byte(query)}
 	}
 	defer tables.Close()
 
-	// delete one table after another
-	tableNames := make([]string, 0)
+	objects := schemaObjects{}
 	for tables.Next() {
-		var tableName string
-		if err := tables.Scan(&tableName); err != nil {
+		var tableName, tableType string
+		if err := tables.Scan(&tableName, &tableType); err != nil {
 			return err
 		}
-		if len(tableName) > 0 {
-			tableNames = append(tableNames, tableName)
+		if len(tableName) == 0 {
+			continue
+		}
+		switch tableType {
+		case "VIEW":
+			objects.views = append(objects.views, tableName)
+		case "SEQUENCE":
+			objects.sequences = append(objects.sequences, tableName)
+		default:
+			objects.tables = append(objects.tables, tableName)
 		}
 	}
+	if err := tables.Err(); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
 
-	if len(tableNames) > 0 {
+	// select all enums in current schema
+	objects.types, err = c.queryColumn(enumTypesQuery, "typname")
+	if err != nil {
+		return err
+	}
+
+	queries := objects.dropQueries()
+	if len(queries) > 0 {
 		// delete one by one ...
-		for _, t := range tableNames {
-			query = `DROP TABLE IF EXISTS ` + t + ` CASCADE`
+		for _, query := range queries {
 			if _, err := c.db.Exec(query); err != nil {
 				return &database.Error{OrigErr: err, Query: []byte(query)}
 			}
@@ -292,16 +1175,414 @@ func (c *CockroachDb) Drop() error {
 		if err := c.ensureVersionTable(); err != nil {
 			return err
 		}
+		if c.config.DropOnlyManaged {
+			return c.ensureObjectsTable()
+		}
+	}
+
+	return nil
+}
+
+// enumTypesQuery selects the enum types of the current schema.
+const enumTypesQuery = `SELECT t.typname FROM pg_catalog.pg_type t JOIN pg_catalog.pg_namespace n ON n.oid = t.typnamespace WHERE n.nspname = current_schema() AND t.typtype = 'e'`
+
+// schemaObjectNames returns the names of the tables, views, sequences
+// and enum types of the current schema.
+func (c *CockroachDb) schemaObjectNames() ([]string, error) {
+	names, err := c.queryColumn(`SELECT table_name FROM information_schema.tables WHERE table_schema=(SELECT current_schema())`, "table_name")
+	if err != nil {
+		return nil, err
+	}
+	types, err := c.queryColumn(enumTypesQuery, "typname")
+	if err != nil {
+		return nil, err
+	}
+	return append(names, types...), nil
+}
+
+// objectsTable is the table recording the objects created by
+// migrations, see Config.DropOnlyManaged.
+func (c *CockroachDb) objectsTable() string {
+	return c.config.MigrationsTable + "_objects"
+}
+
+func (c *CockroachDb) ensureObjectsTable() error {
+	query := `CREATE TABLE IF NOT EXISTS ` + c.versionTable(c.objectsTable()) + ` (name STRING NOT NULL PRIMARY KEY, version INT NOT NULL)`
+	return c.createTable(query)
+}
+
+// recordCreated records the objects of the schema which aren't in before
+// as created by the migration version.
+func (c *CockroachDb) recordCreated(before []string, version int) error {
+	after, err := c.schemaObjectNames()
+	if err != nil {
+		return err
+	}
+	query := `UPSERT INTO ` + c.versionTable(c.objectsTable()) + ` (name, version) VALUES ($1, $2)`
+	for _, name := range notIn(after, before) {
+		if _, err := c.db.Exec(query, name, version); err != nil {
+			return &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+	}
+	return nil
+}
+
+// checkManaged returns ErrUnmanagedObjects if the schema has objects
+// which neither migrate nor a migration created.
+func (c *CockroachDb) checkManaged() error {
+	objects, err := c.schemaObjectNames()
+	if err != nil {
+		return err
+	}
+	managed, err := c.queryColumn(`SELECT name FROM `+c.versionTable(c.objectsTable()), "name")
+	if err != nil {
+		return err
+	}
+	managed = append(managed, c.config.MigrationsTable, c.config.LockTable, c.objectsTable())
+	if unmanaged := notIn(objects, managed); len(unmanaged) > 0 {
+		return ErrUnmanagedObjects{Objects: unmanaged}
+	}
+	return nil
+}
+
+// notIn returns the sorted objects which aren't in known.
+func notIn(objects []string, known []string) []string {
+	result := make([]string, 0)
+	for _, o := range objects {
+		if !contains(known, o) {
+			result = append(result, o)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// schemaObjects are the objects of a schema Drop drops one by one.
+type schemaObjects struct {
+	views     []string
+	tables    []string
+	sequences []string
+	types     []string
+}
+
+// dropQueries returns the statements dropping all objects, dependent
+// ones first: views select from tables, tables use sequences in defaults
+// and types in columns. Objects may already be gone by then, i.e. a view
+// dropped with its table or a sequence owned by a table, hence IF EXISTS.
+func (o schemaObjects) dropQueries() []string {
+	queries := make([]string, 0)
+	for _, v := range o.views {
+		queries = append(queries, `DROP VIEW IF EXISTS `+database.QuoteIdentifier("cockroachdb", v)+` CASCADE`)
+	}
+	for _, t := range o.tables {
+		queries = append(queries, `DROP TABLE IF EXISTS `+database.QuoteIdentifier("cockroachdb", t)+` CASCADE`)
+	}
+	for _, s := range o.sequences {
+		queries = append(queries, `DROP SEQUENCE IF EXISTS `+database.QuoteIdentifier("cockroachdb", s)+` CASCADE`)
+	}
+	// CockroachDB doesn't support DROP TYPE ... CASCADE
+	for _, t := range o.types {
+		queries = append(queries, `DROP TYPE IF EXISTS `+database.QuoteIdentifier("cockroachdb", t))
+	}
+	return queries
+}
+
+// schemaToDrop returns the schema Drop can drop as a whole, given the
+// existing schemas of the search path. The public schema can't be dropped,
+// and with more than one schema dropping tables one by one is safer.
+func schemaToDrop(schemas []string) (string, bool) {
+	if len(schemas) != 1 || schemas[0] == "public" {
+		return "", false
+	}
+	return schemas[0], true
+}
+
+// dropSchema drops schema with all its tables and creates it again,
+// which is much faster than dropping thousands of tables one by one.
+func (c *CockroachDb) dropSchema(schema string) error {
+	for _, query := range []string{
+		`DROP SCHEMA ` + database.QuoteIdentifier("cockroachdb", schema) + ` CASCADE`,
+		`CREATE SCHEMA ` + database.QuoteIdentifier("cockroachdb", schema),
+	} {
+		if _, err := c.db.Exec(query); err != nil {
+			return &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+	}
+	// the lock table is held while dropping, recreate it for Unlock
+	if err := c.ensureLockTable(); err != nil {
+		return err
+	}
+	if c.config.DropOnlyManaged {
+		if err := c.ensureObjectsTable(); err != nil {
+			return err
+		}
+	}
+	return c.ensureVersionTable()
+}
+
+// CheckPrivileges implements database.PrivilegeChecker using SHOW GRANTS.
+// It compares required with the privileges on the database granted to the
+// current user and the roles it is a member of. ALL covers any privilege.
+func (c *CockroachDb) CheckPrivileges(required []string) error {
+	var user string
+	query := `SELECT current_user`
+	if err := c.db.QueryRow(query).Scan(&user); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+
+	// collect the roles granted to user, directly or through other roles
+	grantees := []string{user}
+	for i := 0; i < len(grantees); i++ {
+		query := `SHOW GRANTS ON ROLE FOR ` + database.QuoteIdentifier("cockroachdb", grantees[i])
+		roles, err := c.queryColumn(query, "role_name")
+		if err != nil {
+			return err
+		}
+		for _, role := range roles {
+			if !contains(grantees, role) {
+				grantees = append(grantees, role)
+			}
+		}
+	}
+
+	quoted := make([]string, 0, len(grantees))
+	for _, g := range grantees {
+		quoted = append(quoted, database.QuoteIdentifier("cockroachdb", g))
+	}
+	query = `SHOW GRANTS ON DATABASE ` + database.QuoteIdentifier("cockroachdb", c.config.DatabaseName) +
+		` FOR ` + strings.Join(quoted, ", ")
+	privileges, err := c.queryColumn(query, "privilege_type")
+	if err != nil {
+		return err
 	}
 
+	granted := make(map[string]bool, len(privileges))
+	for _, p := range privileges {
+		granted[strings.ToUpper(p)] = true
+	}
+	missing := make([]string, 0)
+	for _, r := range required {
+		if !granted["ALL"] && !granted[strings.ToUpper(r)] {
+			missing = append(missing, r)
+		}
+	}
+	if len(missing) > 0 {
+		return database.ErrMissingPrivileges{User: user, Missing: missing}
+	}
 	return nil
 }
 
+// CheckWrite implements database.WriteChecker. It replaces the contents of
+// the migrations table like SetVersion, in a transaction that is rolled back.
+func (c *CockroachDb) CheckWrite() error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return &database.Error{OrigErr: err, Err: "transaction start failed"}
+	}
+	defer tx.Rollback()
+
+	if c.config.StateFormat == StateFormatJSON {
+		state, err := c.readState(tx)
+		if err == nil {
+			err = c.writeState(tx, state)
+		}
+		if err != nil {
+			return database.ErrVersionTableNotWritable{Table: c.config.MigrationsTable, Err: err}
+		}
+		return nil
+	}
+
+	table := c.versionTable(c.config.MigrationsTable)
+	for _, query := range []string{
+		`DELETE FROM ` + table,
+		`INSERT INTO ` + table + ` (version, dirty) VALUES (` + strconv.Itoa(database.NilVersion) + `, false)`,
+	} {
+		if _, err := tx.Exec(query); err != nil {
+			err = &database.Error{OrigErr: err, Query: []byte(query)}
+			return database.ErrVersionTableNotWritable{Table: c.config.MigrationsTable, Err: err}
+		}
+	}
+	return nil
+}
+
+// queryColumn returns the values of column in the result of query,
+// whose columns differ between CockroachDB versions.
+func (c *CockroachDb) queryColumn(query string, column string) ([]string, error) {
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	index := -1
+	for i, name := range columns {
+		dest[i] = &values[i]
+		if name == column {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil, &database.Error{Err: fmt.Sprintf("no column %v", column), Query: []byte(query)}
+	}
+
+	result := make([]string, 0)
+	for rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+		result = append(result, values[index].String)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return result, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Dump implements database.Dumper using SHOW CREATE. Tables are dumped
+// after the tables they reference with foreign keys, views come last.
+func (c *CockroachDb) Dump() ([]byte, error) {
+	query := `SELECT table_name, table_type FROM information_schema.tables WHERE table_schema=(SELECT current_schema()) ORDER BY table_name`
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	defer rows.Close()
+
+	tableNames := make([]string, 0)
+	viewNames := make([]string, 0)
+	for rows.Next() {
+		var tableName, tableType string
+		if err := rows.Scan(&tableName, &tableType); err != nil {
+			return nil, err
+		}
+		if (tableName == c.config.MigrationsTable && len(c.config.VersionDatabase) == 0) || tableName == c.config.LockTable {
+			continue
+		}
+		if tableType == "VIEW" {
+			viewNames = append(viewNames, tableName)
+		} else {
+			tableNames = append(tableNames, tableName)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+
+	references, err := c.foreignKeyReferences()
+	if err != nil {
+		return nil, err
+	}
+
+	var dump bytes.Buffer
+	for _, t := range sortByReferences(tableNames, references) {
+		if err := c.dumpCreate(&dump, "TABLE", t); err != nil {
+			return nil, err
+		}
+	}
+	for _, v := range viewNames {
+		if err := c.dumpCreate(&dump, "VIEW", v); err != nil {
+			return nil, err
+		}
+	}
+	return dump.Bytes(), nil
+}
+
+// dumpCreate writes the CREATE statement for the table or view name to w.
+func (c *CockroachDb) dumpCreate(w io.Writer, kind string, name string) error {
+	query := `SHOW CREATE ` + kind + ` ` + database.QuoteIdentifier("cockroachdb", name)
+	var tableName, createStatement string
+	if err := c.db.QueryRow(query).Scan(&tableName, &createStatement); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	_, err := fmt.Fprintf(w, "%s;\n\n", createStatement)
+	return err
+}
+
+// foreignKeyReferences returns the tables each table references
+// with foreign keys in the current schema.
+func (c *CockroachDb) foreignKeyReferences() (map[string][]string, error) {
+	query := `SELECT table_name, referenced_table_name FROM information_schema.referential_constraints WHERE constraint_schema=(SELECT current_schema())`
+	rows, err := c.db.Query(query)
+	if err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	defer rows.Close()
+
+	references := make(map[string][]string)
+	for rows.Next() {
+		var tableName, referencedTableName string
+		if err := rows.Scan(&tableName, &referencedTableName); err != nil {
+			return nil, err
+		}
+		references[tableName] = append(references[tableName], referencedTableName)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return references, nil
+}
+
+// sortByReferences orders tableNames so that every table comes after the
+// tables it references. Self references and cycles can't be ordered and
+// keep the order of tableNames.
+func sortByReferences(tableNames []string, references map[string][]string) []string {
+	sorted := make([]string, 0, len(tableNames))
+	visited := make(map[string]bool)
+	known := make(map[string]bool)
+	for _, t := range tableNames {
+		known[t] = true
+	}
+
+	var visit func(t string)
+	visit = func(t string) {
+		if visited[t] {
+			return
+		}
+		visited[t] = true
+		for _, r := range references[t] {
+			if known[r] {
+				visit(r)
+			}
+		}
+		sorted = append(sorted, t)
+	}
+
+	for _, t := range tableNames {
+		visit(t)
+	}
+	return sorted
+}
+
 func (c *CockroachDb) ensureVersionTable() error {
-	// check if migration table exists
+	// check if migration table exists, the information schema only
+	// covers its own database
 	var count int
 	query := `SELECT COUNT(1) FROM information_schema.tables WHERE table_name = $1 AND table_schema = (SELECT current_schema()) LIMIT 1`
-	if err := c.db.QueryRow(query, c.config.MigrationsTable).Scan(&count); err != nil {
+	args := []interface{}{c.config.MigrationsTable}
+	if len(c.config.VersionDatabase) > 0 {
+		schema, table := "public", c.config.MigrationsTable
+		if i := strings.Index(table, "."); i >= 0 {
+			schema, table = table[:i], table[i+1:]
+		}
+		query = `SELECT COUNT(1) FROM ` + database.QuoteIdentifier("cockroachdb", c.config.VersionDatabase) + `.information_schema.tables WHERE table_name = $1 AND table_schema = $2 LIMIT 1`
+		args = []interface{}{table, schema}
+	}
+	if err := c.db.QueryRow(query, args...).Scan(&count); err != nil {
 		return &database.Error{OrigErr: err, Query: []byte(query)}
 	}
 	if count == 1 {
@@ -309,13 +1590,43 @@ func (c *CockroachDb) ensureVersionTable() error {
 	}
 
 	// if not, create the empty migration table
-	query = `CREATE TABLE "` + c.config.MigrationsTable + `" (version INT NOT NULL PRIMARY KEY, dirty BOOL NOT NULL)`
-	if _, err := c.db.Exec(query); err != nil {
-		return &database.Error{OrigErr: err, Query: []byte(query)}
+	query = `CREATE TABLE IF NOT EXISTS ` + c.versionTable(c.config.MigrationsTable) + ` (version ` + c.config.VersionColumnType + ` NOT NULL PRIMARY KEY, dirty BOOL NOT NULL)`
+	if c.config.StateFormat == StateFormatJSON {
+		query = `CREATE TABLE IF NOT EXISTS ` + c.versionTable(c.config.MigrationsTable) + ` (id INT NOT NULL PRIMARY KEY, state JSONB NOT NULL)`
 	}
-	return nil
+	return c.createTable(query)
 }
 
+// versionTable quotes table, which is kept with the version, qualified by
+// Config.VersionDatabase and schema public if set.
+func (c *CockroachDb) versionTable(table string) string {
+	if len(c.config.VersionDatabase) == 0 {
+		return database.QuoteQualifiedIdentifier("cockroachdb", table)
+	}
+	if !strings.Contains(table, ".") {
+		table = "public." + table
+	}
+	return database.QuoteIdentifier("cockroachdb", c.config.VersionDatabase) + "." + database.QuoteQualifiedIdentifier("cockroachdb", table)
+}
+
+// defaultLockTable returns the lock table for migrationsTable. Independent
+// sets of migrations with custom migrations tables in the same database
+// get a lock table of their own, so that they don't block each other.
+func defaultLockTable(migrationsTable string) string {
+	if migrationsTable == DefaultMigrationsTable {
+		return DefaultLockTable
+	}
+	return migrationsTable + "_lock"
+}
+
+// lockId returns the id of the lock, which is derived from a custom
+// migrations table, too.
+func (c *CockroachDb) lockId() (string, error) {
+	if c.config.MigrationsTable == DefaultMigrationsTable {
+		return database.GenerateAdvisoryLockId(c.config.DatabaseName)
+	}
+	return database.GenerateAdvisoryLockId(c.config.DatabaseName, c.config.MigrationsTable)
+}
 
 func (c *CockroachDb) ensureLockTable() error {
 	// check if lock table exists
@@ -325,14 +1636,41 @@ func (c *CockroachDb) ensureLockTable() error {
 		return &database.Error{OrigErr: err, Query: []byte(query)}
 	}
 	if count == 1 {
-		return nil
+		return c.ensureLockHeartbeat()
 	}
 
 	// if not, create the empty lock table
-	query = `CREATE TABLE "` + c.config.LockTable + `" (lock_id INT NOT NULL PRIMARY KEY)`
+	query = `CREATE TABLE IF NOT EXISTS ` + database.QuoteQualifiedIdentifier("cockroachdb", c.config.LockTable) + ` (lock_id INT NOT NULL PRIMARY KEY)`
+	if err := c.createTable(query); err != nil {
+		return err
+	}
+	return c.ensureLockHeartbeat()
+}
+
+// ensureLockHeartbeat adds the acquired_at and heartbeat_at columns to
+// the lock table if Config.LockHeartbeatInterval is set.
+func (c *CockroachDb) ensureLockHeartbeat() error {
+	if c.config.LockHeartbeatInterval <= 0 {
+		return nil
+	}
+	for _, column := range []string{"acquired_at", "heartbeat_at"} {
+		query := `ALTER TABLE ` + database.QuoteQualifiedIdentifier("cockroachdb", c.config.LockTable) + ` ADD COLUMN IF NOT EXISTS ` + column + ` TIMESTAMPTZ`
+		if _, err := c.db.Exec(query); err != nil {
+			return &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+	}
+	return nil
+}
+
+// createTable runs a CREATE TABLE IF NOT EXISTS query. Another process
+// starting at the same time may still create the table first, which is
+// just as good.
+func (c *CockroachDb) createTable(query string) error {
 	if _, err := c.db.Exec(query); err != nil {
+		if c.classifier().IsDuplicateTable(err) {
+			return nil
+		}
 		return &database.Error{OrigErr: err, Query: []byte(query)}
 	}
-
 	return nil
 }
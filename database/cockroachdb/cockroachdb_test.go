@@ -4,12 +4,20 @@ package cockroachdb
 
 import (
 	//"bytes"
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io"
+	nurl "net/url"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/lib/pq"
+	"github.com/vickxxx/migrate/database"
 	dt "github.com/vickxxx/migrate/database/testing"
 	mt "github.com/vickxxx/migrate/testing"
 	"bytes"
@@ -89,3 +97,1548 @@ func TestFilterCustomQuery(t *testing.T) {
 			}
 		})
 }
+
+func TestVersionColumnType(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable&x-migrations-table=bigint_migrations&x-version-column-type=bigint", i.Host(), i.PortFor(26257))
+			d, err := c.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+
+			// unix timestamp in milliseconds, exceeds INT32
+			version := 1500000000000
+			if err := d.SetVersion(version, false); err != nil {
+				t.Fatal(err)
+			}
+			v, _, err := d.Version()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v != version {
+				t.Fatalf("expected version %v, got %v", version, v)
+			}
+		})
+}
+
+func TestQualifiedTables(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable&x-migrations-table=public.qualified_migrations&x-lock-table=migrate.public.qualified_lock", i.Host(), i.PortFor(26257))
+			d, err := c.Open(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			if err := d.Lock(); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.SetVersion(3, false); err != nil {
+				t.Fatal(err)
+			}
+			v, _, err := d.Version()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v != 3 {
+				t.Fatalf("expected version 3, got %v", v)
+			}
+			if err := d.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+
+			// the tables are created in the schema, not named after it
+			var count int
+			query := `SELECT COUNT(1) FROM information_schema.tables WHERE table_schema = 'public' AND table_name IN ('qualified_migrations', 'qualified_lock')`
+			if err := d.(*CockroachDb).db.QueryRow(query).Scan(&count); err != nil {
+				t.Fatal(err)
+			}
+			if count != 2 {
+				t.Fatalf("expected both tables in schema public, got %v", count)
+			}
+		})
+}
+
+func TestVersionDatabase(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			d, err := c.Open(fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable", i.Host(), i.PortFor(26257)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+			if _, err := d.(*CockroachDb).db.Exec("CREATE DATABASE IF NOT EXISTS trackdb"); err != nil {
+				t.Fatal(err)
+			}
+
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable&x-version-database=trackdb&x-migrations-table=app_migrations", i.Host(), i.PortFor(26257))
+			d2, err := c.Open(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d2.Close()
+			if vd := d2.(*CockroachDb).config.VersionDatabase; vd != "trackdb" {
+				t.Fatalf("expected version database trackdb, got %q", vd)
+			}
+			db := d2.(*CockroachDb).db
+
+			if err := d2.Lock(); err != nil {
+				t.Fatal(err)
+			}
+			if err := d2.Run(bytes.NewReader([]byte("CREATE TABLE tracked_users (id INT PRIMARY KEY)"))); err != nil {
+				t.Fatal(err)
+			}
+			if err := d2.SetVersion(1, false); err != nil {
+				t.Fatal(err)
+			}
+			if err := d2.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+
+			v, dirty, err := d2.Version()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v != 1 || dirty {
+				t.Fatalf("expected version 1, clean, got %v, %v", v, dirty)
+			}
+
+			// the version is kept in the tracking database
+			var tracked int
+			if err := db.QueryRow(`SELECT version FROM trackdb.public.app_migrations`).Scan(&tracked); err != nil {
+				t.Fatal(err)
+			}
+			if tracked != 1 {
+				t.Fatalf("expected version 1 in trackdb, got %v", tracked)
+			}
+
+			// the migration ran in the database of the connection, which has
+			// no migrations table
+			for _, v := range []struct {
+				catalog string
+				table   string
+				expect  int
+			}{
+				{"migrate", "tracked_users", 1},
+				{"migrate", "app_migrations", 0},
+				{"trackdb", "tracked_users", 0},
+			} {
+				var count int
+				query := `SELECT COUNT(1) FROM ` + v.catalog + `.information_schema.tables WHERE table_schema = 'public' AND table_name = $1`
+				if err := db.QueryRow(query, v.table).Scan(&count); err != nil {
+					t.Fatal(err)
+				}
+				if count != v.expect {
+					t.Fatalf("expected %v tables %v in %v, got %v", v.expect, v.table, v.catalog, count)
+				}
+			}
+
+			// opening again finds the existing migrations table in the
+			// tracking database and keeps its version
+			d3, err := c.Open(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d3.Close()
+			if v, _, err := d3.Version(); err != nil || v != 1 {
+				t.Fatalf("expected version 1, got %v, %v", v, err)
+			}
+		})
+}
+
+func TestVersionTable(t *testing.T) {
+	tt := []struct {
+		versionDatabase string
+		table           string
+		expect          string
+	}{
+		{"", "schema_migrations", `"schema_migrations"`},
+		{"", "app.schema_migrations", `"app"."schema_migrations"`},
+		{"trackdb", "schema_migrations", `"trackdb"."public"."schema_migrations"`},
+		{"trackdb", "app.schema_migrations", `"trackdb"."app"."schema_migrations"`},
+		{"track.db", "schema_migrations", `"track.db"."public"."schema_migrations"`},
+	}
+	for i, v := range tt {
+		c := &CockroachDb{config: &Config{VersionDatabase: v.versionDatabase}}
+		if table := c.versionTable(v.table); table != v.expect {
+			t.Errorf("expected %v, got %v, in %v", v.expect, table, i)
+		}
+	}
+}
+
+func TestInvalidVersionColumnType(t *testing.T) {
+	_, err := WithInstance(nil, &Config{VersionColumnType: "TEXT"})
+	if _, ok := err.(ErrInvalidVersionColumnType); !ok {
+		t.Fatalf("expected ErrInvalidVersionColumnType, got %v", err)
+	}
+}
+
+func TestURLRewriter(t *testing.T) {
+	errRewrite := fmt.Errorf("rewrite failed")
+	var rewritten string
+	database.SetURLRewriter(func(url string) (string, error) {
+		rewritten = url
+		return "", errRewrite
+	})
+	defer database.SetURLRewriter(nil)
+
+	c := &CockroachDb{}
+	addr := "cockroach://root@localhost:26257/migrate?sslmode=disable"
+	if _, err := c.Open(addr); err != errRewrite {
+		t.Fatalf("expected %v, got %v", errRewrite, err)
+	}
+	if rewritten != addr {
+		t.Fatalf("expected rewriter to be called with %v, got %v", addr, rewritten)
+	}
+}
+
+func TestCreateDatabaseIfNotExists(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			addr := fmt.Sprintf("cockroach://root@%v:%v/missing?sslmode=disable&x-create-database=true", i.Host(), i.PortFor(26257))
+			d, err := c.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			defer d.Close()
+
+			var databaseName string
+			if err := d.(*CockroachDb).db.QueryRow("SELECT current_database()").Scan(&databaseName); err != nil {
+				t.Fatal(err)
+			}
+			if databaseName != "missing" {
+				t.Fatalf("expected database missing, got %v", databaseName)
+			}
+
+			// opening again must not fail on the existing database
+			d2, err := c.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			d2.Close()
+		})
+}
+
+func TestDump(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable", i.Host(), i.PortFor(26257))
+			d, err := c.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+
+			// a_child sorts before b_parent, but references it
+			migration := `CREATE TABLE b_parent (id INT PRIMARY KEY);
+			CREATE TABLE a_child (id INT PRIMARY KEY, parent_id INT REFERENCES b_parent (id));
+			CREATE VIEW c_view AS SELECT id FROM a_child;`
+			if err := d.Run(bytes.NewReader([]byte(migration))); err != nil {
+				t.Fatal(err)
+			}
+
+			dump, err := d.(database.Dumper).Dump()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := d.Drop(); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.Run(bytes.NewReader(dump)); err != nil {
+				t.Fatalf("expected dump to replay, got %v", err)
+			}
+
+			replayed, err := d.(database.Dumper).Dump()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(dump, replayed) {
+				t.Fatalf("expected same schema after replay\n%s\ngot\n%s", dump, replayed)
+			}
+		})
+}
+
+func TestSortByReferences(t *testing.T) {
+	tableNames := []string{"a", "b", "c", "d"}
+	references := map[string][]string{
+		"a": {"c"},
+		"c": {"d", "c"},
+		"b": {"x"},
+	}
+	sorted := sortByReferences(tableNames, references)
+	expected := []string{"d", "c", "a", "b"}
+	if fmt.Sprint(sorted) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, sorted)
+	}
+}
+
+func TestFreshConnectionPerMigration(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			db, err := sql.Open("postgres", fmt.Sprintf("postgres://root@%v:%v/migrate?sslmode=disable", i.Host(), i.PortFor(26257)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			// a single pooled connection would be reused by every migration
+			db.SetMaxOpenConns(1)
+
+			d, err := WithInstance(db, &Config{FreshConnectionPerMigration: true})
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+
+			if err := d.Run(bytes.NewReader([]byte("SET application_name = 'leaked'"))); err != nil {
+				t.Fatal(err)
+			}
+
+			var applicationName string
+			if err := db.QueryRow("SHOW application_name").Scan(&applicationName); err != nil {
+				t.Fatal(err)
+			}
+			if applicationName == "leaked" {
+				t.Fatal("expected session setting of previous migration to be reset")
+			}
+		})
+}
+
+// triggerVersions support triggers and session_replication_role.
+var triggerVersions = []mt.Version{
+	{Image: "cockroachdb/cockroach:v25.1.0", Cmd: []string{"start-single-node", "--insecure"}},
+}
+
+func TestDisableTriggers(t *testing.T) {
+	mt.ParallelTest(t, triggerVersions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable", i.Host(), i.PortFor(26257))
+			d, err := c.Open(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			// every insert into a is logged by a trigger
+			for _, migration := range []string{
+				"CREATE TABLE a (a INT); CREATE TABLE audit (a INT)",
+				"CREATE FUNCTION log_a() RETURNS TRIGGER LANGUAGE plpgsql AS $$ BEGIN INSERT INTO audit VALUES ((NEW).a); RETURN NEW; END $$",
+				"CREATE TRIGGER log_a AFTER INSERT ON a FOR EACH ROW EXECUTE FUNCTION log_a()",
+				"INSERT INTO a VALUES (1)",
+			} {
+				if err := d.Run(strings.NewReader(migration)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, query := range []string{"&x-disable-triggers=true", "&x-disable-triggers=true&x-fresh-connection-per-migration=true"} {
+				d2, err := c.Open(addr + query)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := d2.Run(strings.NewReader("INSERT INTO a VALUES (2)")); err != nil {
+					t.Fatal(err)
+				}
+
+				// the role is reset on the pooled connection
+				var role string
+				if err := d2.(*CockroachDb).db.QueryRow("SHOW session_replication_role").Scan(&role); err != nil {
+					t.Fatal(err)
+				}
+				if role != "origin" {
+					t.Fatalf("expected session_replication_role origin, got %v", role)
+				}
+				d2.Close()
+			}
+
+			var logged int
+			if err := d.(*CockroachDb).db.QueryRow("SELECT count(*) FROM audit").Scan(&logged); err != nil {
+				t.Fatal(err)
+			}
+			if logged != 1 {
+				t.Fatalf("expected only the insert with triggers enabled to be logged, got %v", logged)
+			}
+		})
+}
+
+func TestOpenPool(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable&x-max-open-conns=3&x-max-idle-conns=1&x-conn-max-lifetime=1m", i.Host(), i.PortFor(26257))
+			d, err := c.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			defer d.Close()
+
+			if max := d.(*CockroachDb).db.Stats().MaxOpenConnections; max != 3 {
+				t.Fatalf("expected max open connections 3, got %v", max)
+			}
+		})
+}
+
+func TestSetPool(t *testing.T) {
+	tt := []struct {
+		query   string
+		maxOpen int
+	}{
+		{"x-max-open-conns=5", 5},
+		{"x-max-open-conns=5&x-max-idle-conns=2&x-conn-max-lifetime=30s", 5},
+		{"x-max-open-conns=many", 0},
+		{"", 0},
+	}
+
+	for i, v := range tt {
+		db, err := sql.Open("postgres", "postgres://root@localhost:26257/migrate?sslmode=disable")
+		if err != nil {
+			t.Fatal(err)
+		}
+		query, err := nurl.ParseQuery(v.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		setPool(db, query)
+		if max := db.Stats().MaxOpenConnections; max != v.maxOpen {
+			t.Errorf("expected max open connections %v, got %v, in %v", v.maxOpen, max, i)
+		}
+		db.Close()
+	}
+}
+
+func TestWithInstanceConcurrent(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			db, err := sql.Open("postgres", fmt.Sprintf("postgres://root@%v:%v?sslmode=disable", i.Host(), i.PortFor(26257)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if _, err := db.Exec("CREATE DATABASE migrate_concurrent"); err != nil {
+				t.Fatal(err)
+			}
+
+			// both see no tables and race to create them
+			errs := make(chan error, 2)
+			var wg sync.WaitGroup
+			for n := 0; n < 2; n++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					db, err := sql.Open("postgres", fmt.Sprintf("postgres://root@%v:%v/migrate_concurrent?sslmode=disable", i.Host(), i.PortFor(26257)))
+					if err != nil {
+						errs <- err
+						return
+					}
+					d, err := WithInstance(db, &Config{})
+					if err != nil {
+						db.Close()
+						errs <- err
+						return
+					}
+					errs <- d.Close()
+				}()
+			}
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+}
+
+func TestMultiStatementErrorLine(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable&x-multi-statement=true", i.Host(), i.PortFor(26257))
+			d, err := c.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+
+			migration := "CREATE TABLE line_a (a INT);\n\n-- the next one fails\nCREATE TABLE line_b (\n  b INT\n);\nSELECT * FROM line_missing;\nCREATE TABLE line_c (c INT);"
+			err = d.Run(bytes.NewReader([]byte(migration)))
+			e, ok := err.(database.Error)
+			if !ok {
+				t.Fatalf("expected database.Error, got %v", err)
+			}
+			if e.Line != 7 {
+				t.Fatalf("expected error in line 7, got %v", e.Line)
+			}
+			if string(e.Query) != "SELECT * FROM line_missing" {
+				t.Fatalf("expected failing statement as query, got %q", e.Query)
+			}
+		})
+}
+
+func TestVersionQuery(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable&x-migrations-table=view_migrations", i.Host(), i.PortFor(26257))
+			d, err := c.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			db := d.(*CockroachDb).db
+
+			query := `CREATE VIEW migration_state (version, dirty, source) AS SELECT version, dirty, 'migrate' FROM view_migrations`
+			if _, err := db.Exec(query); err != nil {
+				t.Fatal(err)
+			}
+
+			tt := []struct {
+				query     string
+				expectErr bool
+			}{
+				{query: `SELECT version, dirty FROM migration_state LIMIT 1`},
+				{query: `SELECT version FROM migration_state`, expectErr: true},
+				{query: `SELECT dirty, version FROM migration_state`, expectErr: true},
+				{query: `SELECT version, source FROM migration_state`, expectErr: true},
+			}
+			for n, v := range tt {
+				_, err := WithInstance(db, &Config{MigrationsTable: "view_migrations", VersionQuery: v.query})
+				if _, ok := err.(ErrInvalidVersionQuery); ok != v.expectErr {
+					t.Fatalf("expected ErrInvalidVersionQuery %v, got %v, in %v", v.expectErr, err, n)
+				}
+			}
+
+			vd, err := WithInstance(db, &Config{MigrationsTable: "view_migrations", VersionQuery: tt[0].query})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version, _, err := vd.Version(); err != nil || version != database.NilVersion {
+				t.Fatalf("expected NilVersion, got %v, %v", version, err)
+			}
+			if err := vd.SetVersion(3, true); err != nil {
+				t.Fatal(err)
+			}
+			version, dirty, err := vd.Version()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != 3 || !dirty {
+				t.Fatalf("expected version 3, dirty, got %v, %v", version, dirty)
+			}
+		})
+}
+
+func TestVersionQueryStateFormatJSON(t *testing.T) {
+	_, err := WithInstance(nil, &Config{StateFormat: StateFormatJSON, VersionQuery: "SELECT 1, false"})
+	if _, ok := err.(ErrInvalidVersionQuery); !ok {
+		t.Fatalf("expected ErrInvalidVersionQuery, got %v", err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable", i.Host(), i.PortFor(26257))
+			d, err := c.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+
+			up := []byte("CREATE TABLE round_trip (a INT)")
+			down := []byte("DROP TABLE round_trip")
+			if err := d.(*CockroachDb).RoundTrip(bytes.NewReader(up), bytes.NewReader(down)); err != nil {
+				t.Fatal(err)
+			}
+
+			var count int
+			query := `SELECT COUNT(1) FROM information_schema.tables WHERE table_name = 'round_trip'`
+			if err := d.(*CockroachDb).db.QueryRow(query).Scan(&count); err != nil {
+				t.Fatal(err)
+			}
+			if count != 0 {
+				t.Fatal("expected table to be rolled back")
+			}
+
+			// a down migration that doesn't apply
+			down = []byte("DROP TABLE round_trip_missing")
+			if err := d.(*CockroachDb).RoundTrip(bytes.NewReader(up), bytes.NewReader(down)); err == nil {
+				t.Fatal("expected err for failing down migration")
+			}
+		})
+}
+
+func TestLockPerMigrationsTable(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable", i.Host(), i.PortFor(26257))
+			billing, err := c.Open(addr + "&x-migrations-table=billing_migrations")
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			shipping, err := c.Open(addr + "&x-migrations-table=shipping_migrations")
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			billing2, err := c.Open(addr + "&x-migrations-table=billing_migrations")
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+
+			if lockTable := billing.(*CockroachDb).config.LockTable; lockTable != "billing_migrations_lock" {
+				t.Fatalf("expected lock table billing_migrations_lock, got %v", lockTable)
+			}
+
+			if err := billing.Lock(); err != nil {
+				t.Fatal(err)
+			}
+			if err := shipping.Lock(); err != nil {
+				t.Fatalf("expected independent migrations not to block each other, got %v", err)
+			}
+			if err := billing2.Lock(); err == nil {
+				t.Fatal("expected lock of the same migrations table to be held")
+			}
+
+			if err := billing.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+			if err := shipping.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+		})
+}
+
+func TestStaleLockTakeOver(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable&x-lock-heartbeat-interval=50ms", i.Host(), i.PortFor(26257))
+			crashed, err := c.Open(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer crashed.Close()
+			if err := crashed.Lock(); err != nil {
+				t.Fatal(err)
+			}
+
+			// the heartbeat is updated while the lock is held
+			db := crashed.(*CockroachDb).db
+			var first, second time.Time
+			query := `SELECT heartbeat_at FROM schema_lock`
+			if err := db.QueryRow(query).Scan(&first); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(200 * time.Millisecond)
+			if err := db.QueryRow(query).Scan(&second); err != nil {
+				t.Fatal(err)
+			}
+			if !second.After(first) {
+				t.Fatalf("expected the heartbeat to be updated, got %v and %v", first, second)
+			}
+
+			// the process crashes, its heartbeat stops
+			crashed.(*CockroachDb).stopHeartbeat()
+			crashed.(*CockroachDb).stopHeartbeat = nil
+			if _, err := db.Exec(`UPDATE schema_lock SET heartbeat_at = now() - INTERVAL '1 hour'`); err != nil {
+				t.Fatal(err)
+			}
+
+			other, err := c.Open(addr + "&x-lock-stale-after=1m")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer other.Close()
+			if err := other.Lock(); err != nil {
+				t.Fatalf("expected the stale lock to be taken over, got %v", err)
+			}
+
+			// a lock with a current heartbeat is held
+			third, err := c.Open(addr + "&x-lock-stale-after=1m")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer third.Close()
+			if err := third.Lock(); err == nil {
+				t.Fatal("expected the live lock to be held")
+			}
+
+			if err := other.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+			if err := third.Lock(); err != nil {
+				t.Fatal(err)
+			}
+			if err := third.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+		})
+}
+
+func TestLockStale(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	tt := []struct {
+		heartbeat pq.NullTime
+		expected  bool
+	}{
+		// set without heartbeat
+		{heartbeat: pq.NullTime{}, expected: false},
+		{heartbeat: pq.NullTime{Time: now.Add(-time.Second), Valid: true}, expected: false},
+		{heartbeat: pq.NullTime{Time: now.Add(-time.Minute), Valid: true}, expected: false},
+		{heartbeat: pq.NullTime{Time: now.Add(-time.Hour), Valid: true}, expected: true},
+	}
+	for i, v := range tt {
+		if stale := lockStale(v.heartbeat, now, time.Minute); stale != v.expected {
+			t.Errorf("expected %v, got %v, in %v", v.expected, stale, i)
+		}
+	}
+}
+
+func TestLockStaleAfterInvalid(t *testing.T) {
+	for _, config := range []*Config{
+		{LockStaleAfter: time.Minute},
+		{LockStaleAfter: time.Second, LockHeartbeatInterval: time.Second},
+	} {
+		if _, err := WithInstance(nil, config); err != ErrLockStaleAfter {
+			t.Fatalf("expected ErrLockStaleAfter, got %v", err)
+		}
+	}
+}
+
+func TestDefaultLockTable(t *testing.T) {
+	if lockTable := defaultLockTable(DefaultMigrationsTable); lockTable != DefaultLockTable {
+		t.Fatalf("expected %v, got %v", DefaultLockTable, lockTable)
+	}
+	if lockTable := defaultLockTable("billing_migrations"); lockTable != "billing_migrations_lock" {
+		t.Fatalf("expected billing_migrations_lock, got %v", lockTable)
+	}
+
+	// the lock id stays the same for the default migrations table
+	c := &CockroachDb{config: &Config{DatabaseName: "migrate", MigrationsTable: DefaultMigrationsTable}}
+	id, err := c.lockId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect, _ := database.GenerateAdvisoryLockId("migrate"); id != expect {
+		t.Fatalf("expected lock id %v, got %v", expect, id)
+	}
+	c.config.MigrationsTable = "billing_migrations"
+	if other, _ := c.lockId(); other == id {
+		t.Fatal("expected another lock id for another migrations table")
+	}
+}
+
+// user-defined schemas need CockroachDB 20.2
+var schemaVersions = []mt.Version{
+	{Image: "cockroachdb/cockroach:v21.2.17", Cmd: []string{"start-single-node", "--insecure"}},
+}
+
+func TestDropSchema(t *testing.T) {
+	mt.ParallelTest(t, schemaVersions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable", i.Host(), i.PortFor(26257))
+			db, err := sql.Open("postgres", fmt.Sprintf("postgres://root@%v:%v/migrate?sslmode=disable", i.Host(), i.PortFor(26257)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if _, err := db.Exec("CREATE SCHEMA app"); err != nil {
+				t.Fatal(err)
+			}
+
+			tt := []struct {
+				query  string
+				schema string
+			}{
+				// dropped as a whole
+				{query: "&search_path=app", schema: "app"},
+				// dropped table by table
+				{query: "", schema: "public"},
+				{query: "&search_path=app,public", schema: "app"},
+			}
+
+			for n, v := range tt {
+				c := &CockroachDb{}
+				d, err := c.Open(addr + "&x-drop-schema=true" + v.query)
+				if err != nil {
+					t.Fatalf("%v, in %v", err, n)
+				}
+				migration := "CREATE TABLE a (a INT); CREATE TABLE b (b INT REFERENCES a (a)); CREATE VIEW c AS SELECT * FROM b"
+				if err := d.Run(bytes.NewReader([]byte(migration))); err != nil {
+					t.Fatalf("%v, in %v", err, n)
+				}
+				if err := d.SetVersion(1, false); err != nil {
+					t.Fatalf("%v, in %v", err, n)
+				}
+
+				if err := d.Drop(); err != nil {
+					t.Fatalf("%v, in %v", err, n)
+				}
+
+				var count int
+				query := `SELECT COUNT(1) FROM information_schema.tables WHERE table_schema = $1 AND table_name IN ('a', 'b', 'c')`
+				if err := db.QueryRow(query, v.schema).Scan(&count); err != nil {
+					t.Fatal(err)
+				}
+				if count != 0 {
+					t.Fatalf("expected tables to be dropped, got %v, in %v", count, n)
+				}
+				if version, _, err := d.Version(); err != nil || version != database.NilVersion {
+					t.Fatalf("expected NilVersion, got %v, %v, in %v", version, err, n)
+				}
+				if err := d.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+}
+
+func TestSchemaToDrop(t *testing.T) {
+	tt := []struct {
+		schemas      []string
+		expectSchema string
+		expectOk     bool
+	}{
+		{schemas: []string{"app"}, expectSchema: "app", expectOk: true},
+		{schemas: []string{"public"}},
+		{schemas: []string{"app", "public"}},
+		{schemas: []string{}},
+	}
+	for i, v := range tt {
+		schema, ok := schemaToDrop(v.schemas)
+		if schema != v.expectSchema || ok != v.expectOk {
+			t.Errorf("expected %q, %v, got %q, %v, in %v", v.expectSchema, v.expectOk, schema, ok, i)
+		}
+	}
+}
+
+func TestDropTypesAndViews(t *testing.T) {
+	mt.ParallelTest(t, schemaVersions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			d, err := c.Open(fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable", i.Host(), i.PortFor(26257)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			migration := "CREATE TYPE status AS ENUM ('open', 'closed'); CREATE SEQUENCE ids; " +
+				"CREATE TABLE a (id INT DEFAULT nextval('ids'), status status); CREATE VIEW b AS SELECT * FROM a"
+			if err := d.Run(bytes.NewReader([]byte(migration))); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := d.Drop(); err != nil {
+				t.Fatal(err)
+			}
+
+			db := d.(*CockroachDb).db
+			var count int
+			query := `SELECT COUNT(1) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name IN ('a', 'b', 'ids')`
+			if err := db.QueryRow(query).Scan(&count); err != nil {
+				t.Fatal(err)
+			}
+			if count != 0 {
+				t.Fatalf("expected table, view and sequence to be dropped, got %v", count)
+			}
+			query = `SELECT COUNT(1) FROM pg_catalog.pg_type WHERE typname = 'status'`
+			if err := db.QueryRow(query).Scan(&count); err != nil {
+				t.Fatal(err)
+			}
+			if count != 0 {
+				t.Fatalf("expected type to be dropped, got %v", count)
+			}
+		})
+}
+
+func TestDropOnlyManaged(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			d, err := c.Open(fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable&x-drop-only-managed=true", i.Host(), i.PortFor(26257)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			migration := "CREATE TABLE a (a INT PRIMARY KEY); CREATE TABLE b (b INT PRIMARY KEY)"
+			if err := d.(database.VersionRunner).RunVersion(1, strings.NewReader(migration)); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.Drop(); err != nil {
+				t.Fatal(err)
+			}
+
+			// a table of another application in the same database
+			db := d.(*CockroachDb).db
+			if _, err := db.Exec("CREATE TABLE shared (id INT PRIMARY KEY)"); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.(database.VersionRunner).RunVersion(1, strings.NewReader(migration)); err != nil {
+				t.Fatal(err)
+			}
+
+			err = d.Drop()
+			if !reflect.DeepEqual(err, ErrUnmanagedObjects{Objects: []string{"shared"}}) {
+				t.Fatalf("expected ErrUnmanagedObjects for shared, got %v", err)
+			}
+			var count int
+			query := `SELECT COUNT(1) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name IN ('a', 'b', 'shared')`
+			if err := db.QueryRow(query).Scan(&count); err != nil {
+				t.Fatal(err)
+			}
+			if count != 3 {
+				t.Fatalf("expected no table to be dropped, got %v of 3", count)
+			}
+		})
+}
+
+func TestNotIn(t *testing.T) {
+	objects := []string{"users", "schema_migrations", "shared", "orders", "audit"}
+	known := []string{"schema_migrations", "users", "orders"}
+	if result := notIn(objects, known); !reflect.DeepEqual(result, []string{"audit", "shared"}) {
+		t.Fatalf("expected [audit shared], got %v", result)
+	}
+	if result := notIn(known, objects); len(result) != 0 {
+		t.Fatalf("expected no objects, got %v", result)
+	}
+
+	err := ErrUnmanagedObjects{Objects: []string{"audit", "shared"}}
+	if !strings.Contains(err.Error(), "audit, shared") {
+		t.Fatalf("expected the objects in the error, got %v", err)
+	}
+}
+
+func TestDropQueries(t *testing.T) {
+	objects := schemaObjects{
+		views:     []string{"v"},
+		tables:    []string{"t"},
+		sequences: []string{"s"},
+		types:     []string{"e"},
+	}
+	expected := []string{
+		`DROP VIEW IF EXISTS "v" CASCADE`,
+		`DROP TABLE IF EXISTS "t" CASCADE`,
+		`DROP SEQUENCE IF EXISTS "s" CASCADE`,
+		`DROP TYPE IF EXISTS "e"`,
+	}
+	if queries := objects.dropQueries(); !reflect.DeepEqual(queries, expected) {
+		t.Fatalf("expected %q, got %q", expected, queries)
+	}
+	if queries := (schemaObjects{}).dropQueries(); len(queries) != 0 {
+		t.Fatalf("expected no queries, got %q", queries)
+	}
+}
+
+// recordingExecer records queries instead of running them,
+// and fails the queries containing fail, if set.
+type recordingExecer struct {
+	queries []string
+	fail    string
+}
+
+func (r *recordingExecer) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if len(r.fail) > 0 && strings.Contains(query, r.fail) {
+		return nil, &pq.Error{Code: "42P01", Message: "relation does not exist"}
+	}
+	r.queries = append(r.queries, query)
+	return nil, nil
+}
+
+func TestQueryBool(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			d, err := c.Open(fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable", i.Host(), i.PortFor(26257)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			if err := d.Run(bytes.NewReader([]byte("CREATE TABLE assert_users (id INT); INSERT INTO assert_users VALUES (1), (2)"))); err != nil {
+				t.Fatal(err)
+			}
+
+			tt := []struct {
+				condition string
+				expect    bool
+			}{
+				{condition: "(SELECT count(*) FROM assert_users) < 3", expect: true},
+				{condition: "(SELECT count(*) FROM assert_users) < 2", expect: false},
+				{condition: "SELECT EXISTS (SELECT 1 FROM assert_users WHERE id = 2)", expect: true},
+				{condition: "NULL", expect: false},
+			}
+			for n, v := range tt {
+				ok, err := d.(*CockroachDb).QueryBool(v.condition)
+				if err != nil {
+					t.Fatalf("%v, in %v", err, n)
+				}
+				if ok != v.expect {
+					t.Errorf("expected %v, got %v, in %v", v.expect, ok, n)
+				}
+			}
+
+			if _, err := d.(*CockroachDb).QueryBool("(SELECT count(*) FROM assert_missing) < 3"); err == nil {
+				t.Fatal("expected error for missing table")
+			}
+		})
+}
+
+func TestStatementFailed(t *testing.T) {
+	migration := []byte("CREATE TABLE a (a INT);\nCREATE TABLE b (b INT);\nSELECT * FROM missing;\nCREATE TABLE c (c INT);")
+	c := &CockroachDb{config: &Config{MultiStatementEnabled: true}}
+	r := &recordingExecer{fail: "missing"}
+
+	err := c.runStatements(context.Background(), r, migration, -1)
+	e, ok := err.(database.Error)
+	if !ok {
+		t.Fatalf("expected database.Error, got %v", err)
+	}
+	if e.Line != 3 {
+		t.Fatalf("expected error in line 3, got %v", e.Line)
+	}
+	var failed ErrStatementFailed
+	if !errors.As(err, &failed) {
+		t.Fatalf("expected ErrStatementFailed, got %v", err)
+	}
+	if !reflect.DeepEqual(failed.Committed, []int{0, 1}) || failed.Failed != 2 {
+		t.Fatalf("expected statements [0 1] committed and 2 failed, got %v and %v", failed.Committed, failed.Failed)
+	}
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "42P01" {
+		t.Fatalf("expected *pq.Error 42P01, got %v", err)
+	}
+	if len(r.queries) != 2 {
+		t.Fatalf("expected no statement after the failed one, got %q", r.queries)
+	}
+}
+
+func TestInjectVersionComment(t *testing.T) {
+	migration := []byte("CREATE TABLE a (a TEXT DEFAULT 'x;y');\n-- comment; with semicolon\nCREATE TABLE b (b INT);")
+
+	tt := []struct {
+		config  Config
+		version int
+		expect  []string
+	}{
+		{
+			config:  Config{InjectVersionComment: true},
+			version: 42,
+			expect:  []string{"/* migrate:version=42 */ CREATE TABLE a (a TEXT DEFAULT 'x;y');\n/* migrate:version=42 */ CREATE TABLE b (b INT);\n"},
+		},
+		{
+			config:  Config{InjectVersionComment: true, MultiStatementEnabled: true},
+			version: 42,
+			expect:  []string{"/* migrate:version=42 */ CREATE TABLE a (a TEXT DEFAULT 'x;y')", "/* migrate:version=42 */ CREATE TABLE b (b INT)"},
+		},
+		{
+			// version unknown, called through Run
+			config:  Config{InjectVersionComment: true},
+			version: -1,
+			expect:  []string{string(migration)},
+		},
+		{
+			config:  Config{},
+			version: 42,
+			expect:  []string{string(migration)},
+		},
+	}
+
+	for i, v := range tt {
+		c := &CockroachDb{config: &v.config}
+		r := &recordingExecer{}
+		if err := c.runStatements(context.Background(), r, migration, v.version); err != nil {
+			t.Fatal(err)
+		}
+		if len(r.queries) != len(v.expect) {
+			t.Errorf("expected %v queries, got %q, in %v", len(v.expect), r.queries, i)
+			continue
+		}
+		for n, q := range r.queries {
+			if q != v.expect[n] {
+				t.Errorf("expected query %q, got %q, in %v", v.expect[n], q, i)
+			}
+		}
+	}
+}
+
+func TestNonTransactionalStatements(t *testing.T) {
+	migration := []byte("CREATE TABLE a (a INT, b INT);\nCREATE INDEX CONCURRENTLY a_a ON a (a);\nALTER TABLE a ADD c INT;\nINSERT INTO a VALUES (1, 2, 3);")
+	c := &CockroachDb{config: &Config{}}
+	if c.TransactionalMigration(migration) {
+		t.Fatal("expected migration not to run in a single transaction")
+	}
+	if !c.TransactionalMigration([]byte("CREATE TABLE a (a INT);\nCREATE INDEX a_a ON a (a);")) {
+		t.Fatal("expected migration to run in a single transaction")
+	}
+	if c.TransactionalMigration([]byte("BEGIN;\nCREATE TABLE a (a INT);\nCOMMIT;")) {
+		t.Fatal("expected migration committing itself not to run in a single transaction")
+	}
+
+	r := &recordingExecer{}
+	if err := c.runStatements(context.Background(), r, migration, -1); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"CREATE TABLE a (a INT, b INT)",
+		"CREATE INDEX CONCURRENTLY a_a ON a (a)",
+		"ALTER TABLE a ADD c INT;\nINSERT INTO a VALUES (1, 2, 3)",
+	}
+	if !reflect.DeepEqual(r.queries, expected) {
+		t.Fatalf("expected queries %q, got %q", expected, r.queries)
+	}
+
+	// the error names the line of the failed batch
+	r = &recordingExecer{fail: "INSERT"}
+	err := c.runStatements(context.Background(), r, migration, -1)
+	if e, ok := err.(database.Error); !ok || e.Line != 3 {
+		t.Fatalf("expected database.Error in line 3, got %v", err)
+	}
+}
+
+func TestCheckPrivileges(t *testing.T) {
+	mt.ParallelTest(t, schemaVersions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable", i.Host(), i.PortFor(26257))
+			d, err := c.Open(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			// root is a member of admin, which has ALL
+			if err := d.(database.PrivilegeChecker).CheckPrivileges([]string{"CREATE", "DROP"}); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, query := range []string{
+				"CREATE USER restricted",
+				"CREATE ROLE deployer",
+				"GRANT CONNECT ON DATABASE migrate TO restricted",
+				"GRANT CREATE ON DATABASE migrate TO deployer",
+				"GRANT deployer TO restricted",
+			} {
+				if _, err := d.(*CockroachDb).db.Exec(query); err != nil {
+					t.Fatalf("%v: %v", query, err)
+				}
+			}
+
+			db, err := sql.Open("postgres", fmt.Sprintf("postgres://restricted@%v:%v/migrate?sslmode=disable", i.Host(), i.PortFor(26257)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			restricted := &CockroachDb{db: db, config: &Config{DatabaseName: "migrate"}}
+
+			// CREATE is granted through deployer
+			if err := restricted.CheckPrivileges([]string{"CONNECT", "CREATE"}); err != nil {
+				t.Fatal(err)
+			}
+
+			err = restricted.CheckPrivileges([]string{"CREATE", "DROP", "ZONECONFIG"})
+			e, ok := err.(database.ErrMissingPrivileges)
+			if !ok {
+				t.Fatalf("expected ErrMissingPrivileges, got %v", err)
+			}
+			if e.User != "restricted" || fmt.Sprint(e.Missing) != "[DROP ZONECONFIG]" {
+				t.Fatalf("expected restricted to miss [DROP ZONECONFIG], got %v %v", e.User, e.Missing)
+			}
+		})
+}
+
+func TestCheckWrite(t *testing.T) {
+	mt.ParallelTest(t, schemaVersions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable", i.Host(), i.PortFor(26257))
+			d, err := c.Open(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+			if err := d.SetVersion(3, false); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.(database.WriteChecker).CheckWrite(); err != nil {
+				t.Fatal(err)
+			}
+
+			// DDL privileges, but INSERT on the version table was forgotten
+			for _, query := range []string{
+				"CREATE USER deployer",
+				"GRANT CREATE, DROP ON DATABASE migrate TO deployer",
+				"GRANT SELECT, DELETE ON TABLE schema_migrations TO deployer",
+			} {
+				if _, err := d.(*CockroachDb).db.Exec(query); err != nil {
+					t.Fatalf("%v: %v", query, err)
+				}
+			}
+
+			db, err := sql.Open("postgres", fmt.Sprintf("postgres://deployer@%v:%v/migrate?sslmode=disable", i.Host(), i.PortFor(26257)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			deployer := &CockroachDb{db: db, config: &Config{DatabaseName: "migrate", MigrationsTable: DefaultMigrationsTable}}
+
+			err = deployer.CheckWrite()
+			e, ok := err.(database.ErrVersionTableNotWritable)
+			if !ok {
+				t.Fatalf("expected ErrVersionTableNotWritable, got %v", err)
+			}
+			if e.Table != DefaultMigrationsTable {
+				t.Fatalf("expected table %v, got %v", DefaultMigrationsTable, e.Table)
+			}
+
+			// the delete was rolled back
+			version, dirty, err := d.Version()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != 3 || dirty {
+				t.Fatalf("expected clean version 3, got %v %v", version, dirty)
+			}
+		})
+}
+
+func TestTryLockConcurrent(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable", i.Host(), i.PortFor(26257))
+
+			const n = 5
+			drivers := make([]*CockroachDb, n)
+			for j := range drivers {
+				c := &CockroachDb{}
+				d, err := c.Open(addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer d.Close()
+				drivers[j] = d.(*CockroachDb)
+			}
+
+			var wg sync.WaitGroup
+			acquired := make([]bool, n)
+			errs := make([]error, n)
+			for j := range drivers {
+				wg.Add(1)
+				go func(j int) {
+					defer wg.Done()
+					acquired[j], errs[j] = drivers[j].TryLock()
+				}(j)
+			}
+			wg.Wait()
+
+			winner := -1
+			for j := range drivers {
+				if errs[j] != nil {
+					t.Fatalf("expected no error, got %v", errs[j])
+				}
+				if acquired[j] {
+					if winner >= 0 {
+						t.Fatalf("expected a single driver to acquire the lock, got %v and %v", winner, j)
+					}
+					winner = j
+				}
+			}
+			if winner < 0 {
+				t.Fatal("expected a driver to acquire the lock")
+			}
+
+			// held by the winner, until released
+			other := drivers[(winner+1)%n]
+			if ok, err := other.TryLock(); ok || err != nil {
+				t.Fatalf("expected lock to be held, got %v, %v", ok, err)
+			}
+			if err := drivers[winner].Unlock(); err != nil {
+				t.Fatal(err)
+			}
+			if ok, err := other.TryLock(); !ok || err != nil {
+				t.Fatalf("expected to acquire the released lock, got %v, %v", ok, err)
+			}
+			if err := other.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+		})
+}
+
+func TestVersionQueryFollowerReads(t *testing.T) {
+	c := &CockroachDb{config: &Config{MigrationsTable: "schema_migrations"}}
+	if q := c.versionQuery(); q != `SELECT version, dirty FROM "schema_migrations" LIMIT 1` {
+		t.Fatalf("unexpected query %v", q)
+	}
+
+	c.config.FollowerReads = true
+	if q := c.versionQuery(); q != `SELECT version, dirty FROM "schema_migrations" AS OF SYSTEM TIME follower_read_timestamp() LIMIT 1` {
+		t.Fatalf("unexpected query %v", q)
+	}
+
+	// the migration decision needs the current version
+	c.isLocked = true
+	if q := c.versionQuery(); q != `SELECT version, dirty FROM "schema_migrations" LIMIT 1` {
+		t.Fatalf("unexpected query while locked %v", q)
+	}
+}
+
+func TestFollowerReadsInvalid(t *testing.T) {
+	for _, config := range []*Config{
+		{FollowerReads: true, VersionQuery: "SELECT 1, false"},
+		{FollowerReads: true, StateFormat: StateFormatJSON},
+	} {
+		if _, err := WithInstance(nil, config); err != ErrFollowerReads {
+			t.Fatalf("expected ErrFollowerReads, got %v", err)
+		}
+	}
+}
+
+func TestFollowerReads(t *testing.T) {
+	mt.ParallelTest(t, schemaVersions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable&x-follower-reads=true", i.Host(), i.PortFor(26257))
+			d, err := c.Open(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			if err := d.Lock(); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.SetVersion(3, false); err != nil {
+				t.Fatal(err)
+			}
+			if version, _, err := d.Version(); err != nil || version != 3 {
+				t.Fatalf("expected current version 3 while locked, got %v, %v", version, err)
+			}
+			if err := d.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+
+			// possibly stale, but a valid query
+			if _, _, err := d.Version(); err != nil {
+				t.Fatal(err)
+			}
+		})
+}
+
+func TestVersionQueryVersionSelect(t *testing.T) {
+	c := &CockroachDb{config: &Config{MigrationsTable: "schema_migrations", VersionSelect: VersionSelectMax}}
+	if q := c.versionQuery(); q != `SELECT version, dirty FROM "schema_migrations" ORDER BY version DESC LIMIT 1` {
+		t.Fatalf("unexpected query %v", q)
+	}
+
+	c.config.FollowerReads = true
+	if q := c.versionQuery(); q != `SELECT version, dirty FROM "schema_migrations" AS OF SYSTEM TIME follower_read_timestamp() ORDER BY version DESC LIMIT 1` {
+		t.Fatalf("unexpected query %v", q)
+	}
+}
+
+func TestVersionSelectInvalid(t *testing.T) {
+	for _, config := range []*Config{
+		{VersionSelect: "min"},
+		{VersionSelect: VersionSelectMax, VersionQuery: "SELECT 1, false"},
+		{VersionSelect: VersionSelectMax, StateFormat: StateFormatJSON},
+	} {
+		if _, err := WithInstance(nil, config); err == nil {
+			t.Fatalf("expected ErrInvalidVersionSelect, got nil for %v", config.VersionSelect)
+		} else if _, ok := err.(ErrInvalidVersionSelect); !ok {
+			t.Fatalf("expected ErrInvalidVersionSelect, got %v", err)
+		}
+	}
+}
+
+func TestVersionSelectMax(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			db, err := sql.Open("postgres", fmt.Sprintf("postgres://root@%v:%v/migrate?sslmode=disable", i.Host(), i.PortFor(26257)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			// a legacy table with a row per applied migration
+			if _, err := db.Exec(`CREATE TABLE legacy_migrations (version INT NOT NULL PRIMARY KEY, dirty BOOL NOT NULL)`); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.Exec(`INSERT INTO legacy_migrations (version, dirty) VALUES (1, false), (5, false), (3, false)`); err != nil {
+				t.Fatal(err)
+			}
+
+			d, err := WithInstance(db, &Config{MigrationsTable: "legacy_migrations", VersionSelect: VersionSelectMax})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version, dirty, err := d.Version(); err != nil || version != 5 || dirty {
+				t.Fatalf("expected version 5, not dirty, got %v, %v, %v", version, dirty, err)
+			}
+
+			if err := d.SetVersion(6, true); err != nil {
+				t.Fatal(err)
+			}
+			if version, dirty, err := d.Version(); err != nil || version != 6 || !dirty {
+				t.Fatalf("expected version 6, dirty, got %v, %v, %v", version, dirty, err)
+			}
+			var count int
+			if err := db.QueryRow(`SELECT COUNT(*) FROM legacy_migrations`).Scan(&count); err != nil {
+				t.Fatal(err)
+			}
+			if count != 1 {
+				t.Fatalf("expected SetVersion to leave a single row, got %v", count)
+			}
+		})
+}
+
+func TestForceUnlock(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable", i.Host(), i.PortFor(26257))
+			c := &CockroachDb{}
+			crashed, err := c.Open(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer crashed.Close()
+			operator, err := c.Open(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer operator.Close()
+
+			if err := crashed.Lock(); err != nil {
+				t.Fatal(err)
+			}
+			if err := crashed.SetVersion(2, true); err != nil {
+				t.Fatal(err)
+			}
+			if err := operator.Lock(); err == nil {
+				t.Fatal("expected the lock to be held")
+			}
+
+			if err := operator.(database.ForceUnlocker).ForceUnlock(); err != nil {
+				t.Fatal(err)
+			}
+			if err := operator.Lock(); err != nil {
+				t.Fatalf("expected to acquire the released lock, got %v", err)
+			}
+			if version, dirty, err := operator.Version(); err != nil || version != 2 || !dirty {
+				t.Fatalf("expected dirty version 2 to be kept, got %v, %v, %v", version, dirty, err)
+			}
+			if err := operator.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+		})
+}
+
+func TestUsesRestartSavepoint(t *testing.T) {
+	tt := []struct {
+		migration string
+		expect    bool
+	}{
+		{"BEGIN; SAVEPOINT seed; ROLLBACK TO SAVEPOINT seed; COMMIT;", false},
+		{"BEGIN; SAVEPOINT cockroach_restart; RELEASE SAVEPOINT cockroach_restart; COMMIT;", true},
+		{"begin;\n  savepoint \"COCKROACH_RESTART\";\ncommit;", true},
+		{"-- SAVEPOINT cockroach_restart;\nSELECT 'SAVEPOINT cockroach_restart';", false},
+		{"SAVEPOINT cockroach_restart_seed;", false},
+	}
+	for n, v := range tt {
+		if uses := usesRestartSavepoint([]byte(v.migration)); uses != v.expect {
+			t.Errorf("expected %v, got %v, in %v", v.expect, uses, n)
+		}
+	}
+
+	// rejected before the migration touches the database
+	c := &CockroachDb{config: &Config{}}
+	if err := c.Run(bytes.NewReader([]byte(tt[1].migration))); err != ErrReservedSavepoint {
+		t.Fatalf("expected ErrReservedSavepoint, got %v", err)
+	}
+}
+
+func TestSavepoint(t *testing.T) {
+	mt.ParallelTest(t, schemaVersions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable", i.Host(), i.PortFor(26257))
+			d, err := c.Open(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			migration := `BEGIN;
+CREATE TABLE savepoints (id INT PRIMARY KEY);
+INSERT INTO savepoints VALUES (1);
+SAVEPOINT seed;
+INSERT INTO savepoints VALUES (2);
+ROLLBACK TO SAVEPOINT seed;
+INSERT INTO savepoints VALUES (3);
+COMMIT;`
+			if err := d.Run(bytes.NewReader([]byte(migration))); err != nil {
+				t.Fatal(err)
+			}
+
+			var ids []int
+			rows, err := d.(*CockroachDb).db.Query(`SELECT id FROM savepoints ORDER BY id`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			for rows.Next() {
+				var id int
+				if err := rows.Scan(&id); err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, id)
+			}
+			if len(ids) != 2 || ids[0] != 1 || ids[1] != 3 {
+				t.Fatalf("expected ids [1 3] after the partial rollback, got %v", ids)
+			}
+		})
+}
+
+func TestCheck(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable", i.Host(), i.PortFor(26257))
+			d, err := c.Open(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+			checker := d.(database.Checker)
+
+			migrations := func() []io.Reader {
+				return []io.Reader{
+					bytes.NewReader([]byte("CREATE TABLE checked (id INT)")),
+					bytes.NewReader([]byte("ALTER TABLE checked ADD COLUMN name STRING")),
+					bytes.NewReader([]byte("ALTER TABLE missing ADD COLUMN name STRING")),
+				}
+			}
+			if failed, err := checker.Check(migrations()[:2]); err != nil {
+				t.Fatalf("expected migrations to pass, got %v at %v", err, failed)
+			}
+			if failed, err := checker.Check(migrations()); err == nil || failed != 2 {
+				t.Fatalf("expected migration 2 to fail, got %v at %v", err, failed)
+			}
+
+			// rolled back
+			var count int
+			if err := d.(*CockroachDb).db.QueryRow(`SELECT COUNT(*) FROM information_schema.tables WHERE table_name = 'checked'`).Scan(&count); err != nil {
+				t.Fatal(err)
+			}
+			if count != 0 {
+				t.Fatal("expected the checked table to be rolled back")
+			}
+		})
+}
@@ -0,0 +1,70 @@
+package cockroachdb
+
+import (
+	"github.com/lib/pq"
+	"github.com/vickxxx/migrate/database"
+)
+
+// CodeClassifier classifies errors by their SQLSTATE code, see
+// database.ErrorClassifier. Forks and versions of CockroachDB
+// report some conditions with different codes.
+type CodeClassifier struct {
+	UndefinedTable []pq.ErrorCode
+	DuplicateTable []pq.ErrorCode
+	Retryable      []pq.ErrorCode
+}
+
+// DefaultErrorClassifier knows the codes of CockroachDB, see
+// https://github.com/cockroachdb/cockroach/blob/master/pkg/sql/pgwire/pgerror/codes.go
+var DefaultErrorClassifier = &CodeClassifier{
+	// UndefinedTableError
+	UndefinedTable: []pq.ErrorCode{"42P01"},
+	// DuplicateRelationError
+	DuplicateTable: []pq.ErrorCode{"42P07"},
+	// SerializationFailureError, and the retry error of CockroachDB before 2.0
+	Retryable: []pq.ErrorCode{"40001", "CR000"},
+}
+
+func (c *CodeClassifier) IsUndefinedTable(err error) bool {
+	return hasCode(err, c.UndefinedTable)
+}
+
+func (c *CodeClassifier) IsDuplicateTable(err error) bool {
+	return hasCode(err, c.DuplicateTable)
+}
+
+func (c *CodeClassifier) IsRetryable(err error) bool {
+	return hasCode(err, c.Retryable)
+}
+
+// hasCode returns true if err is a *pq.Error, possibly wrapped
+// in a database.Error, with one of codes.
+func hasCode(err error, codes []pq.ErrorCode) bool {
+	e, ok := database.OrigErr(err).(*pq.Error)
+	if !ok {
+		return false
+	}
+	for _, code := range codes {
+		if e.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// IsUndefinedTable implements database.ErrorClassifier.
+func (c *CockroachDb) IsUndefinedTable(err error) bool {
+	return c.classifier().IsUndefinedTable(err)
+}
+
+// IsRetryable implements database.ErrorClassifier.
+func (c *CockroachDb) IsRetryable(err error) bool {
+	return c.classifier().IsRetryable(err)
+}
+
+func (c *CockroachDb) classifier() *CodeClassifier {
+	if c.config == nil || c.config.ErrorClassifier == nil {
+		return DefaultErrorClassifier
+	}
+	return c.config.ErrorClassifier
+}
@@ -0,0 +1,96 @@
+package cockroachdb
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/vickxxx/migrate/database"
+)
+
+func TestErrorClassifier(t *testing.T) {
+	// a fork reporting deadlocks as retryable, too
+	fork := &CodeClassifier{
+		UndefinedTable: []pq.ErrorCode{"42P01"},
+		Retryable:      []pq.ErrorCode{"40001", "40P01"},
+	}
+
+	tt := []struct {
+		classifier           *CodeClassifier
+		err                  error
+		expectUndefinedTable bool
+		expectRetryable      bool
+	}{
+		{classifier: DefaultErrorClassifier, err: nil},
+		{classifier: DefaultErrorClassifier, err: fmt.Errorf("connection refused")},
+		{classifier: DefaultErrorClassifier, err: &pq.Error{Code: "42P01"}, expectUndefinedTable: true},
+		{classifier: DefaultErrorClassifier, err: database.Error{OrigErr: &pq.Error{Code: "42P01"}}, expectUndefinedTable: true},
+		{classifier: DefaultErrorClassifier, err: &database.Error{OrigErr: &pq.Error{Code: "42P01"}}, expectUndefinedTable: true},
+		{classifier: DefaultErrorClassifier, err: &pq.Error{Code: "42P07"}},
+		// restart transaction errors of CockroachDB 2.0 and 1.x
+		{classifier: DefaultErrorClassifier, err: &pq.Error{Code: "40001", Message: "restart transaction"}, expectRetryable: true},
+		{classifier: DefaultErrorClassifier, err: database.Error{OrigErr: &pq.Error{Code: "CR000"}}, expectRetryable: true},
+		// deadlocks of PostgreSQL
+		{classifier: DefaultErrorClassifier, err: &pq.Error{Code: "40P01"}},
+		{classifier: fork, err: &pq.Error{Code: "40P01"}, expectRetryable: true},
+		{classifier: fork, err: &pq.Error{Code: "CR000"}},
+	}
+
+	for i, v := range tt {
+		c := &CockroachDb{config: &Config{ErrorClassifier: v.classifier}}
+		if undefined := c.IsUndefinedTable(v.err); undefined != v.expectUndefinedTable {
+			t.Errorf("expected IsUndefinedTable %v, got %v, in %v", v.expectUndefinedTable, undefined, i)
+		}
+		if retryable := c.IsRetryable(v.err); retryable != v.expectRetryable {
+			t.Errorf("expected IsRetryable %v, got %v, in %v", v.expectRetryable, retryable, i)
+		}
+	}
+}
+
+func TestDuplicateTable(t *testing.T) {
+	if !DefaultErrorClassifier.IsDuplicateTable(&pq.Error{Code: "42P07"}) {
+		t.Fatal("expected 42P07 to be a duplicate table")
+	}
+	if DefaultErrorClassifier.IsDuplicateTable(&pq.Error{Code: "42P01"}) {
+		t.Fatal("expected 42P01 not to be a duplicate table")
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	pooler := fmt.Errorf("server conn crashed?")
+	c := &CockroachDb{config: &Config{
+		LockRetryBaseDelay: time.Millisecond,
+		LockRetryMaxDelay:  time.Millisecond,
+		Retryable: func(err error) bool {
+			return err == pooler
+		},
+	}}
+
+	attempts := 0
+	err := c.retryTx(func() error {
+		attempts++
+		if attempts < 3 {
+			return pooler
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Fatalf("expected success after 3 attempts, got %v after %v", err, attempts)
+	}
+
+	attempts = 0
+	if err := c.retryTx(func() error { attempts++; return pooler }); err != pooler || attempts != DefaultTxRetries+1 {
+		t.Fatalf("expected %v after %v attempts, got %v after %v", pooler, DefaultTxRetries+1, err, attempts)
+	}
+
+	// errors the predicate doesn't report, and all errors without one, fail right away
+	other := fmt.Errorf("syntax error")
+	for _, retryable := range []func(error) bool{c.config.Retryable, nil} {
+		c.config.Retryable = retryable
+		attempts = 0
+		if err := c.retryTx(func() error { attempts++; return other }); err != other || attempts != 1 {
+			t.Fatalf("expected %v after 1 attempt, got %v after %v", other, err, attempts)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package cockroachdb
+
+import (
+	"context"
+	"time"
+
+	"github.com/vickxxx/migrate/database"
+)
+
+// pinger is implemented by *sql.Conn.
+type pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// pingFunc is a pinger running a func, i.e. the heartbeat of the lock.
+type pingFunc func(ctx context.Context) error
+
+func (f pingFunc) PingContext(ctx context.Context) error {
+	return f(ctx)
+}
+
+// startKeepAlive pings a dedicated connection every KeepAliveInterval
+// while a migration runs, so that proxies and load balancers in front of
+// the cluster see traffic. The returned func stops pinging, waits for the
+// pinging goroutine to exit and closes the connection.
+func (c *CockroachDb) startKeepAlive() (stop func(), err error) {
+	conn, err := c.db.Conn(context.Background())
+	if err != nil {
+		return nil, &database.Error{OrigErr: err, Err: "failed to acquire keep-alive connection"}
+	}
+
+	stopPings := keepAlive(conn, c.config.KeepAliveInterval)
+	return func() {
+		stopPings()
+		conn.Close()
+	}, nil
+}
+
+// keepAlive pings p every interval until the returned func is called,
+// which returns once the pinging goroutine exited. Failed pings are
+// ignored, the migration reports errors of its own connection, and a
+// missed heartbeat is caught up with by the next one.
+func keepAlive(p pinger, interval time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				p.PingContext(ctx)
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
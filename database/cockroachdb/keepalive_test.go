@@ -0,0 +1,82 @@
+package cockroachdb
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	mt "github.com/vickxxx/migrate/testing"
+)
+
+type pingCounter struct {
+	mu      sync.Mutex
+	pings   int
+	stopped bool
+	t       *testing.T
+}
+
+func (p *pingCounter) PingContext(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopped {
+		p.t.Error("expected no ping after stop returned")
+	}
+	p.pings++
+	return nil
+}
+
+func (p *pingCounter) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pings
+}
+
+func TestKeepAlive(t *testing.T) {
+	p := &pingCounter{t: t}
+	stop := keepAlive(p, time.Millisecond)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for p.count() < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 3 pings, got %v", p.count())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	stop()
+	p.mu.Lock()
+	p.stopped = true
+	p.mu.Unlock()
+
+	// a ping of a goroutine still running would fail the test
+	time.Sleep(10 * time.Millisecond)
+}
+
+func TestKeepAliveRun(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			db, err := sql.Open("postgres", fmt.Sprintf("postgres://root@%v:%v/migrate?sslmode=disable", i.Host(), i.PortFor(26257)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			d, err := WithInstance(db, &Config{KeepAliveInterval: time.Millisecond})
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+
+			if err := d.Run(bytes.NewReader([]byte("CREATE TABLE keep_alive (id INT); DROP TABLE keep_alive"))); err != nil {
+				t.Fatal(err)
+			}
+
+			// the keep-alive connection is closed after its goroutine exited
+			if inUse := db.Stats().InUse; inUse != 0 {
+				t.Fatalf("expected no connection in use after Run, got %v", inUse)
+			}
+		})
+}
@@ -0,0 +1,354 @@
+package cockroachdb
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os/user"
+	"sort"
+	"time"
+
+	"github.com/vickxxx/migrate"
+	"github.com/vickxxx/migrate/database"
+)
+
+const (
+	// StateFormatColumns keeps version and dirty flag in columns
+	// of a single row. This is the default.
+	StateFormatColumns = "columns"
+
+	// StateFormatJSON keeps the state including the full history
+	// as a single JSONB document, see State.
+	StateFormatJSON = "json"
+)
+
+// stateID is the primary key of the single row holding the JSON state.
+const stateID = 1
+
+var (
+	ErrNoJSONState = fmt.Errorf("state format is not %v", StateFormatJSON)
+)
+
+// ErrInvalidStateFormat is returned when Config.StateFormat
+// is neither StateFormatColumns nor StateFormatJSON.
+type ErrInvalidStateFormat struct {
+	Format string
+}
+
+func (e ErrInvalidStateFormat) Error() string {
+	return fmt.Sprintf("invalid state format %v, must be %v or %v", e.Format, StateFormatColumns, StateFormatJSON)
+}
+
+// State is the migration state kept as a JSONB document
+// if Config.StateFormat is StateFormatJSON.
+type State struct {
+	Version int           `json:"version"`
+	Dirty   bool          `json:"dirty"`
+	History []StateChange `json:"history"`
+}
+
+// StateChange records a single version change.
+type StateChange struct {
+	Version int       `json:"version"`
+	Dirty   bool      `json:"dirty"`
+	Time    time.Time `json:"time"`
+
+	// Checksum is the hex encoded SHA-256 of the migration
+	// that led to this version, if one ran.
+	Checksum string `json:"checksum,omitempty"`
+
+	// User is the operating system user running migrate.
+	User string `json:"user,omitempty"`
+
+	// DeployID is Config.DeployID, the deploy that set this version.
+	DeployID string `json:"deploy_id,omitempty"`
+
+	// Squashed marks the migrations up to Version as squashed into a
+	// single migration with Checksum, see Squash. It doesn't change the
+	// current version.
+	Squashed bool `json:"squashed,omitempty"`
+}
+
+// queryer is implemented by *sql.DB and *sql.Tx.
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// ReadState returns the migration state including its history.
+// It returns ErrNoJSONState unless Config.StateFormat is StateFormatJSON.
+func (c *CockroachDb) ReadState() (*State, error) {
+	if c.config.StateFormat != StateFormatJSON {
+		return nil, ErrNoJSONState
+	}
+	return c.readState(c.db)
+}
+
+// WriteState replaces the migration state, i.e. to import an exported
+// history. It returns ErrNoJSONState unless Config.StateFormat is StateFormatJSON.
+func (c *CockroachDb) WriteState(state *State) error {
+	if c.config.StateFormat != StateFormatJSON {
+		return ErrNoJSONState
+	}
+	return c.writeState(c.db, state)
+}
+
+func (c *CockroachDb) readState(q queryer) (*State, error) {
+	query := `SELECT state FROM ` + c.versionTable(c.config.MigrationsTable) + ` WHERE id = $1`
+	var doc []byte
+	err := q.QueryRow(query, stateID).Scan(&doc)
+	if err == sql.ErrNoRows {
+		return &State{Version: database.NilVersion, History: make([]StateChange, 0)}, nil
+	}
+	if c.IsUndefinedTable(err) {
+		// the table is gone after Drop
+		return &State{Version: database.NilVersion, History: make([]StateChange, 0)}, nil
+	}
+	if err != nil {
+		return nil, &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+
+	state := &State{}
+	if err := json.Unmarshal(doc, state); err != nil {
+		return nil, &database.Error{OrigErr: err, Err: "invalid migration state", Query: []byte(query)}
+	}
+	return state, nil
+}
+
+func (c *CockroachDb) writeState(q queryer, state *State) error {
+	doc, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO ` + c.versionTable(c.config.MigrationsTable) + ` (id, state) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET state = excluded.state`
+	if _, err := q.Exec(query, stateID, string(doc)); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	return nil
+}
+
+// setStateVersion implements SetVersion for StateFormatJSON.
+// The change is appended to the history.
+func (c *CockroachDb) setStateVersion(version int, dirty bool) error {
+	change := StateChange{
+		Version:  version,
+		Dirty:    dirty,
+		Time:     c.config.Clock().UTC(),
+		DeployID: c.config.DeployID,
+	}
+	if !dirty {
+		change.Checksum = c.lastChecksum
+		c.lastChecksum = ""
+	}
+	if u, err := user.Current(); err == nil {
+		change.User = u.Username
+	}
+
+	return c.executeTx(func(tx *sql.Tx) error {
+		state, err := c.readState(tx)
+		if err != nil {
+			return err
+		}
+
+		state.Version = version
+		state.Dirty = dirty
+		state.History = append(state.History, change)
+		return c.writeState(tx, state)
+	})
+}
+
+// Squash implements database.Squasher. The squash is appended to the
+// history of StateFormatJSON, so that the squashed migration counts as
+// applied at version with its checksum in place of the squashed ones. With
+// StateFormatColumns there is nothing to record besides the current version,
+// which stays.
+func (c *CockroachDb) Squash(version int, migration []byte) error {
+	if c.config.StateFormat != StateFormatJSON {
+		return nil
+	}
+
+	change := StateChange{
+		Version:  version,
+		Time:     c.config.Clock().UTC(),
+		Checksum: checksum(migration),
+		DeployID: c.config.DeployID,
+		Squashed: true,
+	}
+	if u, err := user.Current(); err == nil {
+		change.User = u.Username
+	}
+
+	return c.executeTx(func(tx *sql.Tx) error {
+		state, err := c.readState(tx)
+		if err != nil {
+			return err
+		}
+
+		state.History = append(state.History, change)
+		return c.writeState(tx, state)
+	})
+}
+
+// SetClock implements database.ClockSetter.
+func (c *CockroachDb) SetClock(clock func() time.Time) {
+	c.config.Clock = clock
+}
+
+// stateVersion implements Version for StateFormatJSON.
+func (c *CockroachDb) stateVersion() (version int, dirty bool, err error) {
+	state, err := c.readState(c.db)
+	if err != nil {
+		return 0, false, err
+	}
+	if state.Version < 0 {
+		return database.NilVersion, false, nil
+	}
+	return state.Version, state.Dirty, nil
+}
+
+// LastAppliedAt implements database.Timestamper. Only the history of
+// StateFormatJSON records times, with StateFormatColumns it returns false.
+func (c *CockroachDb) LastAppliedAt() (time.Time, bool, error) {
+	if c.config.StateFormat != StateFormatJSON {
+		return time.Time{}, false, nil
+	}
+
+	state, err := c.readState(c.db)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	// the dirty change is recorded before the migration ran
+	for i := len(state.History) - 1; i >= 0; i-- {
+		if !state.History[i].Dirty && !state.History[i].Squashed {
+			return state.History[i].Time, true, nil
+		}
+	}
+	return time.Time{}, false, nil
+}
+
+// appliedChanges replays the history and returns the clean change that
+// applied each version which is still applied. Migrating down to a version,
+// or forcing a lower one, unapplies all versions above it.
+func appliedChanges(history []StateChange) map[int]StateChange {
+	applied := make(map[int]StateChange)
+	previous := database.NilVersion
+	for _, change := range history {
+		if change.Squashed {
+			for v := range applied {
+				if v <= change.Version {
+					delete(applied, v)
+				}
+			}
+			applied[change.Version] = change
+			continue
+		}
+		if change.Dirty {
+			continue
+		}
+		if change.Version > previous {
+			applied[change.Version] = change
+		} else {
+			for v := range applied {
+				if v > change.Version {
+					delete(applied, v)
+				}
+			}
+		}
+		previous = change.Version
+	}
+	return applied
+}
+
+// AppliedVersions implements database.Historian, in ascending order. Only
+// the history of StateFormatJSON records them, with StateFormatColumns it
+// returns migrate.ErrNoHistory. A forced version counts as applied on its
+// own, without the versions below it.
+func (c *CockroachDb) AppliedVersions() ([]int, error) {
+	if c.config.StateFormat != StateFormatJSON {
+		return nil, migrate.ErrNoHistory
+	}
+
+	state, err := c.readState(c.db)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]int, 0)
+	for v := range appliedChanges(state.History) {
+		versions = append(versions, v)
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
+
+// RecordsChecksums implements database.Checksummer. Only StateFormatJSON
+// records checksums.
+func (c *CockroachDb) RecordsChecksums() bool {
+	return c.config.StateFormat == StateFormatJSON
+}
+
+// Checksums implements database.Checksummer. Only the history of
+// StateFormatJSON records checksums, with StateFormatColumns there are none.
+// A version applied more than once has the checksum of the last migration.
+// Versions set by migrating down have the checksum of a down migration,
+// which doesn't count, and the versions rolled back have none.
+func (c *CockroachDb) Checksums() (map[int]string, error) {
+	checksums := make(map[int]string)
+	if c.config.StateFormat != StateFormatJSON {
+		return checksums, nil
+	}
+
+	state, err := c.readState(c.db)
+	if err != nil {
+		return nil, err
+	}
+	for v, change := range appliedChanges(state.History) {
+		if len(change.Checksum) > 0 {
+			checksums[v] = change.Checksum
+		}
+	}
+	return checksums, nil
+}
+
+// SetDeployID implements database.DeployTagger.
+func (c *CockroachDb) SetDeployID(id string) {
+	c.config.DeployID = id
+}
+
+// RecordsDeployIDs implements database.DeployTagger. Only StateFormatJSON
+// records deploy ids.
+func (c *CockroachDb) RecordsDeployIDs() bool {
+	return c.config.StateFormat == StateFormatJSON
+}
+
+// DeployIDs implements database.DeployTagger. Only the history of
+// StateFormatJSON records deploy ids, with StateFormatColumns there are none.
+// Versions set by migrating down don't count as applied.
+func (c *CockroachDb) DeployIDs() (map[int]string, error) {
+	deployIDs := make(map[int]string)
+	if c.config.StateFormat != StateFormatJSON {
+		return deployIDs, nil
+	}
+
+	state, err := c.readState(c.db)
+	if err != nil {
+		return nil, err
+	}
+	previous := database.NilVersion
+	for _, change := range state.History {
+		if change.Dirty || change.Squashed {
+			continue
+		}
+		if change.Version > previous && len(change.DeployID) > 0 {
+			deployIDs[change.Version] = change.DeployID
+		}
+		previous = change.Version
+	}
+	return deployIDs, nil
+}
+
+// checksum returns the hex encoded SHA-256 of a migration.
+func checksum(migration []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(migration))
+}
@@ -0,0 +1,556 @@
+package cockroachdb
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/vickxxx/migrate"
+	"github.com/vickxxx/migrate/database"
+	dt "github.com/vickxxx/migrate/database/testing"
+	"github.com/vickxxx/migrate/source"
+	"github.com/vickxxx/migrate/source/memory"
+	mt "github.com/vickxxx/migrate/testing"
+)
+
+// JSONB needs CockroachDB 2.0
+var jsonVersions = []mt.Version{
+	{Image: "cockroachdb/cockroach:v2.0.7", Cmd: []string{"start", "--insecure"}},
+}
+
+func TestStateFormatJSON(t *testing.T) {
+	mt.ParallelTest(t, jsonVersions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable&x-migrations-table=json_migrations&x-state-format=json", i.Host(), i.PortFor(26257))
+			d, err := c.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			dt.Test(t, d, []byte("SELECT 1"))
+		})
+}
+
+func TestStateFormatJSONHistory(t *testing.T) {
+	mt.ParallelTest(t, jsonVersions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable&x-migrations-table=json_history&x-state-format=json", i.Host(), i.PortFor(26257))
+			d, err := c.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+
+			migration := []byte("CREATE TABLE users (id INT PRIMARY KEY)")
+			if err := d.SetVersion(1, true); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.Run(bytes.NewReader(migration)); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.SetVersion(1, false); err != nil {
+				t.Fatal(err)
+			}
+
+			version, dirty, err := d.Version()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != 1 || dirty {
+				t.Fatalf("expected version 1, not dirty, got %v, %v", version, dirty)
+			}
+
+			state, err := d.(*CockroachDb).ReadState()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(state.History) != 2 {
+				t.Fatalf("expected 2 changes in history, got %v", state.History)
+			}
+			if !state.History[0].Dirty || state.History[0].Checksum != "" {
+				t.Fatalf("expected dirty change without checksum first, got %v", state.History[0])
+			}
+			if state.History[1].Checksum != checksum(migration) {
+				t.Fatalf("expected checksum %v, got %v", checksum(migration), state.History[1].Checksum)
+			}
+
+			// write back an edited state
+			state.Version = 2
+			if err := d.(*CockroachDb).WriteState(state); err != nil {
+				t.Fatal(err)
+			}
+			if version, _, err := d.Version(); err != nil || version != 2 {
+				t.Fatalf("expected version 2, got %v, %v", version, err)
+			}
+
+			if err := d.SetVersion(database.NilVersion, false); err != nil {
+				t.Fatal(err)
+			}
+			if version, _, err := d.Version(); err != nil || version != database.NilVersion {
+				t.Fatalf("expected NilVersion, got %v, %v", version, err)
+			}
+		})
+}
+
+func TestStateFormatJSONClock(t *testing.T) {
+	mt.ParallelTest(t, jsonVersions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable&x-migrations-table=json_clock&x-state-format=json", i.Host(), i.PortFor(26257))
+			d, err := c.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+
+			appliedAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+			d.(*CockroachDb).SetClock(func() time.Time { return appliedAt })
+			if err := d.SetVersion(1, false); err != nil {
+				t.Fatal(err)
+			}
+
+			state, err := d.(*CockroachDb).ReadState()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(state.History) != 1 || !state.History[0].Time.Equal(appliedAt) {
+				t.Fatalf("expected a change applied at %v, got %v", appliedAt, state.History)
+			}
+		})
+}
+
+func TestLastAppliedAt(t *testing.T) {
+	mt.ParallelTest(t, jsonVersions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable&x-migrations-table=json_applied_at&x-state-format=json", i.Host(), i.PortFor(26257))
+			d, err := c.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+
+			if _, ok, err := d.(*CockroachDb).LastAppliedAt(); err != nil || ok {
+				t.Fatalf("expected no time before the first migration, got %v, %v", ok, err)
+			}
+
+			startedAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+			appliedAt := startedAt.Add(time.Minute)
+			d.(*CockroachDb).SetClock(func() time.Time { return startedAt })
+			if err := d.SetVersion(1, true); err != nil {
+				t.Fatal(err)
+			}
+			d.(*CockroachDb).SetClock(func() time.Time { return appliedAt })
+			if err := d.SetVersion(1, false); err != nil {
+				t.Fatal(err)
+			}
+
+			at, ok, err := d.(*CockroachDb).LastAppliedAt()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok || !at.Equal(appliedAt) {
+				t.Fatalf("expected applied at %v, got %v, %v", appliedAt, at, ok)
+			}
+		})
+}
+
+func TestLastAppliedAtColumns(t *testing.T) {
+	c := &CockroachDb{config: &Config{StateFormat: StateFormatColumns}}
+	if _, ok, err := c.LastAppliedAt(); err != nil || ok {
+		t.Fatalf("expected no time with state format columns, got %v, %v", ok, err)
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	mt.ParallelTest(t, jsonVersions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable&x-migrations-table=json_checksums&x-state-format=json", i.Host(), i.PortFor(26257))
+			d, err := c.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+
+			apply := func(version int, migration []byte) {
+				if err := d.SetVersion(version, true); err != nil {
+					t.Fatal(err)
+				}
+				if err := d.Run(bytes.NewReader(migration)); err != nil {
+					t.Fatal(err)
+				}
+				if err := d.SetVersion(version, false); err != nil {
+					t.Fatal(err)
+				}
+			}
+			migration := []byte("CREATE TABLE checksums (id INT PRIMARY KEY)")
+			apply(1, migration)
+			migration2 := []byte("CREATE TABLE checksums2 (id INT PRIMARY KEY)")
+			apply(2, migration2)
+
+			// migrating down to 1 keeps the checksum of its up migration,
+			// the rolled back version 2 has none
+			apply(1, []byte("DROP TABLE checksums2"))
+
+			checksums, err := d.(*CockroachDb).Checksums()
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := map[int]string{1: checksum(migration)}
+			if !reflect.DeepEqual(checksums, expected) {
+				t.Fatalf("expected %v, got %v", expected, checksums)
+			}
+		})
+}
+
+func TestStrictRolledBack(t *testing.T) {
+	mt.ParallelTest(t, jsonVersions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable&x-migrations-table=json_strict&x-state-format=json", i.Host(), i.PortFor(26257))
+			d, err := c.Open(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			m := newMemoryMigrate(t, d, "strict", 1, 2)
+			if err := m.SetStrict(true); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.Up(); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.Steps(-1); err != nil {
+				t.Fatal(err)
+			}
+
+			// the rolled back migration 2 is edited before it's applied again
+			sourceDrv, err := memory.WithInstance([]migrate.MemoryMigration{
+				{Version: 1, Direction: source.Up, Body: "CREATE TABLE strict_1 (id INT)"},
+				{Version: 2, Direction: source.Up, Body: "CREATE TABLE strict_2 (id INT, name STRING)"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, err = migrate.NewWithInstance("memory", sourceDrv, "cockroachdb", d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := m.SetStrict(true); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.Up(); err != nil {
+				t.Fatal(err)
+			}
+			if v, _, err := m.Version(); err != nil || v != 2 {
+				t.Fatalf("expected version 2, got %v, %v", v, err)
+			}
+		})
+}
+
+func TestChecksumsColumns(t *testing.T) {
+	c := &CockroachDb{config: &Config{StateFormat: StateFormatColumns}}
+	checksums, err := c.Checksums()
+	if err != nil || len(checksums) != 0 {
+		t.Fatalf("expected no checksums with state format columns, got %v, %v", checksums, err)
+	}
+	if c.RecordsChecksums() {
+		t.Fatal("expected state format columns not to record checksums")
+	}
+	if !(&CockroachDb{config: &Config{StateFormat: StateFormatJSON}}).RecordsChecksums() {
+		t.Fatal("expected state format json to record checksums")
+	}
+}
+
+func TestDeployIDs(t *testing.T) {
+	mt.ParallelTest(t, jsonVersions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable&x-migrations-table=json_deploy_ids&x-state-format=json&x-deploy-id=release-1", i.Host(), i.PortFor(26257))
+			d, err := c.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+
+			setVersion := func(version int) {
+				if err := d.SetVersion(version, true); err != nil {
+					t.Fatal(err)
+				}
+				if err := d.SetVersion(version, false); err != nil {
+					t.Fatal(err)
+				}
+			}
+			setVersion(1)
+			d.(*CockroachDb).SetDeployID("release-2")
+			setVersion(2)
+			// rolled back by release 3, which doesn't apply version 1 again
+			d.(*CockroachDb).SetDeployID("release-3")
+			setVersion(1)
+
+			deployIDs, err := d.(*CockroachDb).DeployIDs()
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := map[int]string{1: "release-1", 2: "release-2"}
+			if !reflect.DeepEqual(deployIDs, expected) {
+				t.Fatalf("expected %v, got %v", expected, deployIDs)
+			}
+		})
+}
+
+func TestDeployIDsColumns(t *testing.T) {
+	c := &CockroachDb{config: &Config{StateFormat: StateFormatColumns}}
+	deployIDs, err := c.DeployIDs()
+	if err != nil || len(deployIDs) != 0 {
+		t.Fatalf("expected no deploy ids with state format columns, got %v, %v", deployIDs, err)
+	}
+	if c.RecordsDeployIDs() {
+		t.Fatal("expected state format columns not to record deploy ids")
+	}
+	if !(&CockroachDb{config: &Config{StateFormat: StateFormatJSON}}).RecordsDeployIDs() {
+		t.Fatal("expected state format json to record deploy ids")
+	}
+}
+
+func TestAppliedChanges(t *testing.T) {
+	tt := []struct {
+		history []StateChange
+		expect  []int
+	}{
+		{nil, []int{}},
+		// up to 3, the dirty changes don't count
+		{[]StateChange{{Version: 1, Dirty: true}, {Version: 1}, {Version: 3, Dirty: true}, {Version: 3}}, []int{1, 3}},
+		// down to 1 unapplies 3, which is applied again
+		{[]StateChange{{Version: 1}, {Version: 3}, {Version: 1}, {Version: 3}}, []int{1, 3}},
+		// down to nil unapplies all
+		{[]StateChange{{Version: 1}, {Version: 2}, {Version: database.NilVersion}}, []int{}},
+		// forced down to 1
+		{[]StateChange{{Version: 1}, {Version: 2}, {Version: 3}, {Version: 1}}, []int{1}},
+		// squashed up to 2 at version 3, which stays applied
+		{[]StateChange{{Version: 1}, {Version: 2}, {Version: 3}, {Version: 2, Squashed: true}}, []int{2, 3}},
+		// squashed up to 3, then down to 2 and up again
+		{[]StateChange{{Version: 1}, {Version: 3}, {Version: 3, Squashed: true}, {Version: 5}, {Version: 3}, {Version: 5}}, []int{3, 5}},
+	}
+	for i, v := range tt {
+		applied := appliedChanges(v.history)
+		versions := make([]int, 0)
+		for version := range applied {
+			versions = append(versions, version)
+		}
+		sort.Ints(versions)
+		if !reflect.DeepEqual(versions, v.expect) {
+			t.Errorf("expected %v, got %v, in %v", v.expect, versions, i)
+		}
+	}
+}
+
+func TestAppliedVersionsColumns(t *testing.T) {
+	c := &CockroachDb{config: &Config{StateFormat: StateFormatColumns}}
+	if _, err := c.AppliedVersions(); err != migrate.ErrNoHistory {
+		t.Fatalf("expected ErrNoHistory with state format columns, got %v", err)
+	}
+}
+
+func TestOutOfOrder(t *testing.T) {
+	mt.ParallelTest(t, jsonVersions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable&x-migrations-table=json_out_of_order&x-state-format=json", i.Host(), i.PortFor(26257))
+			d, err := c.Open(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			if err := newMemoryMigrate(t, d, "out_of_order", 1, 3).Up(); err != nil {
+				t.Fatal(err)
+			}
+
+			// version 2 is merged after 3 was applied
+			err = newMemoryMigrate(t, d, "out_of_order", 1, 2, 3).Up()
+			e, ok := err.(migrate.ErrOutOfOrder)
+			if !ok {
+				t.Fatalf("expected ErrOutOfOrder, got %v", err)
+			}
+			if !reflect.DeepEqual(e.Versions, []uint{2}) || e.Version != 3 {
+				t.Fatalf("expected version 2 older than 3, got %v", e)
+			}
+
+			versions, err := d.(*CockroachDb).AppliedVersions()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(versions, []int{1, 3}) {
+				t.Fatalf("expected versions 1 and 3 applied, got %v", versions)
+			}
+		})
+}
+
+func TestGaps(t *testing.T) {
+	mt.ParallelTest(t, jsonVersions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable&x-migrations-table=json_gaps&x-state-format=json", i.Host(), i.PortFor(26257))
+			d, err := c.Open(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			if err := newMemoryMigrate(t, d, "gaps", 1, 2).Up(); err != nil {
+				t.Fatal(err)
+			}
+			// 3 and 4 were deleted from the source before 5 was applied
+			m := newMemoryMigrate(t, d, "gaps", 1, 2, 5)
+			if err := m.Up(); err != nil {
+				t.Fatal(err)
+			}
+
+			gaps, err := m.Gaps()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(gaps, []uint{3, 4}) {
+				t.Fatalf("expected gaps 3 and 4, got %v", gaps)
+			}
+			status, err := m.Status()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(status.Gaps, []uint{3, 4}) {
+				t.Fatalf("expected gaps 3 and 4 in status, got %v", status.Gaps)
+			}
+
+			// migrating down unapplies 5, which closes the gaps
+			if err := m.Steps(-1); err != nil {
+				t.Fatal(err)
+			}
+			if gaps, err := m.Gaps(); err != nil || len(gaps) != 0 {
+				t.Fatalf("expected no gaps, got %v, %v", gaps, err)
+			}
+		})
+}
+
+// newMemoryMigrate returns a Migrate for d with up and down migrations
+// creating and dropping a table named after prefix for each version.
+func newMemoryMigrate(t *testing.T, d database.Driver, prefix string, versions ...uint) *migrate.Migrate {
+	t.Helper()
+	migrations := make([]migrate.MemoryMigration, 0)
+	for _, v := range versions {
+		migrations = append(migrations,
+			migrate.MemoryMigration{Version: v, Direction: source.Up, Body: fmt.Sprintf("CREATE TABLE %v_%v (id INT)", prefix, v)},
+			migrate.MemoryMigration{Version: v, Direction: source.Down, Body: fmt.Sprintf("DROP TABLE %v_%v", prefix, v)})
+	}
+	sourceDrv, err := memory.WithInstance(migrations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := migrate.NewWithInstance("memory", sourceDrv, "cockroachdb", d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestSquash(t *testing.T) {
+	mt.ParallelTest(t, jsonVersions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			c := &CockroachDb{}
+			addr := fmt.Sprintf("cockroach://root@%v:%v/migrate?sslmode=disable&x-migrations-table=json_squash&x-state-format=json", i.Host(), i.PortFor(26257))
+			d, err := c.Open(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			if err := newMemoryMigrate(t, d, "squash", 1, 2, 3).Up(); err != nil {
+				t.Fatal(err)
+			}
+
+			// the migrations up to 2 are replaced by the schema at 2
+			squashed := "CREATE TABLE squash_1 (id INT); CREATE TABLE squash_2 (id INT)"
+			sourceDrv, err := memory.WithInstance([]migrate.MemoryMigration{
+				{Version: 2, Direction: source.Up, Body: squashed},
+				{Version: 3, Direction: source.Up, Body: "CREATE TABLE squash_3 (id INT)"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			m, err := migrate.NewWithInstance("memory", sourceDrv, "cockroachdb", d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := m.Squash(2); err != nil {
+				t.Fatal(err)
+			}
+
+			if v, dirty, err := m.Version(); err != nil || v != 3 || dirty {
+				t.Fatalf("expected clean version 3, got %v, %v, %v", v, dirty, err)
+			}
+			versions, err := d.(*CockroachDb).AppliedVersions()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(versions, []int{2, 3}) {
+				t.Fatalf("expected versions 2 and 3 applied, got %v", versions)
+			}
+			checksums, err := d.(*CockroachDb).Checksums()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if checksums[2] != checksum([]byte(squashed)) {
+				t.Fatalf("expected the checksum of the squashed migration, got %v", checksums[2])
+			}
+
+			// the squashed source is applied, strictly
+			status, err := m.Status()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(status.Pending) != 0 || len(status.Orphans) != 0 {
+				t.Fatalf("expected nothing pending or orphaned, got %+v", status)
+			}
+			if err := m.SetStrict(true); err != nil {
+				t.Fatal(err)
+			}
+			if err := m.Up(); err != migrate.ErrNoChange {
+				t.Fatalf("expected ErrNoChange, got %v", err)
+			}
+		})
+}
+
+func TestSquashColumns(t *testing.T) {
+	c := &CockroachDb{config: &Config{StateFormat: StateFormatColumns}}
+	if err := c.Squash(2, []byte("CREATE TABLE a (id INT)")); err != nil {
+		t.Fatalf("expected nothing to record with state format columns, got %v", err)
+	}
+}
+
+func TestInvalidStateFormat(t *testing.T) {
+	_, err := WithInstance(nil, &Config{StateFormat: "yaml"})
+	if _, ok := err.(ErrInvalidStateFormat); !ok {
+		t.Fatalf("expected ErrInvalidStateFormat, got %v", err)
+	}
+}
+
+func TestReadStateColumns(t *testing.T) {
+	c := &CockroachDb{config: &Config{StateFormat: StateFormatColumns}}
+	if _, err := c.ReadState(); err != ErrNoJSONState {
+		t.Fatalf("expected ErrNoJSONState, got %v", err)
+	}
+	if err := c.WriteState(&State{}); err != ErrNoJSONState {
+		t.Fatalf("expected ErrNoJSONState, got %v", err)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	// sha256 of the empty string
+	if sum := checksum(nil); sum != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Fatalf("unexpected checksum %v", sum)
+	}
+	if checksum([]byte("a")) == checksum([]byte("b")) {
+		t.Fatal("expected different checksums for different migrations")
+	}
+}
@@ -0,0 +1,430 @@
+package couchbase
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	nurl "net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/couchbase/gocb/v2"
+	"github.com/vickxxx/migrate"
+	"github.com/vickxxx/migrate/database"
+	"github.com/vickxxx/migrate/database/multistmt"
+)
+
+func init() {
+	database.Register("couchbase", &Couchbase{})
+}
+
+var (
+	DefaultMigrationsDocument = "schema_migrations"
+	DefaultConnectTimeout     = 30 * time.Second
+	DefaultIndexTimeout       = 5 * time.Minute
+)
+
+// indexPollInterval is how often Run checks whether new indexes are online.
+var indexPollInterval = time.Second
+
+var (
+	ErrNilConfig = fmt.Errorf("no config")
+	ErrNoBucket  = fmt.Errorf("no bucket")
+)
+
+// ErrIndexesNotReady is returned by Run if indexes created by a migration
+// are still being built after Config.IndexTimeout.
+type ErrIndexesNotReady struct {
+	Indexes []string
+	Timeout time.Duration
+}
+
+func (e ErrIndexesNotReady) Error() string {
+	return fmt.Sprintf("indexes not online after %v: %v", e.Timeout, strings.Join(e.Indexes, ", "))
+}
+
+type Config struct {
+	// Bucket is the bucket the migrations change, Drop cleans it up.
+	Bucket string
+
+	// SystemBucket holds the version and lock documents,
+	// in its default collection. Defaults to Bucket.
+	SystemBucket string
+
+	// MigrationsDocument is the ID of the version document,
+	// the lock document is MigrationsDocument + "::lock".
+	MigrationsDocument string
+
+	// LockTTL lets the lock document expire, so that a crashed migration
+	// doesn't keep the lock forever. Zero means it never expires.
+	LockTTL time.Duration
+
+	// ConnectTimeout is how long WithInstance waits for the system bucket.
+	ConnectTimeout time.Duration
+
+	// IndexTimeout is how long Run waits for the indexes a migration
+	// created to come online.
+	IndexTimeout time.Duration
+}
+
+type Couchbase struct {
+	cluster    *gocb.Cluster
+	collection *gocb.Collection
+
+	// cas of the lock document we created,
+	// used to only ever remove our own lock
+	lockCas  gocb.Cas
+	isLocked bool
+
+	// Open and WithInstance need to guarantee that config is never nil
+	config *Config
+}
+
+type versionDocument struct {
+	Version int  `json:"version"`
+	Dirty   bool `json:"dirty"`
+}
+
+func WithInstance(cluster *gocb.Cluster, config *Config) (database.Driver, error) {
+	if config == nil {
+		return nil, ErrNilConfig
+	}
+
+	if len(config.Bucket) == 0 {
+		return nil, ErrNoBucket
+	}
+	if len(config.SystemBucket) == 0 {
+		config.SystemBucket = config.Bucket
+	}
+	if len(config.MigrationsDocument) == 0 {
+		config.MigrationsDocument = DefaultMigrationsDocument
+	}
+	if config.ConnectTimeout <= 0 {
+		config.ConnectTimeout = DefaultConnectTimeout
+	}
+	if config.IndexTimeout <= 0 {
+		config.IndexTimeout = DefaultIndexTimeout
+	}
+
+	bucket := cluster.Bucket(config.SystemBucket)
+	if err := bucket.WaitUntilReady(config.ConnectTimeout, nil); err != nil {
+		return nil, &database.Error{OrigErr: err, Err: "system bucket not ready", Query: []byte(config.SystemBucket)}
+	}
+
+	return &Couchbase{
+		cluster:    cluster,
+		collection: bucket.DefaultCollection(),
+		config:     config,
+	}, nil
+}
+
+func (c *Couchbase) Open(url string) (database.Driver, error) {
+	url, err := database.RewriteURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	purl, err := nurl.Parse(url)
+	if err != nil {
+		return nil, err
+	}
+
+	tls, err := strconv.ParseBool(purl.Query().Get("x-tls"))
+	if err != nil {
+		tls = false
+	}
+
+	// the SDK takes credentials separately from the connection string
+	connStr := "couchbase://" + purl.Host
+	if tls {
+		connStr = "couchbases://" + purl.Host
+	}
+	password, _ := purl.User.Password()
+	cluster, err := gocb.Connect(connStr, gocb.ClusterOptions{
+		Authenticator: gocb.PasswordAuthenticator{
+			Username: purl.User.Username(),
+			Password: password,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	lockTTL, err := time.ParseDuration(purl.Query().Get("x-lock-ttl"))
+	if err != nil {
+		lockTTL = 0
+	}
+	connectTimeout, err := time.ParseDuration(purl.Query().Get("x-connect-timeout"))
+	if err != nil {
+		connectTimeout = 0
+	}
+	indexTimeout, err := time.ParseDuration(purl.Query().Get("x-index-timeout"))
+	if err != nil {
+		indexTimeout = 0
+	}
+
+	cb, err := WithInstance(cluster, &Config{
+		Bucket:             strings.TrimPrefix(migrate.FilterCustomQuery(purl).Path, "/"),
+		SystemBucket:       purl.Query().Get("x-system-bucket"),
+		MigrationsDocument: purl.Query().Get("x-migrations-document"),
+		LockTTL:            lockTTL,
+		ConnectTimeout:     connectTimeout,
+		IndexTimeout:       indexTimeout,
+	})
+	if err != nil {
+		cluster.Close(nil)
+		return nil, err
+	}
+
+	return cb, nil
+}
+
+func (c *Couchbase) Close() error {
+	return c.cluster.Close(nil)
+}
+
+func (c *Couchbase) lockDocument() string {
+	return c.config.MigrationsDocument + "::lock"
+}
+
+// Lock inserts the lock document, which fails if it already exists.
+// The CAS of the new document is kept, so that Unlock only removes
+// the lock as long as it's unchanged.
+func (c *Couchbase) Lock() error {
+	if c.isLocked {
+		return database.ErrLocked
+	}
+
+	res, err := c.collection.Insert(c.lockDocument(), map[string]bool{"locked": true}, &gocb.InsertOptions{
+		Expiry: c.config.LockTTL,
+	})
+	if errors.Is(err, gocb.ErrDocumentExists) {
+		return database.ErrLocked
+	}
+	if err != nil {
+		return &database.Error{OrigErr: err, Err: "failed to set migration lock", Query: []byte(c.lockDocument())}
+	}
+
+	c.lockCas = res.Cas()
+	c.isLocked = true
+	return nil
+}
+
+func (c *Couchbase) Unlock() error {
+	if !c.isLocked {
+		return nil
+	}
+
+	_, err := c.collection.Remove(c.lockDocument(), &gocb.RemoveOptions{Cas: c.lockCas})
+	// the lock is gone already, i.e. after it expired
+	if err != nil && !errors.Is(err, gocb.ErrDocumentNotFound) {
+		return &database.Error{OrigErr: err, Err: "failed to release migration lock", Query: []byte(c.lockDocument())}
+	}
+
+	c.isLocked = false
+	return nil
+}
+
+// Run runs the N1QL statements of migration one by one, since a
+// query request takes a single statement. Afterwards it waits for
+// indexes that are still being built, so that the next migration
+// can rely on them.
+func (c *Couchbase) Run(migration io.Reader) error {
+	migr, err := ioutil.ReadAll(migration)
+	if err != nil {
+		return err
+	}
+
+	for _, stmt := range multistmt.Split(migr) {
+		if err := c.exec(string(stmt.Query)); err != nil {
+			return database.Error{OrigErr: err, Err: "migration failed", Query: stmt.Query, Line: uint(stmt.Line)}
+		}
+	}
+
+	return c.waitForIndexes()
+}
+
+const pendingIndexesQuery = `SELECT RAW name FROM system:indexes WHERE state IN ["pending", "building", "scheduled for creation"]`
+
+// waitForIndexes polls system:indexes until no index is building anymore.
+// Deferred indexes are left alone, they are built with BUILD INDEX.
+func (c *Couchbase) waitForIndexes() error {
+	return waitFor(c.config.IndexTimeout, indexPollInterval, func() ([]string, error) {
+		return c.queryStrings(pendingIndexesQuery)
+	})
+}
+
+// waitFor calls pending until it returns nothing, or fails with
+// ErrIndexesNotReady after timeout.
+func waitFor(timeout time.Duration, interval time.Duration, pending func() ([]string, error)) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		indexes, err := pending()
+		if err != nil {
+			return &database.Error{OrigErr: err, Query: []byte(pendingIndexesQuery)}
+		}
+		if len(indexes) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return ErrIndexesNotReady{Indexes: indexes, Timeout: timeout}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (c *Couchbase) SetVersion(version int, dirty bool) error {
+	if version < 0 {
+		_, err := c.collection.Remove(c.config.MigrationsDocument, nil)
+		if err != nil && !errors.Is(err, gocb.ErrDocumentNotFound) {
+			return &database.Error{OrigErr: err, Query: []byte(c.config.MigrationsDocument)}
+		}
+		return nil
+	}
+
+	_, err := c.collection.Upsert(c.config.MigrationsDocument, versionDocument{Version: version, Dirty: dirty}, nil)
+	if err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(c.config.MigrationsDocument)}
+	}
+	return nil
+}
+
+func (c *Couchbase) Version() (version int, dirty bool, err error) {
+	res, err := c.collection.Get(c.config.MigrationsDocument, nil)
+	if errors.Is(err, gocb.ErrDocumentNotFound) {
+		return database.NilVersion, false, nil
+	}
+	if err != nil {
+		return 0, false, &database.Error{OrigErr: err, Query: []byte(c.config.MigrationsDocument)}
+	}
+
+	var doc versionDocument
+	if err := res.Content(&doc); err != nil {
+		return 0, false, &database.Error{OrigErr: err, Query: []byte(c.config.MigrationsDocument)}
+	}
+	return doc.Version, doc.Dirty, nil
+}
+
+// index is a row of system:indexes.
+type index struct {
+	Name       string `json:"name"`
+	IsPrimary  bool   `json:"is_primary"`
+	KeyspaceID string `json:"keyspace_id"`
+	BucketID   string `json:"bucket_id"`
+	ScopeID    string `json:"scope_id"`
+}
+
+// keyspace returns the keyspace the index is on, the bucket
+// itself or a collection.
+func (i index) keyspace() string {
+	if len(i.BucketID) == 0 {
+		return quote(i.KeyspaceID)
+	}
+	return quote(i.BucketID) + "." + quote(i.ScopeID) + "." + quote(i.KeyspaceID)
+}
+
+func (i index) dropQuery() string {
+	if i.IsPrimary && i.Name == "#primary" {
+		return "DROP PRIMARY INDEX ON " + i.keyspace()
+	}
+	return "DROP INDEX " + quote(i.Name) + " ON " + i.keyspace()
+}
+
+// Drop drops all indexes of the bucket and its scopes and collections,
+// except for the _default scope and collection. Documents in the default
+// collection are kept, since a bucket can only be flushed via the REST
+// API, and if it's the system bucket they include the version.
+func (c *Couchbase) Drop() error {
+	bucket := c.config.Bucket
+
+	query := `SELECT RAW i FROM system:indexes AS i WHERE i.bucket_id = $1 OR (i.bucket_id IS MISSING AND i.keyspace_id = $1)`
+	res, err := c.cluster.Query(query, &gocb.QueryOptions{PositionalParameters: []interface{}{bucket}})
+	if err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	indexes := make([]index, 0)
+	for res.Next() {
+		var i index
+		if err := res.Row(&i); err != nil {
+			res.Close()
+			return &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+		indexes = append(indexes, i)
+	}
+	if err := res.Err(); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	for _, i := range indexes {
+		if err := c.exec(i.dropQuery()); err != nil {
+			return &database.Error{OrigErr: err, Query: []byte(i.dropQuery())}
+		}
+	}
+
+	query = `SELECT RAW name FROM system:scopes WHERE ` + "`bucket`" + ` = $1 AND name NOT IN ["_default", "_system"]`
+	scopes, err := c.queryStrings(query, bucket)
+	if err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	for _, s := range scopes {
+		drop := "DROP SCOPE " + quote(bucket) + "." + quote(s)
+		if err := c.exec(drop); err != nil {
+			return &database.Error{OrigErr: err, Query: []byte(drop)}
+		}
+	}
+
+	query = `SELECT RAW name FROM system:keyspaces WHERE ` + "`bucket`" + ` = $1 AND ` + "`scope`" + ` = "_default" AND name != "_default"`
+	collections, err := c.queryStrings(query, bucket)
+	if err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+	for _, col := range collections {
+		drop := "DROP COLLECTION " + quote(bucket) + "._default." + quote(col)
+		if err := c.exec(drop); err != nil {
+			return &database.Error{OrigErr: err, Query: []byte(drop)}
+		}
+	}
+
+	return c.SetVersion(database.NilVersion, false)
+}
+
+// exec runs statement and discards its rows.
+func (c *Couchbase) exec(statement string) error {
+	res, err := c.cluster.Query(statement, &gocb.QueryOptions{
+		ScanConsistency: gocb.QueryScanConsistencyRequestPlus,
+	})
+	if err != nil {
+		return err
+	}
+	for res.Next() {
+	}
+	return res.Err()
+}
+
+// queryStrings runs statement with positional params and returns the rows,
+// which must be strings, i.e. of SELECT RAW.
+func (c *Couchbase) queryStrings(statement string, params ...interface{}) ([]string, error) {
+	res, err := c.cluster.Query(statement, &gocb.QueryOptions{
+		PositionalParameters: params,
+		ScanConsistency:      gocb.QueryScanConsistencyRequestPlus,
+	})
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]string, 0)
+	for res.Next() {
+		var row string
+		if err := res.Row(&row); err != nil {
+			res.Close()
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	return rows, res.Err()
+}
+
+// quote returns name as N1QL identifier.
+func quote(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
@@ -5,10 +5,12 @@
 package database
 
 import (
+	"context"
 	"fmt"
 	"io"
 	nurl "net/url"
 	"sync"
+	"time"
 )
 
 var (
@@ -20,6 +22,9 @@ const NilVersion int = -1
 var driversMu sync.RWMutex
 var drivers = make(map[string]Driver)
 
+var urlRewriterMu sync.RWMutex
+var urlRewriter func(url string) (string, error)
+
 // Driver is the interface every database driver must implement.
 //
 // How to implement a database driver?
@@ -32,6 +37,7 @@ var drivers = make(map[string]Driver)
 //      All other functions are tested by tests in database/testing.
 //      Saves you some time and makes sure all database drivers behave the same way.
 //   5. Call Register in init().
+//      Call RewriteURL at the top of Open, before parsing the URL.
 //   6. Create a migrate/cli/build_<driver-name>.go file
 //   7. Add driver name in 'DATABASE' variable in Makefile
 //
@@ -77,6 +83,195 @@ type Driver interface {
 	Drop() error
 }
 
+// Dumper is an optional interface a Driver can implement to export
+// the schema of the database, i.e. when squashing migrations.
+type Dumper interface {
+	// Dump returns statements recreating the current schema, ordered so
+	// that they can be run as a single migration against an empty database.
+	// Migrate's own tables are not part of the dump.
+	Dump() ([]byte, error)
+}
+
+// Squasher is an optional interface a Driver can implement when it keeps
+// track of applied versions or their checksums, to record migrations
+// being squashed, see Migrate.Squash.
+type Squasher interface {
+	// Squash records that the migrations up to and including version were
+	// replaced by the single up migration, which counts as applied at
+	// version in their place. The current version doesn't change.
+	Squash(version int, migration []byte) error
+}
+
+// Historian is an optional interface a Driver can implement when it keeps
+// track of every applied version, not just the current one.
+// Migrate uses it to detect out-of-order migrations.
+type Historian interface {
+	// AppliedVersions returns all versions applied to the database.
+	// A driver keeping track of them only in some configurations returns
+	// migrate.ErrNoHistory in the others, which counts as not implementing
+	// Historian.
+	AppliedVersions() ([]int, error)
+}
+
+// Checksummer is an optional interface a Driver can implement when it
+// records checksums of the migrations it ran.
+type Checksummer interface {
+	// Checksums returns the checksums of the migrations that led to
+	// applied versions, by version. Versions set by migrating down don't
+	// count as applied. It's empty if none are recorded.
+	Checksums() (map[int]string, error)
+
+	// RecordsChecksums returns false if the driver is configured
+	// not to record checksums, so that Checksums is always empty.
+	RecordsChecksums() bool
+}
+
+// Transactional is an optional interface a Driver can implement to report
+// whether a failed migration is rolled back as a whole.
+type Transactional interface {
+	// TransactionalDDL returns true if Run applies a migration, including
+	// schema changes, in a single transaction. Migrate then doesn't set the
+	// dirty flag before the migration, since a failed migration leaves the
+	// database unchanged, only if the version can't be set once it's
+	// committed. Otherwise the database is marked dirty before each
+	// migration.
+	TransactionalDDL() bool
+}
+
+// MigrationTransactional is an optional interface a Transactional Driver
+// can implement when it runs some migrations in several transactions, i.e.
+// around statements that can't run in a transaction block.
+type MigrationTransactional interface {
+	// TransactionalMigration returns false if a failure of migration
+	// isn't rolled back as a whole.
+	TransactionalMigration(migration []byte) bool
+}
+
+// VersionRunner is an optional interface a Driver can implement to learn
+// the version of each migration it runs, i.e. to tag its queries.
+type VersionRunner interface {
+	// RunVersion is called instead of Run.
+	// version is the version of the migration, up or down.
+	RunVersion(version uint, migration io.Reader) error
+}
+
+// ContextRunner is an optional interface a Driver can implement to cancel
+// a migration when a context is done, i.e. when the migration exceeds the
+// timeout of its `-- migrate:timeout` directive.
+type ContextRunner interface {
+	// RunContext is called instead of Run and RunVersion for migrations
+	// with a timeout. version is the version of the migration, up or down.
+	// It returns as soon as possible once ctx is done.
+	RunContext(ctx context.Context, version uint, migration io.Reader) error
+}
+
+// ErrorClassifier is an optional interface a Driver can implement to
+// classify the errors of its database, whose codes differ between
+// databases speaking the same protocol and between their versions.
+// err may be wrapped in an Error.
+type ErrorClassifier interface {
+	// IsUndefinedTable returns true if err is caused by a missing table,
+	// i.e. the migrations table after Drop.
+	IsUndefinedTable(err error) bool
+
+	// IsRetryable returns true if the failed operation can be retried
+	// as is, i.e. after a serialization failure.
+	IsRetryable(err error) bool
+}
+
+// RoundTripper is an optional interface a Driver with transactional DDL can
+// implement to check that a down migration applies after its up migration.
+type RoundTripper interface {
+	// RoundTrip runs up and then down in a single transaction,
+	// which is rolled back in any case.
+	RoundTrip(up io.Reader, down io.Reader) error
+}
+
+// Checker is an optional interface a Driver with transactional DDL can
+// implement to run migrations without keeping their changes, i.e. to check
+// pending migrations against a replica of production.
+type Checker interface {
+	// Check runs migrations one after another in a single transaction,
+	// which is rolled back in any case. If one fails, it returns its index
+	// with the error and doesn't run the following ones.
+	Check(migrations []io.Reader) (failed int, err error)
+}
+
+// PrivilegeChecker is an optional interface a Driver can implement to
+// check the privileges of the connecting user before running migrations,
+// which would otherwise fail midway.
+type PrivilegeChecker interface {
+	// CheckPrivileges returns ErrMissingPrivileges listing the privileges
+	// of required the connecting user lacks, i.e. CREATE.
+	CheckPrivileges(required []string) error
+}
+
+// WriteChecker is an optional interface a Driver can implement to check
+// that the connecting user can write the version table, without changing it.
+type WriteChecker interface {
+	// CheckWrite writes the version table in a transaction that is rolled
+	// back. It returns ErrVersionTableNotWritable if the write fails.
+	CheckWrite() error
+}
+
+// TryLocker is an optional interface a Driver can implement to attempt
+// the lock without waiting, i.e. when many instances of an application
+// start at once and only one of them should migrate.
+type TryLocker interface {
+	// TryLock makes a single attempt to acquire the lock, like Lock.
+	// It returns false without error if the lock is already held.
+	TryLock() (acquired bool, err error)
+}
+
+// Timestamper is an optional interface a Driver can implement when it
+// records when migrations were applied, i.e. to monitor the time since
+// the last migration.
+type Timestamper interface {
+	// LastAppliedAt returns when the current version was set by the last
+	// applied migration. It returns false if no time has been recorded,
+	// i.e. no migration has been applied yet.
+	LastAppliedAt() (time.Time, bool, error)
+}
+
+// Querier is an optional interface a Driver can implement to evaluate
+// the `-- migrate:assert` preconditions of migrations.
+type Querier interface {
+	// QueryBool evaluates the condition of an assertion, a boolean
+	// expression in the SQL dialect of the database.
+	QueryBool(condition string) (bool, error)
+}
+
+// ClockSetter is an optional interface a Driver recording times can
+// implement, so that tests can make them deterministic.
+type ClockSetter interface {
+	// SetClock replaces time.Now for the times the driver records.
+	SetClock(clock func() time.Time)
+}
+
+// DeployTagger is an optional interface a Driver recording a history can
+// implement to record the deploy that applied each version, i.e. to find
+// the release that introduced a migration.
+type DeployTagger interface {
+	// SetDeployID sets the deploy id recorded with the following versions.
+	SetDeployID(id string)
+
+	// RecordsDeployIDs returns false if the driver is configured not to
+	// record deploy ids, so that DeployIDs is always empty.
+	RecordsDeployIDs() bool
+
+	// DeployIDs returns the deploy id of each applied version, by version.
+	// Versions applied without deploy id are left out. A version applied
+	// more than once has the deploy id of the last time.
+	DeployIDs() (map[int]string, error)
+}
+
+// ForceUnlocker is an optional interface a Driver can implement to release
+// a lock left behind by a crashed process, i.e. with a lock table.
+type ForceUnlocker interface {
+	// ForceUnlock releases the lock, no matter which process holds it.
+	ForceUnlock() error
+}
+
 // Open returns a new driver instance.
 func Open(url string) (Driver, error) {
 	u, err := nurl.Parse(url)
@@ -110,3 +305,24 @@ func Register(name string, driver Driver) {
 	}
 	drivers[name] = driver
 }
+
+// SetURLRewriter globally sets a function that rewrites connection URLs
+// before drivers parse them in Open, i.e. to inject credentials fetched
+// at runtime. Pass nil to remove it.
+func SetURLRewriter(rewriter func(url string) (string, error)) {
+	urlRewriterMu.Lock()
+	defer urlRewriterMu.Unlock()
+	urlRewriter = rewriter
+}
+
+// RewriteURL returns url rewritten by the function set with SetURLRewriter.
+// If none is set, url is returned unchanged.
+func RewriteURL(url string) (string, error) {
+	urlRewriterMu.RLock()
+	rewriter := urlRewriter
+	urlRewriterMu.RUnlock()
+	if rewriter == nil {
+		return url, nil
+	}
+	return rewriter(url)
+}
@@ -0,0 +1,408 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	nurl "net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vickxxx/migrate"
+	"github.com/vickxxx/migrate/database"
+)
+
+func init() {
+	db := Elasticsearch{}
+	database.Register("elasticsearch", &db)
+	database.Register("opensearch", &db)
+}
+
+var DefaultMigrationsIndex = ".schema_migrations"
+
+const (
+	versionDocument = "version"
+	lockDocument    = "lock"
+)
+
+var (
+	ErrNilConfig = fmt.Errorf("no config")
+	ErrNoURL     = fmt.Errorf("no url")
+)
+
+type Config struct {
+	// URL is the address of the cluster, i.e. http://localhost:9200
+	URL             string
+	MigrationsIndex string
+}
+
+type Elasticsearch struct {
+	client *http.Client
+
+	// seqNo and primaryTerm of the lock document we created,
+	// used to only ever delete our own lock
+	lockSeqNo       int64
+	lockPrimaryTerm int64
+	isLocked        bool
+
+	// Open and WithInstance need to guarantee that config is never nil
+	config *Config
+}
+
+// Operation is a single request against the REST API of the cluster.
+// A migration is a JSON array of operations, run in order:
+//
+//   [
+//     {"method": "PUT", "path": "/_template/logs", "body": {"index_patterns": ["logs-*"]}},
+//     {"method": "PUT", "path": "/users", "body": {"mappings": {}}, "ignore": [400]},
+//     {"method": "POST", "path": "/_reindex", "body": {"source": {"index": "a"}, "dest": {"index": "b"}}}
+//   ]
+//
+// Responses with a status listed in Ignore don't fail the migration,
+// i.e. 400 for creating an index that already exists.
+type Operation struct {
+	Method string          `json:"method"`
+	Path   string          `json:"path"`
+	Body   json.RawMessage `json:"body,omitempty"`
+	Ignore []int           `json:"ignore,omitempty"`
+}
+
+type versionSource struct {
+	Version int  `json:"version"`
+	Dirty   bool `json:"dirty"`
+}
+
+func WithInstance(client *http.Client, config *Config) (database.Driver, error) {
+	if config == nil {
+		return nil, ErrNilConfig
+	}
+
+	if len(config.URL) == 0 {
+		return nil, ErrNoURL
+	}
+	config.URL = strings.TrimSuffix(config.URL, "/")
+
+	if len(config.MigrationsIndex) == 0 {
+		config.MigrationsIndex = DefaultMigrationsIndex
+	}
+
+	es := &Elasticsearch{
+		client: client,
+		config: config,
+	}
+
+	if err := es.ensureMigrationsIndex(); err != nil {
+		return nil, err
+	}
+
+	return es, nil
+}
+
+func (e *Elasticsearch) Open(url string) (database.Driver, error) {
+	url, err := database.RewriteURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	purl, err := nurl.Parse(url)
+	if err != nil {
+		return nil, err
+	}
+
+	tls, err := strconv.ParseBool(purl.Query().Get("x-tls"))
+	if err != nil {
+		tls = false
+	}
+
+	// talk plain http or https to the cluster
+	curl := migrate.FilterCustomQuery(purl)
+	curl.Scheme = "http"
+	if tls {
+		curl.Scheme = "https"
+	}
+	curl.RawQuery = ""
+
+	es, err := WithInstance(&http.Client{Timeout: time.Minute}, &Config{
+		URL:             curl.String(),
+		MigrationsIndex: purl.Query().Get("x-migrations-index"),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return es, nil
+}
+
+func (e *Elasticsearch) Close() error {
+	return nil
+}
+
+// Lock creates the lock document, which fails if it already exists.
+// The sequence number and primary term of the new document are kept,
+// so that Unlock only deletes the lock as long as it's unchanged.
+func (e *Elasticsearch) Lock() error {
+	if e.isLocked {
+		return database.ErrLocked
+	}
+
+	path := "/" + e.config.MigrationsIndex + "/_create/" + lockDocument + "?refresh=true"
+	status, body, err := e.do("PUT", path, []byte(`{"locked": true}`))
+	if err != nil {
+		return err
+	}
+	if status == http.StatusConflict {
+		return database.ErrLocked
+	}
+	if status >= 300 {
+		return responseError(status, "failed to set migration lock", path, body)
+	}
+
+	var doc struct {
+		SeqNo       int64 `json:"_seq_no"`
+		PrimaryTerm int64 `json:"_primary_term"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return &database.Error{OrigErr: err, Err: "invalid lock response", Query: []byte(path)}
+	}
+
+	e.lockSeqNo = doc.SeqNo
+	e.lockPrimaryTerm = doc.PrimaryTerm
+	e.isLocked = true
+	return nil
+}
+
+func (e *Elasticsearch) Unlock() error {
+	if !e.isLocked {
+		return nil
+	}
+
+	path := fmt.Sprintf("/%v/_doc/%v?refresh=true&if_seq_no=%v&if_primary_term=%v",
+		e.config.MigrationsIndex, lockDocument, e.lockSeqNo, e.lockPrimaryTerm)
+	status, body, err := e.do("DELETE", path, nil)
+	if err != nil {
+		return err
+	}
+	// 404: the lock is gone already, i.e. after Drop
+	if status >= 300 && status != http.StatusNotFound {
+		return responseError(status, "failed to release migration lock", path, body)
+	}
+
+	e.isLocked = false
+	return nil
+}
+
+func (e *Elasticsearch) Run(migration io.Reader) error {
+	migr, err := ioutil.ReadAll(migration)
+	if err != nil {
+		return err
+	}
+
+	var operations []Operation
+	if err := json.Unmarshal(migr, &operations); err != nil {
+		return database.Error{OrigErr: err, Err: "migration is not a JSON array of operations", Query: migr}
+	}
+
+	for _, op := range operations {
+		if len(op.Method) == 0 || len(op.Path) == 0 {
+			return database.Error{Err: "operation needs method and path", Query: migr}
+		}
+
+		status, body, err := e.do(strings.ToUpper(op.Method), op.Path, op.Body)
+		if err != nil {
+			return err
+		}
+		if status >= 300 && !ignored(status, op.Ignore) {
+			return responseError(status, "migration failed", op.Method+" "+op.Path, body)
+		}
+	}
+
+	return nil
+}
+
+func (e *Elasticsearch) SetVersion(version int, dirty bool) error {
+	path := "/" + e.config.MigrationsIndex + "/_doc/" + versionDocument + "?refresh=true"
+
+	if version < 0 {
+		status, body, err := e.do("DELETE", path, nil)
+		if err != nil {
+			return err
+		}
+		if status >= 300 && status != http.StatusNotFound {
+			return responseError(status, "", path, body)
+		}
+		return nil
+	}
+
+	doc, err := json.Marshal(versionSource{Version: version, Dirty: dirty})
+	if err != nil {
+		return err
+	}
+	status, body, err := e.do("PUT", path, doc)
+	if err != nil {
+		return err
+	}
+	if status >= 300 {
+		return responseError(status, "", path, body)
+	}
+	return nil
+}
+
+func (e *Elasticsearch) Version() (version int, dirty bool, err error) {
+	path := "/" + e.config.MigrationsIndex + "/_doc/" + versionDocument
+	status, body, err := e.do("GET", path, nil)
+	if err != nil {
+		return 0, false, err
+	}
+	if status == http.StatusNotFound {
+		return database.NilVersion, false, nil
+	}
+	if status >= 300 {
+		return 0, false, responseError(status, "", path, body)
+	}
+
+	var doc struct {
+		Source versionSource `json:"_source"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return 0, false, &database.Error{OrigErr: err, Query: []byte(path)}
+	}
+	return doc.Source.Version, doc.Source.Dirty, nil
+}
+
+// Drop deletes all indices and legacy index templates, except for the
+// migrations index and system ones starting with a dot.
+func (e *Elasticsearch) Drop() error {
+	path := "/_cat/indices?format=json&h=index"
+	status, body, err := e.do("GET", path, nil)
+	if err != nil {
+		return err
+	}
+	if status >= 300 {
+		return responseError(status, "", path, body)
+	}
+
+	var indices []struct {
+		Index string `json:"index"`
+	}
+	if err := json.Unmarshal(body, &indices); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(path)}
+	}
+
+	for _, i := range indices {
+		if strings.HasPrefix(i.Index, ".") || i.Index == e.config.MigrationsIndex {
+			continue
+		}
+		if err := e.deleteResource("/" + nurl.PathEscape(i.Index)); err != nil {
+			return err
+		}
+	}
+
+	path = "/_template"
+	status, body, err = e.do("GET", path, nil)
+	if err != nil {
+		return err
+	}
+	if status >= 300 {
+		return responseError(status, "", path, body)
+	}
+
+	var templates map[string]json.RawMessage
+	if err := json.Unmarshal(body, &templates); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(path)}
+	}
+
+	for name := range templates {
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		if err := e.deleteResource("/_template/" + nurl.PathEscape(name)); err != nil {
+			return err
+		}
+	}
+
+	return e.SetVersion(database.NilVersion, false)
+}
+
+func (e *Elasticsearch) deleteResource(path string) error {
+	status, body, err := e.do("DELETE", path, nil)
+	if err != nil {
+		return err
+	}
+	if status >= 300 && status != http.StatusNotFound {
+		return responseError(status, "", path, body)
+	}
+	return nil
+}
+
+func (e *Elasticsearch) ensureMigrationsIndex() error {
+	path := "/" + e.config.MigrationsIndex
+	status, body, err := e.do("HEAD", path, nil)
+	if err != nil {
+		return err
+	}
+	if status == http.StatusOK {
+		return nil
+	}
+	if status != http.StatusNotFound {
+		return responseError(status, "", path, body)
+	}
+
+	status, body, err = e.do("PUT", path, nil)
+	if err != nil {
+		return err
+	}
+	// 400: created concurrently by someone else
+	if status >= 300 && status != http.StatusBadRequest {
+		return responseError(status, "", path, body)
+	}
+	return nil
+}
+
+// do sends a request to the cluster and returns status and body of the response.
+func (e *Elasticsearch) do(method string, path string, body []byte) (status int, respBody []byte, err error) {
+	var r io.Reader
+	if len(body) > 0 {
+		r = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequest(method, e.config.URL+path, r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if r != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return 0, nil, &database.Error{OrigErr: err, Query: []byte(method + " " + path)}
+	}
+	defer resp.Body.Close()
+
+	respBody, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	return resp.StatusCode, respBody, nil
+}
+
+func responseError(status int, msg string, query string, body []byte) error {
+	return &database.Error{
+		OrigErr: fmt.Errorf("status %v: %s", status, body),
+		Err:     msg,
+		Query:   []byte(query),
+	}
+}
+
+func ignored(status int, ignore []int) bool {
+	for _, s := range ignore {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
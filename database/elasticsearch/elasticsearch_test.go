@@ -0,0 +1,113 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"testing"
+
+	dt "github.com/vickxxx/migrate/database/testing"
+	mt "github.com/vickxxx/migrate/testing"
+)
+
+var versions = []mt.Version{
+	{Image: "docker.elastic.co/elasticsearch/elasticsearch:7.10.2", ENV: []string{"discovery.type=single-node"}},
+	{Image: "opensearchproject/opensearch:1.3.0", ENV: []string{"discovery.type=single-node", "plugins.security.disabled=true"}},
+}
+
+func isReady(i mt.Instance) bool {
+	resp, err := http.Get(fmt.Sprintf("http://%v:%v/_cluster/health?wait_for_status=yellow&timeout=1s", i.Host(), i.PortFor(9200)))
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+func Test(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			e := &Elasticsearch{}
+			addr := fmt.Sprintf("elasticsearch://%v:%v", i.Host(), i.PortFor(9200))
+			d, err := e.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			dt.Test(t, d, []byte(`[{"method": "PUT", "path": "/test"}]`))
+		})
+}
+
+func TestIdempotentRun(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			e := &Elasticsearch{}
+			addr := fmt.Sprintf("elasticsearch://%v:%v", i.Host(), i.PortFor(9200))
+			d, err := e.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+
+			migration := []byte(`[
+				{"method": "PUT", "path": "/_template/users", "body": {"index_patterns": ["users-*"]}},
+				{"method": "PUT", "path": "/users-1", "body": {"mappings": {"properties": {"name": {"type": "keyword"}}}}, "ignore": [400]}
+			]`)
+			for n := 0; n < 2; n++ {
+				if err := d.Run(bytes.NewReader(migration)); err != nil {
+					t.Fatalf("expected run %v to succeed, got %v", n, err)
+				}
+			}
+
+			// without ignore, creating the index again fails
+			if err := d.Run(bytes.NewReader([]byte(`[{"method": "PUT", "path": "/users-1"}]`))); err == nil {
+				t.Fatal("expected err")
+			}
+		})
+}
+
+func TestLockOptimisticConcurrency(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			e := &Elasticsearch{}
+			addr := fmt.Sprintf("elasticsearch://%v:%v", i.Host(), i.PortFor(9200))
+			d1, err := e.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			d2, err := e.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+
+			if err := d1.Lock(); err != nil {
+				t.Fatal(err)
+			}
+			if err := d2.Lock(); err == nil {
+				t.Fatal("expected second instance not to acquire lock")
+			}
+			if err := d1.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+			if err := d2.Lock(); err != nil {
+				t.Fatal(err)
+			}
+
+			// d1's lock is gone, it must not release d2's
+			d1.(*Elasticsearch).isLocked = true
+			if err := d1.Unlock(); err == nil {
+				t.Fatal("expected err when releasing a lock held by someone else")
+			}
+			if err := d2.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+		})
+}
+
+func TestRunInvalidMigration(t *testing.T) {
+	e := &Elasticsearch{config: &Config{URL: "http://localhost:9200"}}
+	if err := e.Run(bytes.NewReader([]byte(`CREATE TABLE t`))); err == nil {
+		t.Fatal("expected err for migration that isn't JSON")
+	}
+	if err := e.Run(bytes.NewReader([]byte(`[{"path": "/test"}]`))); err == nil {
+		t.Fatal("expected err for operation without method")
+	}
+}
@@ -1,7 +1,10 @@
 package database
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 )
 
 // Error should be used for errors involving queries ran against the database
@@ -25,3 +28,78 @@ func (e Error) Error() string {
 	}
 	return fmt.Sprintf("%v in line %v: %s (details: %v)", e.Err, e.Line, e.Query, e.OrigErr)
 }
+
+// Unwrap returns OrigErr, so that errors.As and errors.Is reach the error
+// of the database client, i.e. a *pq.Error.
+func (e Error) Unwrap() error {
+	return e.OrigErr
+}
+
+// SQLState returns the SQLSTATE code of OrigErr, if the database client
+// reports one with a SQLState method like *pq.Error does.
+func (e Error) SQLState() string {
+	var s interface{ SQLState() string }
+	if errors.As(e.OrigErr, &s) {
+		return s.SQLState()
+	}
+	return ""
+}
+
+// MarshalJSON encodes e for machine consumption, i.e. structured logs.
+func (e Error) MarshalJSON() ([]byte, error) {
+	v := struct {
+		Message  string `json:"message"`
+		Line     uint   `json:"line,omitempty"`
+		Query    string `json:"query,omitempty"`
+		SQLState string `json:"sqlstate,omitempty"`
+		OrigErr  string `json:"error,omitempty"`
+	}{
+		Message:  e.Err,
+		Line:     e.Line,
+		Query:    string(e.Query),
+		SQLState: e.SQLState(),
+	}
+	if e.OrigErr != nil {
+		v.OrigErr = e.OrigErr.Error()
+	}
+	return json.Marshal(v)
+}
+
+// OrigErr returns the underlying error of err if it's an Error,
+// otherwise err itself.
+func OrigErr(err error) error {
+	switch e := err.(type) {
+	case Error:
+		return e.OrigErr
+	case *Error:
+		return e.OrigErr
+	}
+	return err
+}
+
+// ErrMissingPrivileges is returned by a PrivilegeChecker
+// if User lacks the Missing privileges.
+type ErrMissingPrivileges struct {
+	User    string
+	Missing []string
+}
+
+func (e ErrMissingPrivileges) Error() string {
+	return fmt.Sprintf("user %v is missing privileges: %v", e.User, strings.Join(e.Missing, ", "))
+}
+
+// ErrVersionTableNotWritable is returned by a WriteChecker
+// if the connecting user can't write the version Table.
+type ErrVersionTableNotWritable struct {
+	Table string
+	Err   error
+}
+
+func (e ErrVersionTableNotWritable) Error() string {
+	return fmt.Sprintf("can't write version table %v: %v", e.Table, e.Err)
+}
+
+// Unwrap returns Err.
+func (e ErrVersionTableNotWritable) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,57 @@
+package database
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestErrorUnwrap(t *testing.T) {
+	orig := &pq.Error{Code: "42P01", Message: `relation "users" does not exist`}
+	for _, err := range []error{
+		Error{OrigErr: orig, Err: "migration failed", Query: []byte("SELECT * FROM users"), Line: 3},
+		&Error{OrigErr: orig},
+		fmt.Errorf("wrapped: %w", Error{OrigErr: orig}),
+	} {
+		var pqErr *pq.Error
+		if !errors.As(err, &pqErr) {
+			t.Fatalf("expected %v to unwrap to *pq.Error", err)
+		}
+		if pqErr.Code != "42P01" {
+			t.Fatalf("expected code 42P01, got %v", pqErr.Code)
+		}
+		if !errors.Is(err, orig) {
+			t.Fatalf("expected %v to wrap %v", err, orig)
+		}
+	}
+}
+
+func TestErrorSQLState(t *testing.T) {
+	e := Error{OrigErr: &pq.Error{Code: "40001"}}
+	if state := e.SQLState(); state != "40001" {
+		t.Fatalf("expected SQLSTATE 40001, got %v", state)
+	}
+	if state := (Error{OrigErr: errors.New("no state")}).SQLState(); state != "" {
+		t.Fatalf("expected no SQLSTATE, got %v", state)
+	}
+}
+
+func TestErrorMarshalJSON(t *testing.T) {
+	e := Error{
+		OrigErr: &pq.Error{Code: "42601", Message: "syntax error"},
+		Err:     "migration failed",
+		Query:   []byte("SELEC 1"),
+		Line:    2,
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"message":"migration failed","line":2,"query":"SELEC 1","sqlstate":"42601","error":"pq: syntax error"}`
+	if string(b) != expected {
+		t.Fatalf("expected %v, got %s", expected, b)
+	}
+}
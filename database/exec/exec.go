@@ -0,0 +1,246 @@
+// Package exec runs migrations with an external command, i.e. the native
+// CLI of a database without Go driver, and keeps the version in a file.
+package exec
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	nurl "net/url"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/vickxxx/migrate/database"
+)
+
+func init() {
+	database.Register("exec", &Exec{})
+}
+
+var (
+	ErrNilConfig     = fmt.Errorf("no config")
+	ErrNoCommand     = fmt.Errorf("no command")
+	ErrNoVersionFile = fmt.Errorf("no version file")
+	ErrNoDropCommand = fmt.Errorf("no drop command")
+)
+
+type Config struct {
+	// Command is the template of the command running a migration, which
+	// is piped to its stdin, i.e. `cockroach sql --url ...`. The
+	// command is run with sh -c. The template is executed with Data.
+	Command string
+	// DropCommand is the command Drop runs, if set, with sh -c.
+	DropCommand string
+	// VersionFile keeps the version and dirty flag. It's created with the
+	// first version set. A lock file next to it, with the suffix .lock,
+	// is held while migrating.
+	VersionFile string
+}
+
+// Data is passed to the template of Config.Command.
+type Data struct {
+	// Version is the version of the migration, up or down.
+	Version int
+}
+
+type Exec struct {
+	isLocked bool
+	command  *template.Template
+
+	config *Config
+}
+
+func WithConfig(config *Config) (database.Driver, error) {
+	if config == nil {
+		return nil, ErrNilConfig
+	}
+	if len(config.Command) == 0 {
+		return nil, ErrNoCommand
+	}
+	if len(config.VersionFile) == 0 {
+		return nil, ErrNoVersionFile
+	}
+
+	command, err := template.New("command").Option("missingkey=error").Parse(config.Command)
+	if err != nil {
+		return nil, fmt.Errorf("invalid command: %v", err)
+	}
+	return &Exec{
+		command: command,
+		config:  config,
+	}, nil
+}
+
+// Open takes the version file as path, i.e.
+// exec://migrations/version?x-command=cockroach+sql+--url+...
+func (e *Exec) Open(url string) (database.Driver, error) {
+	url, err := database.RewriteURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := nurl.Parse(url)
+	if err != nil {
+		return nil, err
+	}
+	return WithConfig(&Config{
+		Command:     u.Query().Get("x-command"),
+		DropCommand: u.Query().Get("x-drop-command"),
+		VersionFile: u.Host + u.Path,
+	})
+}
+
+func (e *Exec) Close() error {
+	return nil
+}
+
+// Lock creates the lock file, which fails if another process holds it.
+func (e *Exec) Lock() error {
+	if e.isLocked {
+		return database.ErrLocked
+	}
+	f, err := os.OpenFile(e.lockFile(), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if os.IsExist(err) {
+		return database.ErrLocked
+	} else if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	e.isLocked = true
+	return nil
+}
+
+func (e *Exec) Unlock() error {
+	if !e.isLocked {
+		return nil
+	}
+	if err := os.Remove(e.lockFile()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	e.isLocked = false
+	return nil
+}
+
+func (e *Exec) lockFile() string {
+	return e.config.VersionFile + ".lock"
+}
+
+func (e *Exec) Run(migration io.Reader) error {
+	return e.run(migration, database.NilVersion)
+}
+
+// RunVersion implements database.VersionRunner,
+// so that the command can refer to the version.
+func (e *Exec) RunVersion(version uint, migration io.Reader) error {
+	return e.run(migration, int(version))
+}
+
+// run runs the command with migration piped to its stdin.
+// version is database.NilVersion if it's unknown.
+func (e *Exec) run(migration io.Reader, version int) error {
+	migr, err := ioutil.ReadAll(migration)
+	if err != nil {
+		return err
+	}
+
+	var command bytes.Buffer
+	if err := e.command.Execute(&command, Data{Version: version}); err != nil {
+		return fmt.Errorf("invalid command: %v", err)
+	}
+	if err := e.sh(command.String(), migr); err != nil {
+		return database.Error{OrigErr: err, Err: "migration failed", Query: migr}
+	}
+	return nil
+}
+
+// ErrCommandFailed is the error of a command which exited with an error,
+// with its combined Output.
+type ErrCommandFailed struct {
+	Command string
+	Output  string
+	Err     error
+}
+
+func (e ErrCommandFailed) Error() string {
+	return fmt.Sprintf("%v: %v: %v", e.Command, e.Err, e.Output)
+}
+
+// Unwrap returns Err, i.e. an *exec.ExitError.
+func (e ErrCommandFailed) Unwrap() error {
+	return e.Err
+}
+
+// sh runs command with sh -c and stdin piped to it.
+func (e *Exec) sh(command string, stdin []byte) error {
+	cmd := osexec.Command("sh", "-c", command)
+	cmd.Stdin = bytes.NewReader(stdin)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return ErrCommandFailed{Command: command, Output: strings.TrimSpace(string(output)), Err: err}
+	}
+	return nil
+}
+
+// SetVersion writes the version file, through a temporary file,
+// so that it's never left half written.
+func (e *Exec) SetVersion(version int, dirty bool) error {
+	f, err := ioutil.TempFile(filepath.Dir(e.config.VersionFile), filepath.Base(e.config.VersionFile)+".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%v %v\n", version, dirty)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), e.config.VersionFile)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Version reads the version file, which holds
+// the version and dirty flag separated by a space.
+func (e *Exec) Version() (version int, dirty bool, err error) {
+	b, err := ioutil.ReadFile(e.config.VersionFile)
+	if os.IsNotExist(err) {
+		return database.NilVersion, false, nil
+	} else if err != nil {
+		return 0, false, err
+	}
+
+	fields := strings.Fields(string(b))
+	if len(fields) != 2 {
+		return 0, false, fmt.Errorf("invalid version file %v: %q", e.config.VersionFile, b)
+	}
+	if version, err = strconv.Atoi(fields[0]); err != nil {
+		return 0, false, fmt.Errorf("invalid version file %v: %v", e.config.VersionFile, err)
+	}
+	if dirty, err = strconv.ParseBool(fields[1]); err != nil {
+		return 0, false, fmt.Errorf("invalid version file %v: %v", e.config.VersionFile, err)
+	}
+	return version, dirty, nil
+}
+
+// Drop runs Config.DropCommand and removes the version file.
+// It returns ErrNoDropCommand if there is none.
+func (e *Exec) Drop() error {
+	if len(e.config.DropCommand) == 0 {
+		return ErrNoDropCommand
+	}
+	if err := e.sh(e.config.DropCommand, nil); err != nil {
+		return err
+	}
+	if err := os.Remove(e.config.VersionFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
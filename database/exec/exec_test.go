@@ -0,0 +1,157 @@
+package exec
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	nurl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/vickxxx/migrate/database"
+	dt "github.com/vickxxx/migrate/database/testing"
+)
+
+// openFake opens a driver in dir with a fake command,
+// which appends the migrations to the file applied.
+func openFake(t *testing.T, dir string, command string) database.Driver {
+	t.Helper()
+	url := fmt.Sprintf("exec://%v?x-command=%v&x-drop-command=%v", filepath.Join(dir, "version"),
+		nurl.QueryEscape(command), nurl.QueryEscape("rm -f "+filepath.Join(dir, "applied")))
+	d, err := (&Exec{}).Open(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func Test(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := openFake(t, dir, "cat >> "+filepath.Join(dir, "applied"))
+	dt.Test(t, d, []byte("CREATE TABLE t (id INT);"))
+}
+
+func TestRunVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	applied := filepath.Join(dir, "applied")
+	d := openFake(t, dir, "(echo -- {{.Version}}; cat) >> "+applied)
+	if err := d.(database.VersionRunner).RunVersion(3, strings.NewReader("CREATE TABLE a (a INT);\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Run(strings.NewReader("CREATE TABLE b (b INT);\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(applied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "-- 3\nCREATE TABLE a (a INT);\n-- -1\nCREATE TABLE b (b INT);\n"
+	if string(b) != expected {
+		t.Fatalf("expected %q, got %q", expected, b)
+	}
+}
+
+func TestRunFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := openFake(t, dir, "echo syntax error >&2; exit 1")
+	err = d.Run(bytes.NewReader([]byte("CREATE TABLE")))
+	var failed ErrCommandFailed
+	if !errors.As(err, &failed) {
+		t.Fatalf("expected ErrCommandFailed, got %v", err)
+	}
+	if failed.Output != "syntax error" {
+		t.Fatalf("expected output %q, got %q", "syntax error", failed.Output)
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// two processes sharing the version file
+	d := openFake(t, dir, "cat")
+	d2 := openFake(t, dir, "cat")
+	if err := d.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d2.Lock(); err != database.ErrLocked {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+	if err := d.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d2.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d2.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithConfig(t *testing.T) {
+	tt := []struct {
+		config *Config
+		err    error
+	}{
+		{config: nil, err: ErrNilConfig},
+		{config: &Config{VersionFile: "version"}, err: ErrNoCommand},
+		{config: &Config{Command: "cat"}, err: ErrNoVersionFile},
+	}
+	for i, v := range tt {
+		if _, err := WithConfig(v.config); err != v.err {
+			t.Errorf("expected %v, got %v, in %v", v.err, err, i)
+		}
+	}
+
+	if _, err := WithConfig(&Config{Command: "cat {{.Version", VersionFile: "version"}); err == nil {
+		t.Fatal("expected error for invalid template")
+	}
+
+	d, err := WithConfig(&Config{Command: "cat", VersionFile: "version"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Drop(); err != ErrNoDropCommand {
+		t.Fatalf("expected ErrNoDropCommand, got %v", err)
+	}
+}
+
+func TestURLRewriter(t *testing.T) {
+	errRewrite := fmt.Errorf("rewrite failed")
+	var rewritten string
+	database.SetURLRewriter(func(url string) (string, error) {
+		rewritten = url
+		return "", errRewrite
+	})
+	defer database.SetURLRewriter(nil)
+
+	addr := "exec://version?x-command=cockroach+sql+--url+postgres%3A%2F%2Froot%3Asecret%40localhost"
+	if _, err := (&Exec{}).Open(addr); err != errRewrite {
+		t.Fatalf("expected %v, got %v", errRewrite, err)
+	}
+	if rewritten != addr {
+		t.Fatalf("expected rewriter to be called with %v, got %v", addr, rewritten)
+	}
+}
@@ -0,0 +1,381 @@
+// Package multistmt splits migrations into single statements, for database
+// drivers that run the statements of a migration one by one.
+package multistmt
+
+import (
+	"bytes"
+	"regexp"
+)
+
+// Markers of a statement that is sent as a whole, even if it contains
+// semicolons outside of quotes, i.e. a PL/pgSQL block or a trigger body.
+// Each marker is a line comment of its own:
+//
+//	-- migrate:statement-begin
+//	CREATE TRIGGER ...
+//	BEGIN
+//	  ...;
+//	END;
+//	-- migrate:statement-end
+const (
+	StatementBegin = "migrate:statement-begin"
+	StatementEnd   = "migrate:statement-end"
+)
+
+// Statement is a single statement of a migration.
+type Statement struct {
+	// Query is the statement without the terminating semicolon
+	// and without leading comments.
+	Query []byte
+
+	// Offset is the byte offset of Query within the migration.
+	Offset int
+
+	// Line is the line of the migration Query starts in, starting at 1.
+	Line int
+}
+
+// Split splits migration at semicolons. Semicolons within quotes,
+// including MySQL's backticks, dollar-quoted strings and comments
+// don't end a statement. Quotes are escaped by doubling them, and in
+// PostgreSQL's escape strings (E'...') also with a backslash.
+// Statements that are empty or consist of comments only are skipped.
+// Everything between the StatementBegin and StatementEnd markers is a
+// single statement, without a trailing semicolon. A missing end marker
+// runs to the end of the migration. Except for marked statements, joining
+// the statements with newlines and semicolons in between splits into the
+// same statements again.
+func Split(migration []byte) []Statement {
+	return split(migration, false)
+}
+
+// SplitMySQL splits migration like Split, but quoted the way MySQL quotes:
+// backslashes escape within single and double quoted strings, # starts a
+// line comment, block comments don't nest and there are no dollar-quoted
+// strings.
+func SplitMySQL(migration []byte) []Statement {
+	return split(migration, true)
+}
+
+// split splits migration, see Split, with MySQL's quoting if mysql is true.
+func split(migration []byte, mysql bool) []Statement {
+	statements := make([]Statement, 0)
+
+	line := 1
+	start, startLine := -1, 0
+
+	// end adds the statement running up to i, if there is one
+	end := func(i int) {
+		if start >= 0 {
+			statements = append(statements, Statement{
+				Query:  bytes.TrimRightFunc(migration[start:i], isSpace),
+				Offset: start,
+				Line:   startLine,
+			})
+		}
+		start = -1
+	}
+
+	for i := 0; i < len(migration); i++ {
+		c := migration[i]
+
+		switch {
+		case c == '\n':
+			line++
+			continue
+
+		case isSpace(rune(c)):
+			continue
+
+		case c == ';':
+			end(i)
+			continue
+
+		case c == '#' && mysql:
+			// the newline itself is counted by the loop
+			i = lineEnd(migration, i) - 1
+			continue
+
+		case c == '-' && next(migration, i) == '-':
+			j := lineEnd(migration, i)
+			if isMarker(migration[i:j], StatementBegin) {
+				end(i)
+				body, stop := markedEnd(migration, j)
+				if s, ok := markedStatement(migration, j, body, line); ok {
+					statements = append(statements, s)
+				}
+				j = stop
+				line += bytes.Count(migration[i:j], []byte{'\n'})
+			}
+			// the newline itself is counted by the loop
+			i = j - 1
+			continue
+
+		case c == '/' && next(migration, i) == '*':
+			j := blockCommentEnd(migration, i)
+			if mysql {
+				j = quoteEnd(migration, i+1, []byte("*/"))
+			}
+			line += bytes.Count(migration[i:j], []byte{'\n'})
+			i = j - 1
+			continue
+		}
+
+		if start < 0 {
+			start, startLine = i, line
+		}
+
+		var j int
+		switch {
+		case (c == '\'' || c == '"') && mysql:
+			j = escapeStringEnd(migration, i, c)
+		case c == '\'' && isEscapeString(migration, i):
+			j = escapeStringEnd(migration, i, c)
+		case c == '\'' || c == '"' || c == '`':
+			j = quoteEnd(migration, i, []byte{c})
+		case c == '$' && !mysql && (i == 0 || !isIdentifier(migration[i-1])):
+			if tag := dollarTag(migration, i); tag != nil {
+				j = quoteEnd(migration, i+len(tag)-1, tag)
+			}
+		}
+		if j > 0 {
+			line += bytes.Count(migration[i:j], []byte{'\n'})
+			i = j - 1
+		}
+	}
+	end(len(migration))
+
+	return statements
+}
+
+// nonTransactional matches the statements PostgreSQL refuses to run in a
+// transaction block.
+var nonTransactional = regexp.MustCompile(`(?is)^(?:(?:CREATE\s+(?:UNIQUE\s+)?INDEX|DROP\s+INDEX|REINDEX)\s.*\bCONCURRENTLY\b|VACUUM\b|(?:CREATE|DROP)\s+DATABASE\b|ALTER\s+SYSTEM\b)`)
+
+// NonTransactional returns true if query, a single statement as returned
+// by Split, can't run in a transaction block, i.e. CREATE INDEX
+// CONCURRENTLY, DROP INDEX CONCURRENTLY, REINDEX CONCURRENTLY, VACUUM,
+// CREATE DATABASE or ALTER SYSTEM.
+func NonTransactional(query []byte) bool {
+	return nonTransactional.Match(query)
+}
+
+// transactionControl matches the statements that begin or end a
+// transaction block.
+var transactionControl = regexp.MustCompile(`(?is)^(?:BEGIN|START\s+TRANSACTION|COMMIT|END|ROLLBACK|ABORT)\b`)
+
+// TransactionControl returns true if query, a single statement as returned
+// by Split, begins or ends a transaction block, i.e. BEGIN, COMMIT, END or
+// ROLLBACK.
+func TransactionControl(query []byte) bool {
+	return transactionControl.Match(query)
+}
+
+// Atomic returns true if migration, sent as a single query, runs in a
+// single implicit transaction, so that a failure rolls it back as a whole.
+// It isn't if it consists of several batches, see Batches, or controls the
+// transaction itself, i.e. commits in between.
+func Atomic(migration []byte) bool {
+	for _, s := range Split(migration) {
+		if TransactionControl(s.Query) {
+			return false
+		}
+	}
+	batches := Batches(migration)
+	return len(batches) == 1 && !batches[0].NonTransactional
+}
+
+// Batch is a part of a migration sent as a single query, see Batches.
+type Batch struct {
+	// Query is the original text of the migration
+	// from the first to the last statement of the batch.
+	Query []byte
+
+	// Line is the line of the migration Query starts in, starting at 1.
+	Line int
+
+	// NonTransactional is true for a batch of a single statement
+	// that can't run in a transaction block, see NonTransactional.
+	NonTransactional bool
+}
+
+// Batches splits migration around its statements that can't run in a
+// transaction block, for database drivers that send a migration as a
+// single query, which runs in an implicit transaction. Each of these
+// statements is a batch of its own, the statements between them are
+// batched. A migration without such statements is returned as a single
+// batch, unchanged. Only the statements of a batch share a transaction,
+// so a migration of several batches isn't atomic anymore.
+func Batches(migration []byte) []Batch {
+	statements := Split(migration)
+	nonTx := false
+	for _, s := range statements {
+		nonTx = nonTx || NonTransactional(s.Query)
+	}
+	if !nonTx {
+		return []Batch{{Query: migration, Line: 1}}
+	}
+
+	batches := make([]Batch, 0)
+	first := -1
+	// flush adds the batch of the statements from first up to i
+	flush := func(i int) {
+		if first >= 0 {
+			last := statements[i-1]
+			batches = append(batches, Batch{
+				Query: migration[statements[first].Offset : last.Offset+len(last.Query)],
+				Line:  statements[first].Line,
+			})
+		}
+		first = -1
+	}
+	for i, s := range statements {
+		if !NonTransactional(s.Query) {
+			if first < 0 {
+				first = i
+			}
+			continue
+		}
+		flush(i)
+		batches = append(batches, Batch{Query: s.Query, Line: s.Line, NonTransactional: true})
+	}
+	flush(len(statements))
+	return batches
+}
+
+// lineEnd returns the offset of the newline ending the line of i,
+// or the end of migration.
+func lineEnd(migration []byte, i int) int {
+	j := bytes.IndexByte(migration[i:], '\n')
+	if j < 0 {
+		return len(migration)
+	}
+	return i + j
+}
+
+// isMarker returns true if comment, a line comment, is marker.
+func isMarker(comment []byte, marker string) bool {
+	return string(bytes.TrimSpace(bytes.TrimPrefix(comment, []byte("--")))) == marker
+}
+
+// markedEnd returns the offsets of the newlines before and after the
+// StatementEnd marker following the line ending at i, or the end of
+// migration twice if there is none.
+func markedEnd(migration []byte, i int) (body int, stop int) {
+	for i < len(migration) {
+		j := lineEnd(migration, i+1)
+		if isMarker(bytes.TrimSpace(migration[i:j]), StatementEnd) {
+			return i, j
+		}
+		i = j
+	}
+	return len(migration), len(migration)
+}
+
+// markedStatement returns the statement migration[i:body] after a
+// StatementBegin marker in line, or false if it's empty.
+func markedStatement(migration []byte, i int, body int, line int) (Statement, bool) {
+	query := bytes.TrimRightFunc(migration[i:body], isSpace)
+	query = bytes.TrimRightFunc(bytes.TrimSuffix(query, []byte{';'}), isSpace)
+	start := i
+	for start < i+len(query) && isSpace(rune(migration[start])) {
+		start++
+	}
+	if start == i+len(query) {
+		return Statement{}, false
+	}
+	return Statement{
+		Query:  migration[start : i+len(query)],
+		Offset: start,
+		Line:   line + bytes.Count(migration[i:start], []byte{'\n'}),
+	}, true
+}
+
+func isSpace(r rune) bool {
+	return r == ' ' || r == '\t' || r == '\n' || r == '\r' || r == '\f' || r == '\v'
+}
+
+func next(migration []byte, i int) byte {
+	if i+1 < len(migration) {
+		return migration[i+1]
+	}
+	return 0
+}
+
+// quoteEnd returns the offset after the closing quote of a string
+// opened at i, or the end of migration if it isn't closed.
+func quoteEnd(migration []byte, i int, quote []byte) int {
+	j := bytes.Index(migration[i+1:], quote)
+	if j < 0 {
+		return len(migration)
+	}
+	return i + 1 + j + len(quote)
+}
+
+// isEscapeString returns true if the quote at i opens an escape string,
+// i.e. E'it\'s', rather than following an identifier ending in E.
+func isEscapeString(migration []byte, i int) bool {
+	if i < 1 || migration[i-1] != 'E' && migration[i-1] != 'e' {
+		return false
+	}
+	return i < 2 || !isIdentifier(migration[i-2])
+}
+
+// escapeStringEnd returns the offset after the closing quote of a string
+// opened with quote at i, in which backslashes escape, or the end of
+// migration if it isn't closed.
+func escapeStringEnd(migration []byte, i int, quote byte) int {
+	for j := i + 1; j < len(migration); j++ {
+		switch migration[j] {
+		case '\\':
+			j++
+		case quote:
+			if next(migration, j) != quote {
+				return j + 1
+			}
+			j++
+		}
+	}
+	return len(migration)
+}
+
+func isIdentifier(c byte) bool {
+	return c == '_' || c == '$' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
+
+// blockCommentEnd returns the offset after the comment starting at i.
+// Block comments nest like in PostgreSQL.
+func blockCommentEnd(migration []byte, i int) int {
+	depth := 0
+	for j := i; j < len(migration)-1; j++ {
+		switch {
+		case migration[j] == '/' && migration[j+1] == '*':
+			depth++
+			j++
+		case migration[j] == '*' && migration[j+1] == '/':
+			depth--
+			j++
+			if depth == 0 {
+				return j + 1
+			}
+		}
+	}
+	return len(migration)
+}
+
+// dollarTag returns the tag of a dollar-quoted string starting at i,
+// i.e. $$ or $body$, or nil if there is none, i.e. for $1.
+func dollarTag(migration []byte, i int) []byte {
+	for j := i + 1; j < len(migration); j++ {
+		c := migration[j]
+		switch {
+		case c == '$':
+			return migration[i : j+1]
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && j > i+1:
+		default:
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+//go:build go1.18
+// +build go1.18
+
+package multistmt
+
+import (
+	"bytes"
+	"testing"
+)
+
+// FuzzSplit checks that statements point into the migration at their line,
+// and that joining them splits into the same statements again.
+// Run it with go test -fuzz FuzzSplit ./database/multistmt
+func FuzzSplit(f *testing.F) {
+	for _, seed := range []string{
+		"SELECT 1; SELECT 2;",
+		"-- create a; or not\nCREATE TABLE a (a INT);\n/* b;\n*/ SELECT 2;",
+		"/* outer /* inner; */ still comment; */ SELECT 1;",
+		"INSERT INTO a VALUES ('x;\ny', 'it''s;');\nSELECT \"semi;colon\" FROM b;",
+		"CREATE FUNCTION f() RETURNS INT AS $$ SELECT 1; $$ LANGUAGE SQL;\nSELECT $body$;\n$body$;\nSELECT $1;",
+		"INSERT INTO a VALUES (E'it\\'s;', e'\\\\');",
+		"CREATE TABLE `a;b` (a INT); SELECT 1 -- trailing; comment",
+		"SELECT 'unterminated;",
+		"-- migrate:statement-begin\nBEGIN; SELECT 1; END;\n-- migrate:statement-end\nSELECT 2;",
+	} {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, migration []byte) {
+		statements := Split(migration)
+
+		queries := make([][]byte, len(statements))
+		end := 0
+		for n, s := range statements {
+			if s.Offset < end || s.Offset+len(s.Query) > len(migration) {
+				t.Fatalf("statement %v at offset %v overlaps or exceeds the migration", n, s.Offset)
+			}
+			if !bytes.Equal(migration[s.Offset:s.Offset+len(s.Query)], s.Query) {
+				t.Fatalf("statement %v doesn't match the migration at offset %v", n, s.Offset)
+			}
+			if line := 1 + bytes.Count(migration[:s.Offset], []byte{'\n'}); s.Line != line {
+				t.Fatalf("expected statement %v at line %v, got %v", n, line, s.Line)
+			}
+			end = s.Offset + len(s.Query)
+			queries[n] = s.Query
+		}
+
+		// marked statements may contain semicolons, which split when rejoined
+		if bytes.Contains(migration, []byte(StatementBegin)) {
+			return
+		}
+
+		// the newline ends a trailing line comment of the previous statement
+		rejoined := Split(bytes.Join(queries, []byte("\n;\n")))
+		if len(rejoined) != len(statements) {
+			t.Fatalf("expected %v statements after joining, got %v", len(statements), len(rejoined))
+		}
+		for n, s := range rejoined {
+			if !bytes.Equal(s.Query, queries[n]) {
+				t.Fatalf("expected statement %q after joining, got %q", queries[n], s.Query)
+			}
+		}
+	})
+}
@@ -0,0 +1,216 @@
+package multistmt
+
+import (
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	type stmt struct {
+		query string
+		line  int
+	}
+
+	tt := []struct {
+		migration string
+		expect    []stmt
+	}{
+		{"", []stmt{}},
+		{" ; ;\n", []stmt{}},
+		{"SELECT 1", []stmt{{"SELECT 1", 1}}},
+		{"SELECT 1;", []stmt{{"SELECT 1", 1}}},
+		{"SELECT 1; SELECT 2;", []stmt{{"SELECT 1", 1}, {"SELECT 2", 1}}},
+		{
+			"CREATE TABLE a (a INT);\n\nCREATE TABLE b (\n  b INT\n);\nSELECT 1",
+			[]stmt{{"CREATE TABLE a (a INT)", 1}, {"CREATE TABLE b (\n  b INT\n)", 3}, {"SELECT 1", 6}},
+		},
+		{
+			"-- create a; or not\nCREATE TABLE a (a INT);\n/* b;\n*/ SELECT 2;",
+			[]stmt{{"CREATE TABLE a (a INT)", 2}, {"SELECT 2", 4}},
+		},
+		{
+			"/* outer /* inner; */ still comment; */ SELECT 1;",
+			[]stmt{{"SELECT 1", 1}},
+		},
+		{
+			"INSERT INTO a VALUES ('x;\ny', 'it''s;');\nSELECT \"semi;colon\" FROM b;",
+			[]stmt{{"INSERT INTO a VALUES ('x;\ny', 'it''s;')", 1}, {"SELECT \"semi;colon\" FROM b", 3}},
+		},
+		{
+			"CREATE FUNCTION f() RETURNS INT AS $$ SELECT 1; $$ LANGUAGE SQL;\nSELECT $body$;\n$body$;\nSELECT $1;",
+			[]stmt{
+				{"CREATE FUNCTION f() RETURNS INT AS $$ SELECT 1; $$ LANGUAGE SQL", 1},
+				{"SELECT $body$;\n$body$", 2},
+				{"SELECT $1", 4},
+			},
+		},
+		{"CREATE TABLE `a;b` (a INT);", []stmt{{"CREATE TABLE `a;b` (a INT)", 1}}},
+		{"SELECT 1; -- trailing comment", []stmt{{"SELECT 1", 1}}},
+		{"SELECT 'unterminated;", []stmt{{"SELECT 'unterminated;", 1}}},
+		{
+			"INSERT INTO a VALUES (E'it\\'s;\n', e'\\\\');\nSELECT 'C:\\';",
+			[]stmt{{"INSERT INTO a VALUES (E'it\\'s;\n', e'\\\\')", 1}, {"SELECT 'C:\\'", 3}},
+		},
+		{"SELECT name'x;y' FROM a;", []stmt{{"SELECT name'x;y' FROM a", 1}}},
+		{"SELECT a$b$; SELECT $b$;", []stmt{{"SELECT a$b$", 1}, {"SELECT $b$;", 1}}},
+		{
+			"CREATE TABLE a (a INT);\n-- migrate:statement-begin\n\nDO LANGUAGE plpgsql 'BEGIN\n  INSERT INTO a VALUES (1);\nEND';\n-- migrate:statement-end\nSELECT 1;",
+			[]stmt{{"CREATE TABLE a (a INT)", 1}, {"DO LANGUAGE plpgsql 'BEGIN\n  INSERT INTO a VALUES (1);\nEND'", 4}, {"SELECT 1", 8}},
+		},
+		{
+			"SELECT 1\n--migrate:statement-begin\nBEGIN; SELECT 2; END\n  -- migrate:statement-end  ",
+			[]stmt{{"SELECT 1", 1}, {"BEGIN; SELECT 2; END", 3}},
+		},
+		{"-- migrate:statement-begin\n-- migrate:statement-end\nSELECT 1", []stmt{{"SELECT 1", 3}}},
+		{"-- migrate:statement-begin\nSELECT 1; SELECT 2;\n", []stmt{{"SELECT 1; SELECT 2", 2}}},
+		{"-- migrate:statement-end\nSELECT 1; -- migrate:statement-begin", []stmt{{"SELECT 1", 2}}},
+	}
+
+	for i, v := range tt {
+		statements := Split([]byte(v.migration))
+		if len(statements) != len(v.expect) {
+			t.Errorf("expected %v statements, got %+v, in %v", len(v.expect), statements, i)
+			continue
+		}
+		for n, s := range statements {
+			if string(s.Query) != v.expect[n].query {
+				t.Errorf("expected query %q, got %q, in %v", v.expect[n].query, s.Query, i)
+			}
+			if s.Line != v.expect[n].line {
+				t.Errorf("expected line %v for %q, got %v, in %v", v.expect[n].line, s.Query, s.Line, i)
+			}
+			if v.migration[s.Offset:s.Offset+len(s.Query)] != string(s.Query) {
+				t.Errorf("expected offset %v to point at %q, in %v", s.Offset, s.Query, i)
+			}
+		}
+	}
+}
+
+func TestSplitMySQL(t *testing.T) {
+	type stmt struct {
+		query string
+		line  int
+	}
+
+	tt := []struct {
+		migration string
+		expect    []stmt
+	}{
+		{"SELECT 1; SELECT 2;", []stmt{{"SELECT 1", 1}, {"SELECT 2", 1}}},
+		{
+			"INSERT INTO a VALUES ('it\\'s; x'); SELECT 1;",
+			[]stmt{{"INSERT INTO a VALUES ('it\\'s; x')", 1}, {"SELECT 1", 1}},
+		},
+		{
+			"INSERT INTO a VALUES (\"say \\\"hi;\\\"\", 'C:\\\\');\nSELECT 'it''s;';",
+			[]stmt{{"INSERT INTO a VALUES (\"say \\\"hi;\\\"\", 'C:\\\\')", 1}, {"SELECT 'it''s;'", 2}},
+		},
+		{"# comment; here\nSELECT 1;", []stmt{{"SELECT 1", 2}}},
+		{"SELECT 1; # trailing; comment\nSELECT 2", []stmt{{"SELECT 1", 1}, {"SELECT 2", 2}}},
+		{"SELECT 1 -- comment; here\n;", []stmt{{"SELECT 1 -- comment; here", 1}}},
+		{"/* a /* b; */ SELECT 1; */", []stmt{{"SELECT 1", 1}, {"*/", 1}}},
+		{"SELECT $a$; SELECT $a$;", []stmt{{"SELECT $a$", 1}, {"SELECT $a$", 1}}},
+		{"CREATE TABLE `a;b` (a INT);", []stmt{{"CREATE TABLE `a;b` (a INT)", 1}}},
+	}
+
+	for i, v := range tt {
+		statements := SplitMySQL([]byte(v.migration))
+		if len(statements) != len(v.expect) {
+			t.Errorf("expected %v statements, got %+v, in %v", len(v.expect), statements, i)
+			continue
+		}
+		for n, s := range statements {
+			if string(s.Query) != v.expect[n].query {
+				t.Errorf("expected query %q, got %q, in %v", v.expect[n].query, s.Query, i)
+			}
+			if s.Line != v.expect[n].line {
+				t.Errorf("expected line %v for %q, got %v, in %v", v.expect[n].line, s.Query, s.Line, i)
+			}
+		}
+	}
+}
+
+func TestNonTransactional(t *testing.T) {
+	tt := []struct {
+		query  string
+		expect bool
+	}{
+		{"CREATE INDEX CONCURRENTLY users_name ON users (name)", true},
+		{"create unique index concurrently if not exists users_email ON users (email)", true},
+		{"CREATE INDEX\n  CONCURRENTLY users_name ON users (name)", true},
+		{"DROP INDEX CONCURRENTLY users_name", true},
+		{"REINDEX INDEX CONCURRENTLY users_name", true},
+		{"VACUUM ANALYZE users", true},
+		{"CREATE DATABASE app", true},
+		{"ALTER SYSTEM SET work_mem = '64MB'", true},
+		{"CREATE INDEX users_name ON users (name)", false},
+		{"CREATE INDEX concurrently_built ON users (name)", false},
+		{"CREATE TABLE vacuum (a INT)", false},
+		{"INSERT INTO log VALUES ('CREATE INDEX CONCURRENTLY')", false},
+	}
+	for i, v := range tt {
+		if ok := NonTransactional([]byte(v.query)); ok != v.expect {
+			t.Errorf("expected %v for %q, got %v, in %v", v.expect, v.query, ok, i)
+		}
+	}
+}
+
+func TestAtomic(t *testing.T) {
+	tt := []struct {
+		migration string
+		expect    bool
+	}{
+		{"CREATE TABLE a (a INT); INSERT INTO a VALUES (1);", true},
+		{"BEGIN; CREATE TABLE a (a INT); COMMIT;", false},
+		{"CREATE TABLE a (a INT);\ncommit;\nINSERT INTO a VALUES (1);", false},
+		{"START TRANSACTION; CREATE TABLE a (a INT); END;", false},
+		{"CREATE TABLE a (a INT); ROLLBACK;", false},
+		{"CREATE INDEX CONCURRENTLY a_a ON a (a);", false},
+		{"CREATE FUNCTION f() RETURNS INT AS $$ BEGIN RETURN 1; END $$ LANGUAGE plpgsql;", true},
+		{"INSERT INTO log VALUES ('COMMIT'); -- COMMIT", true},
+		{"CREATE TABLE commits (a INT);", true},
+	}
+	for i, v := range tt {
+		if ok := Atomic([]byte(v.migration)); ok != v.expect {
+			t.Errorf("expected %v for %q, got %v, in %v", v.expect, v.migration, ok, i)
+		}
+	}
+}
+
+func TestBatches(t *testing.T) {
+	type batch struct {
+		query            string
+		line             int
+		nonTransactional bool
+	}
+
+	tt := []struct {
+		migration string
+		expect    []batch
+	}{
+		{"CREATE TABLE a (a INT);\nCREATE INDEX a_a ON a (a);", []batch{{"CREATE TABLE a (a INT);\nCREATE INDEX a_a ON a (a);", 1, false}}},
+		{
+			"CREATE TABLE a (a INT);\n-- index a\nALTER TABLE a ADD b INT;\nCREATE INDEX CONCURRENTLY a_a ON a (a);\nCREATE INDEX CONCURRENTLY a_b ON a (b);\nINSERT INTO a VALUES (1, 2);\n",
+			[]batch{
+				{"CREATE TABLE a (a INT);\n-- index a\nALTER TABLE a ADD b INT", 1, false},
+				{"CREATE INDEX CONCURRENTLY a_a ON a (a)", 4, true},
+				{"CREATE INDEX CONCURRENTLY a_b ON a (b)", 5, true},
+				{"INSERT INTO a VALUES (1, 2)", 6, false},
+			},
+		},
+		{"VACUUM a", []batch{{"VACUUM a", 1, true}}},
+	}
+
+	for i, v := range tt {
+		batches := Batches([]byte(v.migration))
+		if len(batches) != len(v.expect) {
+			t.Errorf("expected %v batches, got %+v, in %v", len(v.expect), batches, i)
+			continue
+		}
+		for n, b := range batches {
+			if string(b.Query) != v.expect[n].query || b.Line != v.expect[n].line || b.NonTransactional != v.expect[n].nonTransactional {
+				t.Errorf("expected batch %+v, got %q in line %v, non-transactional %v, in %v",
+					v.expect[n], b.Query, b.Line, b.NonTransactional, i)
+			}
+		}
+	}
+}
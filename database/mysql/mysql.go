@@ -1,6 +1,7 @@
 package mysql
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"database/sql"
@@ -10,14 +11,17 @@ import (
 	nurl "net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/vickxxx/migrate"
 	"github.com/vickxxx/migrate/database"
+	"github.com/vickxxx/migrate/database/multistmt"
 )
 
 func init() {
 	database.Register("mysql", &Mysql{})
+	database.Register("tidb", &Mysql{})
 }
 
 var DefaultMigrationsTable = "schema_migrations"
@@ -27,17 +31,63 @@ var (
 	ErrNilConfig      = fmt.Errorf("no config")
 	ErrNoDatabaseName = fmt.Errorf("no database name")
 	ErrAppendPEM      = fmt.Errorf("failed to append PEM")
+	ErrLockNameLength = fmt.Errorf("lock name longer than %v characters", maxLockNameLength)
 )
 
+// maxLockNameLength is the longest name GET_LOCK accepts since MySQL 5.7.
+const maxLockNameLength = 64
+
+// Flavors of MySQL compatible databases, which differ in how
+// migrations are run and locked.
+const (
+	FlavorMySQL = "mysql"
+	FlavorTiDB  = "tidb"
+)
+
+type ErrInvalidFlavor struct {
+	Flavor string
+}
+
+func (e ErrInvalidFlavor) Error() string {
+	return fmt.Sprintf("invalid database flavor %q, expected %v or %v", e.Flavor, FlavorMySQL, FlavorTiDB)
+}
+
 type Config struct {
 	MigrationsTable string
 	DatabaseName    string
+
+	// Flavor is FlavorMySQL, unless set to FlavorTiDB. TiDB runs the
+	// statements of a migration one by one, since it commits DDL
+	// statements implicitly, and holds the advisory lock on a dedicated
+	// connection, since GET_LOCK locks are bound to the session.
+	Flavor string
+
+	// DDLStrategy is set as @@ddl_strategy before each migration,
+	// i.e. `online` or `vitess`, so that Vitess and PlanetScale run
+	// its DDL statements as online schema changes. The statements of
+	// a migration then run one by one on the same connection.
+	DDLStrategy string
+
+	// LockName is the name of the GET_LOCK lock, which is shared by all
+	// schemas of the server. Defaults to a name derived from DatabaseName
+	// and MigrationsTable, so that migrations of other schemas or with
+	// other migrations tables don't block each other.
+	LockName string
+
+	// PingAttempts is the number of times WithInstance pings the database
+	// before giving up, waiting PingInterval in between, see
+	// database.PingWithRetry. Defaults to a single ping.
+	PingAttempts int
+	PingInterval time.Duration
 }
 
 type Mysql struct {
 	db       *sql.DB
 	isLocked bool
 
+	// lockConn is the connection holding the lock with FlavorTiDB
+	lockConn *sql.Conn
+
 	config *Config
 }
 
@@ -47,7 +97,19 @@ func WithInstance(instance *sql.DB, config *Config) (database.Driver, error) {
 		return nil, ErrNilConfig
 	}
 
-	if err := instance.Ping(); err != nil {
+	switch config.Flavor {
+	case "":
+		config.Flavor = FlavorMySQL
+	case FlavorMySQL, FlavorTiDB:
+	default:
+		return nil, ErrInvalidFlavor{config.Flavor}
+	}
+
+	if len(config.LockName) > maxLockNameLength {
+		return nil, ErrLockNameLength
+	}
+
+	if err := database.PingWithRetry(instance, config.PingAttempts, config.PingInterval); err != nil {
 		return nil, err
 	}
 
@@ -67,6 +129,15 @@ func WithInstance(instance *sql.DB, config *Config) (database.Driver, error) {
 		config.MigrationsTable = DefaultMigrationsTable
 	}
 
+	if len(config.LockName) == 0 {
+		lockName, err := database.GenerateAdvisoryLockId(
+			fmt.Sprintf("%s:%s", config.DatabaseName, config.MigrationsTable))
+		if err != nil {
+			return nil, err
+		}
+		config.LockName = lockName
+	}
+
 	mx := &Mysql{
 		db:     instance,
 		config: config,
@@ -80,6 +151,11 @@ func WithInstance(instance *sql.DB, config *Config) (database.Driver, error) {
 }
 
 func (m *Mysql) Open(url string) (database.Driver, error) {
+	url, err := database.RewriteURL(url)
+	if err != nil {
+		return nil, err
+	}
+
 	purl, err := nurl.Parse(url)
 	if err != nil {
 		return nil, err
@@ -89,8 +165,19 @@ func (m *Mysql) Open(url string) (database.Driver, error) {
 	q.Set("multiStatements", "true")
 	purl.RawQuery = q.Encode()
 
+	flavor := purl.Query().Get("x-database-flavor")
+	if len(flavor) == 0 && purl.Scheme == "tidb" {
+		flavor = FlavorTiDB
+	}
+
+	// the driver would set ddl_strategy as a session variable
+	// on connect, but Run sets it explicitly
+	ddlStrategy := q.Get("ddl_strategy")
+	q.Del("ddl_strategy")
+	purl.RawQuery = q.Encode()
+
 	db, err := sql.Open("mysql", strings.Replace(
-		url, "mysql://", "", 1))
+		migrate.FilterCustomQuery(purl).String(), purl.Scheme+"://", "", 1))
 	if err != nil {
 		return nil, err
 	}
@@ -136,9 +223,24 @@ func (m *Mysql) Open(url string) (database.Driver, error) {
 		}
 	}
 
+	pingAttempts, err := strconv.Atoi(purl.Query().Get("x-ping-attempts"))
+	if err != nil {
+		pingAttempts = 0
+	}
+
+	pingInterval, err := time.ParseDuration(purl.Query().Get("x-ping-interval"))
+	if err != nil {
+		pingInterval = 0
+	}
+
 	mx, err := WithInstance(db, &Config{
 		DatabaseName:    purl.Path,
 		MigrationsTable: migrationsTable,
+		Flavor:          flavor,
+		DDLStrategy:     ddlStrategy,
+		LockName:        purl.Query().Get("x-lock-name"),
+		PingAttempts:    pingAttempts,
+		PingInterval:    pingInterval,
 	})
 	if err != nil {
 		return nil, err
@@ -156,15 +258,13 @@ func (m *Mysql) Lock() error {
 		return database.ErrLocked
 	}
 
-	aid, err := database.GenerateAdvisoryLockId(
-		fmt.Sprintf("%s:%s", m.config.DatabaseName, m.config.MigrationsTable))
-	if err != nil {
-		return err
+	if m.config.Flavor == FlavorTiDB {
+		return m.lockTiDB(m.config.LockName)
 	}
 
 	query := "SELECT GET_LOCK(?, 1)"
 	var success bool
-	if err := m.db.QueryRow(query, aid).Scan(&success); err != nil {
+	if err := m.db.QueryRow(query, m.config.LockName).Scan(&success); err != nil {
 		return &database.Error{OrigErr: err, Err: "try lock failed", Query: []byte(query)}
 	}
 
@@ -176,19 +276,47 @@ func (m *Mysql) Lock() error {
 	return database.ErrLocked
 }
 
+// lockTiDB acquires the lock on a connection kept until Unlock,
+// so that it's released within the session holding it.
+func (m *Mysql) lockTiDB(aid string) error {
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return &database.Error{OrigErr: err, Err: "failed to acquire connection"}
+	}
+
+	query := "SELECT GET_LOCK(?, 1)"
+	var success bool
+	if err := conn.QueryRowContext(ctx, query, aid).Scan(&success); err != nil {
+		conn.Close()
+		return &database.Error{OrigErr: err, Err: "try lock failed", Query: []byte(query)}
+	}
+
+	if !success {
+		conn.Close()
+		return database.ErrLocked
+	}
+
+	m.lockConn = conn
+	m.isLocked = true
+	return nil
+}
+
 func (m *Mysql) Unlock() error {
 	if !m.isLocked {
 		return nil
 	}
 
-	aid, err := database.GenerateAdvisoryLockId(
-		fmt.Sprintf("%s:%s", m.config.DatabaseName, m.config.MigrationsTable))
-	if err != nil {
-		return err
-	}
-
+	var err error
 	query := `SELECT RELEASE_LOCK(?)`
-	if _, err := m.db.Exec(query, aid); err != nil {
+	if m.lockConn != nil {
+		_, err = m.lockConn.ExecContext(context.Background(), query, m.config.LockName)
+		m.lockConn.Close()
+		m.lockConn = nil
+	} else {
+		_, err = m.db.Exec(query, m.config.LockName)
+	}
+	if err != nil {
 		return &database.Error{OrigErr: err, Query: []byte(query)}
 	}
 
@@ -202,6 +330,19 @@ func (m *Mysql) Run(migration io.Reader) error {
 		return err
 	}
 
+	if len(m.config.DDLStrategy) > 0 {
+		return m.runWithDDLStrategy(migr)
+	}
+
+	if m.config.Flavor == FlavorTiDB {
+		for _, stmt := range multistmt.SplitMySQL(migr) {
+			if _, err := m.db.Exec(string(stmt.Query)); err != nil {
+				return database.Error{OrigErr: err, Err: "migration failed", Query: stmt.Query, Line: uint(stmt.Line)}
+			}
+		}
+		return nil
+	}
+
 	query := string(migr[:])
 	if _, err := m.db.Exec(query); err != nil {
 		return database.Error{OrigErr: err, Err: "migration failed", Query: migr}
@@ -210,19 +351,53 @@ func (m *Mysql) Run(migration io.Reader) error {
 	return nil
 }
 
+// runWithDDLStrategy sets @@ddl_strategy and runs the statements of
+// migr one by one on the same connection, since session variables
+// don't carry over to other connections of the pool.
+func (m *Mysql) runWithDDLStrategy(migr []byte) error {
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return &database.Error{OrigErr: err, Err: "failed to acquire connection"}
+	}
+	defer conn.Close()
+
+	query := "SET @@ddl_strategy = " + quoteString(m.config.DDLStrategy)
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return &database.Error{OrigErr: err, Err: "failed to set ddl strategy", Query: []byte(query)}
+	}
+
+	for _, stmt := range multistmt.SplitMySQL(migr) {
+		if _, err := conn.ExecContext(ctx, string(stmt.Query)); err != nil {
+			return database.Error{OrigErr: err, Err: "migration failed", Query: stmt.Query, Line: uint(stmt.Line)}
+		}
+	}
+	return nil
+}
+
+// quoteString quotes s as a MySQL string literal.
+func quoteString(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+	return "'" + r.Replace(s) + "'"
+}
+
 func (m *Mysql) SetVersion(version int, dirty bool) error {
+	if m.config.Flavor == FlavorTiDB {
+		return m.setVersionTiDB(version, dirty)
+	}
+
 	tx, err := m.db.Begin()
 	if err != nil {
 		return &database.Error{OrigErr: err, Err: "transaction start failed"}
 	}
 
-	query := "TRUNCATE `" + m.config.MigrationsTable + "`"
+	query := "TRUNCATE " + database.QuoteIdentifier("mysql", m.config.MigrationsTable)
 	if _, err := m.db.Exec(query); err != nil {
 		return &database.Error{OrigErr: err, Query: []byte(query)}
 	}
 
 	if version >= 0 {
-		query := "INSERT INTO `" + m.config.MigrationsTable + "` (version, dirty) VALUES (?, ?)"
+		query := "INSERT INTO " + database.QuoteIdentifier("mysql", m.config.MigrationsTable) + " (version, dirty) VALUES (?, ?)"
 		if _, err := m.db.Exec(query, version, dirty); err != nil {
 			tx.Rollback()
 			return &database.Error{OrigErr: err, Query: []byte(query)}
@@ -236,8 +411,38 @@ func (m *Mysql) SetVersion(version int, dirty bool) error {
 	return nil
 }
 
+// setVersionTiDB replaces the version within a transaction. It deletes
+// the previous version instead of truncating the table, since TiDB
+// commits the transaction on DDL statements like TRUNCATE.
+func (m *Mysql) setVersionTiDB(version int, dirty bool) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return &database.Error{OrigErr: err, Err: "transaction start failed"}
+	}
+
+	query := "DELETE FROM " + database.QuoteIdentifier("mysql", m.config.MigrationsTable)
+	if _, err := tx.Exec(query); err != nil {
+		tx.Rollback()
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+
+	if version >= 0 {
+		query = "INSERT INTO " + database.QuoteIdentifier("mysql", m.config.MigrationsTable) + " (version, dirty) VALUES (?, ?)"
+		if _, err := tx.Exec(query, version, dirty); err != nil {
+			tx.Rollback()
+			return &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return &database.Error{OrigErr: err, Err: "transaction commit failed"}
+	}
+
+	return nil
+}
+
 func (m *Mysql) Version() (version int, dirty bool, err error) {
-	query := "SELECT version, dirty FROM `" + m.config.MigrationsTable + "` LIMIT 1"
+	query := "SELECT version, dirty FROM " + database.QuoteIdentifier("mysql", m.config.MigrationsTable) + " LIMIT 1"
 	err = m.db.QueryRow(query).Scan(&version, &dirty)
 	switch {
 	case err == sql.ErrNoRows:
@@ -256,6 +461,12 @@ func (m *Mysql) Version() (version int, dirty bool, err error) {
 	}
 }
 
+// TransactionalDDL implements database.Transactional. DDL statements
+// cause an implicit commit, so a failed migration may be partially applied.
+func (m *Mysql) TransactionalDDL() bool {
+	return false
+}
+
 func (m *Mysql) Drop() error {
 	// select all tables
 	query := `SHOW TABLES LIKE '%'`
@@ -280,7 +491,7 @@ func (m *Mysql) Drop() error {
 	if len(tableNames) > 0 {
 		// delete one by one ...
 		for _, t := range tableNames {
-			query = "DROP TABLE IF EXISTS `" + t + "` CASCADE"
+			query = "DROP TABLE IF EXISTS " + database.QuoteIdentifier("mysql", t) + " CASCADE"
 			if _, err := m.db.Exec(query); err != nil {
 				return &database.Error{OrigErr: err, Query: []byte(query)}
 			}
@@ -306,7 +517,7 @@ func (m *Mysql) ensureVersionTable() error {
 	}
 
 	// if not, create the empty migration table
-	query = "CREATE TABLE `" + m.config.MigrationsTable + "` (version bigint not null primary key, dirty boolean not null)"
+	query = "CREATE TABLE " + database.QuoteIdentifier("mysql", m.config.MigrationsTable) + " (version bigint not null primary key, dirty boolean not null)"
 	if _, err := m.db.Exec(query); err != nil {
 		return &database.Error{OrigErr: err, Query: []byte(query)}
 	}
@@ -0,0 +1,104 @@
+// +build integration
+
+package mysql
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"testing"
+
+	"github.com/vickxxx/migrate/database"
+	dt "github.com/vickxxx/migrate/database/testing"
+	mt "github.com/vickxxx/migrate/testing"
+)
+
+// Run with: go test -tags integration -run TiDB ./database/mysql
+
+var tidbVersions = []mt.Version{
+	{Image: "pingcap/tidb:v7.5.0"},
+}
+
+func isReadyTiDB(i mt.Instance) bool {
+	db, err := sql.Open("mysql", fmt.Sprintf("root@tcp(%v:%v)/test", i.Host(), i.PortFor(4000)))
+	if err != nil {
+		return false
+	}
+	defer db.Close()
+	return db.Ping() == nil
+}
+
+func TestTiDB(t *testing.T) {
+	mt.ParallelTest(t, tidbVersions, isReadyTiDB,
+		func(t *testing.T, i mt.Instance) {
+			m := &Mysql{}
+			addr := fmt.Sprintf("tidb://root@tcp(%v:%v)/test", i.Host(), i.PortFor(4000))
+			d, err := m.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if flavor := d.(*Mysql).config.Flavor; flavor != FlavorTiDB {
+				t.Fatalf("expected flavor %v, got %v", FlavorTiDB, flavor)
+			}
+			dt.Test(t, d, []byte("SELECT 1"))
+		})
+}
+
+func TestTiDBMultiStatement(t *testing.T) {
+	mt.ParallelTest(t, tidbVersions, isReadyTiDB,
+		func(t *testing.T, i mt.Instance) {
+			m := &Mysql{}
+			addr := fmt.Sprintf("mysql://root@tcp(%v:%v)/test?x-database-flavor=tidb", i.Host(), i.PortFor(4000))
+			d, err := m.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			migration := "CREATE TABLE foo (foo TEXT);\nINSERT INTO foo VALUES ('a;b');\nCREATE TABLE `b;ar` (bar TEXT);\nSELECT * FROM missing;"
+			err = d.Run(bytes.NewReader([]byte(migration)))
+			e, ok := err.(database.Error)
+			if !ok {
+				t.Fatalf("expected database.Error, got %v", err)
+			}
+			if e.Line != 4 {
+				t.Fatalf("expected error in line 4, got %v", e.Line)
+			}
+
+			// the statements before the failing one are applied
+			var count int
+			if err := d.(*Mysql).db.QueryRow("SELECT COUNT(*) FROM `b;ar`").Scan(&count); err != nil {
+				t.Fatal(err)
+			}
+		})
+}
+
+func TestTiDBLock(t *testing.T) {
+	mt.ParallelTest(t, tidbVersions, isReadyTiDB,
+		func(t *testing.T, i mt.Instance) {
+			m := &Mysql{}
+			addr := fmt.Sprintf("tidb://root@tcp(%v:%v)/test", i.Host(), i.PortFor(4000))
+			d1, err := m.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			d2, err := m.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+
+			if err := d1.Lock(); err != nil {
+				t.Fatal(err)
+			}
+			if err := d2.Lock(); err == nil {
+				t.Fatal("expected second lock to fail while the first is held")
+			}
+			if err := d1.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+			if err := d2.Lock(); err != nil {
+				t.Fatal(err)
+			}
+			if err := d2.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+		})
+}
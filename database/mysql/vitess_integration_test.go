@@ -0,0 +1,71 @@
+// +build integration
+
+package mysql
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"testing"
+
+	mt "github.com/vickxxx/migrate/testing"
+)
+
+// Run with: go test -tags integration -run Vitess ./database/mysql
+
+// vttestserver serves MySQL on PORT + 3
+var vitessVersions = []mt.Version{
+	{
+		Image: "vitess/vttestserver:v17.0.0-mysql80",
+		ENV: []string{
+			"PORT=33574",
+			"KEYSPACES=test",
+			"NUM_SHARDS=1",
+			"MYSQL_BIND_HOST=0.0.0.0",
+		},
+	},
+}
+
+func isReadyVitess(i mt.Instance) bool {
+	db, err := sql.Open("mysql", fmt.Sprintf("root@tcp(%v:%v)/test", i.Host(), i.PortFor(33577)))
+	if err != nil {
+		return false
+	}
+	defer db.Close()
+	return db.Ping() == nil
+}
+
+func TestVitessDDLStrategy(t *testing.T) {
+	mt.ParallelTest(t, vitessVersions, isReadyVitess,
+		func(t *testing.T, i mt.Instance) {
+			m := &Mysql{}
+			addr := fmt.Sprintf("mysql://root@tcp(%v:%v)/test?ddl_strategy=online", i.Host(), i.PortFor(33577))
+			d, err := m.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			defer d.Close()
+			if strategy := d.(*Mysql).config.DDLStrategy; strategy != "online" {
+				t.Fatalf("expected ddl strategy online, got %v", strategy)
+			}
+
+			migration := "CREATE TABLE foo (id BIGINT PRIMARY KEY);\nALTER TABLE foo ADD COLUMN bar TEXT;"
+			if err := d.Run(bytes.NewReader([]byte(migration))); err != nil {
+				t.Fatal(err)
+			}
+
+			// online DDL is submitted as a schema migration
+			rows, err := d.(*Mysql).db.Query("SHOW VITESS_MIGRATIONS")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rows.Close()
+			count := 0
+			for rows.Next() {
+				count++
+			}
+			if count == 0 {
+				t.Fatal("expected online schema migrations")
+			}
+		})
+}
@@ -1,15 +1,20 @@
 package postgres
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
 	"io"
 	"io/ioutil"
 	nurl "net/url"
+	"strconv"
+	"time"
 
 	"github.com/lib/pq"
 	"github.com/vickxxx/migrate"
 	"github.com/vickxxx/migrate/database"
+	"github.com/vickxxx/migrate/database/multistmt"
 )
 
 func init() {
@@ -30,6 +35,17 @@ var (
 type Config struct {
 	MigrationsTable string
 	DatabaseName    string
+
+	// PingAttempts is the number of times WithInstance pings the database
+	// before giving up, waiting PingInterval in between, see
+	// database.PingWithRetry. Defaults to a single ping.
+	PingAttempts int
+	PingInterval time.Duration
+
+	// DisableTriggers runs every migration with session_replication_role
+	// set to replica, so that triggers don't fire, i.e. during bulk data
+	// migrations. It needs superuser privileges.
+	DisableTriggers bool
 }
 
 type Postgres struct {
@@ -45,7 +61,7 @@ func WithInstance(instance *sql.DB, config *Config) (database.Driver, error) {
 		return nil, ErrNilConfig
 	}
 
-	if err := instance.Ping(); err != nil {
+	if err := database.PingWithRetry(instance, config.PingAttempts, config.PingInterval); err != nil {
 		return nil, err
 	}
 
@@ -78,6 +94,11 @@ func WithInstance(instance *sql.DB, config *Config) (database.Driver, error) {
 }
 
 func (p *Postgres) Open(url string) (database.Driver, error) {
+	url, err := database.RewriteURL(url)
+	if err != nil {
+		return nil, err
+	}
+
 	purl, err := nurl.Parse(url)
 	if err != nil {
 		return nil, err
@@ -93,9 +114,27 @@ func (p *Postgres) Open(url string) (database.Driver, error) {
 		migrationsTable = DefaultMigrationsTable
 	}
 
+	pingAttempts, err := strconv.Atoi(purl.Query().Get("x-ping-attempts"))
+	if err != nil {
+		pingAttempts = 0
+	}
+
+	pingInterval, err := time.ParseDuration(purl.Query().Get("x-ping-interval"))
+	if err != nil {
+		pingInterval = 0
+	}
+
+	disableTriggers, err := strconv.ParseBool(purl.Query().Get("x-disable-triggers"))
+	if err != nil {
+		disableTriggers = false
+	}
+
 	px, err := WithInstance(db, &Config{
 		DatabaseName:    purl.Path,
 		MigrationsTable: migrationsTable,
+		PingAttempts:    pingAttempts,
+		PingInterval:    pingInterval,
+		DisableTriggers: disableTriggers,
 	})
 	if err != nil {
 		return nil, err
@@ -114,7 +153,7 @@ func (p *Postgres) Lock() error {
 		return database.ErrLocked
 	}
 
-	aid, err := database.GenerateAdvisoryLockId(p.config.DatabaseName)
+	aid, err := p.lockId()
 	if err != nil {
 		return err
 	}
@@ -135,12 +174,22 @@ func (p *Postgres) Lock() error {
 	return database.ErrLocked
 }
 
+// lockId returns the id of the advisory lock. Independent sets of
+// migrations with custom migrations tables in the same database
+// get a lock id of their own, so that they don't block each other.
+func (p *Postgres) lockId() (string, error) {
+	if p.config.MigrationsTable == DefaultMigrationsTable {
+		return database.GenerateAdvisoryLockId(p.config.DatabaseName)
+	}
+	return database.GenerateAdvisoryLockId(p.config.DatabaseName, p.config.MigrationsTable)
+}
+
 func (p *Postgres) Unlock() error {
 	if !p.isLocked {
 		return nil
 	}
 
-	aid, err := database.GenerateAdvisoryLockId(p.config.DatabaseName)
+	aid, err := p.lockId()
 	if err != nil {
 		return err
 	}
@@ -154,35 +203,118 @@ func (p *Postgres) Unlock() error {
 }
 
 func (p *Postgres) Run(migration io.Reader) error {
+	return p.run(context.Background(), migration)
+}
+
+// RunContext implements database.ContextRunner. The migration is canceled
+// when ctx is done, and if ctx has a deadline, it runs with
+// statement_timeout set to the time left, so that the server stops it
+// even if the cancel request is lost.
+func (p *Postgres) RunContext(ctx context.Context, version uint, migration io.Reader) error {
+	return p.run(ctx, migration)
+}
+
+// run runs a migration until ctx is done.
+func (p *Postgres) run(ctx context.Context, migration io.Reader) error {
 	migr, err := ioutil.ReadAll(migration)
 	if err != nil {
 		return err
 	}
 
-	// run migration
-	query := string(migr[:])
-	if _, err := p.db.Exec(query); err != nil {
-		// TODO: cast to postgress error and get line number
-		return database.Error{OrigErr: err, Err: "migration failed", Query: migr}
+	if _, ok := ctx.Deadline(); ok || p.config.DisableTriggers {
+		return p.runConn(ctx, migr)
 	}
 
+	// run migration
+	return execMigration(ctx, p.db, migr)
+}
+
+// execer is implemented by *sql.DB and *sql.Conn.
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// execMigration runs migr with e in a single query, which runs in an
+// implicit transaction. Statements that can't run in a transaction block,
+// i.e. CREATE INDEX CONCURRENTLY, run on their own between the batches of
+// the other statements, see multistmt.Batches.
+func execMigration(ctx context.Context, e execer, migr []byte) error {
+	batches := multistmt.Batches(migr)
+	for _, b := range batches {
+		if _, err := e.ExecContext(ctx, string(b.Query)); err != nil {
+			// TODO: cast to postgress error and get line number
+			if len(batches) == 1 {
+				return database.Error{OrigErr: err, Err: "migration failed", Query: b.Query}
+			}
+			return database.Error{OrigErr: err, Err: "migration failed", Query: b.Query, Line: uint(b.Line)}
+		}
+	}
 	return nil
 }
 
+// runConn runs migr on a single connection with session settings, which
+// are reset afterwards: with DisableTriggers, session_replication_role is
+// set to replica, and if ctx has a deadline, statement_timeout is set to
+// the time left.
+func (p *Postgres) runConn(ctx context.Context, migr []byte) (err error) {
+	conn, err := p.db.Conn(ctx)
+	if err != nil {
+		return &database.Error{OrigErr: err, Err: "failed to acquire connection"}
+	}
+	defer conn.Close()
+
+	if p.config.DisableTriggers {
+		query := `SET session_replication_role = replica`
+		if _, err := conn.ExecContext(ctx, query); err != nil {
+			return &database.Error{OrigErr: err, Err: "failed to disable triggers", Query: []byte(query)}
+		}
+		defer resetSetting(conn, "session_replication_role", "failed to enable triggers", &err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := time.Until(deadline).Milliseconds()
+		if timeout < 1 {
+			return context.DeadlineExceeded
+		}
+		query := fmt.Sprintf(`SET statement_timeout = %d`, timeout)
+		if _, err := conn.ExecContext(ctx, query); err != nil {
+			return &database.Error{OrigErr: err, Err: "failed to set statement timeout", Query: []byte(query)}
+		}
+		defer resetSetting(conn, "statement_timeout", "failed to reset statement timeout", &err)
+	}
+
+	return execMigration(ctx, conn, migr)
+}
+
+// resetSetting resets the session setting name of conn. If that fails,
+// the connection is discarded instead of going back to the pool, and
+// *err is set to a database.Error with message, unless it's set already.
+func resetSetting(conn *sql.Conn, name string, message string, err *error) {
+	query := `RESET ` + name
+	if _, rerr := conn.ExecContext(context.Background(), query); rerr != nil {
+		conn.Raw(func(interface{}) error {
+			return driver.ErrBadConn
+		})
+		if *err == nil {
+			*err = &database.Error{OrigErr: rerr, Err: message, Query: []byte(query)}
+		}
+	}
+}
+
 func (p *Postgres) SetVersion(version int, dirty bool) error {
 	tx, err := p.db.Begin()
 	if err != nil {
 		return &database.Error{OrigErr: err, Err: "transaction start failed"}
 	}
 
-	query := `TRUNCATE "` + p.config.MigrationsTable + `"`
+	query := `TRUNCATE ` + database.QuoteIdentifier("postgres", p.config.MigrationsTable)
 	if _, err := tx.Exec(query); err != nil {
 		tx.Rollback()
 		return &database.Error{OrigErr: err, Query: []byte(query)}
 	}
 
 	if version >= 0 {
-		query = `INSERT INTO "` + p.config.MigrationsTable + `" (version, dirty) VALUES ($1, $2)`
+		query = `INSERT INTO ` + database.QuoteIdentifier("postgres", p.config.MigrationsTable) + ` (version, dirty) VALUES ($1, $2)`
 		if _, err := tx.Exec(query, version, dirty); err != nil {
 			tx.Rollback()
 			return &database.Error{OrigErr: err, Query: []byte(query)}
@@ -197,17 +329,15 @@ func (p *Postgres) SetVersion(version int, dirty bool) error {
 }
 
 func (p *Postgres) Version() (version int, dirty bool, err error) {
-	query := `SELECT version, dirty FROM "` + p.config.MigrationsTable + `" LIMIT 1`
+	query := `SELECT version, dirty FROM ` + database.QuoteIdentifier("postgres", p.config.MigrationsTable) + ` LIMIT 1`
 	err = p.db.QueryRow(query).Scan(&version, &dirty)
 	switch {
 	case err == sql.ErrNoRows:
 		return database.NilVersion, false, nil
 
 	case err != nil:
-		if e, ok := err.(*pq.Error); ok {
-			if e.Code.Name() == "undefined_table" {
-				return database.NilVersion, false, nil
-			}
+		if p.IsUndefinedTable(err) {
+			return database.NilVersion, false, nil
 		}
 		return 0, false, &database.Error{OrigErr: err, Query: []byte(query)}
 
@@ -216,6 +346,53 @@ func (p *Postgres) Version() (version int, dirty bool, err error) {
 	}
 }
 
+// TransactionalDDL implements database.Transactional. A multi-statement
+// migration runs in a single implicit transaction.
+func (p *Postgres) TransactionalDDL() bool {
+	return true
+}
+
+// TransactionalMigration implements database.MigrationTransactional.
+// A migration with statements that can't run in a transaction block
+// runs in several batches, see multistmt.Batches, and one with BEGIN or
+// COMMIT statements of its own isn't atomic either.
+func (p *Postgres) TransactionalMigration(migration []byte) bool {
+	return multistmt.Atomic(migration)
+}
+
+// IsUndefinedTable implements database.ErrorClassifier.
+func (p *Postgres) IsUndefinedTable(err error) bool {
+	e, ok := database.OrigErr(err).(*pq.Error)
+	return ok && e.Code.Name() == "undefined_table"
+}
+
+// IsRetryable implements database.ErrorClassifier. Errors of class 40,
+// transaction rollback, i.e. serialization failures and deadlocks, are.
+func (p *Postgres) IsRetryable(err error) bool {
+	e, ok := database.OrigErr(err).(*pq.Error)
+	return ok && e.Code.Class() == "40"
+}
+
+// RoundTrip implements database.RoundTripper.
+func (p *Postgres) RoundTrip(up io.Reader, down io.Reader) error {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return &database.Error{OrigErr: err, Err: "transaction start failed"}
+	}
+	defer tx.Rollback()
+
+	for _, r := range []io.Reader{up, down} {
+		migr, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(string(migr)); err != nil {
+			return database.Error{OrigErr: err, Err: "migration failed", Query: migr}
+		}
+	}
+	return nil
+}
+
 func (p *Postgres) Drop() error {
 	// select all tables in current schema
 	query := `SELECT table_name FROM information_schema.tables WHERE table_schema=(SELECT current_schema())`
@@ -240,7 +417,7 @@ func (p *Postgres) Drop() error {
 	if len(tableNames) > 0 {
 		// delete one by one ...
 		for _, t := range tableNames {
-			query = `DROP TABLE IF EXISTS ` + t + ` CASCADE`
+			query = `DROP TABLE IF EXISTS ` + database.QuoteIdentifier("postgres", t) + ` CASCADE`
 			if _, err := p.db.Exec(query); err != nil {
 				return &database.Error{OrigErr: err, Query: []byte(query)}
 			}
@@ -265,7 +442,7 @@ func (p *Postgres) ensureVersionTable() error {
 	}
 
 	// if not, create the empty migration table
-	query = `CREATE TABLE "` + p.config.MigrationsTable + `" (version bigint not null primary key, dirty boolean not null)`
+	query = `CREATE TABLE ` + database.QuoteIdentifier("postgres", p.config.MigrationsTable) + ` (version bigint not null primary key, dirty boolean not null)`
 	if _, err := p.db.Exec(query); err != nil {
 		return &database.Error{OrigErr: err, Query: []byte(query)}
 	}
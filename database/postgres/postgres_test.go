@@ -4,12 +4,15 @@ package postgres
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"fmt"
 	"io"
 	"testing"
+	"time"
 
 	"github.com/lib/pq"
+	"github.com/vickxxx/migrate/database"
 	dt "github.com/vickxxx/migrate/database/testing"
 	mt "github.com/vickxxx/migrate/testing"
 )
@@ -90,6 +93,128 @@ func TestFilterCustomQuery(t *testing.T) {
 		})
 }
 
+func TestDisableTriggers(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			p := &Postgres{}
+			addr := fmt.Sprintf("postgres://postgres@%v:%v/postgres?sslmode=disable", i.Host(), i.Port())
+			d, err := p.Open(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			// every insert into a is logged by a trigger
+			setup := `CREATE TABLE a (a INT);
+				CREATE TABLE audit (a INT);
+				CREATE FUNCTION log_a() RETURNS trigger AS $$
+				BEGIN
+					INSERT INTO audit VALUES (NEW.a);
+					RETURN NEW;
+				END;
+				$$ LANGUAGE plpgsql;
+				CREATE TRIGGER log_a AFTER INSERT ON a FOR EACH ROW EXECUTE PROCEDURE log_a();`
+			if err := d.Run(bytes.NewReader([]byte(setup))); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.Run(bytes.NewReader([]byte("INSERT INTO a VALUES (1)"))); err != nil {
+				t.Fatal(err)
+			}
+
+			d2, err := p.Open(addr + "&x-disable-triggers=true")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d2.Close()
+			if err := d2.Run(bytes.NewReader([]byte("INSERT INTO a VALUES (2)"))); err != nil {
+				t.Fatal(err)
+			}
+
+			var logged int
+			if err := d.(*Postgres).db.QueryRow("SELECT count(*) FROM audit").Scan(&logged); err != nil {
+				t.Fatal(err)
+			}
+			if logged != 1 {
+				t.Fatalf("expected only the insert with triggers enabled to be logged, got %v", logged)
+			}
+
+			// the role is reset on the pooled connection
+			var role string
+			if err := d2.(*Postgres).db.QueryRow("SHOW session_replication_role").Scan(&role); err != nil {
+				t.Fatal(err)
+			}
+			if role != "origin" {
+				t.Fatalf("expected session_replication_role origin, got %v", role)
+			}
+		})
+}
+
+func TestRunContextTimeout(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			p := &Postgres{}
+			addr := fmt.Sprintf("postgres://postgres@%v:%v/postgres?sslmode=disable", i.Host(), i.Port())
+			d, err := p.Open(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			started := time.Now()
+			err = d.(database.ContextRunner).RunContext(ctx, 1, bytes.NewReader([]byte("SELECT pg_sleep(10)")))
+			if err == nil {
+				t.Fatal("expected the migration to exceed its timeout")
+			}
+			if elapsed := time.Since(started); elapsed > 5*time.Second {
+				t.Fatalf("expected the migration to be canceled, took %v", elapsed)
+			}
+
+			// the timeout is reset on the pooled connection
+			var timeout string
+			if err := d.(*Postgres).db.QueryRow("SHOW statement_timeout").Scan(&timeout); err != nil {
+				t.Fatal(err)
+			}
+			if timeout != "0" {
+				t.Fatalf("expected statement_timeout 0, got %v", timeout)
+			}
+		})
+}
+
+func TestConcurrentIndex(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			p := &Postgres{}
+			addr := fmt.Sprintf("postgres://postgres@%v:%v/postgres?sslmode=disable", i.Host(), i.Port())
+			d, err := p.Open(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			// fails inside the implicit transaction of a multi-statement query
+			migration := `CREATE TABLE a (a INT);
+				CREATE INDEX CONCURRENTLY a_a ON a (a);
+				INSERT INTO a VALUES (1);`
+			if d.(database.MigrationTransactional).TransactionalMigration([]byte(migration)) {
+				t.Fatal("expected migration not to run in a single transaction")
+			}
+			if err := d.Run(bytes.NewReader([]byte(migration))); err != nil {
+				t.Fatal(err)
+			}
+
+			var valid bool
+			query := `SELECT indisvalid FROM pg_index WHERE indexrelid = 'a_a'::regclass`
+			if err := d.(*Postgres).db.QueryRow(query).Scan(&valid); err != nil {
+				t.Fatal(err)
+			}
+			if !valid {
+				t.Fatal("expected index a_a to be built")
+			}
+		})
+}
+
 func TestWithSchema(t *testing.T) {
 	mt.ParallelTest(t, versions, isReady,
 		func(t *testing.T, i mt.Instance) {
@@ -145,6 +270,72 @@ func TestWithSchema(t *testing.T) {
 		})
 }
 
+func TestLockPerMigrationsTable(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			p := &Postgres{}
+			addr := fmt.Sprintf("postgres://postgres@%v:%v/postgres?sslmode=disable", i.Host(), i.Port())
+			billing, err := p.Open(addr + "&x-migrations-table=billing_migrations")
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			shipping, err := p.Open(addr + "&x-migrations-table=shipping_migrations")
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			billing2, err := p.Open(addr + "&x-migrations-table=billing_migrations")
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+
+			if err := billing.Lock(); err != nil {
+				t.Fatal(err)
+			}
+			if err := shipping.Lock(); err != nil {
+				t.Fatalf("expected independent migrations not to block each other, got %v", err)
+			}
+			if err := billing2.Lock(); err == nil {
+				t.Fatal("expected lock of the same migrations table to be held")
+			}
+
+			if err := billing.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+			if err := shipping.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+		})
+}
+
 func TestWithInstance(t *testing.T) {
 
 }
+
+func TestErrorClassifier(t *testing.T) {
+	tt := []struct {
+		err                  error
+		expectUndefinedTable bool
+		expectRetryable      bool
+	}{
+		{err: nil},
+		{err: fmt.Errorf("connection refused")},
+		{err: &pq.Error{Code: "42P01"}, expectUndefinedTable: true},
+		{err: &database.Error{OrigErr: &pq.Error{Code: "42P01"}, Query: []byte("SELECT 1")}, expectUndefinedTable: true},
+		{err: &pq.Error{Code: "42P07"}},
+		{err: &pq.Error{Code: "40001"}, expectRetryable: true},
+		{err: database.Error{OrigErr: &pq.Error{Code: "40P01"}}, expectRetryable: true},
+		// CockroachDB's retry error before 2.0 isn't known to PostgreSQL
+		{err: &pq.Error{Code: "CR000"}},
+	}
+
+	p := &Postgres{}
+	var _ database.ErrorClassifier = p
+	for i, v := range tt {
+		if undefined := p.IsUndefinedTable(v.err); undefined != v.expectUndefinedTable {
+			t.Errorf("expected IsUndefinedTable %v, got %v, in %v", v.expectUndefinedTable, undefined, i)
+		}
+		if retryable := p.IsRetryable(v.err); retryable != v.expectRetryable {
+			t.Errorf("expected IsRetryable %v, got %v, in %v", v.expectRetryable, retryable, i)
+		}
+	}
+}
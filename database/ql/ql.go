@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"strconv"
 	"strings"
+	"time"
 
 	nurl "net/url"
 
@@ -29,6 +31,12 @@ var (
 type Config struct {
 	MigrationsTable string
 	DatabaseName    string
+
+	// PingAttempts is the number of times WithInstance pings the database
+	// before giving up, waiting PingInterval in between, see
+	// database.PingWithRetry. Defaults to a single ping.
+	PingAttempts int
+	PingInterval time.Duration
 }
 
 type Ql struct {
@@ -43,7 +51,7 @@ func WithInstance(instance *sql.DB, config *Config) (database.Driver, error) {
 		return nil, ErrNilConfig
 	}
 
-	if err := instance.Ping(); err != nil {
+	if err := database.PingWithRetry(instance, config.PingAttempts, config.PingInterval); err != nil {
 		return nil, err
 	}
 	if len(config.MigrationsTable) == 0 {
@@ -80,6 +88,11 @@ func (m *Ql) ensureVersionTable() error {
 }
 
 func (m *Ql) Open(url string) (database.Driver, error) {
+	url, err := database.RewriteURL(url)
+	if err != nil {
+		return nil, err
+	}
+
 	purl, err := nurl.Parse(url)
 	if err != nil {
 		return nil, err
@@ -93,9 +106,21 @@ func (m *Ql) Open(url string) (database.Driver, error) {
 	if len(migrationsTable) == 0 {
 		migrationsTable = DefaultMigrationsTable
 	}
+	pingAttempts, err := strconv.Atoi(purl.Query().Get("x-ping-attempts"))
+	if err != nil {
+		pingAttempts = 0
+	}
+
+	pingInterval, err := time.ParseDuration(purl.Query().Get("x-ping-interval"))
+	if err != nil {
+		pingInterval = 0
+	}
+
 	mx, err := WithInstance(db, &Config{
 		DatabaseName:    purl.Path,
 		MigrationsTable: migrationsTable,
+		PingAttempts:    pingAttempts,
+		PingInterval:    pingInterval,
 	})
 	if err != nil {
 		return nil, err
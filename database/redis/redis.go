@@ -0,0 +1,261 @@
+// Package redis wraps a database driver, which runs the migrations, and
+// keeps the version and the lock in Redis instead of the database, i.e.
+// for a database that is reset often while the migration state of all
+// environments is kept in one place.
+package redis
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	nurl "net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/vickxxx/migrate"
+	"github.com/vickxxx/migrate/database"
+)
+
+func init() {
+	database.Register("redis", &Redis{})
+}
+
+var DefaultMigrationsKey = "schema_migrations"
+
+var (
+	ErrNilConfig  = fmt.Errorf("no config")
+	ErrNoDatabase = fmt.Errorf("no database")
+)
+
+// unlockScript deletes the lock key only as long as it holds our token.
+var unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+type Config struct {
+	// MigrationsKey is the key of the hash keeping the version and dirty
+	// flag, which never expires. The lock key gets the suffix ":lock".
+	MigrationsKey string
+
+	// LockTTL lets the lock key expire, so that a crashed migration
+	// doesn't keep the lock forever. It has to be longer than the longest
+	// migration. Zero means it never expires.
+	LockTTL time.Duration
+}
+
+type Redis struct {
+	client *redis.Client
+
+	// db is the wrapped driver running the migrations
+	db database.Driver
+
+	// random token of the lock key we set,
+	// used to only ever delete our own lock
+	lockToken string
+	isLocked  bool
+
+	// Open and WithInstance need to guarantee that config is never nil
+	config *Config
+}
+
+// WithInstance returns a driver running migrations with db and keeping
+// the version and lock with client.
+func WithInstance(client *redis.Client, db database.Driver, config *Config) (database.Driver, error) {
+	if config == nil {
+		return nil, ErrNilConfig
+	}
+	if db == nil {
+		return nil, ErrNoDatabase
+	}
+
+	if len(config.MigrationsKey) == 0 {
+		config.MigrationsKey = DefaultMigrationsKey
+	}
+
+	if err := client.Ping().Err(); err != nil {
+		return nil, err
+	}
+
+	return &Redis{
+		client: client,
+		db:     db,
+		config: config,
+	}, nil
+}
+
+// Open connects to Redis at redis://:password@host:port/db and opens the
+// database of the URL-encoded x-database query, i.e.
+// redis://localhost:6379/0?x-database=postgres%3A%2F%2Flocalhost%2Fapp
+func (r *Redis) Open(url string) (database.Driver, error) {
+	url, err := database.RewriteURL(url)
+	if err != nil {
+		return nil, err
+	}
+
+	purl, err := nurl.Parse(url)
+	if err != nil {
+		return nil, err
+	}
+
+	databaseURL := purl.Query().Get("x-database")
+	if len(databaseURL) == 0 {
+		return nil, ErrNoDatabase
+	}
+
+	lockTTL, err := time.ParseDuration(purl.Query().Get("x-lock-ttl"))
+	if err != nil {
+		lockTTL = 0
+	}
+
+	options, err := redis.ParseURL(migrate.FilterCustomQuery(purl).String())
+	if err != nil {
+		return nil, err
+	}
+	client := redis.NewClient(options)
+
+	db, err := database.Open(databaseURL)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	rd, err := WithInstance(client, db, &Config{
+		MigrationsKey: purl.Query().Get("x-migrations-key"),
+		LockTTL:       lockTTL,
+	})
+	if err != nil {
+		client.Close()
+		db.Close()
+		return nil, err
+	}
+
+	return rd, nil
+}
+
+// Close closes the wrapped database and the connection to Redis.
+func (r *Redis) Close() error {
+	dbErr := r.db.Close()
+	if err := r.client.Close(); err != nil {
+		return err
+	}
+	return dbErr
+}
+
+func (r *Redis) lockKey() string {
+	return r.config.MigrationsKey + ":lock"
+}
+
+// Lock sets the lock key to a random token, which fails if it's set
+// already. Unlock only deletes the key as long as it holds the token.
+func (r *Redis) Lock() error {
+	if r.isLocked {
+		return database.ErrLocked
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(b)
+
+	ok, err := r.client.SetNX(r.lockKey(), token, r.config.LockTTL).Result()
+	if err != nil {
+		return &database.Error{OrigErr: err, Err: "failed to set migration lock", Query: []byte(r.lockKey())}
+	}
+	if !ok {
+		return database.ErrLocked
+	}
+
+	r.lockToken = token
+	r.isLocked = true
+	return nil
+}
+
+func (r *Redis) Unlock() error {
+	if !r.isLocked {
+		return nil
+	}
+
+	// the lock is gone already if it expired, which deletes nothing
+	if err := unlockScript.Run(r.client, []string{r.lockKey()}, r.lockToken).Err(); err != nil {
+		return &database.Error{OrigErr: err, Err: "failed to release migration lock", Query: []byte(r.lockKey())}
+	}
+
+	r.isLocked = false
+	return nil
+}
+
+// ForceUnlock implements database.ForceUnlocker. It deletes the lock key,
+// which a crashed process may have left behind.
+func (r *Redis) ForceUnlock() error {
+	if err := r.client.Del(r.lockKey()).Err(); err != nil {
+		return &database.Error{OrigErr: err, Err: "failed to release migration lock", Query: []byte(r.lockKey())}
+	}
+	r.isLocked = false
+	return nil
+}
+
+// Run runs migration with the wrapped database.
+func (r *Redis) Run(migration io.Reader) error {
+	return r.db.Run(migration)
+}
+
+// RunVersion implements database.VersionRunner, passing the
+// version on if the wrapped database implements it as well.
+func (r *Redis) RunVersion(version uint, migration io.Reader) error {
+	if vr, ok := r.db.(database.VersionRunner); ok {
+		return vr.RunVersion(version, migration)
+	}
+	return r.db.Run(migration)
+}
+
+func (r *Redis) SetVersion(version int, dirty bool) error {
+	if version < 0 {
+		if err := r.client.Del(r.config.MigrationsKey).Err(); err != nil {
+			return &database.Error{OrigErr: err, Query: []byte(r.config.MigrationsKey)}
+		}
+		return nil
+	}
+
+	err := r.client.HMSet(r.config.MigrationsKey, map[string]interface{}{
+		"version": strconv.Itoa(version),
+		"dirty":   strconv.FormatBool(dirty),
+	}).Err()
+	if err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(r.config.MigrationsKey)}
+	}
+	return nil
+}
+
+func (r *Redis) Version() (version int, dirty bool, err error) {
+	fields, err := r.client.HGetAll(r.config.MigrationsKey).Result()
+	if err != nil {
+		return 0, false, &database.Error{OrigErr: err, Query: []byte(r.config.MigrationsKey)}
+	}
+	if len(fields) == 0 {
+		return database.NilVersion, false, nil
+	}
+
+	if version, err = strconv.Atoi(fields["version"]); err != nil {
+		return 0, false, fmt.Errorf("invalid version in %v: %v", r.config.MigrationsKey, err)
+	}
+	if dirty, err = strconv.ParseBool(fields["dirty"]); err != nil {
+		return 0, false, fmt.Errorf("invalid dirty flag in %v: %v", r.config.MigrationsKey, err)
+	}
+	return version, dirty, nil
+}
+
+// Drop drops the wrapped database and deletes the version key.
+func (r *Redis) Drop() error {
+	if err := r.db.Drop(); err != nil {
+		return err
+	}
+	if err := r.client.Del(r.config.MigrationsKey).Err(); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(r.config.MigrationsKey)}
+	}
+	return nil
+}
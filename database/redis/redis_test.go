@@ -0,0 +1,193 @@
+package redis
+
+import (
+	"fmt"
+	nurl "net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/vickxxx/migrate/database"
+	dStub "github.com/vickxxx/migrate/database/stub"
+	dt "github.com/vickxxx/migrate/database/testing"
+)
+
+// open opens a driver against s, wrapping the stub database.
+func open(t *testing.T, s *miniredis.Miniredis, query string) database.Driver {
+	t.Helper()
+	d, err := (&Redis{}).Open(fmt.Sprintf("redis://%v/0?x-database=%v%v", s.Addr(), nurl.QueryEscape("stub://"), query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func Test(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	d := open(t, s, "")
+	defer d.Close()
+	dt.Test(t, d, []byte("CREATE 1"))
+}
+
+func TestRun(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	d := open(t, s, "")
+	defer d.Close()
+	if err := d.(database.VersionRunner).RunVersion(1, strings.NewReader("CREATE 1")); err != nil {
+		t.Fatal(err)
+	}
+	stub := d.(*Redis).db.(*dStub.Stub)
+	if len(stub.MigrationSequence) != 1 || stub.MigrationSequence[0] != "CREATE 1" {
+		t.Fatalf("expected the stub database to run the migration, got %q", stub.MigrationSequence)
+	}
+}
+
+func TestVersionKey(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	d := open(t, s, "&x-migrations-key=app:migrations")
+	defer d.Close()
+	if err := d.SetVersion(3, true); err != nil {
+		t.Fatal(err)
+	}
+	if v := s.HGet("app:migrations", "version"); v != "3" {
+		t.Fatalf("expected version 3, got %q", v)
+	}
+	if dirty := s.HGet("app:migrations", "dirty"); dirty != "true" {
+		t.Fatalf("expected dirty true, got %q", dirty)
+	}
+	if ttl := s.TTL("app:migrations"); ttl != 0 {
+		t.Fatalf("expected the version key never to expire, got %v", ttl)
+	}
+
+	// the state is kept in Redis, not in the database
+	d2 := open(t, s, "&x-migrations-key=app:migrations")
+	defer d2.Close()
+	version, dirty, err := d2.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 3 || !dirty {
+		t.Fatalf("expected dirty version 3, got %v, %v", version, dirty)
+	}
+
+	if err := d.SetVersion(database.NilVersion, false); err != nil {
+		t.Fatal(err)
+	}
+	if s.Exists("app:migrations") {
+		t.Fatal("expected the version key to be deleted")
+	}
+}
+
+func TestLockTTL(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	d := open(t, s, "&x-lock-ttl=1m")
+	defer d.Close()
+	d2 := open(t, s, "&x-lock-ttl=1m")
+	defer d2.Close()
+
+	if err := d.Lock(); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := s.TTL(DefaultMigrationsKey + ":lock"); ttl != time.Minute {
+		t.Fatalf("expected the lock to expire after 1m, got %v", ttl)
+	}
+	if err := d2.Lock(); err != database.ErrLocked {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+
+	// the lock of a crashed process expires
+	s.FastForward(time.Minute)
+	if err := d2.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the expired lock isn't ours anymore, unlocking leaves it alone
+	if err := d.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Exists(DefaultMigrationsKey + ":lock") {
+		t.Fatal("expected the lock of the other driver to be kept")
+	}
+	if err := d2.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Exists(DefaultMigrationsKey + ":lock") {
+		t.Fatal("expected the lock to be released")
+	}
+}
+
+func TestForceUnlock(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// a crashed process left its lock behind
+	if err := s.Set(DefaultMigrationsKey+":lock", "crashed"); err != nil {
+		t.Fatal(err)
+	}
+
+	d := open(t, s, "")
+	defer d.Close()
+	if err := d.Lock(); err != database.ErrLocked {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+	if err := d.(database.ForceUnlocker).ForceUnlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Lock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWithInstance(t *testing.T) {
+	if _, err := WithInstance(nil, &dStub.Stub{}, nil); err != ErrNilConfig {
+		t.Fatalf("expected ErrNilConfig, got %v", err)
+	}
+	if _, err := WithInstance(nil, nil, &Config{}); err != ErrNoDatabase {
+		t.Fatalf("expected ErrNoDatabase, got %v", err)
+	}
+	if _, err := (&Redis{}).Open("redis://localhost:6379/0"); err != ErrNoDatabase {
+		t.Fatalf("expected ErrNoDatabase, got %v", err)
+	}
+}
+
+func TestURLRewriter(t *testing.T) {
+	errRewrite := fmt.Errorf("rewrite failed")
+	var rewritten string
+	database.SetURLRewriter(func(url string) (string, error) {
+		rewritten = url
+		return "", errRewrite
+	})
+	defer database.SetURLRewriter(nil)
+
+	addr := "redis://:secret@localhost:6379/0?x-database=stub%3A%2F%2F"
+	if _, err := (&Redis{}).Open(addr); err != errRewrite {
+		t.Fatalf("expected %v, got %v", errRewrite, err)
+	}
+	if rewritten != addr {
+		t.Fatalf("expected rewriter to be called with %v, got %v", addr, rewritten)
+	}
+}
@@ -83,6 +83,11 @@ func WithInstance(instance *DB, config *Config) (database.Driver, error) {
 
 // Open implements database.Driver
 func (s *Spanner) Open(url string) (database.Driver, error) {
+	url, err := database.RewriteURL(url)
+	if err != nil {
+		return nil, err
+	}
+
 	purl, err := nurl.Parse(url)
 	if err != nil {
 		return nil, err
@@ -0,0 +1,29 @@
+//go:build go1.16
+// +build go1.16
+
+package sqlite3
+
+import (
+	"database/sql"
+	"io/fs"
+
+	"github.com/vickxxx/migrate"
+)
+
+// NewWithSourceAndInstance returns a new Migrate instance running the
+// migrations in the directory dir of fsys, i.e. embedded with go:embed,
+// against instance, in one call instead of building URLs:
+//
+//	//go:embed migrations
+//	var migrations embed.FS
+//
+//	m, err := sqlite3.NewWithSourceAndInstance(migrations, "migrations", db, &sqlite3.Config{})
+//
+// Closing the Migrate instance closes instance as well.
+func NewWithSourceAndInstance(fsys fs.FS, dir string, instance *sql.DB, config *Config) (*migrate.Migrate, error) {
+	driver, err := WithInstance(instance, config)
+	if err != nil {
+		return nil, err
+	}
+	return migrate.NewWithSourceAndInstance(fsys, dir, "sqlite3", driver)
+}
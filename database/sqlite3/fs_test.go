@@ -0,0 +1,53 @@
+//go:build go1.16
+// +build go1.16
+
+package sqlite3
+
+import (
+	"database/sql"
+	"testing"
+	"testing/fstest"
+)
+
+func TestNewWithSourceAndInstance(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/1_users.up.sql":   {Data: []byte("CREATE TABLE users (id INTEGER PRIMARY KEY);")},
+		"migrations/1_users.down.sql": {Data: []byte("DROP TABLE users;")},
+		"migrations/2_email.up.sql":   {Data: []byte("ALTER TABLE users ADD COLUMN email TEXT;")},
+		"migrations/2_email.down.sql": {Data: []byte("CREATE TABLE users_new (id INTEGER PRIMARY KEY); DROP TABLE users; ALTER TABLE users_new RENAME TO users;")},
+	}
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to :memory: is a database of its own
+	db.SetMaxOpenConns(1)
+
+	m, err := NewWithSourceAndInstance(fsys, "migrations", db, &Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO users (id, email) VALUES (1, 'a@example.com')"); err != nil {
+		t.Fatal(err)
+	}
+	version, dirty, err := m.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 || dirty {
+		t.Fatalf("expected clean version 2, got %v (dirty %v)", version, dirty)
+	}
+
+	if err := m.Steps(-1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("INSERT INTO users (id, email) VALUES (2, 'b@example.com')"); err == nil {
+		t.Fatal("expected the email column to be dropped")
+	}
+}
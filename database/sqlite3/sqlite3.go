@@ -1,15 +1,19 @@
 package sqlite3
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
 	"github.com/vickxxx/migrate"
 	"github.com/vickxxx/migrate/database"
-	_ "github.com/mattn/go-sqlite3"
+	gosqlite3 "github.com/mattn/go-sqlite3"
 	"io"
 	"io/ioutil"
 	nurl "net/url"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func init() {
@@ -26,6 +30,12 @@ var (
 type Config struct {
 	MigrationsTable string
 	DatabaseName    string
+
+	// PingAttempts is the number of times WithInstance pings the database
+	// before giving up, waiting PingInterval in between, see
+	// database.PingWithRetry. Defaults to a single ping.
+	PingAttempts int
+	PingInterval time.Duration
 }
 
 type Sqlite struct {
@@ -40,7 +50,7 @@ func WithInstance(instance *sql.DB, config *Config) (database.Driver, error) {
 		return nil, ErrNilConfig
 	}
 
-	if err := instance.Ping(); err != nil {
+	if err := database.PingWithRetry(instance, config.PingAttempts, config.PingInterval); err != nil {
 		return nil, err
 	}
 	if len(config.MigrationsTable) == 0 {
@@ -62,7 +72,7 @@ func (m *Sqlite) ensureVersionTable() error {
 	query := fmt.Sprintf(`
 	CREATE TABLE IF NOT EXISTS %s (version uint64,dirty bool);
   CREATE UNIQUE INDEX IF NOT EXISTS version_unique ON %s (version);
-  `, DefaultMigrationsTable, DefaultMigrationsTable)
+  `, database.QuoteIdentifier("sqlite3", DefaultMigrationsTable), database.QuoteIdentifier("sqlite3", DefaultMigrationsTable))
 
 	if _, err := m.db.Exec(query); err != nil {
 		return err
@@ -71,23 +81,53 @@ func (m *Sqlite) ensureVersionTable() error {
 }
 
 func (m *Sqlite) Open(url string) (database.Driver, error) {
-	purl, err := nurl.Parse(url)
+	url, err := database.RewriteURL(url)
 	if err != nil {
 		return nil, err
 	}
-	dbfile := strings.Replace(migrate.FilterCustomQuery(purl).String(), "sqlite3://", "", 1)
-	db, err := sql.Open("sqlite3", dbfile)
+
+	purl, err := nurl.Parse(url)
 	if err != nil {
 		return nil, err
 	}
+	furl := migrate.FilterCustomQuery(purl)
+	key := purl.Query().Get("_key")
+	if len(key) > 0 {
+		q := furl.Query()
+		q.Del("_key")
+		furl.RawQuery = q.Encode()
+	}
+	dbfile := strings.Replace(furl.String(), "sqlite3://", "", 1)
+
+	var db *sql.DB
+	if len(key) > 0 {
+		db = sql.OpenDB(&keyConnector{dsn: dbfile, key: key})
+	} else {
+		db, err = sql.Open("sqlite3", dbfile)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	migrationsTable := purl.Query().Get("x-migrations-table")
 	if len(migrationsTable) == 0 {
 		migrationsTable = DefaultMigrationsTable
 	}
+	pingAttempts, err := strconv.Atoi(purl.Query().Get("x-ping-attempts"))
+	if err != nil {
+		pingAttempts = 0
+	}
+
+	pingInterval, err := time.ParseDuration(purl.Query().Get("x-ping-interval"))
+	if err != nil {
+		pingInterval = 0
+	}
+
 	mx, err := WithInstance(db, &Config{
 		DatabaseName:    purl.Path,
 		MigrationsTable: migrationsTable,
+		PingAttempts:    pingAttempts,
+		PingInterval:    pingInterval,
 	})
 	if err != nil {
 		return nil, err
@@ -95,6 +135,31 @@ func (m *Sqlite) Open(url string) (database.Driver, error) {
 	return mx, nil
 }
 
+// keyConnector opens connections to a database encrypted with SQLCipher,
+// unlocking each one with key before it's used.
+type keyConnector struct {
+	dsn string
+	key string
+}
+
+func (c *keyConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Driver().Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	query := "PRAGMA key = '" + strings.Replace(c.key, "'", "''", -1) + "'"
+	if _, err := conn.(*gosqlite3.SQLiteConn).Exec(query, nil); err != nil {
+		conn.Close()
+		return nil, &database.Error{OrigErr: err, Err: "failed to set key"}
+	}
+	return conn, nil
+}
+
+func (c *keyConnector) Driver() driver.Driver {
+	return &gosqlite3.SQLiteDriver{}
+}
+
 func (m *Sqlite) Close() error {
 	return m.db.Close()
 }
@@ -117,12 +182,8 @@ func (m *Sqlite) Drop() error {
 		}
 	}
 	if len(tableNames) > 0 {
-		for _, t := range tableNames {
-			query := "DROP TABLE " + t
-			err = m.executeQuery(query)
-			if err != nil {
-				return &database.Error{OrigErr: err, Query: []byte(query)}
-			}
+		if err := m.dropTables(tableNames); err != nil {
+			return err
 		}
 		if err := m.ensureVersionTable(); err != nil {
 			return err
@@ -137,6 +198,56 @@ func (m *Sqlite) Drop() error {
 	return nil
 }
 
+// dropTables drops the given tables with foreign key enforcement disabled,
+// so that the order of tableNames doesn't matter. The pragma is scoped to a
+// single connection and can't be changed inside a transaction, so all
+// statements run on one dedicated connection.
+func (m *Sqlite) dropTables(tableNames []string) (err error) {
+	ctx := context.Background()
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return &database.Error{OrigErr: err, Err: "failed to acquire connection"}
+	}
+	defer conn.Close()
+
+	var foreignKeys bool
+	query := "PRAGMA foreign_keys"
+	if err := conn.QueryRowContext(ctx, query).Scan(&foreignKeys); err != nil {
+		return &database.Error{OrigErr: err, Query: []byte(query)}
+	}
+
+	if foreignKeys {
+		query = "PRAGMA foreign_keys = OFF"
+		if _, err := conn.ExecContext(ctx, query); err != nil {
+			return &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+		defer enableForeignKeys(conn, &err)
+	}
+
+	for _, t := range tableNames {
+		query = "DROP TABLE " + database.QuoteIdentifier("sqlite3", t)
+		if _, err := conn.ExecContext(ctx, query); err != nil {
+			return &database.Error{OrigErr: err, Query: []byte(query)}
+		}
+	}
+	return nil
+}
+
+// enableForeignKeys turns foreign keys of conn back on. If that fails, the
+// connection is discarded instead of going back to the pool with foreign
+// keys off, and *err is set to a database.Error, unless it's set already.
+func enableForeignKeys(conn *sql.Conn, err *error) {
+	query := "PRAGMA foreign_keys = ON"
+	if _, ferr := conn.ExecContext(context.Background(), query); ferr != nil {
+		conn.Raw(func(interface{}) error {
+			return driver.ErrBadConn
+		})
+		if *err == nil {
+			*err = &database.Error{OrigErr: ferr, Err: "failed to enable foreign keys", Query: []byte(query)}
+		}
+	}
+}
+
 func (m *Sqlite) Lock() error {
 	if m.isLocked {
 		return database.ErrLocked
@@ -184,13 +295,13 @@ func (m *Sqlite) SetVersion(version int, dirty bool) error {
 		return &database.Error{OrigErr: err, Err: "transaction start failed"}
 	}
 
-	query := "DELETE FROM " + m.config.MigrationsTable
+	query := "DELETE FROM " + database.QuoteQualifiedIdentifier("sqlite3", m.config.MigrationsTable)
 	if _, err := tx.Exec(query); err != nil {
 		return &database.Error{OrigErr: err, Query: []byte(query)}
 	}
 
 	if version >= 0 {
-		query := fmt.Sprintf(`INSERT INTO %s (version, dirty) VALUES (%d, '%t')`, m.config.MigrationsTable, version, dirty)
+		query := fmt.Sprintf(`INSERT INTO %s (version, dirty) VALUES (%d, '%t')`, database.QuoteQualifiedIdentifier("sqlite3", m.config.MigrationsTable), version, dirty)
 		if _, err := tx.Exec(query); err != nil {
 			tx.Rollback()
 			return &database.Error{OrigErr: err, Query: []byte(query)}
@@ -205,7 +316,7 @@ func (m *Sqlite) SetVersion(version int, dirty bool) error {
 }
 
 func (m *Sqlite) Version() (version int, dirty bool, err error) {
-	query := "SELECT version, dirty FROM " + m.config.MigrationsTable + " LIMIT 1"
+	query := "SELECT version, dirty FROM " + database.QuoteQualifiedIdentifier("sqlite3", m.config.MigrationsTable) + " LIMIT 1"
 	err = m.db.QueryRow(query).Scan(&version, &dirty)
 	if err != nil {
 		return database.NilVersion, false, nil
@@ -0,0 +1,68 @@
+// +build sqlcipher
+
+package sqlite3
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Run with SQLCipher, see README.md:
+// go test -tags "sqlcipher libsqlite3" -run SQLCipher ./database/sqlite3
+
+func TestSQLCipher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite3-driver-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbfile := filepath.Join(dir, "encrypted.db")
+
+	p := &Sqlite{}
+	d, err := p.Open(fmt.Sprintf("sqlite3://%s?_key=secret", dbfile))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := d.Run(bytes.NewReader([]byte("CREATE TABLE t (id INTEGER PRIMARY KEY);"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetVersion(1, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the database can't be read without the key
+	db, err := sql.Open("sqlite3", dbfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master").Scan(&count); err == nil {
+		t.Fatal("expected err reading encrypted database without key")
+	}
+
+	if _, err := p.Open(fmt.Sprintf("sqlite3://%s?_key=wrong", dbfile)); err == nil {
+		t.Fatal("expected err opening encrypted database with wrong key")
+	}
+
+	d, err = p.Open(fmt.Sprintf("sqlite3://%s?_key=secret", dbfile))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer d.Close()
+	version, dirty, err := d.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 1 || dirty {
+		t.Fatalf("expected version 1, not dirty, got %v, %v", version, dirty)
+	}
+}
@@ -1,6 +1,7 @@
 package sqlite3
 
 import (
+	"bytes"
 	"database/sql"
 	"fmt"
 	"github.com/vickxxx/migrate"
@@ -59,3 +60,124 @@ func Test(t *testing.T) {
 		t.Fatalf("%v", err)
 	}
 }
+
+func TestDropWithForeignKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite3-driver-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p := &Sqlite{}
+	addr := fmt.Sprintf("sqlite3://%s?_foreign_keys=1", filepath.Join(dir, "sqlite3.db"))
+	d, err := p.Open(addr)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer d.Close()
+
+	migration := `
+	CREATE TABLE parent (id INTEGER PRIMARY KEY);
+	CREATE TABLE child (id INTEGER PRIMARY KEY, parent_id INTEGER REFERENCES parent(id));
+	INSERT INTO parent (id) VALUES (1);
+	INSERT INTO child (id, parent_id) VALUES (1, 1);`
+	if err := d.Run(bytes.NewReader([]byte(migration))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Drop(); err != nil {
+		t.Fatal(err)
+	}
+
+	var foreignKeys bool
+	if err := d.(*Sqlite).db.QueryRow("PRAGMA foreign_keys").Scan(&foreignKeys); err != nil {
+		t.Fatal(err)
+	}
+	if !foreignKeys {
+		t.Fatal("expected foreign keys to be enabled again after Drop")
+	}
+}
+
+func TestOpenWithKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite3-driver-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// without SQLCipher the key is ignored, but every connection is set up with it
+	p := &Sqlite{}
+	addr := fmt.Sprintf("sqlite3://%s?_key=it's%%20secret&_foreign_keys=1", filepath.Join(dir, "sqlite3.db"))
+	d, err := p.Open(addr)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer d.Close()
+	dt.Test(t, d, []byte("CREATE TABLE t (Qty int, Name string);"))
+}
+
+func TestQualifiedMigrationsTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite3-driver-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the migrations table qualified by the schema of the main database
+	p := &Sqlite{}
+	addr := fmt.Sprintf("sqlite3://%s?x-migrations-table=main.schema_migrations", filepath.Join(dir, "sqlite3.db"))
+	d, err := p.Open(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if err := d.SetVersion(3, false); err != nil {
+		t.Fatal(err)
+	}
+	version, dirty, err := d.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 3 || dirty {
+		t.Fatalf("expected clean version 3, got %v, %v", version, dirty)
+	}
+}
+
+func TestSharded(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sqlite3-driver-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	shards := make([]*migrate.Migrate, 2)
+	for i := range shards {
+		m, err := migrate.New("file://./migration", fmt.Sprintf("sqlite3://%s", filepath.Join(dir, fmt.Sprintf("shard%v.db", i))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		shards[i] = m
+	}
+	// shard 1 is a migration behind
+	if err := shards[1].Migrate(33); err != nil {
+		t.Fatal(err)
+	}
+
+	s := migrate.NewSharded(shards)
+	defer s.Close()
+	s.SetConcurrency(2)
+	results, err := s.Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range results {
+		if r.Shard != i || r.Version != 44 || r.Dirty || !r.Changed || r.Err != nil {
+			t.Fatalf("expected shard %v at version 44, got %+v", i, r)
+		}
+	}
+
+	if _, err := s.Up(); err != migrate.ErrNoChange {
+		t.Fatalf("expected ErrNoChange, got %v", err)
+	}
+}
@@ -1,15 +1,130 @@
 package database
 
 import (
+	"database/sql"
 	"fmt"
 	"hash/crc32"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
 )
 
 const advisoryLockIdSalt uint = 1486364155
 
+// Backoff computes the waits between attempts to acquire a lock held by
+// another process. The wait doubles with every attempt up to max and is
+// jittered within its upper half, so that processes started at the same
+// time don't poll in lockstep.
+type Backoff struct {
+	base    time.Duration
+	max     time.Duration
+	attempt uint
+	rand    *rand.Rand
+}
+
+// NewBackoff returns a Backoff starting with waits up to base.
+func NewBackoff(base time.Duration, max time.Duration) *Backoff {
+	return &Backoff{
+		base: base,
+		max:  max,
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Next returns the wait before the next attempt.
+func (b *Backoff) Next() time.Duration {
+	d := b.base << b.attempt
+	if d <= 0 || d > b.max || d>>b.attempt != b.base {
+		d = b.max
+	} else {
+		b.attempt++
+	}
+
+	half := d / 2
+	if half <= 0 {
+		return d
+	}
+	return half + time.Duration(b.rand.Int63n(int64(half)))
+}
+
+// DefaultPingInterval is the pause between two pings of PingWithRetry,
+// unless a driver is configured otherwise.
+var DefaultPingInterval = time.Second
+
+// PingWithRetry pings db up to attempts times, waiting interval between
+// two attempts, so that SQL drivers opening a database that is briefly
+// unreachable, i.e. while its container starts, don't fail right away.
+// Fewer than one attempt is one, no interval is DefaultPingInterval.
+// It returns the error of the last attempt.
+func PingWithRetry(db *sql.DB, attempts int, interval time.Duration) error {
+	if interval <= 0 {
+		interval = DefaultPingInterval
+	}
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = db.Ping(); err == nil || attempt >= attempts {
+			return err
+		}
+		time.Sleep(interval)
+	}
+}
+
 // inspired by rails migrations, see https://goo.gl/8o9bCT
-func GenerateAdvisoryLockId(databaseName string) (string, error) {
+// additionalNames, i.e. a custom migrations table, give independent
+// sets of migrations in the same database a lock id of their own.
+func GenerateAdvisoryLockId(databaseName string, additionalNames ...string) (string, error) {
+	if len(additionalNames) > 0 {
+		databaseName = strings.Join(append(additionalNames, databaseName), "\x00")
+	}
 	sum := crc32.ChecksumIEEE([]byte(databaseName))
 	sum = sum * uint32(advisoryLockIdSalt)
 	return fmt.Sprintf("%v", sum), nil
 }
+
+// quoteStyle holds the characters enclosing a quoted identifier.
+type quoteStyle struct {
+	open  string
+	close string
+}
+
+var quoteStylesMu sync.RWMutex
+var quoteStyles = map[string]quoteStyle{
+	"mysql":      {"`", "`"},
+	"clickhouse": {"`", "`"},
+	"spanner":    {"`", "`"},
+	"sqlserver":  {"[", "]"},
+}
+
+// SetIdentifierQuotes sets the characters QuoteIdentifier encloses identifiers
+// of driver in. Drivers not set use ANSI double quotes.
+func SetIdentifierQuotes(driver string, open string, close string) {
+	quoteStylesMu.Lock()
+	defer quoteStylesMu.Unlock()
+	quoteStyles[driver] = quoteStyle{open, close}
+}
+
+// QuoteIdentifier quotes ident for use as a table or column name in queries
+// of driver, i.e. "postgres" or "mysql". Closing quotes within ident are
+// escaped by doubling them. Dots are part of the name, see
+// QuoteQualifiedIdentifier for schema-qualified names.
+func QuoteIdentifier(driver string, ident string) string {
+	quoteStylesMu.RLock()
+	style, ok := quoteStyles[driver]
+	quoteStylesMu.RUnlock()
+	if !ok {
+		style = quoteStyle{`"`, `"`}
+	}
+	return style.open + strings.Replace(ident, style.close, style.close+style.close, -1) + style.close
+}
+
+// QuoteQualifiedIdentifier quotes name, which may be qualified by a schema
+// or database, i.e. app.schema_migrations, by quoting each of its parts
+// separated by dots with QuoteIdentifier.
+func QuoteQualifiedIdentifier(driver string, name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = QuoteIdentifier(driver, part)
+	}
+	return strings.Join(parts, ".")
+}
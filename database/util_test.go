@@ -1,7 +1,18 @@
 package database
 
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
 func TestGenerateAdvisoryLockId(t *testing.T) {
-	id, err := p.generateAdvisoryLockId("database_name")
+	id, err := GenerateAdvisoryLockId("database_name")
 	if err != nil {
 		t.Errorf("expected err to be nil, got %v", err)
 	}
@@ -9,4 +20,148 @@ func TestGenerateAdvisoryLockId(t *testing.T) {
 		t.Errorf("expected generated id not to be empty")
 	}
 	t.Logf("generated id: %v", id)
+
+	same, _ := GenerateAdvisoryLockId("database_name")
+	other, _ := GenerateAdvisoryLockId("database_name", "component_migrations")
+	if same != id {
+		t.Errorf("expected the same id for the same database, got %v and %v", id, same)
+	}
+	if other == id {
+		t.Errorf("expected another id for another migrations table, got %v", other)
+	}
+}
+
+func TestQuoteIdentifier(t *testing.T) {
+	tt := []struct {
+		driver string
+		ident  string
+		expect string
+	}{
+		{driver: "postgres", ident: "schema_migrations", expect: `"schema_migrations"`},
+		{driver: "postgres", ident: `my"table`, expect: `"my""table"`},
+		{driver: "cockroachdb", ident: "my.table", expect: `"my.table"`},
+		{driver: "mysql", ident: "my`table", expect: "`my``table`"},
+		{driver: "mysql", ident: "my.table", expect: "`my.table`"},
+		{driver: "mysql", ident: `my"table`, expect: "`my\"table`"},
+		{driver: "sqlserver", ident: "my]table", expect: "[my]]table]"},
+	}
+
+	for i, v := range tt {
+		if q := QuoteIdentifier(v.driver, v.ident); q != v.expect {
+			t.Errorf("expected %v, got %v, in %v", v.expect, q, i)
+		}
+	}
+}
+
+func TestQuoteQualifiedIdentifier(t *testing.T) {
+	tt := []struct {
+		driver string
+		name   string
+		expect string
+	}{
+		{driver: "cockroachdb", name: "schema_migrations", expect: `"schema_migrations"`},
+		{driver: "cockroachdb", name: "app.locks", expect: `"app"."locks"`},
+		{driver: "cockroachdb", name: "trackdb.public.schema_migrations", expect: `"trackdb"."public"."schema_migrations"`},
+		{driver: "cockroachdb", name: `my"schema.my"table`, expect: `"my""schema"."my""table"`},
+		{driver: "sqlite3", name: "main.schema_migrations", expect: `"main"."schema_migrations"`},
+		{driver: "mysql", name: "app.my`table", expect: "`app`.`my``table`"},
+	}
+
+	for i, v := range tt {
+		if q := QuoteQualifiedIdentifier(v.driver, v.name); q != v.expect {
+			t.Errorf("expected %v, got %v, in %v", v.expect, q, i)
+		}
+	}
+}
+
+func TestSetIdentifierQuotes(t *testing.T) {
+	SetIdentifierQuotes("test", "<", ">")
+	if q := QuoteIdentifier("test", "a>b"); q != "<a>>b>" {
+		t.Fatalf("expected <a>>b>, got %v", q)
+	}
+}
+
+// flakyDriver fails to connect until it was opened more than fail times.
+type flakyDriver struct {
+	mu     sync.Mutex
+	fail   int
+	opened int
+}
+
+func (d *flakyDriver) Open(name string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.opened++
+	if d.opened <= d.fail {
+		return nil, errors.New("connection refused")
+	}
+	return flakyConn{}, nil
+}
+
+type flakyConn struct{}
+
+func (flakyConn) Prepare(query string) (driver.Stmt, error) { return nil, errors.New("not implemented") }
+func (flakyConn) Close() error                              { return nil }
+func (flakyConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not implemented") }
+
+func TestPingWithRetry(t *testing.T) {
+	tt := []struct {
+		fail      int
+		attempts  int
+		expectErr bool
+	}{
+		{fail: 0, attempts: 0},
+		{fail: 1, attempts: 0, expectErr: true},
+		{fail: 2, attempts: 3},
+		{fail: 3, attempts: 3, expectErr: true},
+	}
+
+	for i, v := range tt {
+		d := &flakyDriver{fail: v.fail}
+		sql.Register(fmt.Sprintf("flaky%v", i), d)
+		db, err := sql.Open(fmt.Sprintf("flaky%v", i), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = PingWithRetry(db, v.attempts, time.Millisecond)
+		if (err != nil) != v.expectErr {
+			t.Errorf("expected error %v, got %v, in %v", v.expectErr, err, i)
+		}
+		if expected := v.fail + 1; !v.expectErr && d.opened != expected {
+			t.Errorf("expected %v attempts, got %v, in %v", expected, d.opened, i)
+		}
+		db.Close()
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := NewBackoff(10*time.Millisecond, time.Hour)
+	b2 := NewBackoff(10*time.Millisecond, time.Hour)
+	b2.rand = rand.New(rand.NewSource(42))
+
+	var prev time.Duration
+	varies := false
+	for i := 0; i < 10; i++ {
+		wait := b.Next()
+		if wait <= prev {
+			t.Fatalf("expected wait %v to be greater than previous wait %v, in %v", wait, prev, i)
+		}
+		if wait != b2.Next() {
+			varies = true
+		}
+		prev = wait
+	}
+	if !varies {
+		t.Fatal("expected waits to vary between backoffs")
+	}
+}
+
+func TestBackoffMax(t *testing.T) {
+	b := NewBackoff(10*time.Millisecond, 50*time.Millisecond)
+	for i := 0; i < 100; i++ {
+		if wait := b.Next(); wait > 50*time.Millisecond {
+			t.Fatalf("expected wait %v not to exceed max, in %v", wait, i)
+		}
+	}
 }
@@ -0,0 +1,90 @@
+package yugabyte
+
+import (
+	"database/sql"
+	"net/url"
+
+	"github.com/vickxxx/migrate"
+	"github.com/vickxxx/migrate/database"
+	"github.com/vickxxx/migrate/database/cockroachdb"
+)
+
+// init registers the driver under the names 'yugabyte' and 'ysql'
+func init() {
+	db := &Yugabyte{CockroachDb: new(cockroachdb.CockroachDb)}
+
+	database.Register("yugabyte", db)
+	database.Register("ysql", db)
+}
+
+// DefaultVersionColumnType is the type of the version column. INT is 32-bit
+// in YSQL, which timestamp versions like 20230101120000 overflow.
+var DefaultVersionColumnType = "BIGINT"
+
+// Yugabyte is a wrapper around the CockroachDB driver which implements YugabyteDB-specific behavior.
+//
+// YugabyteDB speaks the PostgreSQL protocol, but like CockroachDB it is distributed: transactions may have to be
+// retried and pg_advisory_lock isn't reliable across nodes. So it uses the lock table and the transaction retries
+// of the CockroachDB driver, along with its optional interfaces, i.e. database.TryLocker or database.Checksummer.
+// Dump isn't supported, as YugabyteDB has no SHOW CREATE.
+type Yugabyte struct {
+	// The wrapped CockroachDB driver.
+	*cockroachdb.CockroachDb
+}
+
+// Open implements the database.Driver interface by parsing the URL, switching the scheme from "yugabyte" or "ysql"
+// to "cockroachdb", and delegating to the underlying CockroachDB driver.
+func (driver *Yugabyte) Open(dsn string) (database.Driver, error) {
+	crdbDsn, err := cockroachURL(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	crdb, err := driver.CockroachDb.Open(crdbDsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Yugabyte{CockroachDb: crdb.(*cockroachdb.CockroachDb)}, nil
+}
+
+// WithInstance wraps the CockroachDB driver for an existing database connection.
+func WithInstance(instance *sql.DB, config *cockroachdb.Config) (database.Driver, error) {
+	if config != nil && len(config.VersionColumnType) == 0 {
+		config.VersionColumnType = DefaultVersionColumnType
+	}
+
+	crdb, err := cockroachdb.WithInstance(instance, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Yugabyte{CockroachDb: crdb.(*cockroachdb.CockroachDb)}, nil
+}
+
+// TransactionalDDL implements database.Transactional. Schema changes in YugabyteDB
+// aren't rolled back with the transaction, so a failed migration may be partially applied.
+func (driver *Yugabyte) TransactionalDDL() bool { return false }
+
+// Dump implements database.Dumper, which the CockroachDB driver does, but
+// returns migrate.ErrNoDump, as YugabyteDB has no SHOW CREATE.
+func (driver *Yugabyte) Dump() ([]byte, error) {
+	return nil, migrate.ErrNoDump
+}
+
+// cockroachURL switches the scheme of dsn to "cockroachdb"
+// and sets the default version column type.
+func cockroachURL(dsn string) (string, error) {
+	parsed, err := url.Parse(dsn)
+	if err != nil {
+		return "", err
+	}
+
+	parsed.Scheme = "cockroachdb"
+	query := parsed.Query()
+	if len(query.Get("x-version-column-type")) == 0 {
+		query.Set("x-version-column-type", DefaultVersionColumnType)
+		parsed.RawQuery = query.Encode()
+	}
+	return parsed.String(), nil
+}
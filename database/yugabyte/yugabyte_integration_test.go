@@ -0,0 +1,151 @@
+// +build integration
+
+package yugabyte
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"testing"
+
+	"github.com/vickxxx/migrate"
+	"github.com/vickxxx/migrate/database"
+	"github.com/vickxxx/migrate/database/cockroachdb"
+	dt "github.com/vickxxx/migrate/database/testing"
+	mt "github.com/vickxxx/migrate/testing"
+)
+
+// Run with: go test -tags integration ./database/yugabyte
+
+var versions = []mt.Version{
+	{Image: "yugabytedb/yugabyte:2.14.7.0-b51", Cmd: []string{"bin/yugabyted", "start", "--daemon=false"}},
+}
+
+func isReady(i mt.Instance) bool {
+	db, err := sql.Open("postgres", fmt.Sprintf("postgres://yugabyte@%v:%v/yugabyte?sslmode=disable", i.Host(), i.PortFor(5433)))
+	if err != nil {
+		return false
+	}
+	defer db.Close()
+	if err := db.Ping(); err != nil {
+		return false
+	}
+
+	_, err = db.Exec("CREATE DATABASE migrate")
+	return err == nil
+}
+
+func Test(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			y := &Yugabyte{CockroachDb: &cockroachdb.CockroachDb{}}
+			addr := fmt.Sprintf("yugabyte://yugabyte@%v:%v/migrate?sslmode=disable", i.Host(), i.PortFor(5433))
+			d, err := y.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			dt.Test(t, d, []byte("SELECT 1"))
+		})
+}
+
+func TestMultiStatement(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			y := &Yugabyte{CockroachDb: &cockroachdb.CockroachDb{}}
+			addr := fmt.Sprintf("ysql://yugabyte@%v:%v/migrate?sslmode=disable", i.Host(), i.PortFor(5433))
+			d, err := y.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if err := d.Run(bytes.NewReader([]byte("CREATE TABLE foo (foo text); CREATE TABLE bar (bar text);"))); err != nil {
+				t.Fatalf("expected err to be nil, got %v", err)
+			}
+
+			// make sure second table exists
+			db, err := sql.Open("postgres", fmt.Sprintf("postgres://yugabyte@%v:%v/migrate?sslmode=disable", i.Host(), i.PortFor(5433)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			var exists bool
+			if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name = 'bar' AND table_schema = (SELECT current_schema()))").Scan(&exists); err != nil {
+				t.Fatal(err)
+			}
+			if !exists {
+				t.Fatalf("expected table bar to exist")
+			}
+		})
+}
+
+func TestLock(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			y := &Yugabyte{CockroachDb: &cockroachdb.CockroachDb{}}
+			addr := fmt.Sprintf("yugabyte://yugabyte@%v:%v/migrate?sslmode=disable", i.Host(), i.PortFor(5433))
+			d1, err := y.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			d2, err := y.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+
+			if err := d1.Lock(); err != nil {
+				t.Fatal(err)
+			}
+			if err := d2.Lock(); err == nil {
+				t.Fatal("expected second lock to fail while the first is held")
+			}
+			if err := d1.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+			if err := d2.Lock(); err != nil {
+				t.Fatal(err)
+			}
+			if err := d2.Unlock(); err != nil {
+				t.Fatal(err)
+			}
+		})
+}
+
+func TestTimestampVersion(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			y := &Yugabyte{CockroachDb: &cockroachdb.CockroachDb{}}
+			addr := fmt.Sprintf("yugabyte://yugabyte@%v:%v/migrate?sslmode=disable&x-migrations-table=timestamp_migrations", i.Host(), i.PortFor(5433))
+			d, err := y.Open(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer d.Close()
+
+			// overflows the 32-bit INT of YSQL
+			version := 20230101120000
+			if err := d.SetVersion(version, false); err != nil {
+				t.Fatal(err)
+			}
+			v, _, err := d.Version()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v != version {
+				t.Fatalf("expected version %v, got %v", version, v)
+			}
+		})
+}
+
+func TestDumpNotSupported(t *testing.T) {
+	mt.ParallelTest(t, versions, isReady,
+		func(t *testing.T, i mt.Instance) {
+			y := &Yugabyte{CockroachDb: &cockroachdb.CockroachDb{}}
+			addr := fmt.Sprintf("yugabyte://yugabyte@%v:%v/migrate?sslmode=disable", i.Host(), i.PortFor(5433))
+			d, err := y.Open(addr)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if _, err := d.(database.Dumper).Dump(); err != migrate.ErrNoDump {
+				t.Fatalf("expected migrate.ErrNoDump, got %v", err)
+			}
+		})
+}
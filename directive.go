@@ -0,0 +1,136 @@
+package migrate
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DirectivePrefix starts a directive line in a migration body,
+// i.e. `-- migrate:tag pre-deploy`.
+const DirectivePrefix = "-- migrate:"
+
+// readDirectives returns the values of all directive lines named name in r.
+// A directive line has the form `-- migrate:<name> <value>`, leading and
+// trailing whitespace is ignored.
+func readDirectives(r io.Reader, name string) ([]string, error) {
+	values := make([]string, 0)
+	prefix := DirectivePrefix + name
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		line = strings.TrimSpace(strings.TrimPrefix(line, "\uFEFF"))
+		if strings.HasPrefix(line, prefix) {
+			rest := line[len(prefix):]
+			if len(rest) == 0 || rest[0] == ' ' || rest[0] == '\t' {
+				values = append(values, strings.TrimSpace(rest))
+			}
+		}
+		if err == io.EOF {
+			return values, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// hasTag reports whether r carries tag in one of its `-- migrate:tag`
+// directives. A directive may list several tags separated by whitespace.
+func hasTag(r io.Reader, tag string) (bool, error) {
+	values, err := readDirectives(r, "tag")
+	if err != nil {
+		return false, err
+	}
+	for _, v := range values {
+		for _, t := range strings.Fields(v) {
+			if t == tag {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// assertions returns the conditions of the `-- migrate:assert` directives
+// of r, i.e. `-- migrate:assert (SELECT count(*) FROM users) < 1000000`.
+func assertions(r io.Reader) ([]string, error) {
+	values, err := readDirectives(r, "assert")
+	if err != nil {
+		return nil, err
+	}
+	asserts := make([]string, 0, len(values))
+	for _, v := range values {
+		if len(v) == 0 {
+			return nil, fmt.Errorf("empty %vassert directive", DirectivePrefix)
+		}
+		asserts = append(asserts, v)
+	}
+	return asserts, nil
+}
+
+// confirmMessage returns the message of the `-- migrate:confirm`
+// directives of r, i.e. `-- migrate:confirm "This will drop the orders
+// table"`, or "" if there are none. The quotes are optional, several
+// directives are joined by newlines.
+func confirmMessage(r io.Reader) (string, error) {
+	values, err := readDirectives(r, "confirm")
+	if err != nil {
+		return "", err
+	}
+	messages := make([]string, 0, len(values))
+	for _, v := range values {
+		if strings.HasPrefix(v, `"`) {
+			unquoted, err := strconv.Unquote(v)
+			if err != nil {
+				return "", fmt.Errorf("invalid message %v in %vconfirm directive", v, DirectivePrefix)
+			}
+			v = unquoted
+		}
+		if len(v) == 0 {
+			return "", fmt.Errorf("empty %vconfirm directive", DirectivePrefix)
+		}
+		messages = append(messages, v)
+	}
+	return strings.Join(messages, "\n"), nil
+}
+
+// dependencies returns the versions listed in the `-- migrate:after`
+// directives of r, i.e. `-- migrate:after 20230101120000`.
+// A directive may list several versions separated by whitespace.
+func dependencies(r io.Reader) ([]uint, error) {
+	values, err := readDirectives(r, "after")
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]uint, 0)
+	for _, v := range values {
+		for _, f := range strings.Fields(v) {
+			version, err := strconv.ParseUint(f, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid version %q in %vafter directive", f, DirectivePrefix)
+			}
+			versions = append(versions, uint(version))
+		}
+	}
+	return versions, nil
+}
+
+// migrationTimeout returns the duration of the `-- migrate:timeout`
+// directive of r, i.e. `-- migrate:timeout 30s`, or 0 if there is none.
+func migrationTimeout(r io.Reader) (time.Duration, error) {
+	values, err := readDirectives(r, "timeout")
+	if err != nil || len(values) == 0 {
+		return 0, err
+	}
+	if len(values) > 1 {
+		return 0, fmt.Errorf("several %vtimeout directives", DirectivePrefix)
+	}
+	timeout, err := time.ParseDuration(values[0])
+	if err != nil || timeout <= 0 {
+		return 0, fmt.Errorf("invalid duration %q in %vtimeout directive", values[0], DirectivePrefix)
+	}
+	return timeout, nil
+}
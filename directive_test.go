@@ -0,0 +1,126 @@
+package migrate
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadDirectives(t *testing.T) {
+	body := `-- migrate:tag pre-deploy
+  -- migrate:tag   post-deploy  
+-- migrate:tagged nope
+CREATE TABLE t (id int);
+-- migrate:tag last`
+
+	values, err := readDirectives(strings.NewReader(body), "tag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"pre-deploy", "post-deploy", "last"}
+	if !reflect.DeepEqual(values, expected) {
+		t.Fatalf("expected %v, got %v", expected, values)
+	}
+}
+
+func TestHasTag(t *testing.T) {
+	tt := []struct {
+		body      string
+		tag       string
+		expectTag bool
+	}{
+		{body: "-- migrate:tag pre-deploy\nSELECT 1;", tag: "pre-deploy", expectTag: true},
+		{body: "-- migrate:tag a pre-deploy b\nSELECT 1;", tag: "pre-deploy", expectTag: true},
+		{body: "-- migrate:tag post-deploy\nSELECT 1;", tag: "pre-deploy", expectTag: false},
+		{body: "SELECT 1; -- migrate:tag pre-deploy", tag: "pre-deploy", expectTag: false},
+		{body: "", tag: "pre-deploy", expectTag: false},
+	}
+
+	for i, v := range tt {
+		ok, err := hasTag(strings.NewReader(v.body), v.tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != v.expectTag {
+			t.Errorf("expected %v, got %v, in %v", v.expectTag, ok, i)
+		}
+	}
+}
+
+func TestDependencies(t *testing.T) {
+	versions, err := dependencies(strings.NewReader("-- migrate:after 20230101120000\n-- migrate:after 1 2\nSELECT 1;"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []uint{20230101120000, 1, 2}
+	if !reflect.DeepEqual(versions, expected) {
+		t.Fatalf("expected %v, got %v", expected, versions)
+	}
+
+	if _, err := dependencies(strings.NewReader("-- migrate:after tomorrow")); err == nil {
+		t.Fatal("expected error for invalid version")
+	}
+}
+
+func TestAssertions(t *testing.T) {
+	asserts, err := assertions(strings.NewReader("-- migrate:assert (SELECT count(*) FROM users) < 1000000\n-- migrate:asserted no\nALTER TABLE users ADD COLUMN a INT;"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"(SELECT count(*) FROM users) < 1000000"}
+	if !reflect.DeepEqual(asserts, expected) {
+		t.Fatalf("expected %v, got %v", expected, asserts)
+	}
+
+	if _, err := assertions(strings.NewReader("-- migrate:assert\nSELECT 1;")); err == nil {
+		t.Fatal("expected error for empty assertion")
+	}
+}
+
+func TestConfirmMessage(t *testing.T) {
+	tt := []struct {
+		body     string
+		expected string
+	}{
+		{body: "-- migrate:confirm \"This will drop the orders table\"\nDROP TABLE orders;", expected: "This will drop the orders table"},
+		{body: "-- migrate:confirm Unquoted works, too\nDROP TABLE orders;", expected: "Unquoted works, too"},
+		{body: "-- migrate:confirm \"Drops orders\"\n-- migrate:confirm \"and \\\"items\\\"\"\nDROP TABLE orders;", expected: "Drops orders\nand \"items\""},
+		{body: "DROP TABLE orders;", expected: ""},
+	}
+	for i, v := range tt {
+		message, err := confirmMessage(strings.NewReader(v.body))
+		if err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+		if message != v.expected {
+			t.Errorf("%v: expected %q, got %q", i, v.expected, message)
+		}
+	}
+
+	for _, body := range []string{"-- migrate:confirm\nDROP TABLE orders;", "-- migrate:confirm \"unterminated\nDROP TABLE orders;"} {
+		if _, err := confirmMessage(strings.NewReader(body)); err == nil {
+			t.Fatalf("expected error for %q", body)
+		}
+	}
+}
+
+func TestMigrationTimeout(t *testing.T) {
+	timeout, err := migrationTimeout(strings.NewReader("-- migrate:timeout 30s\nCREATE INDEX users_name ON users (name);"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if timeout != 30*time.Second {
+		t.Fatalf("expected 30s, got %v", timeout)
+	}
+
+	if timeout, err := migrationTimeout(strings.NewReader("SELECT 1;")); err != nil || timeout != 0 {
+		t.Fatalf("expected no timeout, got %v, %v", timeout, err)
+	}
+
+	for _, body := range []string{"-- migrate:timeout\nSELECT 1;", "-- migrate:timeout soon\nSELECT 1;", "-- migrate:timeout -1s\nSELECT 1;", "-- migrate:timeout 1s\n-- migrate:timeout 2s\nSELECT 1;"} {
+		if _, err := migrationTimeout(strings.NewReader(body)); err == nil {
+			t.Fatalf("expected error for %q", body)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+//go:build go1.16
+// +build go1.16
+
+package migrate
+
+import (
+	"io/fs"
+
+	"github.com/vickxxx/migrate/database"
+	"github.com/vickxxx/migrate/source/iofs"
+)
+
+// NewWithSourceAndInstance returns a new Migrate instance reading the
+// migrations in the directory dir of fsys, i.e. embedded with go:embed,
+// and running them against an existing database instance, without URLs.
+// Use any string that can serve as an identifier during logging as databaseName.
+// You are responsible for closing the underlying database client if necessary.
+func NewWithSourceAndInstance(fsys fs.FS, dir string, databaseName string, databaseInstance database.Driver) (*Migrate, error) {
+	sourceInstance, err := iofs.WithInstance(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	return NewWithInstance("iofs", sourceInstance, databaseName, databaseInstance)
+}
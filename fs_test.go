@@ -0,0 +1,43 @@
+//go:build go1.16
+// +build go1.16
+
+package migrate
+
+import (
+	"testing"
+	"testing/fstest"
+
+	dStub "github.com/vickxxx/migrate/database/stub"
+)
+
+func TestNewWithSourceAndInstance(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/1_init.up.sql":   {Data: []byte("CREATE 1")},
+		"migrations/1_init.down.sql": {Data: []byte("DROP 1")},
+		"migrations/2_users.up.sql":  {Data: []byte("CREATE 2")},
+	}
+	dbInst, err := dStub.WithInstance(&DummyInstance{"database"}, &dStub.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewWithSourceAndInstance(fsys, "migrations", "stub", dbInst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.sourceName != "iofs" || m.databaseName != "stub" {
+		t.Fatalf("expected iofs and stub, got %v and %v", m.sourceName, m.databaseName)
+	}
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	dbDrv := dbInst.(*dStub.Stub)
+	if !dbDrv.EqualSequence([]string{"CREATE 1", "CREATE 2"}) {
+		t.Fatalf("expected both migrations to run, got %v", dbDrv.MigrationSequence)
+	}
+
+	if _, err := NewWithSourceAndInstance(fsys, "missing", "stub", dbInst); err == nil {
+		t.Fatal("expected error for missing directory")
+	}
+}
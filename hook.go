@@ -0,0 +1,56 @@
+package migrate
+
+import (
+	"time"
+
+	"github.com/vickxxx/migrate/database"
+)
+
+// RunResult is the outcome of a migration run, see SetPostRunHook.
+type RunResult struct {
+	// Command is the method of Migrate that ran, i.e. "Up".
+	Command string
+
+	// Version and Dirty are the state of the database after the run,
+	// Version is database.NilVersion if no migration is applied.
+	Version int
+	Dirty   bool
+
+	// Err is the error the run returned, including ErrNoChange, or the
+	// error reading the version afterwards.
+	Err error
+
+	// Duration is the time the run took, including waiting for the lock.
+	Duration time.Duration
+}
+
+// SetPostRunHook sets a function called with the RunResult after Up,
+// UpSince, Down, Steps or Migrate returns, once the lock is released, i.e.
+// to notify a webhook. It's called whether the run succeeded or not, so
+// that failures can be alerted on.
+func (m *Migrate) SetPostRunHook(hook func(result RunResult)) {
+	m.postRunHook = hook
+}
+
+// postRun calls the post run hook, if set, with the result of command,
+// which started at start and returned err.
+func (m *Migrate) postRun(command string, start time.Time, err error) {
+	if m.postRunHook == nil {
+		return
+	}
+
+	result := RunResult{
+		Command:  command,
+		Version:  database.NilVersion,
+		Err:      err,
+		Duration: time.Since(start),
+	}
+	version, dirty, verr := m.databaseDrv.Version()
+	if verr != nil {
+		result.Err = NewMultiError(err, verr)
+	} else {
+		result.Version = version
+		result.Dirty = dirty
+	}
+	m.postRunHook(result)
+}
@@ -0,0 +1,56 @@
+package migrate
+
+import (
+	"fmt"
+	"testing"
+
+	dStub "github.com/vickxxx/migrate/database/stub"
+	sStub "github.com/vickxxx/migrate/source/stub"
+)
+
+func TestPostRunHook(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	results := make([]RunResult, 0)
+	m.SetPostRunHook(func(result RunResult) {
+		if dbDrv.IsLocked || m.isLocked {
+			t.Errorf("expected the lock to be released before the hook of %v", result.Command)
+		}
+		results = append(results, result)
+	})
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(); err != ErrNoChange {
+		t.Fatalf("expected ErrNoChange, got %v", err)
+	}
+	if err := m.Steps(-2); err != nil {
+		t.Fatal(err)
+	}
+
+	// the hook sees failed runs, too
+	failErr := fmt.Errorf("migration failed")
+	m.databaseDrv = &failingStub{Stub: dbDrv, err: failErr}
+	if err := m.Down(); err != failErr {
+		t.Fatalf("expected %v, got %v", failErr, err)
+	}
+
+	expected := []RunResult{
+		{Command: "Up", Version: 7},
+		{Command: "Up", Version: 7, Err: ErrNoChange},
+		{Command: "Steps", Version: 4},
+		{Command: "Down", Version: 3, Dirty: true, Err: failErr},
+	}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %v results, got %+v", len(expected), results)
+	}
+	for i, r := range results {
+		r.Duration = 0
+		if r != expected[i] {
+			t.Fatalf("expected %+v, got %+v", expected[i], r)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package migrate
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/vickxxx/migrate/source"
+)
+
+// LintConfig configures the checks of Lint.
+type LintConfig struct {
+	// RequireDown requires a down migration for every up migration.
+	RequireDown bool
+
+	// Contiguous requires each version to follow the previous one
+	// by exactly one, i.e. 1, 2, 3. Disable it for timestamp versions.
+	Contiguous bool
+}
+
+// ErrLint is returned by Lint and holds every problem found.
+type ErrLint struct {
+	Problems []string
+}
+
+// Error implements the error interface.
+func (e ErrLint) Error() string {
+	return strings.Join(e.Problems, "\n")
+}
+
+// Lint checks the migrations of a source without touching any database.
+// Every version needs an up migration, and depending on config a down
+// migration and a version following the previous one. It returns the
+// versions checked and ErrLint if there are problems.
+func Lint(d source.Driver, config LintConfig) (versions []uint, err error) {
+	versions = make([]uint, 0)
+	problems := make([]string, 0)
+
+	version, err := d.First()
+	for err == nil {
+		if len(versions) > 0 && config.Contiguous {
+			if prev := versions[len(versions)-1]; version != prev+1 {
+				problems = append(problems, fmt.Sprintf("version %v doesn't follow version %v", version, prev))
+			}
+		}
+		versions = append(versions, version)
+
+		hasUp, upErr := hasMigration(d.ReadUp, version)
+		if upErr != nil {
+			return versions, upErr
+		}
+		hasDown, downErr := hasMigration(d.ReadDown, version)
+		if downErr != nil {
+			return versions, downErr
+		}
+
+		if !hasUp {
+			problems = append(problems, fmt.Sprintf("version %v has no up migration", version))
+		} else if !hasDown && config.RequireDown {
+			problems = append(problems, fmt.Sprintf("version %v has no down migration", version))
+		}
+
+		version, err = d.Next(version)
+	}
+	if !os.IsNotExist(err) {
+		return versions, err
+	}
+
+	if len(problems) > 0 {
+		return versions, ErrLint{Problems: problems}
+	}
+	return versions, nil
+}
+
+// hasMigration returns true if read finds a migration for version.
+func hasMigration(read func(uint) (r io.ReadCloser, identifier string, err error), version uint) (bool, error) {
+	r, _, err := read(version)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	r.Close()
+	return true, nil
+}
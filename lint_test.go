@@ -0,0 +1,98 @@
+package migrate
+
+import (
+	"testing"
+
+	"github.com/vickxxx/migrate/source"
+	sStub "github.com/vickxxx/migrate/source/stub"
+)
+
+func TestLint(t *testing.T) {
+	tt := []struct {
+		migrations     []*source.Migration
+		config         LintConfig
+		expectVersions int
+		expectProblems int
+	}{
+		{
+			migrations: []*source.Migration{
+				{Version: 1, Direction: source.Up},
+				{Version: 1, Direction: source.Down},
+				{Version: 2, Direction: source.Up},
+				{Version: 2, Direction: source.Down},
+			},
+			config:         LintConfig{RequireDown: true, Contiguous: true},
+			expectVersions: 2,
+		},
+		{
+			migrations: []*source.Migration{
+				{Version: 1, Direction: source.Up},
+				{Version: 2, Direction: source.Up},
+			},
+			config:         LintConfig{RequireDown: true},
+			expectVersions: 2,
+			expectProblems: 2,
+		},
+		{
+			migrations: []*source.Migration{
+				{Version: 1, Direction: source.Up},
+				{Version: 2, Direction: source.Up},
+			},
+			config:         LintConfig{},
+			expectVersions: 2,
+		},
+		{
+			migrations: []*source.Migration{
+				{Version: 1, Direction: source.Up},
+				{Version: 3, Direction: source.Up},
+				{Version: 4, Direction: source.Down},
+			},
+			config:         LintConfig{Contiguous: true},
+			expectVersions: 3,
+			expectProblems: 2,
+		},
+		{
+			migrations: []*source.Migration{
+				{Version: 1500000000, Direction: source.Up},
+				{Version: 1600000000, Direction: source.Up},
+			},
+			config:         LintConfig{Contiguous: false},
+			expectVersions: 2,
+		},
+		{
+			config: LintConfig{RequireDown: true, Contiguous: true},
+		},
+	}
+
+	for i, v := range tt {
+		s := &sStub.Stub{}
+		d, err := s.Open("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		migrations := source.NewMigrations()
+		for _, m := range v.migrations {
+			migrations.Append(m)
+		}
+		d.(*sStub.Stub).Migrations = migrations
+
+		versions, err := Lint(d, v.config)
+		if len(versions) != v.expectVersions {
+			t.Errorf("expected %v versions, got %v, in %v", v.expectVersions, versions, i)
+		}
+		if v.expectProblems == 0 {
+			if err != nil {
+				t.Errorf("expected err to be nil, got %v, in %v", err, i)
+			}
+			continue
+		}
+		e, ok := err.(ErrLint)
+		if !ok {
+			t.Errorf("expected ErrLint, got %v, in %v", err, i)
+			continue
+		}
+		if len(e.Problems) != v.expectProblems {
+			t.Errorf("expected %v problems, got %v, in %v", v.expectProblems, e.Problems, i)
+		}
+	}
+}
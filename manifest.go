@@ -0,0 +1,181 @@
+package migrate
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/vickxxx/migrate/source"
+)
+
+// ManifestFile is the name of the manifest in a migrations directory.
+const ManifestFile = "migrations.sum"
+
+// ErrManifestMismatch is returned by Verify and holds the migrations
+// of the source that differ from the manifest, by name.
+type ErrManifestMismatch struct {
+	Modified []string
+	Added    []string
+	Removed  []string
+}
+
+// Error implements the error interface.
+func (e ErrManifestMismatch) Error() string {
+	problems := make([]string, 0)
+	for _, p := range []struct {
+		what  string
+		names []string
+	}{{"modified", e.Modified}, {"added", e.Added}, {"removed", e.Removed}} {
+		if len(p.names) > 0 {
+			problems = append(problems, p.what+" "+strings.Join(p.names, ", "))
+		}
+	}
+	return "migrations differ from " + ManifestFile + ": " + strings.Join(problems, "; ")
+}
+
+// manifestEntry is a line of the manifest.
+type manifestEntry struct {
+	name string
+	sum  string
+}
+
+// WriteManifest writes the manifest of the migrations of d to w, a line
+// per migration with its name and the hex encoded SHA-256 of its body,
+// like go.sum. Sources don't expose file names, so the name is
+// <version>_<identifier>.<direction>, i.e. 1_init.up.
+func WriteManifest(w io.Writer, d source.Driver) error {
+	entries, err := manifestEntries(d)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if _, err := fmt.Fprintf(w, "%v %v\n", e.name, e.sum); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verify checks the migrations of the source against manifest, as written
+// by WriteManifest, so that unreviewed changes of migrations are caught.
+// It returns ErrManifestMismatch if a migration was modified, added or
+// removed without updating the manifest.
+func (m *Migrate) Verify(manifest io.Reader) error {
+	return VerifyManifest(manifest, m.sourceDrv)
+}
+
+// VerifyManifest is Verify for a source without database.
+func VerifyManifest(manifest io.Reader, d source.Driver) error {
+	expected, err := readManifest(manifest)
+	if err != nil {
+		return err
+	}
+	entries, err := manifestEntries(d)
+	if err != nil {
+		return err
+	}
+
+	mismatch := ErrManifestMismatch{}
+	seen := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		seen[e.name] = true
+		sum, ok := expected.sums[e.name]
+		if !ok {
+			mismatch.Added = append(mismatch.Added, e.name)
+		} else if sum != e.sum {
+			mismatch.Modified = append(mismatch.Modified, e.name)
+		}
+	}
+	for _, name := range expected.names {
+		if !seen[name] {
+			mismatch.Removed = append(mismatch.Removed, name)
+		}
+	}
+
+	if len(mismatch.Modified) > 0 || len(mismatch.Added) > 0 || len(mismatch.Removed) > 0 {
+		return mismatch
+	}
+	return nil
+}
+
+// manifestEntries returns the entries of all migrations of d, ordered by
+// version, the up migration first.
+func manifestEntries(d source.Driver) ([]manifestEntry, error) {
+	entries := make([]manifestEntry, 0)
+	version, err := d.First()
+	for err == nil {
+		for _, dir := range []source.Direction{source.Up, source.Down} {
+			read := d.ReadUp
+			if dir == source.Down {
+				read = d.ReadDown
+			}
+			e, ok, rerr := readManifestEntry(read, version, dir)
+			if rerr != nil {
+				return nil, rerr
+			}
+			if ok {
+				entries = append(entries, e)
+			}
+		}
+		version, err = d.Next(version)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// readManifestEntry returns the entry of the migration read returns
+// for version, or false if there is none.
+func readManifestEntry(read func(uint) (io.ReadCloser, string, error), version uint, dir source.Direction) (manifestEntry, bool, error) {
+	r, identifier, err := read(version)
+	if os.IsNotExist(err) {
+		return manifestEntry{}, false, nil
+	} else if err != nil {
+		return manifestEntry{}, false, err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return manifestEntry{}, false, err
+	}
+	return manifestEntry{
+		name: fmt.Sprintf("%v_%v.%v", version, identifier, dir),
+		sum:  fmt.Sprintf("%x", h.Sum(nil)),
+	}, true, nil
+}
+
+// manifestSums maps the names of a manifest to their checksums,
+// and keeps the names in order.
+type manifestSums struct {
+	sums  map[string]string
+	names []string
+}
+
+// readManifest parses a manifest. Empty lines are ignored. The checksum
+// follows the last space of a line, since names may contain spaces.
+func readManifest(r io.Reader) (manifestSums, error) {
+	m := manifestSums{sums: make(map[string]string)}
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 {
+			continue
+		}
+		i := strings.LastIndexAny(line, " \t")
+		if i < 0 {
+			return m, fmt.Errorf("invalid line %v of %v: %q", n, ManifestFile, line)
+		}
+		name, sum := strings.TrimSpace(line[:i]), line[i+1:]
+		if _, ok := m.sums[name]; ok {
+			return m, fmt.Errorf("duplicate %v in %v", name, ManifestFile)
+		}
+		m.sums[name] = sum
+		m.names = append(m.names, name)
+	}
+	return m, s.Err()
+}
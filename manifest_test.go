@@ -0,0 +1,103 @@
+package migrate
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vickxxx/migrate/source"
+	sStub "github.com/vickxxx/migrate/source/stub"
+)
+
+func newManifestMigrate() (*Migrate, *source.Migrations) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE TABLE a (a INT)"})
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Down, Identifier: "DROP TABLE a"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "CREATE TABLE b (b INT)"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	return m, migrations
+}
+
+func TestWriteManifest(t *testing.T) {
+	m, _ := newManifestMigrate()
+	var manifest bytes.Buffer
+	if err := WriteManifest(&manifest, m.sourceDrv); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(manifest.String()), "\n")
+	names := make([]string, len(lines))
+	for i, l := range lines {
+		fields := strings.Fields(l)
+		if len(fields) != 2 || len(fields[1]) != 64 {
+			t.Fatalf("expected name and SHA-256 in line %v, got %q", i, l)
+		}
+		names[i] = fields[0]
+	}
+	expected := []string{"1_1.up.stub.up", "1_1.down.stub.down", "2_2.up.stub.up"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+
+	if err := m.Verify(bytes.NewReader(manifest.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	m, migrations := newManifestMigrate()
+	var manifest bytes.Buffer
+	if err := WriteManifest(&manifest, m.sourceDrv); err != nil {
+		t.Fatal(err)
+	}
+
+	// version 1 edited, 2 removed and 3 added after review
+	tampered := source.NewMigrations()
+	tampered.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE TABLE a (a INT, secret TEXT)"})
+	tampered.Append(&source.Migration{Version: 1, Direction: source.Down, Identifier: "DROP TABLE a"})
+	tampered.Append(&source.Migration{Version: 3, Direction: source.Up, Identifier: "CREATE TABLE c (c INT)"})
+	m.sourceDrv.(*sStub.Stub).Migrations = tampered
+
+	err := m.Verify(bytes.NewReader(manifest.Bytes()))
+	expected := ErrManifestMismatch{
+		Modified: []string{"1_1.up.stub.up"},
+		Added:    []string{"3_3.up.stub.up"},
+		Removed:  []string{"2_2.up.stub.up"},
+	}
+	if !reflect.DeepEqual(err, expected) {
+		t.Fatalf("expected %v, got %v", expected, err)
+	}
+
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	if err := m.Verify(strings.NewReader("1_1.up.stub.up\n")); err == nil {
+		t.Fatal("expected error for invalid manifest")
+	}
+}
+
+// spacedSource names its up migrations with spaces, i.e. 1_add users.up.sql.
+type spacedSource struct {
+	*sStub.Stub
+}
+
+func (s *spacedSource) ReadUp(version uint) (io.ReadCloser, string, error) {
+	r, _, err := s.Stub.ReadUp(version)
+	return r, "add  users", err
+}
+
+func TestVerifySpacedNames(t *testing.T) {
+	m, _ := newManifestMigrate()
+	m.sourceDrv = &spacedSource{Stub: m.sourceDrv.(*sStub.Stub)}
+	var manifest bytes.Buffer
+	if err := WriteManifest(&manifest, m.sourceDrv); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(manifest.String(), "1_add  users.up ") {
+		t.Fatalf("expected the name with spaces in the manifest, got %q", manifest.String())
+	}
+	if err := m.Verify(bytes.NewReader(manifest.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -5,7 +5,11 @@
 package migrate
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"sync"
 	"time"
@@ -21,14 +25,45 @@ import (
 // since each pre-read migration is buffered in memory. See DefaultBufferSize.
 var DefaultPrefetchMigrations = uint(10)
 
+// Latest is a version for Migrate which resolves to the last version of
+// the source at call time, the version Up migrates to.
+const Latest = ^uint(0)
+
 // DefaultLockTimeout sets the max time a database driver has to acquire a lock.
 var DefaultLockTimeout = 15 * time.Second
 
+// lockRetryBaseDelay and lockRetryMaxDelay bound the waits of the
+// jittered exponential backoff between two attempts to acquire a lock
+// held by another process, see waitLock and RunOnce.
+var (
+	lockRetryBaseDelay = 100 * time.Millisecond
+	lockRetryMaxDelay  = 2 * time.Second
+)
+
 var (
 	ErrNoChange    = fmt.Errorf("no change")
 	ErrNilVersion  = fmt.Errorf("no migration")
 	ErrLocked      = fmt.Errorf("database locked")
 	ErrLockTimeout = fmt.Errorf("timeout: can't acquire database lock")
+	ErrNoDump      = fmt.Errorf("database driver can't dump its schema")
+	ErrNotApplied  = fmt.Errorf("migration not applied")
+	ErrNoRoundTrip = fmt.Errorf("database driver can't roll back migrations")
+
+	ErrInvalidRange       = fmt.Errorf("invalid version range")
+	ErrRunRangeNotAllowed = fmt.Errorf("running a range of migrations again isn't allowed, see SetAllowRunRange")
+
+	ErrNoPrivilegeCheck = fmt.Errorf("database driver can't check privileges")
+	ErrNoWriteCheck     = fmt.Errorf("database driver can't check write access")
+	ErrNoTryLock        = fmt.Errorf("database driver can't try to lock")
+	ErrNoForceUnlock    = fmt.Errorf("database driver can't force unlock")
+	ErrNoCheck          = fmt.Errorf("database driver can't check migrations")
+	ErrNoQuerier        = fmt.Errorf("database driver can't evaluate assertions")
+	ErrNoTimeout        = fmt.Errorf("database driver can't enforce migration timeouts")
+	ErrDownNotSupported = fmt.Errorf("source has no down migrations")
+	ErrNoDeployID       = fmt.Errorf("database driver can't record deploy ids")
+	ErrNoHistory        = fmt.Errorf("database driver doesn't track applied versions")
+	ErrNoChecksums      = fmt.Errorf("database driver doesn't record checksums")
+	ErrTooManyGaps      = fmt.Errorf("too many gaps in applied versions, versions aren't sequential")
 )
 
 // ErrShortLimit is an error returned when not enough migrations
@@ -42,6 +77,144 @@ func (e ErrShortLimit) Error() string {
 	return fmt.Sprintf("limit %v short", e.Short)
 }
 
+// ErrCheckFailed is returned by Check for the first pending
+// migration that failed.
+type ErrCheckFailed struct {
+	Version uint
+	Err     error
+}
+
+// Error implements the error interface.
+func (e ErrCheckFailed) Error() string {
+	return fmt.Sprintf("check of migration %v failed: %v", e.Version, e.Err)
+}
+
+// Unwrap returns the error of the migration.
+func (e ErrCheckFailed) Unwrap() error {
+	return e.Err
+}
+
+// ErrAssertionFailed is returned when the `-- migrate:assert` directive
+// of a migration evaluates to false. The migration isn't run.
+type ErrAssertionFailed struct {
+	Version   uint
+	Assertion string
+}
+
+// Error implements the error interface.
+func (e ErrAssertionFailed) Error() string {
+	return fmt.Sprintf("assertion of migration %v failed: %v", e.Version, e.Assertion)
+}
+
+// ErrMigrationTimeout is returned when a migration runs longer than the
+// timeout of its `-- migrate:timeout` directive and is canceled.
+type ErrMigrationTimeout struct {
+	Version uint
+	Timeout time.Duration
+	Err     error
+}
+
+// Error implements the error interface.
+func (e ErrMigrationTimeout) Error() string {
+	return fmt.Sprintf("migration %v exceeded its timeout of %v: %v", e.Version, e.Timeout, e.Err)
+}
+
+// Unwrap returns the error of the canceled migration.
+func (e ErrMigrationTimeout) Unwrap() error {
+	return e.Err
+}
+
+// ErrNotConfirmed is returned when the confirm function declines a down
+// migration with a `-- migrate:confirm` directive. The migration isn't run.
+type ErrNotConfirmed struct {
+	Version uint
+	Message string
+}
+
+// Error implements the error interface.
+func (e ErrNotConfirmed) Error() string {
+	return fmt.Sprintf("down migration %v not confirmed: %v", e.Version, e.Message)
+}
+
+// ErrSquashPartial is returned by Squash when the database only has
+// a part of the squashed range applied.
+type ErrSquashPartial struct {
+	Version int
+	To      uint
+}
+
+// Error implements the error interface.
+func (e ErrSquashPartial) Error() string {
+	return fmt.Sprintf("database version %v is inside the squashed range up to %v. Migrate to %v before squashing.", e.Version, e.To, e.To)
+}
+
+// ErrSquashNotReplaced is returned by Squash when the source doesn't start
+// with the squashed migration, but with an older one of the squashed range.
+type ErrSquashNotReplaced struct {
+	First uint
+	To    uint
+}
+
+// Error implements the error interface.
+func (e ErrSquashNotReplaced) Error() string {
+	return fmt.Sprintf("the source starts with version %v. Replace the migrations up to %v with the squashed migration %v first.", e.First, e.To, e.To)
+}
+
+// ErrBaselineTracked is returned by Baseline when the database
+// already tracks a migration version.
+type ErrBaselineTracked struct {
+	Version int
+	Dirty   bool
+}
+
+// Error implements the error interface.
+func (e ErrBaselineTracked) Error() string {
+	if e.Dirty {
+		return fmt.Sprintf("can't baseline, database already tracks dirty version %v", e.Version)
+	}
+	return fmt.Sprintf("can't baseline, database already tracks version %v", e.Version)
+}
+
+// ErrOutOfOrder is returned by Up when the source has versions older than
+// the current database version, which the database hasn't applied.
+type ErrOutOfOrder struct {
+	Versions []uint
+	Version  int
+}
+
+// Error implements the error interface.
+func (e ErrOutOfOrder) Error() string {
+	return fmt.Sprintf("migrations %v are older than database version %v, but not applied", e.Versions, e.Version)
+}
+
+// OutOfOrderMode is the policy for migrations older than the current
+// database version, which the database hasn't applied,
+// i.e. a late-merged branch.
+type OutOfOrderMode string
+
+const (
+	// OutOfOrderForbid fails with ErrOutOfOrder.
+	OutOfOrderForbid OutOfOrderMode = "forbid"
+
+	// OutOfOrderAllow ignores them.
+	OutOfOrderAllow OutOfOrderMode = "allow"
+
+	// OutOfOrderWarn logs them and carries on.
+	OutOfOrderWarn OutOfOrderMode = "warn"
+)
+
+// ErrPending is returned by RunOnce when the process elected to migrate
+// released the lock before migrating all the way up, i.e. after a failed
+// migration was rolled back.
+type ErrPending struct {
+	Version int
+	Last    uint
+}
+
+func (e ErrPending) Error() string {
+	return fmt.Sprintf("migrations pending: database is at version %v, last version is %v", e.Version, e.Last)
+}
+
 type ErrDirty struct {
 	Version int
 }
@@ -75,6 +248,61 @@ type Migrate struct {
 	// LockTimeout defaults to DefaultLockTimeout,
 	// but can be set per Migrate instance.
 	LockTimeout time.Duration
+
+	// outOfOrder defaults to OutOfOrderForbid, see SetOutOfOrder.
+	outOfOrder OutOfOrderMode
+
+	// interMigrationDelay is the pause between two migrations,
+	// see SetInterMigrationDelay.
+	interMigrationDelay time.Duration
+
+	// dirtyHandler is called with the version when a dirty
+	// database is detected, see SetDirtyHandler.
+	dirtyHandler func(version int) error
+
+	// auditWriter receives an AuditRecord per migration,
+	// see SetAuditWriter.
+	auditWriter io.Writer
+
+	// requiredPrivileges are checked before migrating,
+	// see SetRequiredPrivileges.
+	requiredPrivileges []string
+
+	// writeCheck checks write access to the version table before
+	// migrating, see SetWriteCheck.
+	writeCheck bool
+
+	// strict checks that applied migrations are unchanged before
+	// migrating, see SetStrict.
+	strict bool
+
+	// preflight is called before migrating, see SetPreflight.
+	preflight func(d database.Driver) error
+
+	// continueOnError checks the migrations after a failed one,
+	// see SetContinueOnError.
+	continueOnError bool
+
+	// clock returns the times recorded, see SetClock.
+	clock func() time.Time
+
+	// allowEmptySource makes migrating up an empty source
+	// no change, see SetAllowEmptySource.
+	allowEmptySource bool
+
+	// confirm is asked before destructive down migrations,
+	// see SetConfirm.
+	confirm func(version uint, message string) bool
+
+	// allowRunRange acknowledges that RunRange runs applied
+	// migrations again, see SetAllowRunRange.
+	allowRunRange bool
+
+	// deployID is recorded with each migration, see SetDeployID.
+	deployID string
+
+	// postRunHook is called after a run, see SetPostRunHook.
+	postRunHook func(result RunResult)
 }
 
 // New returns a new Migrate instance from a source URL and a database URL.
@@ -183,7 +411,157 @@ func newCommon() *Migrate {
 		PrefetchMigrations: DefaultPrefetchMigrations,
 		LockTimeout:        DefaultLockTimeout,
 		isLockedMu:         &sync.Mutex{},
+		outOfOrder:         OutOfOrderForbid,
+		clock:              time.Now,
+	}
+}
+
+// SetOutOfOrder sets the policy for migrations older than the current
+// database version, which the database hasn't applied. Defaults to
+// OutOfOrderForbid. Only the current version is tracked, so Up never runs
+// these migrations, they have to be applied by hand. Out-of-order migrations
+// can only be detected if the database driver implements database.Historian.
+func (m *Migrate) SetOutOfOrder(mode OutOfOrderMode) error {
+	switch mode {
+	case OutOfOrderForbid, OutOfOrderAllow, OutOfOrderWarn:
+		m.outOfOrder = mode
+		return nil
+	}
+	return fmt.Errorf("invalid out-of-order mode %q", mode)
+}
+
+// SetInterMigrationDelay makes Migrate pause for d between two migrations,
+// i.e. to let the database recover from large data backfills. A stop
+// signal on GracefulStop ends the pause and stops before the next migration.
+func (m *Migrate) SetInterMigrationDelay(d time.Duration) {
+	m.interMigrationDelay = d
+}
+
+// SetDirtyHandler sets a function called with the dirty version whenever
+// Migrate finds the database dirty, i.e. to page someone. Migrate returns
+// ErrDirty regardless, an error returned by handler is only logged.
+func (m *Migrate) SetDirtyHandler(handler func(version int) error) {
+	m.dirtyHandler = handler
+}
+
+// SetRequiredPrivileges makes Migrate check that the database user has
+// the required privileges, i.e. CREATE, before running any migration,
+// instead of failing midway. A missing privilege fails with
+// database.ErrMissingPrivileges. It returns ErrNoPrivilegeCheck if the
+// database driver doesn't implement database.PrivilegeChecker.
+func (m *Migrate) SetRequiredPrivileges(required []string) error {
+	if _, ok := m.databaseDrv.(database.PrivilegeChecker); !ok {
+		return ErrNoPrivilegeCheck
 	}
+	m.requiredPrivileges = required
+	return nil
+}
+
+// SetWriteCheck makes Migrate check that the database user can write the
+// version table before running any migration, i.e. when DDL privileges were
+// granted but INSERT on the version table was forgotten, which would fail
+// after the first migration ran. The check writes in a transaction that is
+// rolled back and fails with database.ErrVersionTableNotWritable. It returns
+// ErrNoWriteCheck if the database driver doesn't implement
+// database.WriteChecker.
+func (m *Migrate) SetWriteCheck(writeCheck bool) error {
+	if _, ok := m.databaseDrv.(database.WriteChecker); !ok {
+		return ErrNoWriteCheck
+	}
+	m.writeCheck = writeCheck
+	return nil
+}
+
+// SetStrict makes Migrate check that the up migrations of all applied
+// versions are unchanged before running any migration, i.e. in CI to
+// enforce that applied migrations are never edited. Their checksums are
+// compared with the ones the database recorded when they were applied, and
+// the first changed one fails with ErrChecksumMismatch. Versions without
+// recorded checksum or missing from the source aren't checked. It returns
+// ErrNoChecksums if the database driver doesn't implement
+// database.Checksummer or doesn't record checksums.
+func (m *Migrate) SetStrict(strict bool) error {
+	if c, ok := m.databaseDrv.(database.Checksummer); !ok || !c.RecordsChecksums() {
+		return ErrNoChecksums
+	}
+	m.strict = strict
+	return nil
+}
+
+// SetContinueOnError makes Migrate report the errors of all remaining
+// migrations after one fails, instead of only the first, i.e. for bulk data
+// migrations. The version never advances past a failed migration: it stays
+// at the migration before, and the following migrations are only checked in
+// a rolled back transaction like Check. A migration failing the check is
+// left out and the rest checked again without it, so that all failures show
+// up at once. The errors are returned as MultiError, starting with the
+// error of the failed migration, followed by an ErrCheckFailed per failed
+// check. It returns ErrNoCheck if the database driver doesn't implement
+// database.Checker or doesn't support transactional DDL.
+func (m *Migrate) SetContinueOnError(continueOnError bool) error {
+	if _, ok := m.databaseDrv.(database.Checker); continueOnError && (!ok || !m.transactionalDDL()) {
+		return ErrNoCheck
+	}
+	m.continueOnError = continueOnError
+	return nil
+}
+
+// SetAllowEmptySource makes Up and Steps return ErrNoChange instead of an
+// os.ErrNotExist error if the source has no migrations and none has been
+// applied, i.e. for a new service without migrations yet.
+func (m *Migrate) SetAllowEmptySource(allow bool) {
+	m.allowEmptySource = allow
+}
+
+// SetConfirm sets a function asked before a down migration with a
+// `-- migrate:confirm "message"` directive runs, i.e. to prompt on a
+// terminal. It's called with the version and the message, and if it
+// returns false the migration fails with ErrNotConfirmed, leaving the
+// version unchanged. Without confirm, i.e. in non-interactive runs, the
+// message is only logged.
+func (m *Migrate) SetConfirm(confirm func(version uint, message string) bool) {
+	m.confirm = confirm
+}
+
+// SetAllowRunRange acknowledges that RunRange runs migrations which are
+// applied already again. RunRange returns ErrRunRangeNotAllowed until it's
+// set, since most migrations break if they run twice.
+func (m *Migrate) SetAllowRunRange(allow bool) {
+	m.allowRunRange = allow
+}
+
+// SetDeployID sets the id of the deploy or release running the migrations,
+// which the database driver records with each version it applies, see
+// DeployIDs. It's also in the AuditRecord of each migration. It returns
+// ErrNoDeployID if the database driver doesn't implement
+// database.DeployTagger or doesn't record deploy ids.
+func (m *Migrate) SetDeployID(id string) error {
+	t, ok := m.databaseDrv.(database.DeployTagger)
+	if !ok || !t.RecordsDeployIDs() {
+		return ErrNoDeployID
+	}
+	t.SetDeployID(id)
+	m.deployID = id
+	return nil
+}
+
+// SetClock replaces time.Now for the times Migrate records, i.e. in the
+// audit log, and for those of the database driver if it implements
+// database.ClockSetter, so that tests can assert them. Durations are
+// still measured with the wall clock.
+func (m *Migrate) SetClock(clock func() time.Time) {
+	m.clock = clock
+	if c, ok := m.databaseDrv.(database.ClockSetter); ok {
+		c.SetClock(clock)
+	}
+}
+
+// SetPreflight sets a function called with the database driver once the
+// lock is acquired, before the first migration runs, i.e. to assert that
+// no long-running transactions are active. An error returned by preflight
+// aborts the run, releases the lock and is returned.
+func (m *Migrate) SetPreflight(preflight func(d database.Driver) error) {
+	m.preflight = preflight
 }
 
 // Close closes the the source and the database.
@@ -206,7 +584,11 @@ func (m *Migrate) Close() (source error, database error) {
 
 // Migrate looks at the currently active migration version,
 // then migrates either up or down to the specified version.
-func (m *Migrate) Migrate(version uint) error {
+// Latest migrates to the last version of the source.
+// Migrating down returns ErrDownNotSupported if the source is up only.
+func (m *Migrate) Migrate(version uint) (err error) {
+	defer func(start time.Time) { m.postRun("Migrate", start, err) }(time.Now())
+
 	if err := m.lock(); err != nil {
 		return err
 	}
@@ -217,7 +599,21 @@ func (m *Migrate) Migrate(version uint) error {
 	}
 
 	if dirty {
-		return m.unlockErr(ErrDirty{curVersion})
+		return m.unlockErr(m.dirtyErr(curVersion))
+	}
+
+	if version == Latest {
+		if version, err = m.lastVersion(); err != nil {
+			return m.unlockErr(err)
+		}
+	}
+
+	if m.before(int(version), curVersion) && !m.downSupported() {
+		return m.unlockErr(ErrDownNotSupported)
+	}
+
+	if err := m.runPreflight(); err != nil {
+		return m.unlockErr(err)
 	}
 
 	ret := make(chan interface{}, m.PrefetchMigrations)
@@ -226,13 +622,40 @@ func (m *Migrate) Migrate(version uint) error {
 	return m.unlockErr(m.runMigrations(ret))
 }
 
+// lastVersion returns the last version of the source in the order Up
+// applies them, i.e. the highest one unless OrderByDependencies was called.
+func (m *Migrate) lastVersion() (uint, error) {
+	last, err := m.sourceDrv.First()
+	if os.IsNotExist(err) && m.allowEmptySource {
+		return 0, ErrNoChange
+	} else if err != nil {
+		return 0, err
+	}
+	for {
+		next, err := m.sourceDrv.Next(last)
+		if os.IsNotExist(err) {
+			return last, nil
+		} else if err != nil {
+			return 0, err
+		}
+		last = next
+	}
+}
+
 // Steps looks at the currently active migration version.
 // It will migrate up if n > 0, and down if n < 0.
-func (m *Migrate) Steps(n int) error {
+// Migrating down returns ErrDownNotSupported if the source is up only.
+func (m *Migrate) Steps(n int) (err error) {
+	defer func(start time.Time) { m.postRun("Steps", start, err) }(time.Now())
+
 	if n == 0 {
 		return ErrNoChange
 	}
 
+	if n < 0 && !m.downSupported() {
+		return ErrDownNotSupported
+	}
+
 	if err := m.lock(); err != nil {
 		return err
 	}
@@ -243,7 +666,11 @@ func (m *Migrate) Steps(n int) error {
 	}
 
 	if dirty {
-		return m.unlockErr(ErrDirty{curVersion})
+		return m.unlockErr(m.dirtyErr(curVersion))
+	}
+
+	if err := m.runPreflight(); err != nil {
+		return m.unlockErr(err)
 	}
 
 	ret := make(chan interface{}, m.PrefetchMigrations)
@@ -259,18 +686,100 @@ func (m *Migrate) Steps(n int) error {
 
 // Up looks at the currently active migration version
 // and will migrate all the way up (applying all up migrations).
-func (m *Migrate) Up() error {
-	if err := m.lock(); err != nil {
+// If the database driver implements database.TryLocker, Up waits up to
+// LockTimeout while another process holds the lock, and returns ErrNoChange
+// if that process migrated all the way up in the meantime.
+func (m *Migrate) Up() (err error) {
+	defer func(start time.Time) { m.postRun("Up", start, err) }(time.Now())
+
+	if err := m.waitLock(); err != nil {
+		return err
+	}
+	return m.upLocked()
+}
+
+// TryUp is like Up, but returns false without migrating if the database
+// is locked, i.e. because another instance of the application migrates.
+// It returns ErrNoTryLock if the database driver doesn't implement
+// database.TryLocker.
+func (m *Migrate) TryUp() (acquired bool, err error) {
+	acquired, err = m.tryLock()
+	if !acquired || err != nil {
+		return false, err
+	}
+	return true, m.upLocked()
+}
+
+// RunOnce migrates all the way up exactly once across many processes
+// starting at the same time, i.e. the pods of a deployment. The process
+// acquiring the lock first is elected to migrate, like with Up. The other
+// ones wait until it released the lock and return ErrNoChange, the error
+// of the dirty version it left behind, or ErrPending if it left migrations
+// pending. They don't retry migrations the elected process failed on.
+// Waiting isn't limited by LockTimeout, but by ctx, since the elected
+// process may migrate for a long time. Like waitLock, the waiting ones back
+// off with jitter, so that they don't poll the lock in lockstep.
+// It returns ErrNoTryLock if the database driver doesn't implement
+// database.TryLocker.
+func (m *Migrate) RunOnce(ctx context.Context) error {
+	acquired, err := m.tryLock()
+	if err != nil {
 		return err
 	}
+	if acquired {
+		return m.upLocked()
+	}
+
+	backoff := database.NewBackoff(lockRetryBaseDelay, lockRetryMaxDelay)
+	for !acquired {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff.Next()):
+		}
+
+		if acquired, err = m.tryLock(); err != nil {
+			return err
+		}
+	}
 
+	curVersion, dirty, err := m.databaseDrv.Version()
+	if err != nil {
+		return m.unlockErr(err)
+	}
+	if dirty {
+		return m.unlockErr(m.dirtyErr(curVersion))
+	}
+
+	// a failed migration rolled back leaves a clean, but outdated version
+	last, err := m.lastVersion()
+	if err != nil {
+		return m.unlockErr(err)
+	}
+	if curVersion != int(last) {
+		return m.unlockErr(ErrPending{Version: curVersion, Last: last})
+	}
+	return m.unlockErr(ErrNoChange)
+}
+
+// upLocked migrates all the way up once the lock is acquired
+// and releases it afterwards.
+func (m *Migrate) upLocked() error {
 	curVersion, dirty, err := m.databaseDrv.Version()
 	if err != nil {
 		return m.unlockErr(err)
 	}
 
 	if dirty {
-		return m.unlockErr(ErrDirty{curVersion})
+		return m.unlockErr(m.dirtyErr(curVersion))
+	}
+
+	if err := m.checkOutOfOrder(curVersion); err != nil {
+		return m.unlockErr(err)
+	}
+
+	if err := m.runPreflight(); err != nil {
+		return m.unlockErr(err)
 	}
 
 	ret := make(chan interface{}, m.PrefetchMigrations)
@@ -279,9 +788,88 @@ func (m *Migrate) Up() error {
 	return m.unlockErr(m.runMigrations(ret))
 }
 
+// UpTagged looks at the currently active migration version and applies
+// the pending up migrations carrying tag in a `-- migrate:tag` directive.
+// Since only a single version is tracked, it stops at the first pending
+// migration without tag, so that no migration is ever skipped. This way
+// leading "pre-deploy" migrations can be applied before new code is
+// deployed and Up applies the remaining ones afterwards.
+func (m *Migrate) UpTagged(tag string) error {
+	if err := m.lock(); err != nil {
+		return err
+	}
+
+	curVersion, dirty, err := m.databaseDrv.Version()
+	if err != nil {
+		return m.unlockErr(err)
+	}
+
+	if dirty {
+		return m.unlockErr(m.dirtyErr(curVersion))
+	}
+
+	if err := m.checkOutOfOrder(curVersion); err != nil {
+		return m.unlockErr(err)
+	}
+
+	if err := m.runPreflight(); err != nil {
+		return m.unlockErr(err)
+	}
+
+	ret := make(chan interface{}, m.PrefetchMigrations)
+
+	go m.readUpTagged(curVersion, tag, ret)
+	return m.unlockErr(m.runMigrations(ret))
+}
+
+// UpSince looks at the currently active migration version and applies the
+// pending up migrations whose version is greater than cutoff, i.e. for
+// timestamp versions those created after a date, skipping the older
+// pending ones. Since only a single version is tracked, skipped migrations
+// count as applied once a later version is: Up won't apply them afterwards.
+// With a database.Historian they are reported as out of order, see
+// SetOutOfOrder, so that they can be applied deliberately.
+func (m *Migrate) UpSince(cutoff uint) (err error) {
+	defer func(start time.Time) { m.postRun("UpSince", start, err) }(time.Now())
+
+	if err := m.lock(); err != nil {
+		return err
+	}
+
+	curVersion, dirty, err := m.databaseDrv.Version()
+	if err != nil {
+		return m.unlockErr(err)
+	}
+
+	if dirty {
+		return m.unlockErr(m.dirtyErr(curVersion))
+	}
+
+	if err := m.checkOutOfOrder(curVersion); err != nil {
+		return m.unlockErr(err)
+	}
+
+	if err := m.runPreflight(); err != nil {
+		return m.unlockErr(err)
+	}
+
+	ret := make(chan interface{}, m.PrefetchMigrations)
+
+	go m.readUpSince(curVersion, cutoff, ret)
+	return m.unlockErr(m.runMigrations(ret))
+}
+
 // Down looks at the currently active migration version
 // and will migrate all the way down (applying all down migrations).
-func (m *Migrate) Down() error {
+// It returns ErrDownNotSupported if the source is up only, see
+// source.CapabilityReporter.
+func (m *Migrate) Down() (err error) {
+	defer func(start time.Time) { m.postRun("Down", start, err) }(time.Now())
+
+	if !m.downSupported() {
+		return ErrDownNotSupported
+	}
+
 	if err := m.lock(); err != nil {
 		return err
 	}
@@ -292,7 +880,11 @@ func (m *Migrate) Down() error {
 	}
 
 	if dirty {
-		return m.unlockErr(ErrDirty{curVersion})
+		return m.unlockErr(m.dirtyErr(curVersion))
+	}
+
+	if err := m.runPreflight(); err != nil {
+		return m.unlockErr(err)
 	}
 
 	ret := make(chan interface{}, m.PrefetchMigrations)
@@ -330,7 +922,11 @@ func (m *Migrate) Run(migration ...*Migration) error {
 	}
 
 	if dirty {
-		return m.unlockErr(ErrDirty{curVersion})
+		return m.unlockErr(m.dirtyErr(curVersion))
+	}
+
+	if err := m.runPreflight(); err != nil {
+		return m.unlockErr(err)
 	}
 
 	ret := make(chan interface{}, m.PrefetchMigrations)
@@ -371,6 +967,432 @@ func (m *Migrate) Force(version int) error {
 	return m.unlock()
 }
 
+// ForceUnlock releases a lock left behind by a crashed process, even if the
+// database is dirty. It must not be called while another process migrates.
+// It returns ErrNoForceUnlock if the database driver doesn't implement
+// database.ForceUnlocker, i.e. because its locks are released with the
+// connection of the crashed process.
+func (m *Migrate) ForceUnlock() error {
+	unlocker, ok := m.databaseDrv.(database.ForceUnlocker)
+	if !ok {
+		return ErrNoForceUnlock
+	}
+	return unlocker.ForceUnlock()
+}
+
+// Baseline marks a database with an existing schema as being at version,
+// without running any migration, so that Up continues with the migrations
+// after version. Unlike Force, it only sets the version if the database
+// doesn't track one yet, and returns ErrBaselineTracked otherwise.
+// version has to exist in the source.
+func (m *Migrate) Baseline(version uint) error {
+	if err := m.lock(); err != nil {
+		return err
+	}
+
+	curVersion, dirty, err := m.databaseDrv.Version()
+	if err != nil {
+		return m.unlockErr(err)
+	}
+
+	if curVersion != database.NilVersion || dirty {
+		return m.unlockErr(ErrBaselineTracked{curVersion, dirty})
+	}
+
+	if err := m.versionExists(version); err != nil {
+		return m.unlockErr(err)
+	}
+
+	if err := m.databaseDrv.SetVersion(int(version), false); err != nil {
+		return m.unlockErr(err)
+	}
+
+	return m.unlock()
+}
+
+// Replay runs the up migration of an already applied version again,
+// without touching any other migration. The recorded version doesn't change,
+// but the database is marked dirty while the migration runs.
+// Making the migration safe to run twice is up to you.
+// It returns ErrNotApplied if version is beyond the current version.
+func (m *Migrate) Replay(version uint) error {
+	if err := m.lock(); err != nil {
+		return err
+	}
+
+	curVersion, dirty, err := m.databaseDrv.Version()
+	if err != nil {
+		return m.unlockErr(err)
+	}
+
+	if dirty {
+		return m.unlockErr(m.dirtyErr(curVersion))
+	}
+
+	if curVersion == database.NilVersion || m.before(curVersion, int(version)) {
+		return m.unlockErr(ErrNotApplied)
+	}
+
+	migr, err := m.newMigration(version, int(version))
+	if err != nil {
+		return m.unlockErr(err)
+	}
+
+	if migr.Body == nil {
+		return m.unlockErr(ErrNoChange)
+	}
+
+	m.logPrintf("MANUAL OVERRIDE: replaying %v, database stays at version %v\n", migr.LogString(), curVersion)
+	go migr.Buffer()
+
+	if err := m.databaseDrv.SetVersion(curVersion, true); err != nil {
+		return m.unlockErr(err)
+	}
+
+	if err := m.runAudited(migr); err != nil {
+		return m.unlockErr(err)
+	}
+
+	if err := m.databaseDrv.SetVersion(curVersion, false); err != nil {
+		return m.unlockErr(err)
+	}
+
+	return m.unlock()
+}
+
+// RunRange runs the up or down migrations of all applied versions in
+// [from, to] again, i.e. idempotent data fixes. Up migrations run in order,
+// down migrations in reverse order. The recorded version doesn't change,
+// but the database is marked dirty while the migrations run.
+// It returns ErrRunRangeNotAllowed unless allowed with SetAllowRunRange,
+// ErrNotApplied if a version in the range is beyond the current version
+// and ErrNoChange if the range has no migrations in direction.
+func (m *Migrate) RunRange(from, to uint, direction source.Direction) error {
+	if !m.allowRunRange {
+		return ErrRunRangeNotAllowed
+	}
+	if from > to {
+		return ErrInvalidRange
+	}
+	switch direction {
+	case source.Up:
+	case source.Down:
+		if !m.downSupported() {
+			return ErrDownNotSupported
+		}
+	default:
+		return fmt.Errorf("invalid direction %q", direction)
+	}
+
+	if err := m.lock(); err != nil {
+		return err
+	}
+
+	curVersion, dirty, err := m.databaseDrv.Version()
+	if err != nil {
+		return m.unlockErr(err)
+	}
+
+	if dirty {
+		return m.unlockErr(m.dirtyErr(curVersion))
+	}
+
+	versions, err := m.versionRange(from, to)
+	if err != nil {
+		return m.unlockErr(err)
+	}
+	for _, version := range versions {
+		if curVersion == database.NilVersion || m.before(curVersion, int(version)) {
+			return m.unlockErr(ErrNotApplied)
+		}
+	}
+
+	migrs := make([]*Migration, 0, len(versions))
+	for _, version := range versions {
+		targetVersion := int(version)
+		if direction == source.Down {
+			prev, err := m.sourceDrv.Prev(version)
+			if os.IsNotExist(err) {
+				targetVersion = database.NilVersion
+			} else if err != nil {
+				return m.unlockErr(err)
+			} else {
+				targetVersion = int(prev)
+			}
+		}
+		migr, err := m.newMigration(version, targetVersion)
+		if err != nil {
+			return m.unlockErr(err)
+		}
+		if migr.Body != nil {
+			migrs = append(migrs, migr)
+		}
+	}
+	if len(migrs) == 0 {
+		return m.unlockErr(ErrNoChange)
+	}
+	if direction == source.Down {
+		for i, j := 0, len(migrs)-1; i < j; i, j = i+1, j-1 {
+			migrs[i], migrs[j] = migrs[j], migrs[i]
+		}
+	}
+
+	if err := m.databaseDrv.SetVersion(curVersion, true); err != nil {
+		return m.unlockErr(err)
+	}
+
+	for _, migr := range migrs {
+		m.logPrintf("MANUAL OVERRIDE: running %v again, database stays at version %v\n", migr.LogString(), curVersion)
+		go migr.Buffer()
+
+		if err := m.runAudited(migr); err != nil {
+			return m.unlockErr(err)
+		}
+	}
+
+	if err := m.databaseDrv.SetVersion(curVersion, false); err != nil {
+		return m.unlockErr(err)
+	}
+
+	return m.unlock()
+}
+
+// versionRange returns the versions of the source in [from, to],
+// in the order of the source.
+func (m *Migrate) versionRange(from, to uint) ([]uint, error) {
+	versions := make([]uint, 0)
+	version, err := m.sourceDrv.First()
+	for err == nil {
+		if version >= from && version <= to {
+			versions = append(versions, version)
+		}
+		version, err = m.sourceDrv.Next(version)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// Squash records that the migrations up to and including version were
+// collapsed into a single up migration with that version, i.e. the schema
+// Dump returned at that version, so that it counts as applied in place of
+// the squashed range. The source has to start with the squashed migration,
+// otherwise it returns ErrSquashNotReplaced.
+// If the database driver implements database.Squasher, it records the
+// squashed migration and its checksum in place of the range. Drivers that
+// only track the current version keep it, as it stays applied.
+// A database without any migration applied runs the squashed migration as
+// pending and records nothing. Any version in between returns
+// ErrSquashPartial, since the database couldn't catch up once the squashed
+// migrations are removed from the source.
+func (m *Migrate) Squash(version uint) error {
+	if err := m.lock(); err != nil {
+		return err
+	}
+
+	curVersion, dirty, err := m.databaseDrv.Version()
+	if err != nil {
+		return m.unlockErr(err)
+	}
+
+	if dirty {
+		return m.unlockErr(m.dirtyErr(curVersion))
+	}
+
+	first, err := m.sourceDrv.First()
+	if err != nil {
+		return m.unlockErr(err)
+	}
+	if first != version {
+		return m.unlockErr(ErrSquashNotReplaced{first, version})
+	}
+	migration, err := m.Read(version, source.Up)
+	if err != nil {
+		return m.unlockErr(err)
+	}
+
+	if curVersion == database.NilVersion {
+		return m.unlock()
+	}
+
+	if m.before(curVersion, int(version)) {
+		return m.unlockErr(ErrSquashPartial{curVersion, version})
+	}
+
+	if s, ok := m.databaseDrv.(database.Squasher); ok {
+		if err := s.Squash(int(version), migration); err != nil {
+			return m.unlockErr(err)
+		}
+	}
+
+	return m.unlock()
+}
+
+// RoundTrip runs the up and then the down migration of version in a single
+// transaction, which is rolled back afterwards, to check in tests that the
+// down migration applies. The database and its version are left unchanged.
+// It returns ErrNoRoundTrip if the database driver doesn't implement
+// database.RoundTripper or doesn't support transactional DDL, and
+// ErrDownNotSupported if the source is up only.
+func (m *Migrate) RoundTrip(version uint) error {
+	rt, ok := m.databaseDrv.(database.RoundTripper)
+	if !ok || !m.transactionalDDL() {
+		return ErrNoRoundTrip
+	}
+	if !m.downSupported() {
+		return ErrDownNotSupported
+	}
+
+	up, err := m.Read(version, source.Up)
+	if err != nil {
+		return err
+	}
+	down, err := m.Read(version, source.Down)
+	if err != nil {
+		return err
+	}
+
+	if err := m.lock(); err != nil {
+		return err
+	}
+
+	curVersion, dirty, err := m.databaseDrv.Version()
+	if err != nil {
+		return m.unlockErr(err)
+	}
+
+	if dirty {
+		return m.unlockErr(m.dirtyErr(curVersion))
+	}
+
+	if err := rt.RoundTrip(bytes.NewReader(up), bytes.NewReader(down)); err != nil {
+		return m.unlockErr(err)
+	}
+
+	return m.unlock()
+}
+
+// Check runs all pending up migrations in a single transaction, which is
+// rolled back afterwards, to check that they apply against a real database,
+// i.e. a replica of production. The database and its version are left
+// unchanged. It returns ErrCheckFailed for the first migration that fails,
+// the following ones depend on it and aren't run. It returns ErrNoCheck if
+// the database driver doesn't implement database.Checker or doesn't support
+// transactional DDL.
+func (m *Migrate) Check() error {
+	checker, ok := m.databaseDrv.(database.Checker)
+	if !ok || !m.transactionalDDL() {
+		return ErrNoCheck
+	}
+
+	if err := m.lock(); err != nil {
+		return err
+	}
+
+	curVersion, dirty, err := m.databaseDrv.Version()
+	if err != nil {
+		return m.unlockErr(err)
+	}
+
+	if dirty {
+		return m.unlockErr(m.dirtyErr(curVersion))
+	}
+
+	versions, bodies, err := m.pendingUp(curVersion)
+	if err != nil {
+		return m.unlockErr(err)
+	}
+	if len(versions) == 0 {
+		return m.unlock()
+	}
+
+	migrations := make([]io.Reader, len(bodies))
+	for i, body := range bodies {
+		migrations[i] = bytes.NewReader(body)
+	}
+	if failed, err := checker.Check(migrations); err != nil {
+		if failed >= 0 && failed < len(versions) {
+			err = ErrCheckFailed{Version: versions[failed], Err: err}
+		}
+		return m.unlockErr(err)
+	}
+
+	return m.unlock()
+}
+
+// pendingUp returns the versions and bodies of the up migrations
+// after curVersion in the order Up runs them.
+func (m *Migrate) pendingUp(curVersion int) ([]uint, [][]byte, error) {
+	var version uint
+	var err error
+	if curVersion == database.NilVersion {
+		version, err = m.sourceDrv.First()
+	} else {
+		version, err = m.sourceDrv.Next(suint(curVersion))
+	}
+
+	versions := make([]uint, 0)
+	bodies := make([][]byte, 0)
+	for err == nil {
+		body, rerr := m.Read(version, source.Up)
+		if rerr == nil {
+			versions = append(versions, version)
+			bodies = append(bodies, body)
+		} else if !os.IsNotExist(rerr) {
+			return nil, nil, rerr
+		}
+		version, err = m.sourceDrv.Next(version)
+	}
+	if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	return versions, bodies, nil
+}
+
+// Dump returns the current schema of the database as statements that can
+// serve as the body of a squashed migration. It returns ErrNoDump if the
+// database driver doesn't implement database.Dumper.
+func (m *Migrate) Dump() ([]byte, error) {
+	dumper, ok := m.databaseDrv.(database.Dumper)
+	if !ok {
+		return nil, ErrNoDump
+	}
+
+	if err := m.lock(); err != nil {
+		return nil, err
+	}
+
+	dump, err := dumper.Dump()
+	if err != nil {
+		return nil, m.unlockErr(err)
+	}
+
+	return dump, m.unlock()
+}
+
+// Read returns the body of the migration version in direction from the
+// source, without running it, i.e. to record what ran in an audit log.
+// It returns os.ErrNotExist if the source has no such migration.
+func (m *Migrate) Read(version uint, direction source.Direction) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch direction {
+	case source.Up:
+		r, _, err = m.sourceDrv.ReadUp(version)
+	case source.Down:
+		r, _, err = m.sourceDrv.ReadDown(version)
+	default:
+		return nil, fmt.Errorf("invalid direction %q", direction)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(newBOMReader(r))
+}
+
 // Version returns the currently active migration version.
 // If no migration has been applied, yet, it will return ErrNilVersion.
 func (m *Migrate) Version() (version uint, dirty bool, err error) {
@@ -382,8 +1404,42 @@ func (m *Migrate) Version() (version uint, dirty bool, err error) {
 	if v == database.NilVersion {
 		return 0, false, ErrNilVersion
 	}
-
-	return suint(v), d, nil
+
+	return suint(v), d, nil
+}
+
+// LastAppliedAt returns when the last migration was applied, if the
+// database driver records it, see database.Timestamper. It returns false
+// if the driver doesn't record times or no migration has been applied yet.
+func (m *Migrate) LastAppliedAt() (time.Time, bool, error) {
+	t, ok := m.databaseDrv.(database.Timestamper)
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	return t.LastAppliedAt()
+}
+
+// DeployIDs returns the deploy id recorded for each applied version,
+// see SetDeployID, i.e. to find the release that introduced a migration.
+// Versions applied without deploy id are left out. It returns
+// ErrNoDeployID if the database driver doesn't implement
+// database.DeployTagger.
+func (m *Migrate) DeployIDs() (map[uint]string, error) {
+	t, ok := m.databaseDrv.(database.DeployTagger)
+	if !ok {
+		return nil, ErrNoDeployID
+	}
+	ids, err := t.DeployIDs()
+	if err != nil {
+		return nil, err
+	}
+	deployIDs := make(map[uint]string, len(ids))
+	for v, id := range ids {
+		if v >= 0 {
+			deployIDs[uint(v)] = id
+		}
+	}
+	return deployIDs, nil
 }
 
 // read reads either up or down migrations from source `from` to `to`.
@@ -415,7 +1471,7 @@ func (m *Migrate) read(from int, to int, ret chan<- interface{}) {
 		return
 	}
 
-	if from < to {
+	if m.before(from, to) {
 		// it's going up
 		// apply first migration if from is nil version
 		if from == -1 {
@@ -437,7 +1493,7 @@ func (m *Migrate) read(from int, to int, ret chan<- interface{}) {
 		}
 
 		// run until we reach target ...
-		for from < to {
+		for m.before(from, to) {
 			if m.stop() {
 				return
 			}
@@ -462,7 +1518,7 @@ func (m *Migrate) read(from int, to int, ret chan<- interface{}) {
 	} else {
 		// it's going down
 		// run until we reach target ...
-		for from > to && from >= 0 {
+		for m.before(to, from) && from >= 0 {
 			if m.stop() {
 				return
 			}
@@ -527,7 +1583,10 @@ func (m *Migrate) readUp(from int, limit int, ret chan<- interface{}) {
 		// apply first migration if from is nil version
 		if from == -1 {
 			firstVersion, err := m.sourceDrv.First()
-			if err != nil {
+			if os.IsNotExist(err) && m.allowEmptySource {
+				ret <- ErrNoChange
+				return
+			} else if err != nil {
 				ret <- err
 				return
 			}
@@ -589,6 +1648,136 @@ func (m *Migrate) readUp(from int, limit int, ret chan<- interface{}) {
 	}
 }
 
+// readUpTagged reads up migrations from `from` as long as they carry tag.
+// Each migration is then written to the ret channel.
+// If an error occurs during reading, that error is written to the ret channel, too.
+// Once readUpTagged is done reading it will close the ret channel.
+func (m *Migrate) readUpTagged(from int, tag string, ret chan<- interface{}) {
+	defer close(ret)
+
+	// check if from version exists
+	if from >= 0 {
+		if m.versionExists(suint(from)) != nil {
+			ret <- os.ErrNotExist
+			return
+		}
+	}
+
+	count := 0
+	for {
+		if m.stop() {
+			return
+		}
+
+		var next uint
+		var err error
+		if from == -1 {
+			next, err = m.sourceDrv.First()
+		} else {
+			next, err = m.sourceDrv.Next(suint(from))
+		}
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			ret <- err
+			return
+		}
+
+		tagged, err := m.versionHasTag(next, tag)
+		if err != nil {
+			ret <- err
+			return
+		}
+		if !tagged {
+			break
+		}
+
+		migr, err := m.newMigration(next, int(next))
+		if err != nil {
+			ret <- err
+			return
+		}
+
+		ret <- migr
+		go migr.Buffer()
+		from = int(next)
+		count++
+	}
+
+	if count == 0 {
+		ret <- ErrNoChange
+	}
+}
+
+// readUpSince reads the up migrations after from, skipping those whose
+// version isn't greater than cutoff, and writes them to the ret channel
+// like readUp.
+func (m *Migrate) readUpSince(from int, cutoff uint, ret chan<- interface{}) {
+	defer close(ret)
+
+	// check if from version exists
+	if from >= 0 {
+		if m.versionExists(suint(from)) != nil {
+			ret <- os.ErrNotExist
+			return
+		}
+	}
+
+	count := 0
+	for {
+		if m.stop() {
+			return
+		}
+
+		var next uint
+		var err error
+		if from == -1 {
+			next, err = m.sourceDrv.First()
+		} else {
+			next, err = m.sourceDrv.Next(suint(from))
+		}
+		if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			ret <- err
+			return
+		}
+		from = int(next)
+
+		if next <= cutoff {
+			m.logVerbosePrintf("Skipping %v, not after cutoff %v\n", next, cutoff)
+			continue
+		}
+
+		migr, err := m.newMigration(next, int(next))
+		if err != nil {
+			ret <- err
+			return
+		}
+
+		ret <- migr
+		go migr.Buffer()
+		count++
+	}
+
+	if count == 0 {
+		ret <- ErrNoChange
+	}
+}
+
+// versionHasTag reports whether the up migration for version carries tag.
+// A version without up migration carries no tags.
+func (m *Migrate) versionHasTag(version uint, tag string) (bool, error) {
+	r, _, err := m.sourceDrv.ReadUp(version)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	return hasTag(r, tag)
+}
+
 // readDown reads down migrations from `from` limitted by `limit`.
 // limit can be -1, implying no limit and reading until there are no more migrations.
 // Each migration is then written to the ret channel.
@@ -678,12 +1867,19 @@ func (m *Migrate) readDown(from int, limit int, ret chan<- interface{}) {
 // to stop execution because it might have received a stop signal on the
 // GracefulStop channel.
 func (m *Migrate) runMigrations(ret <-chan interface{}) error {
+	applied := 0
 	for r := range ret {
 
 		if m.stop() {
 			return nil
 		}
 
+		if _, ok := r.(*Migration); ok && applied > 0 && m.interMigrationDelay > 0 {
+			if !m.pause(m.interMigrationDelay) {
+				return nil
+			}
+		}
+
 		switch r.(type) {
 		case error:
 			return r.(error)
@@ -691,22 +1887,49 @@ func (m *Migrate) runMigrations(ret <-chan interface{}) error {
 		case *Migration:
 			migr := r.(*Migration)
 
-			// set version with dirty state
-			if err := m.databaseDrv.SetVersion(migr.TargetVersion, true); err != nil {
-				return err
+			if migr.Body != nil {
+				if err := m.checkDirectives(migr); err != nil {
+					return err
+				}
+			}
+
+			// set version with dirty state, unless a failed migration
+			// is rolled back and leaves the database unchanged anyway
+			dirty := !m.transactionalDDL() || migr.partial
+			if dirty {
+				if err := m.databaseDrv.SetVersion(migr.TargetVersion, true); err != nil {
+					return err
+				}
 			}
 
 			if migr.Body != nil {
 				m.logVerbosePrintf("Read and execute %v\n", migr.LogString())
-				if err := m.databaseDrv.Run(migr.BufferedBody); err != nil {
+				if err := m.runAudited(migr); err != nil {
+					if _, ok := err.(ErrAudit); ok {
+						// the migration is applied, so it must not stay
+						// recorded as pending and run again
+						if !dirty {
+							m.databaseDrv.SetVersion(migr.TargetVersion, true)
+						}
+						return err
+					}
+					if m.continueOnError {
+						return m.checkRemaining(err, ret)
+					}
 					return err
 				}
 			}
 
 			// set clean state
 			if err := m.databaseDrv.SetVersion(migr.TargetVersion, false); err != nil {
+				// the migration is committed, so the last clean version
+				// must not stay recorded as if it hadn't run
+				if !dirty {
+					m.databaseDrv.SetVersion(migr.TargetVersion, true)
+				}
 				return err
 			}
+			applied++
 
 			endTime := time.Now()
 			readTime := migr.FinishedReading.Sub(migr.StartedBuffering)
@@ -728,6 +1951,179 @@ func (m *Migrate) runMigrations(ret <-chan interface{}) error {
 	return nil
 }
 
+// checkRemaining reads the migrations left in ret after one failed with
+// runErr and checks them without changing the version, see
+// SetContinueOnError. It returns all errors as MultiError.
+func (m *Migrate) checkRemaining(runErr error, ret <-chan interface{}) error {
+	errs := []error{runErr}
+	versions := make([]uint, 0)
+	bodies := make([][]byte, 0)
+	for r := range ret {
+		switch r := r.(type) {
+		case error:
+			errs = append(errs, r)
+		case *Migration:
+			if r.Body == nil {
+				continue
+			}
+			body, err := ioutil.ReadAll(r.BufferedBody)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			versions = append(versions, r.Version)
+			bodies = append(bodies, body)
+		}
+	}
+
+	checker := m.databaseDrv.(database.Checker)
+	for len(versions) > 0 {
+		migrations := make([]io.Reader, len(bodies))
+		for i, body := range bodies {
+			migrations[i] = bytes.NewReader(body)
+		}
+		failed, err := checker.Check(migrations)
+		if err == nil {
+			break
+		}
+		if failed < 0 || failed >= len(versions) {
+			errs = append(errs, err)
+			break
+		}
+		errs = append(errs, ErrCheckFailed{Version: versions[failed], Err: err})
+
+		// check the following migrations again without the failed one
+		versions = append(versions[:failed:failed], versions[failed+1:]...)
+		bodies = append(bodies[:failed:failed], bodies[failed+1:]...)
+	}
+	return NewMultiError(errs...)
+}
+
+// runBody runs the body of migr against the database, passing its version
+// along if the database driver implements database.VersionRunner.
+func (m *Migrate) runBody(migr *Migration) error {
+	if migr.Timeout > 0 {
+		return m.runTimeout(migr)
+	}
+	if r, ok := m.databaseDrv.(database.VersionRunner); ok {
+		return r.RunVersion(migr.Version, migr.BufferedBody)
+	}
+	return m.databaseDrv.Run(migr.BufferedBody)
+}
+
+// runTimeout runs the body of migr with a context which expires after
+// migr.Timeout, which cancels the migration in the database driver.
+func (m *Migrate) runTimeout(migr *Migration) error {
+	r, ok := m.databaseDrv.(database.ContextRunner)
+	if !ok {
+		return ErrNoTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), migr.Timeout)
+	defer cancel()
+	err := r.RunContext(ctx, migr.Version, migr.BufferedBody)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return ErrMigrationTimeout{Version: migr.Version, Timeout: migr.Timeout, Err: err}
+	}
+	return err
+}
+
+// checkDirectives evaluates the `-- migrate:assert` directives of migr
+// before it runs, and for a down migration asks to confirm its
+// `-- migrate:confirm` directive. It sets the timeout of migr from its
+// `-- migrate:timeout` directive, and whether it runs in a single
+// transaction. They are parsed from the buffered body of migr, which is
+// read into memory for that and runs from there.
+func (m *Migrate) checkDirectives(migr *Migration) error {
+	body, err := ioutil.ReadAll(migr.BufferedBody)
+	if err != nil {
+		return err
+	}
+	migr.BufferedBody = bytes.NewReader(body)
+
+	if t, ok := m.databaseDrv.(database.MigrationTransactional); ok {
+		migr.partial = !t.TransactionalMigration(body)
+	}
+	if err := m.checkTimeout(migr, body); err != nil {
+		return err
+	}
+	if err := m.checkAssertions(migr, body); err != nil {
+		return err
+	}
+	if migr.direction() == source.Down {
+		return m.checkConfirm(migr, body)
+	}
+	return nil
+}
+
+// checkTimeout sets the timeout of migr from the `-- migrate:timeout`
+// directive in body, the body of migr, before anything runs.
+func (m *Migrate) checkTimeout(migr *Migration, body []byte) error {
+	timeout, err := migrationTimeout(bytes.NewReader(body))
+	if err != nil || timeout == 0 {
+		return err
+	}
+	if _, ok := m.databaseDrv.(database.ContextRunner); !ok {
+		return ErrNoTimeout
+	}
+	migr.Timeout = timeout
+	return nil
+}
+
+// checkAssertions evaluates the `-- migrate:assert` directives
+// in body, the body of migr.
+func (m *Migrate) checkAssertions(migr *Migration, body []byte) error {
+	asserts, err := assertions(bytes.NewReader(body))
+	if err != nil || len(asserts) == 0 {
+		return err
+	}
+	q, ok := m.databaseDrv.(database.Querier)
+	if !ok {
+		return ErrNoQuerier
+	}
+	for _, assertion := range asserts {
+		m.logVerbosePrintf("Assert %v for %v\n", assertion, migr.LogString())
+		ok, err := q.QueryBool(assertion)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return ErrAssertionFailed{Version: migr.Version, Assertion: assertion}
+		}
+	}
+	return nil
+}
+
+// checkConfirm asks to confirm the `-- migrate:confirm` directive in
+// body, the body of the down migration migr, or logs its message
+// without confirm function.
+func (m *Migrate) checkConfirm(migr *Migration, body []byte) error {
+	message, err := confirmMessage(bytes.NewReader(body))
+	if err != nil || len(message) == 0 {
+		return err
+	}
+	if m.confirm == nil {
+		m.logPrintf("WARNING: %v: %v\n", migr.LogString(), message)
+		return nil
+	}
+	if !m.confirm(migr.Version, message) {
+		return ErrNotConfirmed{Version: migr.Version, Message: message}
+	}
+	return nil
+}
+
+// downSupported returns false if the source reports that it has
+// no down migrations.
+func (m *Migrate) downSupported() bool {
+	return !source.CapabilitiesOf(m.sourceDrv).UpOnly
+}
+
+// transactionalDDL returns true if the database driver reports
+// that it runs each migration in a single transaction.
+func (m *Migrate) transactionalDDL() bool {
+	t, ok := m.databaseDrv.(database.Transactional)
+	return ok && t.TransactionalDDL()
+}
+
 // versionExists checks the source if either the up or down migration for
 // the specified migration version exists.
 func (m *Migrate) versionExists(version uint) error {
@@ -756,6 +2152,93 @@ func (m *Migrate) versionExists(version uint) error {
 	return os.ErrNotExist
 }
 
+// checkOutOfOrder applies the out-of-order policy to the source versions
+// older than curVersion, which the database hasn't applied.
+func (m *Migrate) checkOutOfOrder(curVersion int) error {
+	if m.outOfOrder == OutOfOrderAllow {
+		return nil
+	}
+
+	versions, err := m.outOfOrderVersions(curVersion)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return nil
+	}
+
+	if m.outOfOrder == OutOfOrderWarn {
+		m.logPrintf("WARNING: migrations %v are older than database version %v, but not applied\n", versions, curVersion)
+		return nil
+	}
+	return ErrOutOfOrder{Versions: versions, Version: curVersion}
+}
+
+// runPreflight checks the required privileges and write access and calls
+// the preflight function, if set, before migrating.
+func (m *Migrate) runPreflight() error {
+	if err := m.checkPrivileges(); err != nil {
+		return err
+	}
+	if checker, ok := m.databaseDrv.(database.WriteChecker); ok && m.writeCheck {
+		if err := checker.CheckWrite(); err != nil {
+			return err
+		}
+	}
+	if m.strict {
+		if err := m.checkChecksums(); err != nil {
+			return err
+		}
+	}
+	if m.preflight != nil {
+		return m.preflight(m.databaseDrv)
+	}
+	return nil
+}
+
+// checkPrivileges checks the privileges set with SetRequiredPrivileges.
+func (m *Migrate) checkPrivileges() error {
+	checker, ok := m.databaseDrv.(database.PrivilegeChecker)
+	if !ok || len(m.requiredPrivileges) == 0 {
+		return nil
+	}
+	return checker.CheckPrivileges(m.requiredPrivileges)
+}
+
+// outOfOrderVersions returns the source versions older than curVersion,
+// which the database hasn't applied. Without database.Historian there is
+// nothing to compare with and none are returned.
+func (m *Migrate) outOfOrderVersions(curVersion int) ([]uint, error) {
+	historian, ok := m.databaseDrv.(database.Historian)
+	if !ok || curVersion < 0 {
+		return nil, nil
+	}
+
+	applied, err := historian.AppliedVersions()
+	if err == ErrNoHistory {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	isApplied := make(map[int]bool, len(applied))
+	for _, v := range applied {
+		isApplied[v] = true
+	}
+
+	versions := make([]uint, 0)
+	version, err := m.sourceDrv.First()
+	for err == nil && m.before(int(version), curVersion) {
+		if !isApplied[int(version)] {
+			versions = append(versions, version)
+		}
+		version, err = m.sourceDrv.Next(version)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return versions, nil
+}
+
 // stop returns true if no more migrations should be run against the database
 // because a stop signal was received on the GracefulStop channel.
 // Calls are cheap and this function is not blocking.
@@ -774,12 +2257,39 @@ func (m *Migrate) stop() bool {
 	}
 }
 
+// dirtyErr calls the dirty handler, if set,
+// and returns ErrDirty for version.
+func (m *Migrate) dirtyErr(version int) error {
+	if m.dirtyHandler != nil {
+		if err := m.dirtyHandler(version); err != nil {
+			m.logPrintf("dirty handler failed for version %v: %v\n", version, err)
+		}
+	}
+	return ErrDirty{version}
+}
+
+// pause blocks for d. It returns false if a stop signal was received
+// on the GracefulStop channel in the meantime.
+func (m *Migrate) pause(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-m.GracefulStop:
+		m.isGracefulStop = true
+		return false
+
+	case <-timer.C:
+		return true
+	}
+}
+
 // newMigration is a helper func that returns a *Migration for the
 // specified version and targetVersion.
 func (m *Migrate) newMigration(version uint, targetVersion int) (*Migration, error) {
 	var migr *Migration
 
-	if targetVersion >= int(version) {
+	if !m.before(targetVersion, int(version)) {
 		r, identifier, err := m.sourceDrv.ReadUp(version)
 		if os.IsNotExist(err) {
 			// create "empty" migration
@@ -820,6 +2330,8 @@ func (m *Migrate) newMigration(version uint, targetVersion int) (*Migration, err
 		}
 	}
 
+	migr.down = m.before(targetVersion, int(version))
+
 	if m.PrefetchMigrations > 0 && migr.Body != nil {
 		m.logVerbosePrintf("Start buffering %v\n", migr.LogString())
 	} else {
@@ -880,6 +2392,56 @@ func (m *Migrate) lock() error {
 	return err
 }
 
+// tryLock is like lock, but makes a single attempt without timeout
+// and returns false if the database is locked.
+func (m *Migrate) tryLock() (bool, error) {
+	m.isLockedMu.Lock()
+	defer m.isLockedMu.Unlock()
+
+	if m.isLocked {
+		return false, ErrLocked
+	}
+
+	locker, ok := m.databaseDrv.(database.TryLocker)
+	if !ok {
+		return false, ErrNoTryLock
+	}
+
+	acquired, err := locker.TryLock()
+	if acquired && err == nil {
+		m.isLocked = true
+	}
+	return acquired, err
+}
+
+// waitLock polls tryLock until the lock is acquired or LockTimeout passes,
+// so that a lock held by another process doesn't fail the caller. The
+// attempts back off exponentially with jitter, so that many processes
+// waiting for the same lock don't poll in lockstep.
+// Without database.TryLocker it falls back to lock.
+func (m *Migrate) waitLock() error {
+	if _, ok := m.databaseDrv.(database.TryLocker); !ok {
+		return m.lock()
+	}
+
+	timeout := time.After(m.LockTimeout)
+	backoff := database.NewBackoff(lockRetryBaseDelay, lockRetryMaxDelay)
+	for {
+		acquired, err := m.tryLock()
+		if err != nil {
+			return err
+		} else if acquired {
+			return nil
+		}
+
+		select {
+		case <-timeout:
+			return ErrLockTimeout
+		case <-time.After(backoff.Next()):
+		}
+	}
+}
+
 // unlock is a thread safe helper function to unlock the database.
 // It should be called as early as possible when no more migrations are
 // expected to be executed.
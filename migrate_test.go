@@ -2,12 +2,21 @@ package migrate
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/vickxxx/migrate/database"
 	dStub "github.com/vickxxx/migrate/database/stub"
 	"github.com/vickxxx/migrate/source"
 	sStub "github.com/vickxxx/migrate/source/stub"
@@ -294,6 +303,50 @@ func TestMigrateDirty(t *testing.T) {
 	}
 }
 
+func TestMigrateLatest(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+	seq := newMigSeq()
+
+	if err := m.Migrate(Latest); err != nil {
+		t.Fatal(err)
+	}
+	version, _, err := m.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 7 {
+		t.Fatalf("expected version 7, got %v", version)
+	}
+	equalDbSeq(t, 0, seq.add(M(1), M(3), M(4), M(7)), dbDrv)
+
+	if err := m.Migrate(Latest); err != ErrNoChange {
+		t.Fatalf("expected ErrNoChange, got %v", err)
+	}
+
+	// the latest version is resolved at call time
+	sourceDrv := m.sourceDrv.(*sStub.Stub)
+	migrations := source.NewMigrations()
+	for _, v := range []uint{1, 3, 4, 7} {
+		migr, _ := sourceStubMigrations.Up(v)
+		migrations.Append(migr)
+	}
+	migrations.Append(&source.Migration{Version: 9, Direction: source.Up, Identifier: "CREATE 9"})
+	sourceDrv.Migrations = migrations
+	if err := m.Migrate(Latest); err != nil {
+		t.Fatal(err)
+	}
+	if dbDrv.CurrentVersion != 9 {
+		t.Fatalf("expected version 9, got %v", dbDrv.CurrentVersion)
+	}
+
+	m.sourceDrv.(*sStub.Stub).Migrations = source.NewMigrations()
+	if err := m.Migrate(Latest); !os.IsNotExist(err) {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+}
+
 func TestSteps(t *testing.T) {
 	m, _ := New("stub://", "stub://")
 	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
@@ -412,6 +465,102 @@ func TestUpAndDown(t *testing.T) {
 	equalDbSeq(t, 0, seq.add(M(7, 5), M(5, 4), M(4, 3), M(3, 1), M(1, -1)), dbDrv)
 }
 
+func TestUpTagged(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "-- migrate:tag pre-deploy\n1"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "-- migrate:tag pre-deploy\n2"})
+	migrations.Append(&source.Migration{Version: 3, Direction: source.Up, Identifier: "-- migrate:tag post-deploy\n3"})
+	migrations.Append(&source.Migration{Version: 4, Direction: source.Up, Identifier: "-- migrate:tag pre-deploy\n4"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	if err := m.UpTagged("pre-deploy"); err != nil {
+		t.Fatal(err)
+	}
+	if dbDrv.CurrentVersion != 2 {
+		t.Fatalf("expected version 2, got %v", dbDrv.CurrentVersion)
+	}
+	if len(dbDrv.MigrationSequence) != 2 {
+		t.Fatalf("expected 2 migrations to run, got %v", dbDrv.MigrationSequence)
+	}
+
+	// next pending migration isn't tagged
+	if err := m.UpTagged("pre-deploy"); err != ErrNoChange {
+		t.Fatalf("expected ErrNoChange, got %v", err)
+	}
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if dbDrv.CurrentVersion != 4 {
+		t.Fatalf("expected version 4, got %v", dbDrv.CurrentVersion)
+	}
+}
+
+func TestUpTaggedDirty(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+	if err := dbDrv.SetVersion(0, true); err != nil {
+		t.Fatal(err)
+	}
+
+	err := m.UpTagged("pre-deploy")
+	if _, ok := err.(ErrDirty); !ok {
+		t.Fatalf("expected ErrDirty, got %v", err)
+	}
+}
+
+func TestUpSince(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	for _, v := range []uint{20230501120000, 20230515093000, 20230602080000, 20230610170000} {
+		migrations.Append(&source.Migration{Version: v, Direction: source.Up, Identifier: fmt.Sprintf("CREATE %v", v)})
+	}
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	if err := m.UpSince(20230601000000); err != nil {
+		t.Fatal(err)
+	}
+	if dbDrv.CurrentVersion != 20230610170000 {
+		t.Fatalf("expected version 20230610170000, got %v", dbDrv.CurrentVersion)
+	}
+	expected := []string{"CREATE 20230602080000", "CREATE 20230610170000"}
+	if !reflect.DeepEqual(dbDrv.MigrationSequence, expected) {
+		t.Fatalf("expected %v, got %v", expected, dbDrv.MigrationSequence)
+	}
+
+	// the skipped migrations count as applied
+	if err := m.Up(); err != ErrNoChange {
+		t.Fatalf("expected ErrNoChange, got %v", err)
+	}
+
+	// unless the history shows they weren't
+	m.databaseDrv = &historyStub{Stub: dbDrv, applied: []int{20230602080000, 20230610170000}}
+	err := m.UpSince(20230601000000)
+	if _, ok := err.(ErrOutOfOrder); !ok {
+		t.Fatalf("expected ErrOutOfOrder, got %v", err)
+	}
+}
+
+func TestUpSinceNoChange(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	for _, v := range []uint{20230501120000, 20230515093000} {
+		migrations.Append(&source.Migration{Version: v, Direction: source.Up, Identifier: fmt.Sprintf("CREATE %v", v)})
+	}
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	if err := m.UpSince(20230601000000); err != ErrNoChange {
+		t.Fatalf("expected ErrNoChange, got %v", err)
+	}
+	if dbDrv.CurrentVersion != database.NilVersion || len(dbDrv.MigrationSequence) != 0 {
+		t.Fatalf("expected no migration to run, got version %v, %v", dbDrv.CurrentVersion, dbDrv.MigrationSequence)
+	}
+}
+
 func TestUpDirty(t *testing.T) {
 	m, _ := New("stub://", "stub://")
 	dbDrv := m.databaseDrv.(*dStub.Stub)
@@ -425,6 +574,53 @@ func TestUpDirty(t *testing.T) {
 	}
 }
 
+func TestDirtyHandler(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+	if err := dbDrv.SetVersion(3, true); err != nil {
+		t.Fatal(err)
+	}
+
+	calls := make([]int, 0)
+	m.SetDirtyHandler(func(version int) error {
+		calls = append(calls, version)
+		return nil
+	})
+
+	err := m.Up()
+	if _, ok := err.(ErrDirty); !ok {
+		t.Fatalf("expected ErrDirty, got %v", err)
+	}
+	if err := m.Down(); err == nil {
+		t.Fatal("expected ErrDirty")
+	}
+	if len(calls) != 2 || calls[0] != 3 || calls[1] != 3 {
+		t.Fatalf("expected handler to be called twice with version 3, got %v", calls)
+	}
+}
+
+func TestDirtyHandlerError(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+	if err := dbDrv.SetVersion(3, true); err != nil {
+		t.Fatal(err)
+	}
+	logger := &bufferLogger{}
+	m.Log = logger
+
+	m.SetDirtyHandler(func(version int) error {
+		return fmt.Errorf("pager unreachable")
+	})
+
+	err := m.Up()
+	if _, ok := err.(ErrDirty); !ok {
+		t.Fatalf("expected ErrDirty, got %v", err)
+	}
+	if !strings.Contains(logger.String(), "pager unreachable") {
+		t.Fatalf("expected handler error to be logged, got %q", logger.String())
+	}
+}
+
 func TestDownDirty(t *testing.T) {
 	m, _ := New("stub://", "stub://")
 	dbDrv := m.databaseDrv.(*dStub.Stub)
@@ -551,391 +747,2251 @@ func TestForceDirty(t *testing.T) {
 	}
 }
 
-func TestRead(t *testing.T) {
-	m, _ := New("stub://", "stub://")
-	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
-
+func TestBaseline(t *testing.T) {
 	tt := []struct {
-		from             int
-		to               int
-		expectErr        error
-		expectMigrations migrationSequence
+		curVersion    int
+		curDirty      bool
+		version       uint
+		expectErr     error
+		expectVersion int
 	}{
-		{from: -1, to: -1, expectErr: ErrNoChange},
-		{from: -1, to: 0, expectErr: os.ErrNotExist},
-		{from: -1, to: 1, expectErr: nil, expectMigrations: newMigSeq(M(1))},
-		{from: -1, to: 2, expectErr: os.ErrNotExist},
-		{from: -1, to: 3, expectErr: nil, expectMigrations: newMigSeq(M(1), M(3))},
-		{from: -1, to: 4, expectErr: nil, expectMigrations: newMigSeq(M(1), M(3), M(4))},
-		{from: -1, to: 5, expectErr: nil, expectMigrations: newMigSeq(M(1), M(3), M(4), M(5))},
-		{from: -1, to: 6, expectErr: os.ErrNotExist},
-		{from: -1, to: 7, expectErr: nil, expectMigrations: newMigSeq(M(1), M(3), M(4), M(5), M(7))},
-		{from: -1, to: 8, expectErr: os.ErrNotExist},
+		{curVersion: -1, version: 4, expectErr: nil, expectVersion: 4},
+		{curVersion: -1, version: 6, expectErr: os.ErrNotExist, expectVersion: -1},
+		{curVersion: 1, version: 4, expectErr: ErrBaselineTracked{1, false}, expectVersion: 1},
+		{curVersion: 7, version: 4, expectErr: ErrBaselineTracked{7, false}, expectVersion: 7},
+		{curVersion: 3, curDirty: true, version: 4, expectErr: ErrBaselineTracked{3, true}, expectVersion: 3},
+	}
 
-		{from: 0, to: -1, expectErr: os.ErrNotExist},
-		{from: 0, to: 0, expectErr: os.ErrNotExist},
-		{from: 0, to: 1, expectErr: os.ErrNotExist},
-		{from: 0, to: 2, expectErr: os.ErrNotExist},
-		{from: 0, to: 3, expectErr: os.ErrNotExist},
-		{from: 0, to: 4, expectErr: os.ErrNotExist},
-		{from: 0, to: 5, expectErr: os.ErrNotExist},
-		{from: 0, to: 6, expectErr: os.ErrNotExist},
-		{from: 0, to: 7, expectErr: os.ErrNotExist},
-		{from: 0, to: 8, expectErr: os.ErrNotExist},
+	for i, v := range tt {
+		m, _ := New("stub://", "stub://")
+		m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+		dbDrv := m.databaseDrv.(*dStub.Stub)
+		if err := dbDrv.SetVersion(v.curVersion, v.curDirty); err != nil {
+			t.Fatal(err)
+		}
 
-		{from: 1, to: -1, expectErr: nil, expectMigrations: newMigSeq(M(1, -1))},
-		{from: 1, to: 0, expectErr: os.ErrNotExist},
-		{from: 1, to: 1, expectErr: ErrNoChange},
-		{from: 1, to: 2, expectErr: os.ErrNotExist},
-		{from: 1, to: 3, expectErr: nil, expectMigrations: newMigSeq(M(3))},
-		{from: 1, to: 4, expectErr: nil, expectMigrations: newMigSeq(M(3), M(4))},
-		{from: 1, to: 5, expectErr: nil, expectMigrations: newMigSeq(M(3), M(4), M(5))},
-		{from: 1, to: 6, expectErr: os.ErrNotExist},
-		{from: 1, to: 7, expectErr: nil, expectMigrations: newMigSeq(M(3), M(4), M(5), M(7))},
-		{from: 1, to: 8, expectErr: os.ErrNotExist},
+		err := m.Baseline(v.version)
+		if err != v.expectErr {
+			t.Errorf("expected err %v, got %v, in %v", v.expectErr, err, i)
+		}
+		if dbDrv.CurrentVersion != v.expectVersion {
+			t.Errorf("expected version %v, got %v, in %v", v.expectVersion, dbDrv.CurrentVersion, i)
+		}
+		if len(dbDrv.MigrationSequence) != 0 {
+			t.Errorf("expected no migrations to run, got %v, in %v", dbDrv.MigrationSequence, i)
+		}
+	}
+}
 
-		{from: 2, to: -1, expectErr: os.ErrNotExist},
-		{from: 2, to: 0, expectErr: os.ErrNotExist},
-		{from: 2, to: 1, expectErr: os.ErrNotExist},
-		{from: 2, to: 2, expectErr: os.ErrNotExist},
-		{from: 2, to: 3, expectErr: os.ErrNotExist},
-		{from: 2, to: 4, expectErr: os.ErrNotExist},
-		{from: 2, to: 5, expectErr: os.ErrNotExist},
-		{from: 2, to: 6, expectErr: os.ErrNotExist},
-		{from: 2, to: 7, expectErr: os.ErrNotExist},
-		{from: 2, to: 8, expectErr: os.ErrNotExist},
+func TestBaselineUp(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
 
-		{from: 3, to: -1, expectErr: nil, expectMigrations: newMigSeq(M(3, 1), M(1, -1))},
-		{from: 3, to: 0, expectErr: os.ErrNotExist},
-		{from: 3, to: 1, expectErr: nil, expectMigrations: newMigSeq(M(3, 1))},
-		{from: 3, to: 2, expectErr: os.ErrNotExist},
-		{from: 3, to: 3, expectErr: ErrNoChange},
-		{from: 3, to: 4, expectErr: nil, expectMigrations: newMigSeq(M(4))},
-		{from: 3, to: 5, expectErr: nil, expectMigrations: newMigSeq(M(4), M(5))},
-		{from: 3, to: 6, expectErr: os.ErrNotExist},
-		{from: 3, to: 7, expectErr: nil, expectMigrations: newMigSeq(M(4), M(5), M(7))},
-		{from: 3, to: 8, expectErr: os.ErrNotExist},
+	if err := m.Baseline(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	equalDbSeq(t, 0, newMigSeq(M(4), M(7)), dbDrv)
+	if dbDrv.IsDirty || dbDrv.CurrentVersion != 7 {
+		t.Fatalf("expected clean version 7, got %v, %v", dbDrv.CurrentVersion, dbDrv.IsDirty)
+	}
+}
 
-		{from: 4, to: -1, expectErr: nil, expectMigrations: newMigSeq(M(4, 3), M(3, 1), M(1, -1))},
-		{from: 4, to: 0, expectErr: os.ErrNotExist},
-		{from: 4, to: 1, expectErr: nil, expectMigrations: newMigSeq(M(4, 3), M(3, 1))},
-		{from: 4, to: 2, expectErr: os.ErrNotExist},
-		{from: 4, to: 3, expectErr: nil, expectMigrations: newMigSeq(M(4, 3))},
-		{from: 4, to: 4, expectErr: ErrNoChange},
-		{from: 4, to: 5, expectErr: nil, expectMigrations: newMigSeq(M(5))},
-		{from: 4, to: 6, expectErr: os.ErrNotExist},
-		{from: 4, to: 7, expectErr: nil, expectMigrations: newMigSeq(M(5), M(7))},
-		{from: 4, to: 8, expectErr: os.ErrNotExist},
+type bufferLogger struct {
+	bytes.Buffer
+}
 
-		{from: 5, to: -1, expectErr: nil, expectMigrations: newMigSeq(M(5, 4), M(4, 3), M(3, 1), M(1, -1))},
-		{from: 5, to: 0, expectErr: os.ErrNotExist},
-		{from: 5, to: 1, expectErr: nil, expectMigrations: newMigSeq(M(5, 4), M(4, 3), M(3, 1))},
-		{from: 5, to: 2, expectErr: os.ErrNotExist},
-		{from: 5, to: 3, expectErr: nil, expectMigrations: newMigSeq(M(5, 4), M(4, 3))},
-		{from: 5, to: 4, expectErr: nil, expectMigrations: newMigSeq(M(5, 4))},
-		{from: 5, to: 5, expectErr: ErrNoChange},
-		{from: 5, to: 6, expectErr: os.ErrNotExist},
-		{from: 5, to: 7, expectErr: nil, expectMigrations: newMigSeq(M(7))},
-		{from: 5, to: 8, expectErr: os.ErrNotExist},
+func (l *bufferLogger) Printf(format string, v ...interface{}) {
+	fmt.Fprintf(&l.Buffer, format, v...)
+}
 
-		{from: 6, to: -1, expectErr: os.ErrNotExist},
-		{from: 6, to: 0, expectErr: os.ErrNotExist},
-		{from: 6, to: 1, expectErr: os.ErrNotExist},
-		{from: 6, to: 2, expectErr: os.ErrNotExist},
-		{from: 6, to: 3, expectErr: os.ErrNotExist},
-		{from: 6, to: 4, expectErr: os.ErrNotExist},
-		{from: 6, to: 5, expectErr: os.ErrNotExist},
-		{from: 6, to: 6, expectErr: os.ErrNotExist},
-		{from: 6, to: 7, expectErr: os.ErrNotExist},
-		{from: 6, to: 8, expectErr: os.ErrNotExist},
+func (l *bufferLogger) Verbose() bool {
+	return false
+}
 
-		{from: 7, to: -1, expectErr: nil, expectMigrations: newMigSeq(M(7, 5), M(5, 4), M(4, 3), M(3, 1), M(1, -1))},
-		{from: 7, to: 0, expectErr: os.ErrNotExist},
-		{from: 7, to: 1, expectErr: nil, expectMigrations: newMigSeq(M(7, 5), M(5, 4), M(4, 3), M(3, 1))},
-		{from: 7, to: 2, expectErr: os.ErrNotExist},
-		{from: 7, to: 3, expectErr: nil, expectMigrations: newMigSeq(M(7, 5), M(5, 4), M(4, 3))},
-		{from: 7, to: 4, expectErr: nil, expectMigrations: newMigSeq(M(7, 5), M(5, 4))},
-		{from: 7, to: 5, expectErr: nil, expectMigrations: newMigSeq(M(7, 5))},
-		{from: 7, to: 6, expectErr: os.ErrNotExist},
-		{from: 7, to: 7, expectErr: ErrNoChange},
-		{from: 7, to: 8, expectErr: os.ErrNotExist},
+func TestReplay(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "CREATE 2"})
+	migrations.Append(&source.Migration{Version: 3, Direction: source.Up, Identifier: "CREATE 3"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+	logger := &bufferLogger{}
+	m.Log = logger
 
-		{from: 8, to: -1, expectErr: os.ErrNotExist},
-		{from: 8, to: 0, expectErr: os.ErrNotExist},
-		{from: 8, to: 1, expectErr: os.ErrNotExist},
-		{from: 8, to: 2, expectErr: os.ErrNotExist},
-		{from: 8, to: 3, expectErr: os.ErrNotExist},
-		{from: 8, to: 4, expectErr: os.ErrNotExist},
-		{from: 8, to: 5, expectErr: os.ErrNotExist},
-		{from: 8, to: 6, expectErr: os.ErrNotExist},
-		{from: 8, to: 7, expectErr: os.ErrNotExist},
-		{from: 8, to: 8, expectErr: os.ErrNotExist},
+	if err := dbDrv.SetVersion(2, false); err != nil {
+		t.Fatal(err)
 	}
 
-	for i, v := range tt {
-		ret := make(chan interface{})
-		go m.read(v.from, v.to, ret)
-		migrations, err := migrationsFromChannel(ret)
+	if err := m.Replay(1); err != nil {
+		t.Fatal(err)
+	}
+	if !dbDrv.EqualSequence([]string{"CREATE 1"}) {
+		t.Fatalf("expected migration 1 to run again, got %v", dbDrv.MigrationSequence)
+	}
 
-		if (v.expectErr == os.ErrNotExist && !os.IsNotExist(err)) ||
-			(v.expectErr != os.ErrNotExist && v.expectErr != err) {
-			t.Errorf("expected %v, got %v, in %v", v.expectErr, err, i)
-			t.Logf("%v, in %v", migrations, i)
-		}
-		if len(v.expectMigrations) > 0 {
-			equalMigSeq(t, i, v.expectMigrations, migrations)
-		}
+	version, dirty, err := dbDrv.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 || dirty {
+		t.Fatalf("expected clean version 2, got %v (dirty %v)", version, dirty)
+	}
+	if !strings.Contains(logger.String(), "MANUAL OVERRIDE") {
+		t.Fatalf("expected replay to be logged, got %q", logger.String())
+	}
+
+	if err := m.Replay(3); err != ErrNotApplied {
+		t.Fatalf("expected ErrNotApplied, got %v", err)
 	}
 }
 
-func TestReadUp(t *testing.T) {
+func TestReplayDirty(t *testing.T) {
 	m, _ := New("stub://", "stub://")
 	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+	if err := dbDrv.SetVersion(4, true); err != nil {
+		t.Fatal(err)
+	}
 
-	tt := []struct {
-		from             int
-		limit            int // -1 means no limit
-		expectErr        error
-		expectMigrations migrationSequence
-	}{
-		{from: -1, limit: -1, expectErr: nil, expectMigrations: newMigSeq(M(1), M(3), M(4), M(5), M(7))},
-		{from: -1, limit: 0, expectErr: ErrNoChange},
-		{from: -1, limit: 1, expectErr: nil, expectMigrations: newMigSeq(M(1))},
-		{from: -1, limit: 2, expectErr: nil, expectMigrations: newMigSeq(M(1), M(3))},
-
-		{from: 0, limit: -1, expectErr: os.ErrNotExist},
-		{from: 0, limit: 0, expectErr: os.ErrNotExist},
-		{from: 0, limit: 1, expectErr: os.ErrNotExist},
-		{from: 0, limit: 2, expectErr: os.ErrNotExist},
-
-		{from: 1, limit: -1, expectErr: nil, expectMigrations: newMigSeq(M(3), M(4), M(5), M(7))},
-		{from: 1, limit: 0, expectErr: ErrNoChange},
-		{from: 1, limit: 1, expectErr: nil, expectMigrations: newMigSeq(M(3))},
-		{from: 1, limit: 2, expectErr: nil, expectMigrations: newMigSeq(M(3), M(4))},
-
-		{from: 2, limit: -1, expectErr: os.ErrNotExist},
-		{from: 2, limit: 0, expectErr: os.ErrNotExist},
-		{from: 2, limit: 1, expectErr: os.ErrNotExist},
-		{from: 2, limit: 2, expectErr: os.ErrNotExist},
-
-		{from: 3, limit: -1, expectErr: nil, expectMigrations: newMigSeq(M(4), M(5), M(7))},
-		{from: 3, limit: 0, expectErr: ErrNoChange},
-		{from: 3, limit: 1, expectErr: nil, expectMigrations: newMigSeq(M(4))},
-		{from: 3, limit: 2, expectErr: nil, expectMigrations: newMigSeq(M(4), M(5))},
-
-		{from: 4, limit: -1, expectErr: nil, expectMigrations: newMigSeq(M(5), M(7))},
-		{from: 4, limit: 0, expectErr: ErrNoChange},
-		{from: 4, limit: 1, expectErr: nil, expectMigrations: newMigSeq(M(5))},
-		{from: 4, limit: 2, expectErr: nil, expectMigrations: newMigSeq(M(5), M(7))},
+	err := m.Replay(3)
+	if _, ok := err.(ErrDirty); !ok {
+		t.Fatalf("expected ErrDirty, got %v", err)
+	}
+}
 
-		{from: 5, limit: -1, expectErr: nil, expectMigrations: newMigSeq(M(7))},
-		{from: 5, limit: 0, expectErr: ErrNoChange},
-		{from: 5, limit: 1, expectErr: nil, expectMigrations: newMigSeq(M(7))},
-		{from: 5, limit: 2, expectErr: ErrShortLimit{1}, expectMigrations: newMigSeq(M(7))},
+func TestRunRange(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1"})
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Down, Identifier: "DROP 1"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "CREATE 2"})
+	migrations.Append(&source.Migration{Version: 3, Direction: source.Up, Identifier: "CREATE 3"})
+	migrations.Append(&source.Migration{Version: 3, Direction: source.Down, Identifier: "DROP 3"})
+	migrations.Append(&source.Migration{Version: 4, Direction: source.Up, Identifier: "CREATE 4"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
 
-		{from: 6, limit: -1, expectErr: os.ErrNotExist},
-		{from: 6, limit: 0, expectErr: os.ErrNotExist},
-		{from: 6, limit: 1, expectErr: os.ErrNotExist},
-		{from: 6, limit: 2, expectErr: os.ErrNotExist},
+	if err := dbDrv.SetVersion(3, false); err != nil {
+		t.Fatal(err)
+	}
 
-		{from: 7, limit: -1, expectErr: ErrNoChange},
-		{from: 7, limit: 0, expectErr: ErrNoChange},
-		{from: 7, limit: 1, expectErr: os.ErrNotExist},
-		{from: 7, limit: 2, expectErr: os.ErrNotExist},
+	if err := m.RunRange(1, 3, source.Up); err != ErrRunRangeNotAllowed {
+		t.Fatalf("expected ErrRunRangeNotAllowed, got %v", err)
+	}
+	m.SetAllowRunRange(true)
 
-		{from: 8, limit: -1, expectErr: os.ErrNotExist},
-		{from: 8, limit: 0, expectErr: os.ErrNotExist},
-		{from: 8, limit: 1, expectErr: os.ErrNotExist},
-		{from: 8, limit: 2, expectErr: os.ErrNotExist},
+	tt := []struct {
+		from      uint
+		to        uint
+		direction source.Direction
+		expectErr error
+		expectSeq []string
+	}{
+		{from: 2, to: 3, direction: source.Up, expectSeq: []string{"CREATE 2", "CREATE 3"}},
+		{from: 0, to: 9, direction: source.Down, expectErr: ErrNotApplied},
+		{from: 1, to: 3, direction: source.Down, expectSeq: []string{"DROP 3", "DROP 1"}},
+		{from: 2, to: 2, direction: source.Down, expectErr: ErrNoChange},
+		{from: 3, to: 4, direction: source.Up, expectErr: ErrNotApplied},
+		{from: 5, to: 9, direction: source.Up, expectErr: ErrNoChange},
+		{from: 3, to: 2, direction: source.Up, expectErr: ErrInvalidRange},
 	}
 
 	for i, v := range tt {
-		ret := make(chan interface{})
-		go m.readUp(v.from, v.limit, ret)
-		migrations, err := migrationsFromChannel(ret)
+		dbDrv.MigrationSequence = nil
 
-		if (v.expectErr == os.ErrNotExist && !os.IsNotExist(err)) ||
-			(v.expectErr != os.ErrNotExist && v.expectErr != err) {
-			t.Errorf("expected %v, got %v, in %v", v.expectErr, err, i)
-			t.Logf("%v, in %v", migrations, i)
+		if err := m.RunRange(v.from, v.to, v.direction); err != v.expectErr {
+			t.Errorf("expected err %v, got %v, in %v", v.expectErr, err, i)
 		}
-		if len(v.expectMigrations) > 0 {
-			equalMigSeq(t, i, v.expectMigrations, migrations)
+		if !dbDrv.EqualSequence(v.expectSeq) {
+			t.Errorf("expected sequence %v, got %v, in %v", v.expectSeq, dbDrv.MigrationSequence, i)
+		}
+
+		version, dirty, err := dbDrv.Version()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != 3 || dirty {
+			t.Errorf("expected clean version 3, got %v (dirty %v), in %v", version, dirty, i)
 		}
 	}
 }
 
-func TestReadDown(t *testing.T) {
+func TestRunRangeDirty(t *testing.T) {
 	m, _ := New("stub://", "stub://")
 	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	m.SetAllowRunRange(true)
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+	if err := dbDrv.SetVersion(4, true); err != nil {
+		t.Fatal(err)
+	}
 
-	tt := []struct {
-		from             int
-		limit            int // -1 means no limit
-		expectErr        error
-		expectMigrations migrationSequence
-	}{
-		{from: -1, limit: -1, expectErr: ErrNoChange},
-		{from: -1, limit: 0, expectErr: ErrNoChange},
-		{from: -1, limit: 1, expectErr: os.ErrNotExist},
-		{from: -1, limit: 2, expectErr: os.ErrNotExist},
-
-		{from: 0, limit: -1, expectErr: os.ErrNotExist},
-		{from: 0, limit: 0, expectErr: os.ErrNotExist},
-		{from: 0, limit: 1, expectErr: os.ErrNotExist},
-		{from: 0, limit: 2, expectErr: os.ErrNotExist},
-
-		{from: 1, limit: -1, expectErr: nil, expectMigrations: newMigSeq(M(1, -1))},
-		{from: 1, limit: 0, expectErr: ErrNoChange},
-		{from: 1, limit: 1, expectErr: nil, expectMigrations: newMigSeq(M(1, -1))},
-		{from: 1, limit: 2, expectErr: ErrShortLimit{1}, expectMigrations: newMigSeq(M(1, -1))},
-
-		{from: 2, limit: -1, expectErr: os.ErrNotExist},
-		{from: 2, limit: 0, expectErr: os.ErrNotExist},
-		{from: 2, limit: 1, expectErr: os.ErrNotExist},
-		{from: 2, limit: 2, expectErr: os.ErrNotExist},
-
-		{from: 3, limit: -1, expectErr: nil, expectMigrations: newMigSeq(M(3, 1), M(1, -1))},
-		{from: 3, limit: 0, expectErr: ErrNoChange},
-		{from: 3, limit: 1, expectErr: nil, expectMigrations: newMigSeq(M(3, 1))},
-		{from: 3, limit: 2, expectErr: nil, expectMigrations: newMigSeq(M(3, 1), M(1, -1))},
+	err := m.RunRange(1, 3, source.Up)
+	if _, ok := err.(ErrDirty); !ok {
+		t.Fatalf("expected ErrDirty, got %v", err)
+	}
+}
 
-		{from: 4, limit: -1, expectErr: nil, expectMigrations: newMigSeq(M(4, 3), M(3, 1), M(1, -1))},
-		{from: 4, limit: 0, expectErr: ErrNoChange},
-		{from: 4, limit: 1, expectErr: nil, expectMigrations: newMigSeq(M(4, 3))},
-		{from: 4, limit: 2, expectErr: nil, expectMigrations: newMigSeq(M(4, 3), M(3, 1))},
+// squashStub records the squashed migrations like database drivers
+// implementing database.Squasher.
+type squashStub struct {
+	*dStub.Stub
+	squashed map[int]string
+}
 
-		{from: 5, limit: -1, expectErr: nil, expectMigrations: newMigSeq(M(5, 4), M(4, 3), M(3, 1), M(1, -1))},
-		{from: 5, limit: 0, expectErr: ErrNoChange},
-		{from: 5, limit: 1, expectErr: nil, expectMigrations: newMigSeq(M(5, 4))},
-		{from: 5, limit: 2, expectErr: nil, expectMigrations: newMigSeq(M(5, 4), M(4, 3))},
+func (s *squashStub) Squash(version int, migration []byte) error {
+	s.squashed[version] = string(migration)
+	return nil
+}
 
-		{from: 6, limit: -1, expectErr: os.ErrNotExist},
-		{from: 6, limit: 0, expectErr: os.ErrNotExist},
-		{from: 6, limit: 1, expectErr: os.ErrNotExist},
-		{from: 6, limit: 2, expectErr: os.ErrNotExist},
+// squashedMigrations are the migrations of sourceStubMigrations with
+// versions up to 4 squashed.
+func squashedMigrations() *source.Migrations {
+	migrations := source.NewMigrations()
+	// the byte order mark isn't part of the recorded migration
+	migrations.Append(&source.Migration{Version: 4, Direction: source.Up, Identifier: "\xef\xbb\xbfCREATE 1; CREATE 3; CREATE 4"})
+	migrations.Append(&source.Migration{Version: 5, Direction: source.Down})
+	migrations.Append(&source.Migration{Version: 7, Direction: source.Up})
+	migrations.Append(&source.Migration{Version: 7, Direction: source.Down})
+	return migrations
+}
 
-		{from: 7, limit: -1, expectErr: nil, expectMigrations: newMigSeq(M(7, 5), M(5, 4), M(4, 3), M(3, 1), M(1, -1))},
-		{from: 7, limit: 0, expectErr: ErrNoChange},
-		{from: 7, limit: 1, expectErr: nil, expectMigrations: newMigSeq(M(7, 5))},
-		{from: 7, limit: 2, expectErr: nil, expectMigrations: newMigSeq(M(7, 5), M(5, 4))},
+func TestSquash(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = squashedMigrations()
+	dbDrv := &squashStub{Stub: m.databaseDrv.(*dStub.Stub)}
+	m.databaseDrv = dbDrv
 
-		{from: 8, limit: -1, expectErr: os.ErrNotExist},
-		{from: 8, limit: 0, expectErr: os.ErrNotExist},
-		{from: 8, limit: 1, expectErr: os.ErrNotExist},
-		{from: 8, limit: 2, expectErr: os.ErrNotExist},
+	tt := []struct {
+		curVersion     int
+		squashVersion  uint
+		expectErr      error
+		expectSquashed bool
+	}{
+		{curVersion: -1, squashVersion: 4, expectErr: nil},
+		{curVersion: 1, squashVersion: 4, expectErr: ErrSquashPartial{1, 4}},
+		{curVersion: 3, squashVersion: 4, expectErr: ErrSquashPartial{3, 4}},
+		{curVersion: 4, squashVersion: 4, expectErr: nil, expectSquashed: true},
+		{curVersion: 7, squashVersion: 4, expectErr: nil, expectSquashed: true},
+		{curVersion: 7, squashVersion: 7, expectErr: ErrSquashNotReplaced{4, 7}},
 	}
 
 	for i, v := range tt {
-		ret := make(chan interface{})
-		go m.readDown(v.from, v.limit, ret)
-		migrations, err := migrationsFromChannel(ret)
+		dbDrv.squashed = make(map[int]string)
+		if err := dbDrv.SetVersion(v.curVersion, false); err != nil {
+			t.Fatal(err)
+		}
 
-		if (v.expectErr == os.ErrNotExist && !os.IsNotExist(err)) ||
-			(v.expectErr != os.ErrNotExist && v.expectErr != err) {
-			t.Errorf("expected %v, got %v, in %v", v.expectErr, err, i)
-			t.Logf("%v, in %v", migrations, i)
+		if err := m.Squash(v.squashVersion); err != v.expectErr {
+			t.Errorf("expected err %v, got %v, in %v", v.expectErr, err, i)
 		}
-		if len(v.expectMigrations) > 0 {
-			equalMigSeq(t, i, v.expectMigrations, migrations)
+
+		expected := map[int]string{}
+		if v.expectSquashed {
+			expected[4] = "CREATE 1; CREATE 3; CREATE 4"
+		}
+		if !reflect.DeepEqual(dbDrv.squashed, expected) {
+			t.Errorf("expected %q to be squashed, got %q, in %v", expected, dbDrv.squashed, i)
+		}
+
+		// the version stays
+		version, dirty, err := dbDrv.Version()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != v.curVersion || dirty {
+			t.Errorf("expected clean version %v, got %v, %v, in %v", v.curVersion, version, dirty, i)
+		}
+		if dbDrv.IsLocked {
+			t.Errorf("expected database to be unlocked, in %v", i)
 		}
 	}
 }
 
-func TestLock(t *testing.T) {
+func TestSquashNotReplaced(t *testing.T) {
 	m, _ := New("stub://", "stub://")
-	if err := m.lock(); err != nil {
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbDrv := &squashStub{Stub: m.databaseDrv.(*dStub.Stub), squashed: make(map[int]string)}
+	m.databaseDrv = dbDrv
+	if err := dbDrv.SetVersion(4, false); err != nil {
 		t.Fatal(err)
 	}
 
-	if err := m.lock(); err == nil {
-		t.Fatal("should be locked already")
+	// the migrations up to 4 are still in the source
+	if err := m.Squash(4); err != (ErrSquashNotReplaced{1, 4}) {
+		t.Fatalf("expected ErrSquashNotReplaced, got %v", err)
+	}
+	if len(dbDrv.squashed) != 0 {
+		t.Fatalf("expected nothing to be squashed, got %q", dbDrv.squashed)
 	}
 }
 
-func migrationsFromChannel(ret chan interface{}) ([]*Migration, error) {
-	slice := make([]*Migration, 0)
-	for r := range ret {
-		switch r.(type) {
-		case error:
-			return slice, r.(error)
+func TestSquashDirty(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = squashedMigrations()
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+	if err := dbDrv.SetVersion(4, true); err != nil {
+		t.Fatal(err)
+	}
 
-		case *Migration:
-			slice = append(slice, r.(*Migration))
-		}
+	err := m.Squash(4)
+	if _, ok := err.(ErrDirty); !ok {
+		t.Fatalf("expected ErrDirty, got %v", err)
 	}
-	return slice, nil
 }
 
-type migrationSequence []*Migration
-
-func newMigSeq(migr ...*Migration) migrationSequence {
-	return migr
+type dumpStub struct {
+	*dStub.Stub
 }
 
-func (m *migrationSequence) add(migr ...*Migration) migrationSequence {
-	*m = append(*m, migr...)
-	return *m
+func (s *dumpStub) Dump() ([]byte, error) {
+	return []byte("CREATE TABLE t ();"), nil
 }
 
-func (m *migrationSequence) bodySequence() []string {
-	r := make([]string, 0)
-	for _, v := range *m {
-		if v.Body != nil {
-			body, err := ioutil.ReadAll(v.Body)
-			if err != nil {
-				panic(err) // that should never happen
-			}
-
-			// reset body reader
-			// TODO: is there a better/nicer way?
-			v.Body = ioutil.NopCloser(bytes.NewReader(body))
+func TestDump(t *testing.T) {
+	m, _ := New("stub://", "stub://")
 
-			r = append(r, string(body[:]))
-		}
+	if _, err := m.Dump(); err != ErrNoDump {
+		t.Fatalf("expected ErrNoDump, got %v", err)
 	}
-	return r
-}
 
-// M is a convenience func to create a new *Migration
-func M(version uint, targetVersion ...int) *Migration {
-	if len(targetVersion) > 1 {
-		panic("only one targetVersion allowed")
+	m.databaseDrv = &dumpStub{m.databaseDrv.(*dStub.Stub)}
+	dump, err := m.Dump()
+	if err != nil {
+		t.Fatal(err)
 	}
-	ts := int(version)
-	if len(targetVersion) == 1 {
-		ts = targetVersion[0]
+	if string(dump) != "CREATE TABLE t ();" {
+		t.Fatalf("expected dump from driver, got %s", dump)
 	}
+	if m.isLocked {
+		t.Fatal("expected lock to be released")
+	}
+}
 
+type historyStub struct {
+	*dStub.Stub
+	applied []int
+	err     error
+}
+
+func (s *historyStub) AppliedVersions() ([]int, error) {
+	return s.applied, s.err
+}
+
+// newOutOfOrderMigrate returns a Migrate at version 4 with versions 1, 2
+// and 4 applied, and a late version 3 in the source.
+func newOutOfOrderMigrate(t *testing.T) (*Migrate, *dStub.Stub) {
 	m, _ := New("stub://", "stub://")
-	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
-	migr, err := m.newMigration(version, ts)
-	if err != nil {
-		panic(err)
+	migrations := source.NewMigrations()
+	for _, v := range []uint{1, 2, 3, 4, 5} {
+		migrations.Append(&source.Migration{Version: v, Direction: source.Up, Identifier: fmt.Sprintf("CREATE %v", v)})
 	}
-	return migr
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+	if err := dbDrv.SetVersion(4, false); err != nil {
+		t.Fatal(err)
+	}
+	m.databaseDrv = &historyStub{Stub: dbDrv, applied: []int{1, 2, 4}}
+	return m, dbDrv
 }
 
-func equalMigSeq(t *testing.T, i int, expected, got migrationSequence) {
-	if len(expected) != len(got) {
-		t.Errorf("expected migrations %v, got %v, in %v", expected, got, i)
+func TestUpOutOfOrderForbid(t *testing.T) {
+	m, dbDrv := newOutOfOrderMigrate(t)
 
-	} else {
-		for ii := 0; ii < len(expected); ii++ {
-			if expected[ii].Version != got[ii].Version {
-				t.Errorf("expected version %v, got %v, in %v", expected[ii].Version, got[ii].Version, i)
-			}
+	err := m.Up()
+	e, ok := err.(ErrOutOfOrder)
+	if !ok {
+		t.Fatalf("expected ErrOutOfOrder, got %v", err)
+	}
+	if len(e.Versions) != 1 || e.Versions[0] != 3 || e.Version != 4 {
+		t.Fatalf("expected version 3 out of order at 4, got %v", e)
+	}
+	if len(dbDrv.MigrationSequence) != 0 {
+		t.Fatalf("expected no migrations to run, got %v", dbDrv.MigrationSequence)
+	}
+	if m.isLocked {
+		t.Fatal("expected lock to be released")
+	}
+}
 
-			if expected[ii].TargetVersion != got[ii].TargetVersion {
-				t.Errorf("expected targetVersion %v, got %v, in %v", expected[ii].TargetVersion, got[ii].TargetVersion, i)
-			}
-		}
+func TestUpOutOfOrderAllow(t *testing.T) {
+	m, dbDrv := newOutOfOrderMigrate(t)
+	logger := &bufferLogger{}
+	m.Log = logger
+
+	if err := m.SetOutOfOrder(OutOfOrderAllow); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if !dbDrv.EqualSequence([]string{"CREATE 5"}) {
+		t.Fatalf("expected only version 5 to run, got %v", dbDrv.MigrationSequence)
+	}
+	if strings.Contains(logger.String(), "WARNING") {
+		t.Fatalf("expected no warning, got %q", logger.String())
 	}
 }
 
-func equalDbSeq(t *testing.T, i int, expected migrationSequence, got *dStub.Stub) {
-	bs := expected.bodySequence()
+func TestUpOutOfOrderWarn(t *testing.T) {
+	m, dbDrv := newOutOfOrderMigrate(t)
+	logger := &bufferLogger{}
+	m.Log = logger
+
+	if err := m.SetOutOfOrder(OutOfOrderWarn); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if !dbDrv.EqualSequence([]string{"CREATE 5"}) {
+		t.Fatalf("expected only version 5 to run, got %v", dbDrv.MigrationSequence)
+	}
+	if !strings.Contains(logger.String(), "WARNING: migrations [3] are older than database version 4") {
+		t.Fatalf("expected warning, got %q", logger.String())
+	}
+}
+
+func TestUpOutOfOrderNoHistory(t *testing.T) {
+	m, dbDrv := newOutOfOrderMigrate(t)
+	// i.e. a driver recording the history only in some configurations
+	m.databaseDrv.(*historyStub).err = ErrNoHistory
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if !dbDrv.EqualSequence([]string{"CREATE 5"}) {
+		t.Fatalf("expected only version 5 to run, got %v", dbDrv.MigrationSequence)
+	}
+
+	status, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectJSON(t, status, `{"version":5,"dirty":false,"applied":[1,2,3,4,5],"pending":[],"orphans":[]}`)
+}
+
+func TestSetOutOfOrderInvalid(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	if err := m.SetOutOfOrder("sometimes"); err == nil {
+		t.Fatal("expected err for invalid mode")
+	}
+	if m.outOfOrder != OutOfOrderForbid {
+		t.Fatalf("expected mode to stay %v, got %v", OutOfOrderForbid, m.outOfOrder)
+	}
+}
+
+// transactionalStub fails to run migrations containing "FAIL" and
+// reports transactional DDL as configured.
+type transactionalStub struct {
+	*dStub.Stub
+	transactional bool
+}
+
+func (s *transactionalStub) Run(migration io.Reader) error {
+	body, err := ioutil.ReadAll(migration)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(string(body), "FAIL") {
+		return fmt.Errorf("migration failed")
+	}
+	return s.Stub.Run(bytes.NewReader(body))
+}
+
+func (s *transactionalStub) TransactionalDDL() bool {
+	return s.transactional
+}
+
+func TestRunFailedMigrationDirty(t *testing.T) {
+	tt := []struct {
+		transactional bool
+		expectVersion int
+		expectDirty   bool
+	}{
+		// partially applied, needs to be fixed by hand
+		{transactional: false, expectVersion: 2, expectDirty: true},
+		// rolled back, still at the last good version
+		{transactional: true, expectVersion: 1, expectDirty: false},
+	}
+
+	for i, v := range tt {
+		m, _ := New("stub://", "stub://")
+		migrations := source.NewMigrations()
+		migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1"})
+		migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "FAIL 2"})
+		m.sourceDrv.(*sStub.Stub).Migrations = migrations
+		dbDrv := m.databaseDrv.(*dStub.Stub)
+		m.databaseDrv = &transactionalStub{Stub: dbDrv, transactional: v.transactional}
+
+		if err := m.Up(); err == nil {
+			t.Fatalf("expected err, in %v", i)
+		}
+		if dbDrv.CurrentVersion != v.expectVersion || dbDrv.IsDirty != v.expectDirty {
+			t.Errorf("expected version %v, dirty %v, got %v, %v, in %v",
+				v.expectVersion, v.expectDirty, dbDrv.CurrentVersion, dbDrv.IsDirty, i)
+		}
+	}
+}
+
+// partialStub runs migrations containing CONCURRENTLY
+// outside of their transaction.
+type partialStub struct {
+	transactionalStub
+}
+
+func (s *partialStub) TransactionalMigration(migration []byte) bool {
+	return !strings.Contains(string(migration), "CONCURRENTLY")
+}
+
+func TestRunFailedPartialMigrationDirty(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "CREATE 2; CREATE INDEX CONCURRENTLY 2; FAIL 2"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+	m.databaseDrv = &partialStub{transactionalStub{Stub: dbDrv, transactional: true}}
+
+	if err := m.Up(); err == nil {
+		t.Fatal("expected err")
+	}
+	// partially applied despite transactional DDL
+	if dbDrv.CurrentVersion != 2 || !dbDrv.IsDirty {
+		t.Fatalf("expected dirty version 2, got %v, %v", dbDrv.CurrentVersion, dbDrv.IsDirty)
+	}
+}
+
+// setVersionFailStub fails to set versions clean after a
+// migration ran, i.e. when the connection was lost.
+type setVersionFailStub struct {
+	transactionalStub
+}
+
+func (s *setVersionFailStub) SetVersion(version int, dirty bool) error {
+	if !dirty && len(s.MigrationSequence) > 0 {
+		return fmt.Errorf("connection lost")
+	}
+	return s.Stub.SetVersion(version, dirty)
+}
+
+func TestRunSetVersionFailedDirty(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+	m.databaseDrv = &setVersionFailStub{transactionalStub{Stub: dbDrv, transactional: true}}
+
+	if err := m.Up(); err == nil {
+		t.Fatal("expected err")
+	}
+	// committed, but not recorded clean
+	if dbDrv.CurrentVersion != 1 || !dbDrv.IsDirty {
+		t.Fatalf("expected dirty version 1, got %v, %v", dbDrv.CurrentVersion, dbDrv.IsDirty)
+	}
+}
+
+// timedStub records when each migration ran.
+type timedStub struct {
+	*dStub.Stub
+	ranAt []time.Time
+}
+
+func (s *timedStub) Run(migration io.Reader) error {
+	s.ranAt = append(s.ranAt, time.Now())
+	return s.Stub.Run(migration)
+}
+
+// versionRunnerStub records the versions passed to RunVersion.
+type versionRunnerStub struct {
+	*dStub.Stub
+	versions []uint
+}
+
+func (s *versionRunnerStub) RunVersion(version uint, migration io.Reader) error {
+	s.versions = append(s.versions, version)
+	return s.Stub.Run(migration)
+}
+
+func TestRunVersion(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbDrv := &versionRunnerStub{Stub: m.databaseDrv.(*dStub.Stub)}
+	m.databaseDrv = dbDrv
+
+	if err := m.Migrate(4); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Steps(-1); err != nil {
+		t.Fatal(err)
+	}
+
+	// version 4 up and down
+	expect := []uint{1, 3, 4, 4}
+	if fmt.Sprint(dbDrv.versions) != fmt.Sprint(expect) {
+		t.Fatalf("expected versions %v, got %v", expect, dbDrv.versions)
+	}
+}
+
+func TestInterMigrationDelay(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "CREATE 2"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	dbDrv := &timedStub{Stub: m.databaseDrv.(*dStub.Stub)}
+	m.databaseDrv = dbDrv
+
+	delay := 50 * time.Millisecond
+	m.SetInterMigrationDelay(delay)
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dbDrv.ranAt) != 2 {
+		t.Fatalf("expected 2 migrations to run, got %v", len(dbDrv.ranAt))
+	}
+	if gap := dbDrv.ranAt[1].Sub(dbDrv.ranAt[0]); gap < delay {
+		t.Fatalf("expected migrations to be at least %v apart, got %v", delay, gap)
+	}
+}
+
+func TestInterMigrationDelayGracefulStop(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "CREATE 2"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	m.SetInterMigrationDelay(time.Hour)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		m.GracefulStop <- true
+	}()
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if dbDrv.CurrentVersion != 1 {
+		t.Fatalf("expected to stop at version 1, got %v", dbDrv.CurrentVersion)
+	}
+}
+
+func TestReadMigration(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1"})
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Down, Identifier: "DROP 1"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "CREATE 2"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	tt := []struct {
+		version   uint
+		direction source.Direction
+		expect    string
+	}{
+		{1, source.Up, "CREATE 1"},
+		{1, source.Down, "DROP 1"},
+		{2, source.Up, "CREATE 2"},
+	}
+	for i, v := range tt {
+		body, err := m.Read(v.version, v.direction)
+		if err != nil {
+			t.Fatalf("expected err to be nil, got %v, in %v", err, i)
+		}
+		if string(body) != v.expect {
+			t.Errorf("expected %q, got %q, in %v", v.expect, body, i)
+		}
+	}
+
+	if _, err := m.Read(2, source.Down); !os.IsNotExist(err) {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+	if _, err := m.Read(1, "sideways"); err == nil {
+		t.Fatal("expected err for invalid direction")
+	}
+	if len(dbDrv.MigrationSequence) != 0 {
+		t.Fatalf("expected no migrations to run, got %v", dbDrv.MigrationSequence)
+	}
+}
+
+func TestRead(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+
+	tt := []struct {
+		from             int
+		to               int
+		expectErr        error
+		expectMigrations migrationSequence
+	}{
+		{from: -1, to: -1, expectErr: ErrNoChange},
+		{from: -1, to: 0, expectErr: os.ErrNotExist},
+		{from: -1, to: 1, expectErr: nil, expectMigrations: newMigSeq(M(1))},
+		{from: -1, to: 2, expectErr: os.ErrNotExist},
+		{from: -1, to: 3, expectErr: nil, expectMigrations: newMigSeq(M(1), M(3))},
+		{from: -1, to: 4, expectErr: nil, expectMigrations: newMigSeq(M(1), M(3), M(4))},
+		{from: -1, to: 5, expectErr: nil, expectMigrations: newMigSeq(M(1), M(3), M(4), M(5))},
+		{from: -1, to: 6, expectErr: os.ErrNotExist},
+		{from: -1, to: 7, expectErr: nil, expectMigrations: newMigSeq(M(1), M(3), M(4), M(5), M(7))},
+		{from: -1, to: 8, expectErr: os.ErrNotExist},
+
+		{from: 0, to: -1, expectErr: os.ErrNotExist},
+		{from: 0, to: 0, expectErr: os.ErrNotExist},
+		{from: 0, to: 1, expectErr: os.ErrNotExist},
+		{from: 0, to: 2, expectErr: os.ErrNotExist},
+		{from: 0, to: 3, expectErr: os.ErrNotExist},
+		{from: 0, to: 4, expectErr: os.ErrNotExist},
+		{from: 0, to: 5, expectErr: os.ErrNotExist},
+		{from: 0, to: 6, expectErr: os.ErrNotExist},
+		{from: 0, to: 7, expectErr: os.ErrNotExist},
+		{from: 0, to: 8, expectErr: os.ErrNotExist},
+
+		{from: 1, to: -1, expectErr: nil, expectMigrations: newMigSeq(M(1, -1))},
+		{from: 1, to: 0, expectErr: os.ErrNotExist},
+		{from: 1, to: 1, expectErr: ErrNoChange},
+		{from: 1, to: 2, expectErr: os.ErrNotExist},
+		{from: 1, to: 3, expectErr: nil, expectMigrations: newMigSeq(M(3))},
+		{from: 1, to: 4, expectErr: nil, expectMigrations: newMigSeq(M(3), M(4))},
+		{from: 1, to: 5, expectErr: nil, expectMigrations: newMigSeq(M(3), M(4), M(5))},
+		{from: 1, to: 6, expectErr: os.ErrNotExist},
+		{from: 1, to: 7, expectErr: nil, expectMigrations: newMigSeq(M(3), M(4), M(5), M(7))},
+		{from: 1, to: 8, expectErr: os.ErrNotExist},
+
+		{from: 2, to: -1, expectErr: os.ErrNotExist},
+		{from: 2, to: 0, expectErr: os.ErrNotExist},
+		{from: 2, to: 1, expectErr: os.ErrNotExist},
+		{from: 2, to: 2, expectErr: os.ErrNotExist},
+		{from: 2, to: 3, expectErr: os.ErrNotExist},
+		{from: 2, to: 4, expectErr: os.ErrNotExist},
+		{from: 2, to: 5, expectErr: os.ErrNotExist},
+		{from: 2, to: 6, expectErr: os.ErrNotExist},
+		{from: 2, to: 7, expectErr: os.ErrNotExist},
+		{from: 2, to: 8, expectErr: os.ErrNotExist},
+
+		{from: 3, to: -1, expectErr: nil, expectMigrations: newMigSeq(M(3, 1), M(1, -1))},
+		{from: 3, to: 0, expectErr: os.ErrNotExist},
+		{from: 3, to: 1, expectErr: nil, expectMigrations: newMigSeq(M(3, 1))},
+		{from: 3, to: 2, expectErr: os.ErrNotExist},
+		{from: 3, to: 3, expectErr: ErrNoChange},
+		{from: 3, to: 4, expectErr: nil, expectMigrations: newMigSeq(M(4))},
+		{from: 3, to: 5, expectErr: nil, expectMigrations: newMigSeq(M(4), M(5))},
+		{from: 3, to: 6, expectErr: os.ErrNotExist},
+		{from: 3, to: 7, expectErr: nil, expectMigrations: newMigSeq(M(4), M(5), M(7))},
+		{from: 3, to: 8, expectErr: os.ErrNotExist},
+
+		{from: 4, to: -1, expectErr: nil, expectMigrations: newMigSeq(M(4, 3), M(3, 1), M(1, -1))},
+		{from: 4, to: 0, expectErr: os.ErrNotExist},
+		{from: 4, to: 1, expectErr: nil, expectMigrations: newMigSeq(M(4, 3), M(3, 1))},
+		{from: 4, to: 2, expectErr: os.ErrNotExist},
+		{from: 4, to: 3, expectErr: nil, expectMigrations: newMigSeq(M(4, 3))},
+		{from: 4, to: 4, expectErr: ErrNoChange},
+		{from: 4, to: 5, expectErr: nil, expectMigrations: newMigSeq(M(5))},
+		{from: 4, to: 6, expectErr: os.ErrNotExist},
+		{from: 4, to: 7, expectErr: nil, expectMigrations: newMigSeq(M(5), M(7))},
+		{from: 4, to: 8, expectErr: os.ErrNotExist},
+
+		{from: 5, to: -1, expectErr: nil, expectMigrations: newMigSeq(M(5, 4), M(4, 3), M(3, 1), M(1, -1))},
+		{from: 5, to: 0, expectErr: os.ErrNotExist},
+		{from: 5, to: 1, expectErr: nil, expectMigrations: newMigSeq(M(5, 4), M(4, 3), M(3, 1))},
+		{from: 5, to: 2, expectErr: os.ErrNotExist},
+		{from: 5, to: 3, expectErr: nil, expectMigrations: newMigSeq(M(5, 4), M(4, 3))},
+		{from: 5, to: 4, expectErr: nil, expectMigrations: newMigSeq(M(5, 4))},
+		{from: 5, to: 5, expectErr: ErrNoChange},
+		{from: 5, to: 6, expectErr: os.ErrNotExist},
+		{from: 5, to: 7, expectErr: nil, expectMigrations: newMigSeq(M(7))},
+		{from: 5, to: 8, expectErr: os.ErrNotExist},
+
+		{from: 6, to: -1, expectErr: os.ErrNotExist},
+		{from: 6, to: 0, expectErr: os.ErrNotExist},
+		{from: 6, to: 1, expectErr: os.ErrNotExist},
+		{from: 6, to: 2, expectErr: os.ErrNotExist},
+		{from: 6, to: 3, expectErr: os.ErrNotExist},
+		{from: 6, to: 4, expectErr: os.ErrNotExist},
+		{from: 6, to: 5, expectErr: os.ErrNotExist},
+		{from: 6, to: 6, expectErr: os.ErrNotExist},
+		{from: 6, to: 7, expectErr: os.ErrNotExist},
+		{from: 6, to: 8, expectErr: os.ErrNotExist},
+
+		{from: 7, to: -1, expectErr: nil, expectMigrations: newMigSeq(M(7, 5), M(5, 4), M(4, 3), M(3, 1), M(1, -1))},
+		{from: 7, to: 0, expectErr: os.ErrNotExist},
+		{from: 7, to: 1, expectErr: nil, expectMigrations: newMigSeq(M(7, 5), M(5, 4), M(4, 3), M(3, 1))},
+		{from: 7, to: 2, expectErr: os.ErrNotExist},
+		{from: 7, to: 3, expectErr: nil, expectMigrations: newMigSeq(M(7, 5), M(5, 4), M(4, 3))},
+		{from: 7, to: 4, expectErr: nil, expectMigrations: newMigSeq(M(7, 5), M(5, 4))},
+		{from: 7, to: 5, expectErr: nil, expectMigrations: newMigSeq(M(7, 5))},
+		{from: 7, to: 6, expectErr: os.ErrNotExist},
+		{from: 7, to: 7, expectErr: ErrNoChange},
+		{from: 7, to: 8, expectErr: os.ErrNotExist},
+
+		{from: 8, to: -1, expectErr: os.ErrNotExist},
+		{from: 8, to: 0, expectErr: os.ErrNotExist},
+		{from: 8, to: 1, expectErr: os.ErrNotExist},
+		{from: 8, to: 2, expectErr: os.ErrNotExist},
+		{from: 8, to: 3, expectErr: os.ErrNotExist},
+		{from: 8, to: 4, expectErr: os.ErrNotExist},
+		{from: 8, to: 5, expectErr: os.ErrNotExist},
+		{from: 8, to: 6, expectErr: os.ErrNotExist},
+		{from: 8, to: 7, expectErr: os.ErrNotExist},
+		{from: 8, to: 8, expectErr: os.ErrNotExist},
+	}
+
+	for i, v := range tt {
+		ret := make(chan interface{})
+		go m.read(v.from, v.to, ret)
+		migrations, err := migrationsFromChannel(ret)
+
+		if (v.expectErr == os.ErrNotExist && !os.IsNotExist(err)) ||
+			(v.expectErr != os.ErrNotExist && v.expectErr != err) {
+			t.Errorf("expected %v, got %v, in %v", v.expectErr, err, i)
+			t.Logf("%v, in %v", migrations, i)
+		}
+		if len(v.expectMigrations) > 0 {
+			equalMigSeq(t, i, v.expectMigrations, migrations)
+		}
+	}
+}
+
+func TestReadUp(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+
+	tt := []struct {
+		from             int
+		limit            int // -1 means no limit
+		expectErr        error
+		expectMigrations migrationSequence
+	}{
+		{from: -1, limit: -1, expectErr: nil, expectMigrations: newMigSeq(M(1), M(3), M(4), M(5), M(7))},
+		{from: -1, limit: 0, expectErr: ErrNoChange},
+		{from: -1, limit: 1, expectErr: nil, expectMigrations: newMigSeq(M(1))},
+		{from: -1, limit: 2, expectErr: nil, expectMigrations: newMigSeq(M(1), M(3))},
+
+		{from: 0, limit: -1, expectErr: os.ErrNotExist},
+		{from: 0, limit: 0, expectErr: os.ErrNotExist},
+		{from: 0, limit: 1, expectErr: os.ErrNotExist},
+		{from: 0, limit: 2, expectErr: os.ErrNotExist},
+
+		{from: 1, limit: -1, expectErr: nil, expectMigrations: newMigSeq(M(3), M(4), M(5), M(7))},
+		{from: 1, limit: 0, expectErr: ErrNoChange},
+		{from: 1, limit: 1, expectErr: nil, expectMigrations: newMigSeq(M(3))},
+		{from: 1, limit: 2, expectErr: nil, expectMigrations: newMigSeq(M(3), M(4))},
+
+		{from: 2, limit: -1, expectErr: os.ErrNotExist},
+		{from: 2, limit: 0, expectErr: os.ErrNotExist},
+		{from: 2, limit: 1, expectErr: os.ErrNotExist},
+		{from: 2, limit: 2, expectErr: os.ErrNotExist},
+
+		{from: 3, limit: -1, expectErr: nil, expectMigrations: newMigSeq(M(4), M(5), M(7))},
+		{from: 3, limit: 0, expectErr: ErrNoChange},
+		{from: 3, limit: 1, expectErr: nil, expectMigrations: newMigSeq(M(4))},
+		{from: 3, limit: 2, expectErr: nil, expectMigrations: newMigSeq(M(4), M(5))},
+
+		{from: 4, limit: -1, expectErr: nil, expectMigrations: newMigSeq(M(5), M(7))},
+		{from: 4, limit: 0, expectErr: ErrNoChange},
+		{from: 4, limit: 1, expectErr: nil, expectMigrations: newMigSeq(M(5))},
+		{from: 4, limit: 2, expectErr: nil, expectMigrations: newMigSeq(M(5), M(7))},
+
+		{from: 5, limit: -1, expectErr: nil, expectMigrations: newMigSeq(M(7))},
+		{from: 5, limit: 0, expectErr: ErrNoChange},
+		{from: 5, limit: 1, expectErr: nil, expectMigrations: newMigSeq(M(7))},
+		{from: 5, limit: 2, expectErr: ErrShortLimit{1}, expectMigrations: newMigSeq(M(7))},
+
+		{from: 6, limit: -1, expectErr: os.ErrNotExist},
+		{from: 6, limit: 0, expectErr: os.ErrNotExist},
+		{from: 6, limit: 1, expectErr: os.ErrNotExist},
+		{from: 6, limit: 2, expectErr: os.ErrNotExist},
+
+		{from: 7, limit: -1, expectErr: ErrNoChange},
+		{from: 7, limit: 0, expectErr: ErrNoChange},
+		{from: 7, limit: 1, expectErr: os.ErrNotExist},
+		{from: 7, limit: 2, expectErr: os.ErrNotExist},
+
+		{from: 8, limit: -1, expectErr: os.ErrNotExist},
+		{from: 8, limit: 0, expectErr: os.ErrNotExist},
+		{from: 8, limit: 1, expectErr: os.ErrNotExist},
+		{from: 8, limit: 2, expectErr: os.ErrNotExist},
+	}
+
+	for i, v := range tt {
+		ret := make(chan interface{})
+		go m.readUp(v.from, v.limit, ret)
+		migrations, err := migrationsFromChannel(ret)
+
+		if (v.expectErr == os.ErrNotExist && !os.IsNotExist(err)) ||
+			(v.expectErr != os.ErrNotExist && v.expectErr != err) {
+			t.Errorf("expected %v, got %v, in %v", v.expectErr, err, i)
+			t.Logf("%v, in %v", migrations, i)
+		}
+		if len(v.expectMigrations) > 0 {
+			equalMigSeq(t, i, v.expectMigrations, migrations)
+		}
+	}
+}
+
+func TestReadDown(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+
+	tt := []struct {
+		from             int
+		limit            int // -1 means no limit
+		expectErr        error
+		expectMigrations migrationSequence
+	}{
+		{from: -1, limit: -1, expectErr: ErrNoChange},
+		{from: -1, limit: 0, expectErr: ErrNoChange},
+		{from: -1, limit: 1, expectErr: os.ErrNotExist},
+		{from: -1, limit: 2, expectErr: os.ErrNotExist},
+
+		{from: 0, limit: -1, expectErr: os.ErrNotExist},
+		{from: 0, limit: 0, expectErr: os.ErrNotExist},
+		{from: 0, limit: 1, expectErr: os.ErrNotExist},
+		{from: 0, limit: 2, expectErr: os.ErrNotExist},
+
+		{from: 1, limit: -1, expectErr: nil, expectMigrations: newMigSeq(M(1, -1))},
+		{from: 1, limit: 0, expectErr: ErrNoChange},
+		{from: 1, limit: 1, expectErr: nil, expectMigrations: newMigSeq(M(1, -1))},
+		{from: 1, limit: 2, expectErr: ErrShortLimit{1}, expectMigrations: newMigSeq(M(1, -1))},
+
+		{from: 2, limit: -1, expectErr: os.ErrNotExist},
+		{from: 2, limit: 0, expectErr: os.ErrNotExist},
+		{from: 2, limit: 1, expectErr: os.ErrNotExist},
+		{from: 2, limit: 2, expectErr: os.ErrNotExist},
+
+		{from: 3, limit: -1, expectErr: nil, expectMigrations: newMigSeq(M(3, 1), M(1, -1))},
+		{from: 3, limit: 0, expectErr: ErrNoChange},
+		{from: 3, limit: 1, expectErr: nil, expectMigrations: newMigSeq(M(3, 1))},
+		{from: 3, limit: 2, expectErr: nil, expectMigrations: newMigSeq(M(3, 1), M(1, -1))},
+
+		{from: 4, limit: -1, expectErr: nil, expectMigrations: newMigSeq(M(4, 3), M(3, 1), M(1, -1))},
+		{from: 4, limit: 0, expectErr: ErrNoChange},
+		{from: 4, limit: 1, expectErr: nil, expectMigrations: newMigSeq(M(4, 3))},
+		{from: 4, limit: 2, expectErr: nil, expectMigrations: newMigSeq(M(4, 3), M(3, 1))},
+
+		{from: 5, limit: -1, expectErr: nil, expectMigrations: newMigSeq(M(5, 4), M(4, 3), M(3, 1), M(1, -1))},
+		{from: 5, limit: 0, expectErr: ErrNoChange},
+		{from: 5, limit: 1, expectErr: nil, expectMigrations: newMigSeq(M(5, 4))},
+		{from: 5, limit: 2, expectErr: nil, expectMigrations: newMigSeq(M(5, 4), M(4, 3))},
+
+		{from: 6, limit: -1, expectErr: os.ErrNotExist},
+		{from: 6, limit: 0, expectErr: os.ErrNotExist},
+		{from: 6, limit: 1, expectErr: os.ErrNotExist},
+		{from: 6, limit: 2, expectErr: os.ErrNotExist},
+
+		{from: 7, limit: -1, expectErr: nil, expectMigrations: newMigSeq(M(7, 5), M(5, 4), M(4, 3), M(3, 1), M(1, -1))},
+		{from: 7, limit: 0, expectErr: ErrNoChange},
+		{from: 7, limit: 1, expectErr: nil, expectMigrations: newMigSeq(M(7, 5))},
+		{from: 7, limit: 2, expectErr: nil, expectMigrations: newMigSeq(M(7, 5), M(5, 4))},
+
+		{from: 8, limit: -1, expectErr: os.ErrNotExist},
+		{from: 8, limit: 0, expectErr: os.ErrNotExist},
+		{from: 8, limit: 1, expectErr: os.ErrNotExist},
+		{from: 8, limit: 2, expectErr: os.ErrNotExist},
+	}
+
+	for i, v := range tt {
+		ret := make(chan interface{})
+		go m.readDown(v.from, v.limit, ret)
+		migrations, err := migrationsFromChannel(ret)
+
+		if (v.expectErr == os.ErrNotExist && !os.IsNotExist(err)) ||
+			(v.expectErr != os.ErrNotExist && v.expectErr != err) {
+			t.Errorf("expected %v, got %v, in %v", v.expectErr, err, i)
+			t.Logf("%v, in %v", migrations, i)
+		}
+		if len(v.expectMigrations) > 0 {
+			equalMigSeq(t, i, v.expectMigrations, migrations)
+		}
+	}
+}
+
+func TestLock(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	if err := m.lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.lock(); err == nil {
+		t.Fatal("should be locked already")
+	}
+}
+
+func migrationsFromChannel(ret chan interface{}) ([]*Migration, error) {
+	slice := make([]*Migration, 0)
+	for r := range ret {
+		switch r.(type) {
+		case error:
+			return slice, r.(error)
+
+		case *Migration:
+			slice = append(slice, r.(*Migration))
+		}
+	}
+	return slice, nil
+}
+
+type migrationSequence []*Migration
+
+func newMigSeq(migr ...*Migration) migrationSequence {
+	return migr
+}
+
+func (m *migrationSequence) add(migr ...*Migration) migrationSequence {
+	*m = append(*m, migr...)
+	return *m
+}
+
+func (m *migrationSequence) bodySequence() []string {
+	r := make([]string, 0)
+	for _, v := range *m {
+		if v.Body != nil {
+			body, err := ioutil.ReadAll(v.Body)
+			if err != nil {
+				panic(err) // that should never happen
+			}
+
+			// reset body reader
+			// TODO: is there a better/nicer way?
+			v.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+			r = append(r, string(body[:]))
+		}
+	}
+	return r
+}
+
+// M is a convenience func to create a new *Migration
+func M(version uint, targetVersion ...int) *Migration {
+	if len(targetVersion) > 1 {
+		panic("only one targetVersion allowed")
+	}
+	ts := int(version)
+	if len(targetVersion) == 1 {
+		ts = targetVersion[0]
+	}
+
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	migr, err := m.newMigration(version, ts)
+	if err != nil {
+		panic(err)
+	}
+	return migr
+}
+
+func equalMigSeq(t *testing.T, i int, expected, got migrationSequence) {
+	if len(expected) != len(got) {
+		t.Errorf("expected migrations %v, got %v, in %v", expected, got, i)
+
+	} else {
+		for ii := 0; ii < len(expected); ii++ {
+			if expected[ii].Version != got[ii].Version {
+				t.Errorf("expected version %v, got %v, in %v", expected[ii].Version, got[ii].Version, i)
+			}
+
+			if expected[ii].TargetVersion != got[ii].TargetVersion {
+				t.Errorf("expected targetVersion %v, got %v, in %v", expected[ii].TargetVersion, got[ii].TargetVersion, i)
+			}
+		}
+	}
+}
+
+func equalDbSeq(t *testing.T, i int, expected migrationSequence, got *dStub.Stub) {
+	bs := expected.bodySequence()
 	if !got.EqualSequence(bs) {
 		t.Fatalf("\nexpected sequence %v,\ngot               %v, in %v", bs, got.MigrationSequence, i)
 	}
 }
+
+// roundTripStub records the migrations passed to RoundTrip.
+type roundTripStub struct {
+	transactionalStub
+	bodies []string
+}
+
+func (s *roundTripStub) RoundTrip(up io.Reader, down io.Reader) error {
+	for _, r := range []io.Reader{up, down} {
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		s.bodies = append(s.bodies, string(body))
+	}
+	return nil
+}
+
+func TestRoundTrip(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1"})
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Down, Identifier: "DROP 1"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	if err := m.RoundTrip(1); err != ErrNoRoundTrip {
+		t.Fatalf("expected ErrNoRoundTrip, got %v", err)
+	}
+
+	rt := &roundTripStub{transactionalStub: transactionalStub{Stub: dbDrv}}
+	m.databaseDrv = rt
+	if err := m.RoundTrip(1); err != ErrNoRoundTrip {
+		t.Fatalf("expected ErrNoRoundTrip without transactional DDL, got %v", err)
+	}
+
+	rt.transactional = true
+	if err := m.RoundTrip(1); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(rt.bodies) != "[CREATE 1 DROP 1]" {
+		t.Fatalf("expected create and drop, got %v", rt.bodies)
+	}
+	if dbDrv.CurrentVersion != -1 || len(dbDrv.MigrationSequence) != 0 {
+		t.Fatalf("expected database to be unchanged, got version %v, %v", dbDrv.CurrentVersion, dbDrv.MigrationSequence)
+	}
+	if m.isLocked {
+		t.Fatal("expected lock to be released")
+	}
+
+	if err := dbDrv.SetVersion(1, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.RoundTrip(1).(ErrDirty); !ok {
+		t.Fatal("expected ErrDirty")
+	}
+}
+
+// privilegeStub lacks the privileges in missing.
+type privilegeStub struct {
+	*dStub.Stub
+	missing []string
+}
+
+func (s *privilegeStub) CheckPrivileges(required []string) error {
+	missing := make([]string, 0)
+	for _, r := range required {
+		for _, m := range s.missing {
+			if r == m {
+				missing = append(missing, r)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return database.ErrMissingPrivileges{User: "stub", Missing: missing}
+	}
+	return nil
+}
+
+func TestSetRequiredPrivileges(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	if err := m.SetRequiredPrivileges([]string{"CREATE"}); err != ErrNoPrivilegeCheck {
+		t.Fatalf("expected ErrNoPrivilegeCheck, got %v", err)
+	}
+
+	dbDrv := &privilegeStub{Stub: m.databaseDrv.(*dStub.Stub), missing: []string{"DROP"}}
+	m.databaseDrv = dbDrv
+
+	if err := m.SetRequiredPrivileges([]string{"CREATE", "DROP"}); err != nil {
+		t.Fatal(err)
+	}
+	err := m.Up()
+	e, ok := err.(database.ErrMissingPrivileges)
+	if !ok {
+		t.Fatalf("expected ErrMissingPrivileges, got %v", err)
+	}
+	if len(e.Missing) != 1 || e.Missing[0] != "DROP" {
+		t.Fatalf("expected DROP to be missing, got %v", e.Missing)
+	}
+	if dbDrv.CurrentVersion != -1 || len(dbDrv.MigrationSequence) != 0 {
+		t.Fatalf("expected no migration to run, got %v", dbDrv.MigrationSequence)
+	}
+	if dbDrv.IsLocked {
+		t.Fatal("expected database to be unlocked")
+	}
+
+	if err := m.SetRequiredPrivileges([]string{"CREATE"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if dbDrv.CurrentVersion != 7 {
+		t.Fatalf("expected version 7, got %v", dbDrv.CurrentVersion)
+	}
+}
+
+// writeCheckStub implements database.WriteChecker,
+// failing as long as readOnly is set.
+type writeCheckStub struct {
+	*dStub.Stub
+	readOnly bool
+}
+
+func (s *writeCheckStub) CheckWrite() error {
+	if s.readOnly {
+		return database.ErrVersionTableNotWritable{Table: "stub", Err: fmt.Errorf("permission denied")}
+	}
+	return nil
+}
+
+func TestSetWriteCheck(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	if err := m.SetWriteCheck(true); err != ErrNoWriteCheck {
+		t.Fatalf("expected ErrNoWriteCheck, got %v", err)
+	}
+
+	dbDrv := &writeCheckStub{Stub: m.databaseDrv.(*dStub.Stub), readOnly: true}
+	m.databaseDrv = dbDrv
+
+	// not checked unless enabled
+	if err := m.Steps(1); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.SetWriteCheck(true); err != nil {
+		t.Fatal(err)
+	}
+	err := m.Up()
+	if _, ok := err.(database.ErrVersionTableNotWritable); !ok {
+		t.Fatalf("expected ErrVersionTableNotWritable, got %v", err)
+	}
+	if dbDrv.CurrentVersion != 1 || len(dbDrv.MigrationSequence) != 1 {
+		t.Fatalf("expected no further migration to run, got %v", dbDrv.MigrationSequence)
+	}
+	if dbDrv.IsLocked {
+		t.Fatal("expected database to be unlocked")
+	}
+
+	dbDrv.readOnly = false
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if dbDrv.CurrentVersion != 7 {
+		t.Fatalf("expected version 7, got %v", dbDrv.CurrentVersion)
+	}
+}
+
+// recordingChecksumStub records the checksum of the up migration leading
+// to a clean version, like database drivers implementing
+// database.Checksummer. Checksums of rolled back versions are kept.
+type recordingChecksumStub struct {
+	*dStub.Stub
+	checksums map[int]string
+	up        bool
+}
+
+func (s *recordingChecksumStub) SetVersion(version int, dirty bool) error {
+	if dirty {
+		s.up = version > s.CurrentVersion
+	}
+	if !dirty && s.up && len(s.LastRunMigration) > 0 {
+		s.checksums[version] = fmt.Sprintf("%x", sha256.Sum256(s.LastRunMigration))
+		s.LastRunMigration = nil
+	}
+	return s.Stub.SetVersion(version, dirty)
+}
+
+func (s *recordingChecksumStub) Checksums() (map[int]string, error) {
+	return s.checksums, nil
+}
+
+func (s *recordingChecksumStub) RecordsChecksums() bool {
+	return s.checksums != nil
+}
+
+func TestSetStrict(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	// the checksum is recorded without the byte order mark
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "\xef\xbb\xbfCREATE 1"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "CREATE 2"})
+	migrations.Append(&source.Migration{Version: 3, Direction: source.Up, Identifier: "CREATE 3"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	if err := m.SetStrict(true); err != ErrNoChecksums {
+		t.Fatalf("expected ErrNoChecksums, got %v", err)
+	}
+
+	// a driver configured not to record checksums
+	m.databaseDrv = &recordingChecksumStub{Stub: m.databaseDrv.(*dStub.Stub)}
+	if err := m.SetStrict(true); err != ErrNoChecksums {
+		t.Fatalf("expected ErrNoChecksums, got %v", err)
+	}
+
+	dbDrv := &recordingChecksumStub{Stub: m.databaseDrv.(*recordingChecksumStub).Stub, checksums: make(map[int]string)}
+	m.databaseDrv = dbDrv
+	if err := m.SetStrict(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Steps(2); err != nil {
+		t.Fatal(err)
+	}
+
+	// applied migration 2 is edited afterwards
+	edited, _ := migrations.Up(2)
+	edited.Identifier = "CREATE 2 edited"
+	err := m.Up()
+	mismatch, ok := err.(ErrChecksumMismatch)
+	if !ok {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+	if mismatch.Version != 2 || mismatch.Identifier != "2.up.stub" {
+		t.Fatalf("expected migration 2 to be reported, got %v", mismatch)
+	}
+	if mismatch.Recorded != fmt.Sprintf("%x", sha256.Sum256([]byte("CREATE 2"))) ||
+		mismatch.Actual != fmt.Sprintf("%x", sha256.Sum256([]byte("CREATE 2 edited"))) {
+		t.Fatalf("expected the checksums of the original and edited migration, got %v", mismatch)
+	}
+	if dbDrv.CurrentVersion != 2 || len(dbDrv.MigrationSequence) != 2 {
+		t.Fatalf("expected migration 3 not to run, got %q", dbDrv.MigrationSequence)
+	}
+	if dbDrv.IsLocked {
+		t.Fatal("expected database to be unlocked")
+	}
+
+	// not checked unless enabled
+	if err := m.SetStrict(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if dbDrv.CurrentVersion != 3 {
+		t.Fatalf("expected version 3, got %v", dbDrv.CurrentVersion)
+	}
+}
+
+func TestSetStrictRolledBack(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1"})
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Down, Identifier: "DROP 1"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "CREATE 2"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Down, Identifier: "DROP 2"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	// keeps the checksum of 2 after it's rolled back
+	dbDrv := &recordingChecksumStub{Stub: m.databaseDrv.(*dStub.Stub), checksums: make(map[int]string)}
+	m.databaseDrv = dbDrv
+	if err := m.SetStrict(true); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Steps(-1); err != nil {
+		t.Fatal(err)
+	}
+
+	// the rolled back migration 2 is edited before it's applied again
+	edited, _ := migrations.Up(2)
+	edited.Identifier = "CREATE 2 edited"
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if dbDrv.CurrentVersion != 2 {
+		t.Fatalf("expected version 2, got %v", dbDrv.CurrentVersion)
+	}
+}
+
+// tryLockStub implements database.TryLocker.
+type tryLockStub struct {
+	*dStub.Stub
+}
+
+func (s *tryLockStub) TryLock() (bool, error) {
+	if s.IsLocked {
+		return false, nil
+	}
+	s.IsLocked = true
+	return true, nil
+}
+
+// countingTryLockStub counts the attempts to acquire the lock, which is
+// released after a while.
+type countingTryLockStub struct {
+	*dStub.Stub
+	mu       sync.Mutex
+	attempts int
+	until    time.Time
+}
+
+func (s *countingTryLockStub) TryLock() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attempts++
+	if time.Now().Before(s.until) {
+		return false, nil
+	}
+	s.IsLocked = true
+	return true, nil
+}
+
+func TestUpWaitsForLock(t *testing.T) {
+	defer func(base, max time.Duration) {
+		lockRetryBaseDelay, lockRetryMaxDelay = base, max
+	}(lockRetryBaseDelay, lockRetryMaxDelay)
+	lockRetryBaseDelay, lockRetryMaxDelay = time.Millisecond, 20*time.Millisecond
+
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbDrv := &countingTryLockStub{Stub: m.databaseDrv.(*dStub.Stub), until: time.Now().Add(100 * time.Millisecond)}
+	m.databaseDrv = dbDrv
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if dbDrv.CurrentVersion != 7 {
+		t.Fatalf("expected version 7, got %v", dbDrv.CurrentVersion)
+	}
+	// a fixed interval of 1ms would take about 100 attempts
+	if dbDrv.attempts < 2 || dbDrv.attempts > 30 {
+		t.Fatalf("expected the attempts to back off, got %v", dbDrv.attempts)
+	}
+}
+
+func TestTryUp(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	if _, err := m.TryUp(); err != ErrNoTryLock {
+		t.Fatalf("expected ErrNoTryLock, got %v", err)
+	}
+
+	dbDrv := &tryLockStub{Stub: m.databaseDrv.(*dStub.Stub)}
+	m.databaseDrv = dbDrv
+
+	// locked by someone else
+	dbDrv.IsLocked = true
+	acquired, err := m.TryUp()
+	if acquired || err != nil {
+		t.Fatalf("expected not to acquire the lock, got %v, %v", acquired, err)
+	}
+	if dbDrv.CurrentVersion != -1 {
+		t.Fatalf("expected no migration to run, got version %v", dbDrv.CurrentVersion)
+	}
+
+	dbDrv.IsLocked = false
+	acquired, err = m.TryUp()
+	if !acquired || err != nil {
+		t.Fatalf("expected to acquire the lock, got %v, %v", acquired, err)
+	}
+	if dbDrv.CurrentVersion != 7 || dbDrv.IsLocked {
+		t.Fatalf("expected version 7 and unlocked, got %v, %v", dbDrv.CurrentVersion, dbDrv.IsLocked)
+	}
+
+	if acquired, err := m.TryUp(); !acquired || err != ErrNoChange {
+		t.Fatalf("expected ErrNoChange, got %v, %v", acquired, err)
+	}
+}
+
+func TestUpWithBOM(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "\uFEFF-- migrate:tag pre-deploy\nCREATE TABLE a (a INT)"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "CREATE TABLE b (b \uFEFF)"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	if err := m.UpTagged("pre-deploy"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	// only a leading byte order mark is stripped
+	expected := []string{"-- migrate:tag pre-deploy\nCREATE TABLE a (a INT)", "CREATE TABLE b (b \uFEFF)"}
+	if !dbDrv.EqualSequence(expected) {
+		t.Fatalf("expected %q, got %q", expected, dbDrv.MigrationSequence)
+	}
+
+	body, err := m.Read(1, source.Up)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != expected[0] {
+		t.Fatalf("expected %q, got %q", expected[0], body)
+	}
+}
+
+// sharedStub is a database shared by several Migrate instances,
+// which is locked with TryLock only.
+type sharedStub struct {
+	*dStub.Stub
+	mu *sync.Mutex
+}
+
+func (s *sharedStub) TryLock() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.IsLocked {
+		return false, nil
+	}
+	s.IsLocked = true
+	return true, nil
+}
+
+func (s *sharedStub) Lock() error {
+	if ok, _ := s.TryLock(); !ok {
+		return database.ErrLocked
+	}
+	return nil
+}
+
+func (s *sharedStub) Unlock() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Stub.Unlock()
+}
+
+func (s *sharedStub) Run(migration io.Reader) error {
+	// give the other instance time to wait for the lock
+	time.Sleep(10 * time.Millisecond)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Stub.Run(migration)
+}
+
+func (s *sharedStub) SetVersion(version int, dirty bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Stub.SetVersion(version, dirty)
+}
+
+func (s *sharedStub) Version() (int, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Stub.Version()
+}
+
+func TestUpConcurrent(t *testing.T) {
+	db := &sharedStub{mu: &sync.Mutex{}}
+	const n = 3
+
+	instances := make([]*Migrate, n)
+	for i := range instances {
+		m, _ := New("stub://", "stub://")
+		m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+		if db.Stub == nil {
+			db.Stub = m.databaseDrv.(*dStub.Stub)
+		}
+		m.databaseDrv = db
+		instances[i] = m
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i, m := range instances {
+		wg.Add(1)
+		go func(i int, m *Migrate) {
+			defer wg.Done()
+			errs[i] = m.Up()
+		}(i, m)
+	}
+	wg.Wait()
+
+	applied := 0
+	for _, err := range errs {
+		switch err {
+		case nil:
+			applied++
+		case ErrNoChange:
+		default:
+			t.Fatalf("expected nil or ErrNoChange, got %v", err)
+		}
+	}
+	if applied != 1 {
+		t.Fatalf("expected a single instance to migrate, got %v", errs)
+	}
+
+	// each migration ran once
+	if db.CurrentVersion != 7 || len(db.MigrationSequence) != 4 {
+		t.Fatalf("expected version 7 after 4 migrations, got %v after %v", db.CurrentVersion, db.MigrationSequence)
+	}
+}
+
+func TestSetPreflight(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	errBusy := fmt.Errorf("long-running transactions active")
+	calls := 0
+	m.SetPreflight(func(d database.Driver) error {
+		calls++
+		if d != dbDrv {
+			t.Errorf("expected the database driver, got %v", d)
+		}
+		if !dbDrv.IsLocked {
+			t.Error("expected preflight to run with the lock held")
+		}
+		if calls == 1 {
+			return errBusy
+		}
+		return nil
+	})
+
+	if err := m.Up(); err != errBusy {
+		t.Fatalf("expected %v, got %v", errBusy, err)
+	}
+	if dbDrv.CurrentVersion != -1 || len(dbDrv.MigrationSequence) != 0 {
+		t.Fatalf("expected no migration to run, got %v", dbDrv.MigrationSequence)
+	}
+	if dbDrv.IsLocked {
+		t.Fatal("expected database to be unlocked")
+	}
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if dbDrv.CurrentVersion != 7 || calls != 2 {
+		t.Fatalf("expected version 7 after 2 preflights, got %v after %v", dbDrv.CurrentVersion, calls)
+	}
+}
+
+type forceUnlockStub struct {
+	*dStub.Stub
+}
+
+func (s *forceUnlockStub) ForceUnlock() error {
+	s.IsLocked = false
+	return nil
+}
+
+func TestForceUnlock(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	if err := m.ForceUnlock(); err != ErrNoForceUnlock {
+		t.Fatalf("expected ErrNoForceUnlock, got %v", err)
+	}
+
+	dbDrv := &forceUnlockStub{Stub: m.databaseDrv.(*dStub.Stub)}
+	m.databaseDrv = dbDrv
+
+	// left behind by a migration that crashed
+	dbDrv.IsLocked = true
+	dbDrv.CurrentVersion = 3
+	dbDrv.IsDirty = true
+
+	if err := m.ForceUnlock(); err != nil {
+		t.Fatal(err)
+	}
+	if dbDrv.IsLocked {
+		t.Fatal("expected the lock to be released")
+	}
+	if dbDrv.CurrentVersion != 3 || !dbDrv.IsDirty {
+		t.Fatalf("expected dirty version 3 to be kept, got %v, %v", dbDrv.CurrentVersion, dbDrv.IsDirty)
+	}
+}
+
+// checkStub records the checked migrations and fails
+// at the first one containing FAIL.
+type checkStub struct {
+	transactionalStub
+	bodies []string
+}
+
+func (s *checkStub) Check(migrations []io.Reader) (int, error) {
+	for i, r := range migrations {
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			return i, err
+		}
+		s.bodies = append(s.bodies, string(body))
+		if strings.Contains(string(body), "FAIL") {
+			return i, fmt.Errorf("migration failed")
+		}
+	}
+	return -1, nil
+}
+
+func TestCheck(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "CREATE 2"})
+	migrations.Append(&source.Migration{Version: 3, Direction: source.Down, Identifier: "DROP 3"})
+	migrations.Append(&source.Migration{Version: 4, Direction: source.Up, Identifier: "FAIL 4"})
+	migrations.Append(&source.Migration{Version: 5, Direction: source.Up, Identifier: "CREATE 5"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	if err := m.Check(); err != ErrNoCheck {
+		t.Fatalf("expected ErrNoCheck, got %v", err)
+	}
+
+	c := &checkStub{transactionalStub: transactionalStub{Stub: dbDrv}}
+	m.databaseDrv = c
+	if err := m.Check(); err != ErrNoCheck {
+		t.Fatalf("expected ErrNoCheck without transactional DDL, got %v", err)
+	}
+
+	c.transactional = true
+	if err := dbDrv.SetVersion(1, false); err != nil {
+		t.Fatal(err)
+	}
+	err := m.Check()
+	e, ok := err.(ErrCheckFailed)
+	if !ok || e.Version != 4 {
+		t.Fatalf("expected ErrCheckFailed for version 4, got %v", err)
+	}
+	if fmt.Sprint(c.bodies) != "[CREATE 2 FAIL 4]" {
+		t.Fatalf("expected pending migrations up to the failing one, got %v", c.bodies)
+	}
+	if dbDrv.CurrentVersion != 1 || len(dbDrv.MigrationSequence) != 0 {
+		t.Fatalf("expected database to be unchanged, got version %v, %v", dbDrv.CurrentVersion, dbDrv.MigrationSequence)
+	}
+	if m.isLocked {
+		t.Fatal("expected lock to be released")
+	}
+
+	c.bodies = nil
+	if err := dbDrv.SetVersion(4, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(c.bodies) != "[CREATE 5]" {
+		t.Fatalf("expected pending migration 5, got %v", c.bodies)
+	}
+
+	if err := dbDrv.SetVersion(5, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.Check().(ErrDirty); !ok {
+		t.Fatal("expected ErrDirty")
+	}
+}
+
+func TestSetContinueOnError(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "CREATE 1"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "FAIL 2"})
+	migrations.Append(&source.Migration{Version: 3, Direction: source.Up, Identifier: "CREATE 3"})
+	migrations.Append(&source.Migration{Version: 4, Direction: source.Up, Identifier: "FAIL 4"})
+	migrations.Append(&source.Migration{Version: 5, Direction: source.Up, Identifier: "CREATE 5"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	if err := m.SetContinueOnError(true); err != ErrNoCheck {
+		t.Fatalf("expected ErrNoCheck, got %v", err)
+	}
+	if err := m.SetContinueOnError(false); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &checkStub{transactionalStub: transactionalStub{Stub: dbDrv, transactional: true}}
+	m.databaseDrv = c
+	if err := m.SetContinueOnError(true); err != nil {
+		t.Fatal(err)
+	}
+
+	err := m.Up()
+	merr, ok := err.(MultiError)
+	if !ok || len(merr.Errs) != 2 {
+		t.Fatalf("expected the errors of migrations 2 and 4, got %v", err)
+	}
+	if e, ok := merr.Errs[1].(ErrCheckFailed); !ok || e.Version != 4 {
+		t.Fatalf("expected ErrCheckFailed for version 4, got %v", merr.Errs[1])
+	}
+
+	// the version doesn't advance past the failed migration
+	if dbDrv.CurrentVersion != 1 || dbDrv.IsDirty {
+		t.Fatalf("expected clean version 1, got %v, %v", dbDrv.CurrentVersion, dbDrv.IsDirty)
+	}
+	if !dbDrv.EqualSequence([]string{"CREATE 1"}) {
+		t.Fatalf("expected only migration 1 to be applied, got %q", dbDrv.MigrationSequence)
+	}
+	// 3 and 5 are checked again without 4
+	if fmt.Sprint(c.bodies) != "[CREATE 3 FAIL 4 CREATE 3 CREATE 5]" {
+		t.Fatalf("unexpected checks %v", c.bodies)
+	}
+	if m.isLocked {
+		t.Fatal("expected lock to be released")
+	}
+}
+
+// timestampStub reports at as the time of the last migration.
+type timestampStub struct {
+	*dStub.Stub
+	at time.Time
+}
+
+func (s *timestampStub) LastAppliedAt() (time.Time, bool, error) {
+	return s.at, !s.at.IsZero(), nil
+}
+
+func TestLastAppliedAt(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	if at, ok, err := m.LastAppliedAt(); err != nil || ok || !at.IsZero() {
+		t.Fatalf("expected no time without database.Timestamper, got %v, %v, %v", at, ok, err)
+	}
+
+	appliedAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	m.databaseDrv = &timestampStub{Stub: m.databaseDrv.(*dStub.Stub), at: appliedAt}
+	at, ok, err := m.LastAppliedAt()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || !at.Equal(appliedAt) {
+		t.Fatalf("expected applied at %v, got %v, %v", appliedAt, at, ok)
+	}
+}
+
+func TestRunOnce(t *testing.T) {
+	defer func(base, max time.Duration) {
+		lockRetryBaseDelay, lockRetryMaxDelay = base, max
+	}(lockRetryBaseDelay, lockRetryMaxDelay)
+	lockRetryBaseDelay, lockRetryMaxDelay = time.Millisecond, 4*time.Millisecond
+
+	m, _ := New("stub://", "stub://")
+	if err := m.RunOnce(context.Background()); err != ErrNoTryLock {
+		t.Fatalf("expected ErrNoTryLock, got %v", err)
+	}
+
+	db := &sharedStub{mu: &sync.Mutex{}}
+	const n = 5
+
+	instances := make([]*Migrate, n)
+	for i := range instances {
+		m, _ := New("stub://", "stub://")
+		m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+		if db.Stub == nil {
+			db.Stub = m.databaseDrv.(*dStub.Stub)
+		}
+		m.databaseDrv = db
+		instances[i] = m
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i, m := range instances {
+		wg.Add(1)
+		go func(i int, m *Migrate) {
+			defer wg.Done()
+			errs[i] = m.RunOnce(context.Background())
+		}(i, m)
+	}
+	wg.Wait()
+
+	leaders := 0
+	for _, err := range errs {
+		switch err {
+		case nil:
+			leaders++
+		case ErrNoChange:
+		default:
+			t.Fatalf("expected nil or ErrNoChange, got %v", err)
+		}
+	}
+	if leaders != 1 {
+		t.Fatalf("expected a single instance to migrate, got %v", errs)
+	}
+	if len(db.MigrationSequence) != 4 {
+		t.Fatalf("expected each of the 4 up migrations to run once, got %v", len(db.MigrationSequence))
+	}
+	if db.CurrentVersion != 7 || db.IsLocked {
+		t.Fatalf("expected version 7 and unlocked, got %v, %v", db.CurrentVersion, db.IsLocked)
+	}
+}
+
+func TestRunOncePending(t *testing.T) {
+	defer func(base, max time.Duration) {
+		lockRetryBaseDelay, lockRetryMaxDelay = base, max
+	}(lockRetryBaseDelay, lockRetryMaxDelay)
+	lockRetryBaseDelay, lockRetryMaxDelay = time.Millisecond, 4*time.Millisecond
+
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	db := &sharedStub{Stub: m.databaseDrv.(*dStub.Stub), mu: &sync.Mutex{}}
+	m.databaseDrv = db
+
+	// the elected instance failed on version 4, which was rolled back
+	db.IsLocked = true
+	db.CurrentVersion = 3
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		db.Unlock()
+	}()
+
+	err := m.RunOnce(context.Background())
+	if e, ok := err.(ErrPending); !ok || e.Version != 3 || e.Last != 7 {
+		t.Fatalf("expected ErrPending at version 3 of 7, got %v", err)
+	}
+	if len(db.MigrationSequence) != 0 || db.IsLocked {
+		t.Fatalf("expected no migration to run and unlocked, got %v, %v", db.MigrationSequence, db.IsLocked)
+	}
+}
+
+func TestRunOnceBackoff(t *testing.T) {
+	defer func(base, max time.Duration) {
+		lockRetryBaseDelay, lockRetryMaxDelay = base, max
+	}(lockRetryBaseDelay, lockRetryMaxDelay)
+	lockRetryBaseDelay, lockRetryMaxDelay = time.Millisecond, 20*time.Millisecond
+
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbDrv := &countingTryLockStub{Stub: m.databaseDrv.(*dStub.Stub), until: time.Now().Add(100 * time.Millisecond)}
+	// the elected instance migrated up
+	dbDrv.CurrentVersion = 7
+	m.databaseDrv = dbDrv
+
+	if err := m.RunOnce(context.Background()); err != ErrNoChange {
+		t.Fatalf("expected ErrNoChange, got %v", err)
+	}
+	// a fixed interval of 1ms would take about 100 attempts
+	if dbDrv.attempts < 2 || dbDrv.attempts > 30 {
+		t.Fatalf("expected the attempts to back off, got %v", dbDrv.attempts)
+	}
+}
+
+func TestRunOnceCanceled(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	dbDrv := &tryLockStub{Stub: m.databaseDrv.(*dStub.Stub)}
+	m.databaseDrv = dbDrv
+
+	// the elected instance never finishes
+	dbDrv.IsLocked = true
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.RunOnce(ctx); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+// querierStub evaluates the conditions true and false.
+type querierStub struct {
+	*dStub.Stub
+	conditions []string
+}
+
+func (s *querierStub) QueryBool(condition string) (bool, error) {
+	s.conditions = append(s.conditions, condition)
+	return condition == "true", nil
+}
+
+func TestUpAssertions(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "-- migrate:assert true\nCREATE 1"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "-- migrate:assert true\n-- migrate:assert false\nCREATE 2"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+
+	if err := m.Up(); err != ErrNoQuerier {
+		t.Fatalf("expected ErrNoQuerier, got %v", err)
+	}
+
+	dbDrv := &querierStub{Stub: m.databaseDrv.(*dStub.Stub)}
+	m.databaseDrv = dbDrv
+	err := m.Up()
+	expected := ErrAssertionFailed{Version: 2, Assertion: "false"}
+	if err != expected {
+		t.Fatalf("expected %v, got %v", expected, err)
+	}
+	if !reflect.DeepEqual(dbDrv.conditions, []string{"true", "true", "false"}) {
+		t.Fatalf("expected conditions true, true and false, got %v", dbDrv.conditions)
+	}
+	if dbDrv.CurrentVersion != 1 || dbDrv.IsDirty {
+		t.Fatalf("expected clean version 1, got %v, %v", dbDrv.CurrentVersion, dbDrv.IsDirty)
+	}
+	if len(dbDrv.MigrationSequence) != 1 {
+		t.Fatalf("expected migration 2 not to run, got %q", dbDrv.MigrationSequence)
+	}
+}
+
+// readCountingSource counts the up migrations read from it.
+type readCountingSource struct {
+	*sStub.Stub
+	reads int
+}
+
+func (s *readCountingSource) ReadUp(version uint) (io.ReadCloser, string, error) {
+	s.reads++
+	return s.Stub.ReadUp(version)
+}
+
+func TestAssertionsReadOnce(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "-- migrate:assert true\nCREATE 1"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "-- migrate:assert true\nCREATE 2"})
+	srcDrv := &readCountingSource{Stub: m.sourceDrv.(*sStub.Stub)}
+	srcDrv.Migrations = migrations
+	m.sourceDrv = srcDrv
+	dbDrv := &querierStub{Stub: m.databaseDrv.(*dStub.Stub)}
+	m.databaseDrv = dbDrv
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if srcDrv.reads != 2 {
+		t.Fatalf("expected each migration to be read once, got %v reads", srcDrv.reads)
+	}
+	if !reflect.DeepEqual(dbDrv.conditions, []string{"true", "true"}) {
+		t.Fatalf("expected conditions true and true, got %v", dbDrv.conditions)
+	}
+}
+
+func TestRunAssertionsOfOwnBody(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "-- migrate:assert false\nCREATE 1"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	dbDrv := &querierStub{Stub: m.databaseDrv.(*dStub.Stub)}
+	m.databaseDrv = dbDrv
+
+	// the directives of the migration passed to Run count,
+	// not the ones of the source with the same version
+	migr, err := NewMigration(ioutil.NopCloser(strings.NewReader("-- migrate:assert true\nCREATE 1")), "1.up", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Run(migr); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(dbDrv.conditions, []string{"true"}) {
+		t.Fatalf("expected condition true, got %v", dbDrv.conditions)
+	}
+	if !dbDrv.EqualSequence([]string{"-- migrate:assert true\nCREATE 1"}) {
+		t.Fatalf("expected the migration passed to Run to run, got %q", dbDrv.MigrationSequence)
+	}
+}
+
+// contextRunnerStub runs migrations containing SLEEP until their context is done.
+type contextRunnerStub struct {
+	*dStub.Stub
+}
+
+func (s *contextRunnerStub) RunContext(ctx context.Context, version uint, migration io.Reader) error {
+	body, err := ioutil.ReadAll(migration)
+	if err != nil {
+		return err
+	}
+	if strings.Contains(string(body), "SLEEP") {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return s.Run(bytes.NewReader(body))
+}
+
+func TestUpTimeout(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "-- migrate:timeout 1m\nCREATE 1"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "-- migrate:timeout 10ms\nSLEEP 2"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+
+	if err := m.Up(); err != ErrNoTimeout {
+		t.Fatalf("expected ErrNoTimeout, got %v", err)
+	}
+
+	dbDrv := &contextRunnerStub{Stub: m.databaseDrv.(*dStub.Stub)}
+	m.databaseDrv = dbDrv
+	err := m.Up()
+	timeoutErr, ok := err.(ErrMigrationTimeout)
+	if !ok {
+		t.Fatalf("expected ErrMigrationTimeout, got %v", err)
+	}
+	expected := ErrMigrationTimeout{Version: 2, Timeout: 10 * time.Millisecond, Err: context.DeadlineExceeded}
+	if timeoutErr != expected {
+		t.Fatalf("expected %v, got %v", expected, timeoutErr)
+	}
+	if dbDrv.CurrentVersion != 2 || !dbDrv.IsDirty {
+		t.Fatalf("expected dirty version 2, got %v, %v", dbDrv.CurrentVersion, dbDrv.IsDirty)
+	}
+	if len(dbDrv.MigrationSequence) != 1 {
+		t.Fatalf("expected only migration 1 to complete, got %q", dbDrv.MigrationSequence)
+	}
+}
+
+func TestSetAllowEmptySource(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = source.NewMigrations()
+	if err := m.Up(); !os.IsNotExist(err) {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+
+	m.SetAllowEmptySource(true)
+	if err := m.Up(); err != ErrNoChange {
+		t.Fatalf("expected ErrNoChange, got %v", err)
+	}
+	if err := m.Steps(1); err != ErrNoChange {
+		t.Fatalf("expected ErrNoChange, got %v", err)
+	}
+	if m.isLocked {
+		t.Fatal("expected lock to be released")
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "-- migrate:confirm \"never asked for up\"\nCREATE 1"})
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Down, Identifier: "-- migrate:confirm \"This will drop table 1\"\nDROP 1"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "CREATE 2"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Down, Identifier: "DROP 2"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	asked := make([]string, 0)
+	confirmed := false
+	m.SetConfirm(func(version uint, message string) bool {
+		asked = append(asked, fmt.Sprintf("%v: %v", version, message))
+		return confirmed
+	})
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	err := m.Down()
+	expected := ErrNotConfirmed{Version: 1, Message: "This will drop table 1"}
+	if err != expected {
+		t.Fatalf("expected %v, got %v", expected, err)
+	}
+	if dbDrv.CurrentVersion != 1 || dbDrv.IsDirty {
+		t.Fatalf("expected clean version 1, got %v, %v", dbDrv.CurrentVersion, dbDrv.IsDirty)
+	}
+
+	confirmed = true
+	if err := m.Down(); err != nil {
+		t.Fatal(err)
+	}
+	if dbDrv.CurrentVersion != database.NilVersion {
+		t.Fatalf("expected NilVersion, got %v", dbDrv.CurrentVersion)
+	}
+	if !reflect.DeepEqual(asked, []string{"1: This will drop table 1", "1: This will drop table 1"}) {
+		t.Fatalf("expected to be asked twice for version 1, got %q", asked)
+	}
+
+	// without confirm function the message is only logged
+	m.SetConfirm(nil)
+	logger := &bufferLogger{}
+	m.Log = logger
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Down(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logger.String(), "WARNING: 1/d 1.down.stub: This will drop table 1\n") {
+		t.Fatalf("expected the message to be logged, got %q", logger.String())
+	}
+}
+
+func TestDownNotSupported(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	m.sourceDrv = source.UpOnly(m.sourceDrv)
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	if err := m.Migrate(4); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Down(); err != ErrDownNotSupported {
+		t.Fatalf("expected ErrDownNotSupported, got %v", err)
+	}
+	if err := m.Steps(-1); err != ErrDownNotSupported {
+		t.Fatalf("expected ErrDownNotSupported, got %v", err)
+	}
+	if err := m.Migrate(3); err != ErrDownNotSupported {
+		t.Fatalf("expected ErrDownNotSupported, got %v", err)
+	}
+	if dbDrv.CurrentVersion != 4 || dbDrv.IsLocked || len(dbDrv.MigrationSequence) != 3 {
+		t.Fatalf("expected version 4 and no down migration, got %v, %q", dbDrv.CurrentVersion, dbDrv.MigrationSequence)
+	}
+
+	// migrating up is unaffected, also with the source reordered
+	if err := m.OrderByDependencies(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Steps(-1); err != ErrDownNotSupported {
+		t.Fatalf("expected ErrDownNotSupported after reordering, got %v", err)
+	}
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	if dbDrv.CurrentVersion != 7 {
+		t.Fatalf("expected version 7, got %v", dbDrv.CurrentVersion)
+	}
+}
+
+// deployStub records the deploy id of each version it sets.
+type deployStub struct {
+	*dStub.Stub
+	deployID  string
+	deployIDs map[int]string
+}
+
+func (s *deployStub) SetDeployID(id string) {
+	s.deployID = id
+}
+
+func (s *deployStub) SetVersion(version int, dirty bool) error {
+	if !dirty && len(s.deployID) > 0 {
+		s.deployIDs[version] = s.deployID
+	}
+	return s.Stub.SetVersion(version, dirty)
+}
+
+func (s *deployStub) DeployIDs() (map[int]string, error) {
+	return s.deployIDs, nil
+}
+
+func (s *deployStub) RecordsDeployIDs() bool {
+	return s.deployIDs != nil
+}
+
+func TestSetDeployID(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	if err := m.SetDeployID("release-1"); err != ErrNoDeployID {
+		t.Fatalf("expected ErrNoDeployID, got %v", err)
+	}
+	if _, err := m.DeployIDs(); err != ErrNoDeployID {
+		t.Fatalf("expected ErrNoDeployID, got %v", err)
+	}
+
+	// a driver configured not to record deploy ids
+	m.databaseDrv = &deployStub{Stub: m.databaseDrv.(*dStub.Stub)}
+	if err := m.SetDeployID("release-1"); err != ErrNoDeployID {
+		t.Fatalf("expected ErrNoDeployID, got %v", err)
+	}
+
+	m.databaseDrv = &deployStub{Stub: m.databaseDrv.(*deployStub).Stub, deployIDs: make(map[int]string)}
+	var audit bytes.Buffer
+	m.SetAuditWriter(&audit)
+	if err := m.SetDeployID("release-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Migrate(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.SetDeployID("release-2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+
+	deployIDs, err := m.DeployIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[uint]string{1: "release-1", 3: "release-1", 4: "release-2", 5: "release-2", 7: "release-2"}
+	if !reflect.DeepEqual(deployIDs, expected) {
+		t.Fatalf("expected %v, got %v", expected, deployIDs)
+	}
+	if strings.Count(audit.String(), `"deploy_id":"release-2"`) != 2 {
+		t.Fatalf("expected the audit records of release 2 to carry its deploy id, got %v", audit.String())
+	}
+}
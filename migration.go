@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"time"
+
+	"github.com/vickxxx/migrate/source"
 )
 
 // DefaultBufferSize sets the in memory buffer size (in Bytes) for every
@@ -27,12 +29,24 @@ type Migration struct {
 	// Can be -1, implying that this is a NilVersion.
 	TargetVersion int
 
+	// partial is set for a migration the database driver doesn't run in
+	// a single transaction, see database.MigrationTransactional.
+	partial bool
+
+	// down is set for down migrations whose target version is numerically
+	// higher, which happens if the source is ordered by dependencies.
+	down bool
+
 	// Body holds an io.ReadCloser to the source.
 	Body io.ReadCloser
 
 	// BufferedBody holds an buffered io.Reader to the underlying Body.
 	BufferedBody io.Reader
 
+	// Timeout is the time the migration may run, see the
+	// `-- migrate:timeout` directive. Zero means no limit.
+	Timeout time.Duration
+
 	// BufferSize defaults to DefaultBufferSize
 	BufferSize uint
 
@@ -56,6 +70,14 @@ type Migration struct {
 	BytesRead int64
 }
 
+// MemoryMigration is a migration defined in code, to be read by the
+// source/memory driver. Direction is either source.Up or source.Down.
+type MemoryMigration struct {
+	Version   uint
+	Direction source.Direction
+	Body      string
+}
+
 // NewMigration returns a new Migration and sets the body, identifier,
 // version and targetVersion. Body can be nil, which turns this migration
 // into a "NilMigration". If no identifier is provided, it will default to "<empty>".
@@ -95,7 +117,7 @@ func NewMigration(body io.ReadCloser, identifier string,
 	}
 
 	br, bw := io.Pipe()
-	m.Body = body // want to simulate low latency? newSlowReader(body)
+	m.Body = newBOMReader(body) // want to simulate low latency? newSlowReader(body)
 	m.BufferSize = DefaultBufferSize
 	m.BufferedBody = br
 	m.bufferWriter = bw
@@ -110,12 +132,20 @@ func (m *Migration) String() string {
 // LogString returns a string describing this migration to humans.
 func (m *Migration) LogString() string {
 	directionStr := "u"
-	if m.TargetVersion < int(m.Version) {
+	if m.direction() == source.Down {
 		directionStr = "d"
 	}
 	return fmt.Sprintf("%v/%v %v", m.Version, directionStr, m.Identifier)
 }
 
+// direction returns whether m is an up or a down migration.
+func (m *Migration) direction() source.Direction {
+	if m.down || m.TargetVersion < int(m.Version) {
+		return source.Down
+	}
+	return source.Up
+}
+
 // Buffer buffers Body up to BufferSize.
 // Calling this function blocks. Call with goroutine.
 func (m *Migration) Buffer() error {
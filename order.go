@@ -0,0 +1,181 @@
+package migrate
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/vickxxx/migrate/source"
+)
+
+// ErrDependencyCycle is returned by OrderByDependencies when the
+// `-- migrate:after` directives of the source form a cycle.
+type ErrDependencyCycle struct {
+	Versions []uint
+}
+
+// Error implements the error interface.
+func (e ErrDependencyCycle) Error() string {
+	return fmt.Sprintf("migrations %v depend on each other in a cycle", e.Versions)
+}
+
+// OrderByDependencies reorders the migrations of the source, so that each
+// migration runs after the versions listed in its `-- migrate:after`
+// directives, i.e. `-- migrate:after 20230101120000`. Otherwise migrations
+// keep their numeric order. It returns ErrDependencyCycle if the
+// dependencies form a cycle, and an error if a migration depends on a
+// version the source doesn't have.
+// Call it before migrating. Only the current version is tracked, so the
+// order must not change for migrations the database already applied.
+func (m *Migrate) OrderByDependencies() error {
+	if o, ok := m.sourceDrv.(*orderedSource); ok {
+		m.sourceDrv = o.Driver
+	}
+
+	versions := make([]uint, 0)
+	after := make(map[uint][]uint)
+	version, err := m.sourceDrv.First()
+	for err == nil {
+		versions = append(versions, version)
+		deps, rerr := m.readDependencies(version)
+		if rerr != nil {
+			return rerr
+		}
+		after[version] = deps
+		version, err = m.sourceDrv.Next(version)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	order, err := sortByDependencies(versions, after)
+	if err != nil {
+		return err
+	}
+	m.sourceDrv = newOrderedSource(m.sourceDrv, order)
+	return nil
+}
+
+// readDependencies returns the dependencies of the up migration for
+// version. A version without up migration has no dependencies.
+func (m *Migrate) readDependencies(version uint) ([]uint, error) {
+	r, _, err := m.sourceDrv.ReadUp(version)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return dependencies(r)
+}
+
+// sortByDependencies sorts versions topologically, so that each version
+// comes after the versions it depends on according to after.
+// Among the versions whose dependencies are met the lowest comes first,
+// so versions without dependencies keep their numeric order.
+func sortByDependencies(versions []uint, after map[uint][]uint) ([]uint, error) {
+	pending := make(map[uint]int, len(versions))
+	for _, v := range versions {
+		pending[v] = 0
+	}
+	dependents := make(map[uint][]uint)
+	for _, v := range versions {
+		for _, dep := range after[v] {
+			if _, ok := pending[dep]; !ok {
+				return nil, fmt.Errorf("migration %v depends on version %v, which doesn't exist", v, dep)
+			}
+			pending[v]++
+			dependents[dep] = append(dependents[dep], v)
+		}
+	}
+
+	ready := make([]uint, 0)
+	for _, v := range versions {
+		if pending[v] == 0 {
+			ready = append(ready, v)
+		}
+	}
+
+	order := make([]uint, 0, len(versions))
+	for len(ready) > 0 {
+		sort.Slice(ready, func(i, j int) bool { return ready[i] < ready[j] })
+		v := ready[0]
+		ready = ready[1:]
+		order = append(order, v)
+		for _, d := range dependents[v] {
+			pending[d]--
+			if pending[d] == 0 {
+				ready = append(ready, d)
+			}
+		}
+	}
+
+	if len(order) < len(versions) {
+		cycle := make([]uint, 0)
+		for _, v := range versions {
+			if pending[v] > 0 {
+				cycle = append(cycle, v)
+			}
+		}
+		return nil, ErrDependencyCycle{Versions: cycle}
+	}
+	return order, nil
+}
+
+// orderedSource is a source.Driver walking the versions
+// of the wrapped driver in a given order.
+type orderedSource struct {
+	source.Driver
+	order    []uint
+	position map[uint]int
+}
+
+func newOrderedSource(driver source.Driver, order []uint) *orderedSource {
+	position := make(map[uint]int, len(order))
+	for i, v := range order {
+		position[v] = i
+	}
+	return &orderedSource{Driver: driver, order: order, position: position}
+}
+
+// Capabilities are those of the wrapped driver.
+func (o *orderedSource) Capabilities() source.Capabilities {
+	return source.CapabilitiesOf(o.Driver)
+}
+
+func (o *orderedSource) First() (version uint, err error) {
+	if len(o.order) == 0 {
+		return 0, &os.PathError{Op: "first", Path: "<ordered>", Err: os.ErrNotExist}
+	}
+	return o.order[0], nil
+}
+
+func (o *orderedSource) Prev(version uint) (prevVersion uint, err error) {
+	if i, ok := o.position[version]; ok && i > 0 {
+		return o.order[i-1], nil
+	}
+	return 0, &os.PathError{Op: fmt.Sprintf("prev for version %v", version), Path: "<ordered>", Err: os.ErrNotExist}
+}
+
+func (o *orderedSource) Next(version uint) (nextVersion uint, err error) {
+	if i, ok := o.position[version]; ok && i+1 < len(o.order) {
+		return o.order[i+1], nil
+	}
+	return 0, &os.PathError{Op: fmt.Sprintf("next for version %v", version), Path: "<ordered>", Err: os.ErrNotExist}
+}
+
+// before reports whether version a comes before version b, where either
+// may be NilVersion (-1), which comes first. Versions compare by their
+// position if the source was reordered by OrderByDependencies.
+func (m *Migrate) before(a, b int) bool {
+	o, ok := m.sourceDrv.(*orderedSource)
+	if !ok || a < 0 || b < 0 {
+		return a < b
+	}
+	i, iok := o.position[suint(a)]
+	j, jok := o.position[suint(b)]
+	if !iok || !jok {
+		return a < b
+	}
+	return i < j
+}
@@ -0,0 +1,107 @@
+package migrate
+
+import (
+	"reflect"
+	"testing"
+
+	dStub "github.com/vickxxx/migrate/database/stub"
+	"github.com/vickxxx/migrate/source"
+	sStub "github.com/vickxxx/migrate/source/stub"
+)
+
+func TestSortByDependencies(t *testing.T) {
+	tt := []struct {
+		versions    []uint
+		after       map[uint][]uint
+		expectOrder []uint
+	}{
+		{versions: []uint{}, expectOrder: []uint{}},
+		{versions: []uint{1, 3, 4}, expectOrder: []uint{1, 3, 4}},
+		{versions: []uint{1, 3, 4}, after: map[uint][]uint{1: {4}}, expectOrder: []uint{3, 4, 1}},
+		{versions: []uint{1, 2, 3, 4}, after: map[uint][]uint{2: {3}, 1: {2}}, expectOrder: []uint{3, 2, 1, 4}},
+		{versions: []uint{1, 2, 3}, after: map[uint][]uint{3: {1}, 2: {1}}, expectOrder: []uint{1, 2, 3}},
+	}
+
+	for i, v := range tt {
+		order, err := sortByDependencies(v.versions, v.after)
+		if err != nil {
+			t.Fatalf("%v, in %v", err, i)
+		}
+		if !reflect.DeepEqual(order, v.expectOrder) {
+			t.Errorf("expected %v, got %v, in %v", v.expectOrder, order, i)
+		}
+	}
+}
+
+func TestSortByDependenciesCycle(t *testing.T) {
+	_, err := sortByDependencies([]uint{1, 2, 3, 4}, map[uint][]uint{1: {3}, 3: {2}, 2: {1}})
+	e, ok := err.(ErrDependencyCycle)
+	if !ok {
+		t.Fatalf("expected ErrDependencyCycle, got %v", err)
+	}
+	if !reflect.DeepEqual(e.Versions, []uint{1, 2, 3}) {
+		t.Fatalf("expected versions [1 2 3], got %v", e.Versions)
+	}
+}
+
+func TestSortByDependenciesUnknown(t *testing.T) {
+	if _, err := sortByDependencies([]uint{1, 2}, map[uint][]uint{1: {5}}); err == nil {
+		t.Fatal("expected error for unknown dependency")
+	}
+}
+
+func TestOrderByDependencies(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "1 up"})
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Down, Identifier: "1 down"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "-- migrate:after 3\n2 up"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Down, Identifier: "2 down"})
+	migrations.Append(&source.Migration{Version: 3, Direction: source.Up, Identifier: "3 up"})
+	migrations.Append(&source.Migration{Version: 3, Direction: source.Down, Identifier: "3 down"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	if err := m.OrderByDependencies(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"1 up", "3 up", "-- migrate:after 3\n2 up"}
+	if !dbDrv.EqualSequence(expected) {
+		t.Fatalf("expected %q, got %q", expected, dbDrv.MigrationSequence)
+	}
+	if dbDrv.CurrentVersion != 2 {
+		t.Fatalf("expected version 2, got %v", dbDrv.CurrentVersion)
+	}
+
+	// down to 3 runs only the down migration of 2
+	if err := m.Migrate(3); err != nil {
+		t.Fatal(err)
+	}
+	if dbDrv.CurrentVersion != 3 {
+		t.Fatalf("expected version 3, got %v", dbDrv.CurrentVersion)
+	}
+
+	if err := m.Down(); err != nil {
+		t.Fatal(err)
+	}
+	expected = append(expected, "2 down", "3 down", "1 down")
+	if !dbDrv.EqualSequence(expected) {
+		t.Fatalf("expected %q, got %q", expected, dbDrv.MigrationSequence)
+	}
+}
+
+func TestOrderByDependenciesCycle(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "-- migrate:after 2\n1 up"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "-- migrate:after 1\n2 up"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+
+	if _, ok := m.OrderByDependencies().(ErrDependencyCycle); !ok {
+		t.Fatal("expected ErrDependencyCycle")
+	}
+}
@@ -0,0 +1,167 @@
+package migrate
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/vickxxx/migrate/database"
+)
+
+// PlanStep is a version of the source and its status, see Plan.
+type PlanStep struct {
+	Version uint
+
+	// Identifier is the identifier of the up migration,
+	// or of the down migration if there is no up migration.
+	Identifier string
+
+	// Applied is true for the versions up to the current version.
+	Applied bool
+
+	// Dirty is true for the current version if the database is dirty.
+	Dirty bool
+
+	// After lists the versions of the `-- migrate:after` directives
+	// of the up migration.
+	After []uint
+}
+
+// Plan returns all versions of the source in the order Up applies them,
+// i.e. ordered by OrderByDependencies if it was called, and whether the
+// database applied them. It neither locks nor changes the database.
+func (m *Migrate) Plan() ([]PlanStep, error) {
+	curVersion, dirty, err := m.databaseDrv.Version()
+	if err != nil {
+		return nil, err
+	}
+
+	steps := make([]PlanStep, 0)
+	version, err := m.sourceDrv.First()
+	for err == nil {
+		step, serr := m.planStep(version)
+		if serr != nil {
+			return nil, serr
+		}
+		step.Applied = !m.before(curVersion, int(version))
+		step.Dirty = dirty && int(version) == curVersion
+		steps = append(steps, step)
+		version, err = m.sourceDrv.Next(version)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return steps, nil
+}
+
+// DownPlan returns the versions Steps(-n) reverts, in the order they are
+// reverted, or all versions Down reverts if n is negative, i.e. to ask
+// before rolling them back. Fewer than n versions are returned if fewer are
+// applied. Like Plan it neither locks nor changes the database.
+// It returns ErrNoChange if no version would be reverted and
+// ErrDownNotSupported if the source is up only.
+func (m *Migrate) DownPlan(n int) ([]uint, error) {
+	if !m.downSupported() {
+		return nil, ErrDownNotSupported
+	}
+
+	curVersion, _, err := m.databaseDrv.Version()
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 || curVersion == database.NilVersion {
+		return nil, ErrNoChange
+	}
+	if err := m.versionExists(suint(curVersion)); err != nil {
+		return nil, err
+	}
+
+	versions := make([]uint, 0)
+	for from := curVersion; from != database.NilVersion && (n < 0 || len(versions) < n); {
+		versions = append(versions, suint(from))
+		prev, err := m.sourceDrv.Prev(suint(from))
+		if os.IsNotExist(err) {
+			from = database.NilVersion
+		} else if err != nil {
+			return nil, err
+		} else {
+			from = int(prev)
+		}
+	}
+	return versions, nil
+}
+
+// planStep returns the step for version without its status.
+func (m *Migrate) planStep(version uint) (PlanStep, error) {
+	step := PlanStep{Version: version, After: make([]uint, 0)}
+
+	r, identifier, err := m.sourceDrv.ReadUp(version)
+	if os.IsNotExist(err) {
+		r, identifier, err = m.sourceDrv.ReadDown(version)
+		if err != nil {
+			return step, err
+		}
+		r.Close()
+		step.Identifier = identifier
+		return step, nil
+	} else if err != nil {
+		return step, err
+	}
+	defer r.Close()
+
+	step.Identifier = identifier
+	step.After, err = dependencies(r)
+	return step, err
+}
+
+// Colors of the nodes of WritePlanDot.
+const (
+	dotApplied = "palegreen"
+	dotPending = "lightgrey"
+	dotDirty   = "salmon"
+)
+
+// WritePlanDot writes steps as a graphviz DOT graph to w, i.e. for the
+// description of a pull request. Versions are connected in the order they
+// are applied by dashed edges and with their dependencies by solid edges.
+// Applied versions are green, pending ones grey and a dirty one red.
+func WritePlanDot(w io.Writer, steps []PlanStep) error {
+	var b strings.Builder
+	b.WriteString("digraph migrations {\n")
+	b.WriteString("\trankdir=LR;\n")
+	b.WriteString("\tnode [shape=box, style=filled];\n")
+
+	for _, s := range steps {
+		color := dotPending
+		switch {
+		case s.Dirty:
+			color = dotDirty
+		case s.Applied:
+			color = dotApplied
+		}
+		label := fmt.Sprint(s.Version)
+		if len(s.Identifier) > 0 {
+			label += `\n` + dotEscape(s.Identifier)
+		}
+		fmt.Fprintf(&b, "\t\"%v\" [label=\"%v\", fillcolor=%v];\n", s.Version, label, color)
+	}
+
+	for i := 1; i < len(steps); i++ {
+		fmt.Fprintf(&b, "\t\"%v\" -> \"%v\" [style=dashed, color=grey];\n", steps[i-1].Version, steps[i].Version)
+	}
+	for _, s := range steps {
+		for _, dep := range s.After {
+			fmt.Fprintf(&b, "\t\"%v\" -> \"%v\";\n", dep, s.Version)
+		}
+	}
+
+	b.WriteString("}\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// dotEscape escapes s for a quoted DOT string.
+func dotEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
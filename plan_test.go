@@ -0,0 +1,201 @@
+package migrate
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	dStub "github.com/vickxxx/migrate/database/stub"
+	"github.com/vickxxx/migrate/source"
+	sStub "github.com/vickxxx/migrate/source/stub"
+)
+
+func TestPlan(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "1 up"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Up, Identifier: "-- migrate:after 3\n2 up"})
+	migrations.Append(&source.Migration{Version: 3, Direction: source.Up, Identifier: "3 up"})
+	migrations.Append(&source.Migration{Version: 4, Direction: source.Down, Identifier: "4 down"})
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	if err := m.OrderByDependencies(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Steps(2); err != nil {
+		t.Fatal(err)
+	}
+
+	steps, err := m.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []PlanStep{
+		{Version: 1, Identifier: "1.up.stub", Applied: true, After: []uint{}},
+		{Version: 3, Identifier: "3.up.stub", Applied: true, After: []uint{}},
+		{Version: 2, Identifier: "2.up.stub", After: []uint{3}},
+		{Version: 4, Identifier: "4.down.stub", After: []uint{}},
+	}
+	if !reflect.DeepEqual(steps, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, steps)
+	}
+
+	// the plan doesn't change the database
+	if dbDrv.CurrentVersion != 3 || len(dbDrv.MigrationSequence) != 2 {
+		t.Fatalf("expected version 3 after 2 migrations, got %v after %q", dbDrv.CurrentVersion, dbDrv.MigrationSequence)
+	}
+
+	dbDrv.IsDirty = true
+	steps, err = m.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !steps[1].Dirty || steps[0].Dirty {
+		t.Fatalf("expected only version 3 to be dirty, got %+v", steps)
+	}
+}
+
+// closeCountingSource counts the migrations read from it which are still
+// open.
+type closeCountingSource struct {
+	*sStub.Stub
+	open int
+}
+
+type countedReadCloser struct {
+	io.ReadCloser
+	s *closeCountingSource
+}
+
+func (r *countedReadCloser) Close() error {
+	r.s.open--
+	return r.ReadCloser.Close()
+}
+
+func (s *closeCountingSource) ReadUp(version uint) (io.ReadCloser, string, error) {
+	r, identifier, err := s.Stub.ReadUp(version)
+	if err != nil {
+		return nil, "", err
+	}
+	s.open++
+	return &countedReadCloser{r, s}, identifier, nil
+}
+
+func (s *closeCountingSource) ReadDown(version uint) (io.ReadCloser, string, error) {
+	r, identifier, err := s.Stub.ReadDown(version)
+	if err != nil {
+		return nil, "", err
+	}
+	s.open++
+	return &countedReadCloser{r, s}, identifier, nil
+}
+
+func TestPlanClosesMigrations(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	migrations.Append(&source.Migration{Version: 1, Direction: source.Up, Identifier: "1 up"})
+	migrations.Append(&source.Migration{Version: 2, Direction: source.Down, Identifier: "2 down"})
+	srcDrv := &closeCountingSource{Stub: m.sourceDrv.(*sStub.Stub)}
+	srcDrv.Migrations = migrations
+	m.sourceDrv = srcDrv
+
+	if _, err := m.Plan(); err != nil {
+		t.Fatal(err)
+	}
+	if srcDrv.open != 0 {
+		t.Fatalf("expected all migrations to be closed, got %v open", srcDrv.open)
+	}
+}
+
+func TestDownPlan(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	tt := []struct {
+		curVersion     int
+		n              int
+		expectErr      error
+		expectVersions []uint
+	}{
+		{curVersion: -1, n: -1, expectErr: ErrNoChange},
+		{curVersion: -1, n: 1, expectErr: ErrNoChange},
+		{curVersion: 4, n: 0, expectErr: ErrNoChange},
+		{curVersion: 1, n: 1, expectVersions: []uint{1}},
+		{curVersion: 4, n: 1, expectVersions: []uint{4}},
+		{curVersion: 4, n: 2, expectVersions: []uint{4, 3}},
+		{curVersion: 7, n: -1, expectVersions: []uint{7, 5, 4, 3, 1}},
+		{curVersion: 4, n: 5, expectVersions: []uint{4, 3, 1}},
+	}
+
+	for i, v := range tt {
+		if err := dbDrv.SetVersion(v.curVersion, false); err != nil {
+			t.Fatal(err)
+		}
+		dbDrv.MigrationSequence = nil
+
+		versions, err := m.DownPlan(v.n)
+		if err != v.expectErr {
+			t.Errorf("expected err %v, got %v, in %v", v.expectErr, err, i)
+		}
+		if !reflect.DeepEqual(versions, v.expectVersions) {
+			t.Errorf("expected versions %v, got %v, in %v", v.expectVersions, versions, i)
+		}
+
+		// the plan doesn't change the database
+		if dbDrv.CurrentVersion != v.curVersion || len(dbDrv.MigrationSequence) != 0 {
+			t.Errorf("expected version %v without migrations, got %v after %q, in %v",
+				v.curVersion, dbDrv.CurrentVersion, dbDrv.MigrationSequence, i)
+		}
+	}
+}
+
+func TestDownPlanMatchesSteps(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+	if err := dbDrv.SetVersion(7, false); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := m.DownPlan(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Steps(-3); err != nil {
+		t.Fatal(err)
+	}
+	// Steps reverted down to the version before the last one of the plan
+	if dbDrv.CurrentVersion != 3 || !reflect.DeepEqual(versions, []uint{7, 5, 4}) {
+		t.Fatalf("expected versions [7 5 4] and version 3, got %v and version %v", versions, dbDrv.CurrentVersion)
+	}
+}
+
+func TestWritePlanDot(t *testing.T) {
+	steps := []PlanStep{
+		{Version: 1, Identifier: "create_users", Applied: true},
+		{Version: 3, Identifier: `add "email"`, Applied: true, Dirty: true},
+		{Version: 2, Identifier: "backfill", After: []uint{3}},
+	}
+
+	var buf bytes.Buffer
+	if err := WritePlanDot(&buf, steps); err != nil {
+		t.Fatal(err)
+	}
+	expected := `digraph migrations {
+	rankdir=LR;
+	node [shape=box, style=filled];
+	"1" [label="1\ncreate_users", fillcolor=palegreen];
+	"3" [label="3\nadd \"email\"", fillcolor=salmon];
+	"2" [label="2\nbackfill", fillcolor=lightgrey];
+	"1" -> "3" [style=dashed, color=grey];
+	"3" -> "2" [style=dashed, color=grey];
+	"3" -> "2";
+}
+`
+	if buf.String() != expected {
+		t.Fatalf("expected\n%v\ngot\n%v", expected, buf.String())
+	}
+}
@@ -0,0 +1,164 @@
+package migrate
+
+import (
+	"fmt"
+	"sync"
+)
+
+// ErrShardFailed is the error of a single shard, see ShardedMigrate.
+type ErrShardFailed struct {
+	Shard int
+	Err   error
+}
+
+// Error implements the error interface.
+func (e ErrShardFailed) Error() string {
+	return fmt.Sprintf("shard %v: %v", e.Shard, e.Err)
+}
+
+// Unwrap returns the error of the shard.
+func (e ErrShardFailed) Unwrap() error {
+	return e.Err
+}
+
+// ShardResult is the outcome of migrating a single shard.
+type ShardResult struct {
+	// Shard is the index of the shard passed to NewSharded.
+	Shard int
+
+	// Version and Dirty are the state of the shard afterwards,
+	// Version is database.NilVersion if no migration is applied.
+	Version int
+	Dirty   bool
+
+	// Changed is false if the shard was up to date already.
+	Changed bool
+
+	// Err is the error migrating the shard, except ErrNoChange.
+	Err error
+}
+
+// ShardedMigrate migrates several databases with identical schemas, the
+// shards, i.e. the physical shards of a database. Each shard is a Migrate
+// instance of its own, usually with the same source, and acquires its own
+// lock. A failing shard doesn't stop the others.
+type ShardedMigrate struct {
+	shards []*Migrate
+
+	// concurrency is the number of shards migrated at once,
+	// see SetConcurrency.
+	concurrency int
+}
+
+// NewSharded returns a ShardedMigrate for shards,
+// which migrates one shard after another.
+func NewSharded(shards []*Migrate) *ShardedMigrate {
+	return &ShardedMigrate{
+		shards:      shards,
+		concurrency: 1,
+	}
+}
+
+// SetConcurrency sets the number of shards migrated at once.
+// Zero or less migrates all shards at once.
+func (s *ShardedMigrate) SetConcurrency(n int) {
+	s.concurrency = n
+}
+
+// Up runs Up on all shards, see Migrate.Up. It returns a ShardResult per
+// shard, in the order of the shards. The error is a MultiError holding an
+// ErrShardFailed per failed shard, or ErrNoChange if all shards were up
+// to date already.
+func (s *ShardedMigrate) Up() ([]ShardResult, error) {
+	return s.run(func(m *Migrate) error {
+		return m.Up()
+	})
+}
+
+// Migrate runs Migrate with version on all shards, like Up.
+func (s *ShardedMigrate) Migrate(version uint) ([]ShardResult, error) {
+	return s.run(func(m *Migrate) error {
+		return m.Migrate(version)
+	})
+}
+
+// Close closes all shards and returns their errors as MultiError.
+func (s *ShardedMigrate) Close() error {
+	errs := make([]error, 0)
+	for i, m := range s.shards {
+		srcErr, dbErr := m.Close()
+		for _, err := range []error{srcErr, dbErr} {
+			if err != nil {
+				errs = append(errs, ErrShardFailed{Shard: i, Err: err})
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return NewMultiError(errs...)
+	}
+	return nil
+}
+
+// run calls migrate for all shards, at most s.concurrency at once.
+func (s *ShardedMigrate) run(migrate func(m *Migrate) error) ([]ShardResult, error) {
+	concurrency := s.concurrency
+	if concurrency <= 0 || concurrency > len(s.shards) {
+		concurrency = len(s.shards)
+	}
+
+	results := make([]ShardResult, len(s.shards))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, m := range s.shards {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, m *Migrate) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = migrateShard(i, m, migrate)
+		}(i, m)
+	}
+	wg.Wait()
+
+	errs := make([]error, 0)
+	changed := false
+	for _, r := range results {
+		if r.Err != nil {
+			errs = append(errs, ErrShardFailed{Shard: r.Shard, Err: r.Err})
+		}
+		changed = changed || r.Changed
+	}
+	if len(errs) > 0 {
+		return results, NewMultiError(errs...)
+	}
+	if !changed {
+		return results, ErrNoChange
+	}
+	return results, nil
+}
+
+// migrateShard calls migrate for m, the shard with index i,
+// and returns its result.
+func migrateShard(i int, m *Migrate, migrate func(m *Migrate) error) ShardResult {
+	r := ShardResult{Shard: i}
+	switch err := migrate(m); err {
+	case nil:
+		r.Changed = true
+	case ErrNoChange:
+	default:
+		r.Err = err
+	}
+
+	version, dirty, err := m.databaseDrv.Version()
+	if err != nil {
+		if r.Err == nil {
+			r.Err = err
+		}
+		return r
+	}
+	r.Version = version
+	r.Dirty = dirty
+	return r
+}
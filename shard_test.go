@@ -0,0 +1,115 @@
+package migrate
+
+import (
+	"io"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dStub "github.com/vickxxx/migrate/database/stub"
+	sStub "github.com/vickxxx/migrate/source/stub"
+)
+
+func newShards(t *testing.T, n int) []*Migrate {
+	shards := make([]*Migrate, n)
+	for i := range shards {
+		m, err := New("stub://", "stub://")
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.sourceDrv.(*sStub.Stub).Migrations = sourceStubMigrations
+		shards[i] = m
+	}
+	return shards
+}
+
+func TestShardedUp(t *testing.T) {
+	shards := newShards(t, 3)
+	shards[1].databaseDrv.(*dStub.Stub).CurrentVersion = 4
+	shards[1].databaseDrv.(*dStub.Stub).IsDirty = true
+
+	results, err := NewSharded(shards).Up()
+	expected := []ShardResult{
+		{Shard: 0, Version: 7, Changed: true},
+		{Shard: 1, Version: 4, Dirty: true, Err: ErrDirty{Version: 4}},
+		{Shard: 2, Version: 7, Changed: true},
+	}
+	if !reflect.DeepEqual(results, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, results)
+	}
+	if !reflect.DeepEqual(err, NewMultiError(ErrShardFailed{Shard: 1, Err: ErrDirty{Version: 4}})) {
+		t.Fatalf("expected shard 1 to fail, got %v", err)
+	}
+	for i, m := range shards {
+		if m.databaseDrv.(*dStub.Stub).IsLocked {
+			t.Fatalf("expected shard %v to be unlocked", i)
+		}
+	}
+
+	shards[1].databaseDrv.(*dStub.Stub).IsDirty = false
+	results, err = NewSharded(shards).Up()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Changed || !results[1].Changed || results[1].Version != 7 {
+		t.Fatalf("expected only shard 1 to change, got %+v", results)
+	}
+
+	if _, err := NewSharded(shards).Up(); err != ErrNoChange {
+		t.Fatalf("expected ErrNoChange, got %v", err)
+	}
+}
+
+// concurrencyStub counts the migrations running at once across shards.
+type concurrencyStub struct {
+	*dStub.Stub
+	running *int32
+	max     *int32
+}
+
+func (s *concurrencyStub) Run(migration io.Reader) error {
+	n := atomic.AddInt32(s.running, 1)
+	defer atomic.AddInt32(s.running, -1)
+	for {
+		max := atomic.LoadInt32(s.max)
+		if n <= max || atomic.CompareAndSwapInt32(s.max, max, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	return s.Stub.Run(migration)
+}
+
+func TestShardedConcurrency(t *testing.T) {
+	for _, concurrency := range []int{1, 2, 0} {
+		var running, max int32
+		shards := newShards(t, 4)
+		for _, m := range shards {
+			m.databaseDrv = &concurrencyStub{Stub: m.databaseDrv.(*dStub.Stub), running: &running, max: &max}
+		}
+
+		s := NewSharded(shards)
+		s.SetConcurrency(concurrency)
+		results, err := s.Migrate(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range results {
+			if r.Version != 3 || r.Err != nil {
+				t.Fatalf("expected all shards at version 3, got %+v", results)
+			}
+		}
+
+		limit := int32(concurrency)
+		if concurrency == 0 {
+			limit = int32(len(shards))
+		}
+		if max > limit {
+			t.Fatalf("expected at most %v shards at once, got %v", limit, max)
+		}
+		if concurrency == 1 && max != 1 {
+			t.Fatalf("expected one shard after another, got %v at once", max)
+		}
+	}
+}
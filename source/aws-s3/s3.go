@@ -1,12 +1,14 @@
 package awss3
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/url"
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -24,6 +26,13 @@ type s3Driver struct {
 	bucket     string
 	prefix     string
 	migrations *source.Migrations
+	// etags are the ETags of the migration files, by name
+	etags map[string]string
+
+	// readTimeout bounds fetching a single migration, if set
+	readTimeout time.Duration
+	// maxSize bounds the size of a single migration in bytes, if set
+	maxSize int64
 }
 
 func (s *s3Driver) Open(folder string) (source.Driver, error) {
@@ -31,15 +40,28 @@ func (s *s3Driver) Open(folder string) (source.Driver, error) {
 	if err != nil {
 		return nil, err
 	}
+	var readTimeout time.Duration
+	if s := u.Query().Get("x-read-timeout"); len(s) > 0 {
+		readTimeout, err = time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x-read-timeout %q: %v", s, err)
+		}
+	}
+	maxSize, err := source.ParseMaxSize(u.Query().Get("x-max-size"))
+	if err != nil {
+		return nil, err
+	}
 	sess, err := session.NewSession()
 	if err != nil {
 		return nil, err
 	}
 	driver := s3Driver{
-		bucket:     u.Host,
-		prefix:     strings.Trim(u.Path, "/") + "/",
-		s3client:   s3.New(sess),
-		migrations: source.NewMigrations(),
+		bucket:      u.Host,
+		prefix:      strings.Trim(u.Path, "/") + "/",
+		s3client:    s3.New(sess),
+		migrations:  source.NewMigrations(),
+		readTimeout: readTimeout,
+		maxSize:     maxSize,
 	}
 	err = driver.loadMigrations()
 	if err != nil {
@@ -57,6 +79,7 @@ func (s *s3Driver) loadMigrations() error {
 	if err != nil {
 		return err
 	}
+	s.etags = make(map[string]string, len(output.Contents))
 	for _, object := range output.Contents {
 		_, fileName := path.Split(aws.StringValue(object.Key))
 		m, err := source.DefaultParse(fileName)
@@ -66,6 +89,7 @@ func (s *s3Driver) loadMigrations() error {
 		if !s.migrations.Append(m) {
 			return fmt.Errorf("unable to parse file %v", aws.StringValue(object.Key))
 		}
+		s.etags[fileName] = aws.StringValue(object.ETag)
 	}
 	return nil
 }
@@ -112,14 +136,28 @@ func (s *s3Driver) ReadDown(version uint) (io.ReadCloser, string, error) {
 	return nil, "", os.ErrNotExist
 }
 
+// ETag implements source.ETagger with the ETags listed on open.
+func (s *s3Driver) ETag(version uint, direction source.Direction) (string, error) {
+	if m, ok := s.migrations.Get(version, direction); ok {
+		return s.etags[m.Raw], nil
+	}
+	return "", os.ErrNotExist
+}
+
 func (s *s3Driver) open(m *source.Migration) (io.ReadCloser, string, error) {
 	key := path.Join(s.prefix, m.Raw)
-	object, err := s.s3client.GetObject(&s3.GetObjectInput{
-		Bucket: aws.String(s.bucket),
-		Key:    aws.String(key),
+	body, err := source.ReadWithTimeout(key, s.readTimeout, func(ctx context.Context) (io.ReadCloser, error) {
+		object, err := s.s3client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return source.LimitSize(key, s.maxSize, object.Body), nil
 	})
 	if err != nil {
 		return nil, "", err
 	}
-	return object.Body, m.Identifier, nil
+	return body, m.Identifier, nil
 }
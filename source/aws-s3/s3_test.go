@@ -5,8 +5,10 @@ import (
 	"io/ioutil"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/vickxxx/migrate/source"
 	st "github.com/vickxxx/migrate/source/testing"
@@ -43,10 +45,92 @@ func Test(t *testing.T) {
 	st.Test(t, &driver)
 }
 
+func TestReadTimeout(t *testing.T) {
+	s3Client := fakeS3{
+		bucket: "some-bucket",
+		objects: map[string]string{
+			"prod/migrations/1_foobar.up.sql": "1 up",
+		},
+		delay: time.Second,
+	}
+	driver := s3Driver{
+		bucket:      "some-bucket",
+		prefix:      "prod/migrations/",
+		migrations:  source.NewMigrations(),
+		s3client:    &s3Client,
+		readTimeout: 50 * time.Millisecond,
+	}
+	if err := driver.loadMigrations(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err := driver.ReadUp(1)
+	if _, ok := err.(source.ErrReadTimeout); !ok {
+		t.Fatalf("expected source.ErrReadTimeout, got %v", err)
+	}
+
+	s3Client.delay = 0
+	r, _, err := driver.ReadUp(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "1 up" {
+		t.Fatalf("expected body %q, got %q", "1 up", body)
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	s3Client := fakeS3{
+		bucket: "some-bucket",
+		objects: map[string]string{
+			"prod/migrations/1_foobar.up.sql":   "1 up",
+			"prod/migrations/1_foobar.down.sql": strings.Repeat("DROP TABLE t;\n", 1024),
+		},
+	}
+	for _, readTimeout := range []time.Duration{0, time.Second} {
+		driver := s3Driver{
+			bucket:      "some-bucket",
+			prefix:      "prod/migrations/",
+			migrations:  source.NewMigrations(),
+			s3client:    &s3Client,
+			readTimeout: readTimeout,
+			maxSize:     1024,
+		}
+		if err := driver.loadMigrations(); err != nil {
+			t.Fatal(err)
+		}
+
+		r, _, err := driver.ReadUp(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body, err := ioutil.ReadAll(r); err != nil || string(body) != "1 up" {
+			t.Fatalf("expected body %q, got %q, %v", "1 up", body, err)
+		}
+
+		// the timeout reads the body right away, otherwise it fails on reading
+		r, _, err = driver.ReadDown(1)
+		if err == nil {
+			_, err = ioutil.ReadAll(r)
+		}
+		expected := source.ErrMigrationTooLarge{Name: "prod/migrations/1_foobar.down.sql", MaxSize: 1024}
+		if err != expected {
+			t.Fatalf("expected %v, got %v", expected, err)
+		}
+	}
+}
+
 type fakeS3 struct {
 	s3.S3
 	bucket  string
 	objects map[string]string
+
+	// delay is how long GetObjectWithContext takes to respond
+	delay time.Duration
 }
 
 func (s *fakeS3) ListObjects(input *s3.ListObjectsInput) (*s3.ListObjectsOutput, error) {
@@ -80,3 +164,12 @@ func (s *fakeS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error
 	}
 	return nil, errors.New("object not found")
 }
+
+func (s *fakeS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	select {
+	case <-time.After(s.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return s.GetObject(input)
+}
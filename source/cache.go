@@ -0,0 +1,102 @@
+package source
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ETagger is an optional interface a Driver can implement to report a tag
+// of the body of a migration which changes whenever the body does, i.e.
+// the ETag of an object in a bucket, without fetching the body.
+type ETagger interface {
+	// ETag returns the tag of the migration of version in direction,
+	// or os.ErrNotExist if there is none.
+	ETag(version uint, direction Direction) (string, error)
+}
+
+// cache is the Driver returned by Cache.
+type cache struct {
+	Driver
+	dir string
+}
+
+// Cache returns a driver keeping the migrations read from inner in dir on
+// local disk, keyed by version, direction and the tag reported by inner,
+// so that repeated runs against a remote source fetch a migration again
+// only after it changed. Reads are passed through if inner doesn't
+// implement ETagger. Failing to write the cache doesn't fail the read.
+func Cache(inner Driver, dir string) Driver {
+	return &cache{Driver: inner, dir: dir}
+}
+
+func (c *cache) ReadUp(version uint) (r io.ReadCloser, identifier string, err error) {
+	return c.read(version, Up, c.Driver.ReadUp)
+}
+
+func (c *cache) ReadDown(version uint) (r io.ReadCloser, identifier string, err error) {
+	return c.read(version, Down, c.Driver.ReadDown)
+}
+
+func (c *cache) Capabilities() Capabilities {
+	return CapabilitiesOf(c.Driver)
+}
+
+// read returns the cached migration of version in direction, if its tag
+// is unchanged, and reads it with read and caches it otherwise.
+func (c *cache) read(version uint, direction Direction, read func(uint) (io.ReadCloser, string, error)) (io.ReadCloser, string, error) {
+	tagger, ok := c.Driver.(ETagger)
+	if !ok {
+		return read(version)
+	}
+	tag, err := tagger.ETag(version, direction)
+	if err != nil {
+		return nil, "", err
+	}
+
+	name := filepath.Join(c.dir, fmt.Sprintf("%v.%v.%x", version, direction, sha256.Sum256([]byte(tag))))
+	if cached, err := ioutil.ReadFile(name); err == nil {
+		// the identifier is on the first line, followed by the body
+		if i := bytes.IndexByte(cached, '\n'); i >= 0 {
+			return ioutil.NopCloser(bytes.NewReader(cached[i+1:])), string(cached[:i]), nil
+		}
+	}
+
+	r, identifier, err := read(version)
+	if err != nil {
+		return nil, "", err
+	}
+	defer r.Close()
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+	c.write(name, append([]byte(identifier+"\n"), body...))
+	return ioutil.NopCloser(bytes.NewReader(body)), identifier, nil
+}
+
+// write writes a cache entry to name, through a temporary file,
+// so that an interrupted write never leaves a partial entry.
+func (c *cache) write(name string, entry []byte) {
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return
+	}
+	f, err := ioutil.TempFile(c.dir, ".tmp-")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(entry)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+}
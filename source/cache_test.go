@@ -0,0 +1,113 @@
+package source_test
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/vickxxx/migrate/source"
+	sStub "github.com/vickxxx/migrate/source/stub"
+	st "github.com/vickxxx/migrate/source/testing"
+)
+
+// taggedStub counts the reads of the migrations and tags them with etags.
+type taggedStub struct {
+	source.Driver
+	etags map[uint]string
+	reads int
+}
+
+func (s *taggedStub) ReadUp(version uint) (io.ReadCloser, string, error) {
+	s.reads++
+	return s.Driver.ReadUp(version)
+}
+
+func (s *taggedStub) ReadDown(version uint) (io.ReadCloser, string, error) {
+	s.reads++
+	return s.Driver.ReadDown(version)
+}
+
+func (s *taggedStub) ETag(version uint, direction source.Direction) (string, error) {
+	if _, ok := s.Driver.(*sStub.Stub).Migrations.Get(version, direction); !ok {
+		return "", os.ErrNotExist
+	}
+	return s.etags[version], nil
+}
+
+func newTaggedStub() *taggedStub {
+	return &taggedStub{
+		Driver: stub(
+			&source.Migration{Version: 1, Direction: source.Up, Identifier: "1 up"},
+			&source.Migration{Version: 1, Direction: source.Down, Identifier: "1 down"},
+			&source.Migration{Version: 3, Direction: source.Up, Identifier: "3 up"},
+			&source.Migration{Version: 4, Direction: source.Up, Identifier: "4 up"},
+			&source.Migration{Version: 4, Direction: source.Down, Identifier: "4 down"},
+			&source.Migration{Version: 5, Direction: source.Down, Identifier: "5 down"},
+			&source.Migration{Version: 7, Direction: source.Up, Identifier: "7 up"},
+			&source.Migration{Version: 7, Direction: source.Down, Identifier: "7 down"},
+		),
+		etags: map[uint]string{1: "a", 3: "b", 4: "c", 5: "d", 7: "e"},
+	}
+}
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st.Test(t, source.Cache(newTaggedStub(), dir))
+}
+
+func TestCacheHit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	inner := newTaggedStub()
+	d := source.Cache(inner, dir)
+	read := func() string {
+		t.Helper()
+		r, identifier, err := d.ReadUp(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if identifier != "1.up.stub" {
+			t.Fatalf("expected identifier %q, got %q", "1.up.stub", identifier)
+		}
+		return string(body)
+	}
+
+	first := read()
+	if second := read(); second != first {
+		t.Fatalf("expected cached body %q, got %q", first, second)
+	}
+	if inner.reads != 1 {
+		t.Fatalf("expected the second read to hit the cache, got %v reads", inner.reads)
+	}
+
+	// a changed migration is fetched again
+	inner.etags[1] = "a2"
+	read()
+	if inner.reads != 2 {
+		t.Fatalf("expected the changed migration to be read again, got %v reads", inner.reads)
+	}
+
+	// without tags reads are passed through
+	untagged := source.Cache(inner.Driver, dir)
+	if _, _, err := untagged.ReadUp(4); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := ioutil.ReadDir(dir); err != nil || len(entries) != 2 {
+		t.Fatalf("expected 2 cache entries, got %v, %v", len(entries), err)
+	}
+}
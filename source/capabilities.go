@@ -0,0 +1,50 @@
+package source
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Capabilities describes the migrations a source driver provides.
+// The zero value is a driver with up and down migrations.
+type Capabilities struct {
+	// UpOnly is true if the driver has no down migrations at all,
+	// i.e. a read-only archive of the migrations applied in production.
+	UpOnly bool
+}
+
+// CapabilityReporter is an optional interface a Driver can implement
+// to advertise its Capabilities, so that Migrate can refuse to migrate
+// down right away instead of failing partway.
+type CapabilityReporter interface {
+	Capabilities() Capabilities
+}
+
+// CapabilitiesOf returns the Capabilities of d, or the zero value
+// if d doesn't implement CapabilityReporter.
+func CapabilitiesOf(d Driver) Capabilities {
+	if c, ok := d.(CapabilityReporter); ok {
+		return c.Capabilities()
+	}
+	return Capabilities{}
+}
+
+// upOnly is the Driver returned by UpOnly.
+type upOnly struct {
+	Driver
+}
+
+// UpOnly returns a driver with the up migrations of d only, which reports
+// Capabilities with UpOnly set. Its ReadDown always returns os.ErrNotExist.
+func UpOnly(d Driver) Driver {
+	return &upOnly{Driver: d}
+}
+
+func (u *upOnly) ReadDown(version uint) (r io.ReadCloser, identifier string, err error) {
+	return nil, "", &os.PathError{Op: fmt.Sprintf("read down version %v", version), Path: "<up only>", Err: os.ErrNotExist}
+}
+
+func (u *upOnly) Capabilities() Capabilities {
+	return Capabilities{UpOnly: true}
+}
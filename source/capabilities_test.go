@@ -0,0 +1,54 @@
+package source_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/vickxxx/migrate/source"
+)
+
+func TestUpOnly(t *testing.T) {
+	archive := stub(
+		&source.Migration{Version: 1, Direction: source.Up, Identifier: "1 up"},
+		&source.Migration{Version: 1, Direction: source.Down, Identifier: "1 down"},
+		&source.Migration{Version: 3, Direction: source.Up, Identifier: "3 up"},
+	)
+	if source.CapabilitiesOf(archive).UpOnly {
+		t.Fatal("expected a driver without CapabilityReporter to have down migrations")
+	}
+
+	d := source.UpOnly(archive)
+	if !source.CapabilitiesOf(d).UpOnly {
+		t.Fatal("expected UpOnly to report no down migrations")
+	}
+	if _, _, err := d.ReadDown(1); !os.IsNotExist(err) {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+	r, identifier, err := d.ReadUp(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Close()
+	if identifier != "3.up.stub" {
+		t.Fatalf("expected 3.up.stub, got %v", identifier)
+	}
+}
+
+func TestOverlayCapabilities(t *testing.T) {
+	archive := source.UpOnly(stub(&source.Migration{Version: 1, Direction: source.Up, Identifier: "1 up"}))
+	upOnly, err := source.Overlay(archive, source.UpOnly(stub()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !source.CapabilitiesOf(upOnly).UpOnly {
+		t.Fatal("expected overlay of up only drivers to be up only")
+	}
+
+	mixed, err := source.Overlay(archive, stub(&source.Migration{Version: 2, Direction: source.Down, Identifier: "2 down"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source.CapabilitiesOf(mixed).UpOnly {
+		t.Fatal("expected overlay with down migrations not to be up only")
+	}
+}
@@ -0,0 +1,157 @@
+package consul
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	nurl "net/url"
+	"os"
+	"strings"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/vickxxx/migrate/source"
+)
+
+func init() {
+	source.Register("consul", &Consul{})
+}
+
+var ErrNilClient = fmt.Errorf("no consul client")
+
+// Consul reads migrations from the keys under a prefix of the
+// Consul KV store, named like files, i.e. migrations/1_init.up.sql.
+type Consul struct {
+	kv         *api.KV
+	migrations *source.Migrations
+
+	config *Config
+}
+
+type Config struct {
+	// Prefix is the folder of the migrations in the KV store, i.e.
+	// migrations/prod. Keys in folders below it are ignored.
+	Prefix string
+}
+
+// Open connects to the Consul agent at consul://host:port/prefix.
+// Like the consul CLI it reads the token and TLS settings from the
+// CONSUL_HTTP_* environment variables.
+func (c *Consul) Open(url string) (source.Driver, error) {
+	u, err := nurl.Parse(url)
+	if err != nil {
+		return nil, err
+	}
+
+	config := api.DefaultConfig()
+	if len(u.Host) > 0 {
+		config.Address = u.Host
+	}
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return WithInstance(client, &Config{Prefix: u.Path})
+}
+
+func WithInstance(client *api.Client, config *Config) (source.Driver, error) {
+	if client == nil {
+		return nil, ErrNilClient
+	}
+	if config == nil {
+		config = &Config{}
+	}
+
+	c := &Consul{
+		kv:         client.KV(),
+		migrations: source.NewMigrations(),
+		config:     &Config{Prefix: folder(config.Prefix)},
+	}
+	if err := c.loadMigrations(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// folder returns prefix with a trailing slash, or the root folder.
+func folder(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if len(prefix) == 0 {
+		return ""
+	}
+	return prefix + "/"
+}
+
+func (c *Consul) loadMigrations() error {
+	keys, _, err := c.kv.Keys(c.config.Prefix, "/", nil)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, c.config.Prefix)
+		if strings.Contains(name, "/") {
+			continue // ignore folders
+		}
+		m, err := source.DefaultParse(name)
+		if err != nil {
+			continue // ignore keys that we can't parse
+		}
+		if !c.migrations.Append(m) {
+			return fmt.Errorf("unable to parse key %v", key)
+		}
+	}
+	return nil
+}
+
+func (c *Consul) Close() error {
+	return nil
+}
+
+func (c *Consul) First() (version uint, err error) {
+	if v, ok := c.migrations.First(); ok {
+		return v, nil
+	}
+	return 0, &os.PathError{Op: "first", Path: c.config.Prefix, Err: os.ErrNotExist}
+}
+
+func (c *Consul) Prev(version uint) (prevVersion uint, err error) {
+	if v, ok := c.migrations.Prev(version); ok {
+		return v, nil
+	}
+	return 0, &os.PathError{Op: fmt.Sprintf("prev for version %v", version), Path: c.config.Prefix, Err: os.ErrNotExist}
+}
+
+func (c *Consul) Next(version uint) (nextVersion uint, err error) {
+	if v, ok := c.migrations.Next(version); ok {
+		return v, nil
+	}
+	return 0, &os.PathError{Op: fmt.Sprintf("next for version %v", version), Path: c.config.Prefix, Err: os.ErrNotExist}
+}
+
+func (c *Consul) ReadUp(version uint) (r io.ReadCloser, identifier string, err error) {
+	if m, ok := c.migrations.Up(version); ok {
+		return c.read(m)
+	}
+	return nil, "", &os.PathError{Op: fmt.Sprintf("read version %v", version), Path: c.config.Prefix, Err: os.ErrNotExist}
+}
+
+func (c *Consul) ReadDown(version uint) (r io.ReadCloser, identifier string, err error) {
+	if m, ok := c.migrations.Down(version); ok {
+		return c.read(m)
+	}
+	return nil, "", &os.PathError{Op: fmt.Sprintf("read version %v", version), Path: c.config.Prefix, Err: os.ErrNotExist}
+}
+
+// read reads the body of m, which may have been deleted since Open.
+func (c *Consul) read(m *source.Migration) (io.ReadCloser, string, error) {
+	key := c.config.Prefix + m.Raw
+	pair, _, err := c.kv.Get(key, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if pair == nil {
+		return nil, "", &os.PathError{Op: "read", Path: key, Err: os.ErrNotExist}
+	}
+	return ioutil.NopCloser(bytes.NewReader(pair.Value)), m.Identifier, nil
+}
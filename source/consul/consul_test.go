@@ -0,0 +1,153 @@
+package consul
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/consul/api"
+	st "github.com/vickxxx/migrate/source/testing"
+)
+
+// kvServer serves the keys and values of the Consul KV HTTP API, i.e.
+// GET /v1/kv/prefix?keys&separator=/ and GET /v1/kv/key.
+type kvServer map[string]string
+
+func (s kvServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+
+	if _, ok := r.URL.Query()["keys"]; ok {
+		separator := r.URL.Query().Get("separator")
+		seen := make(map[string]bool)
+		keys := make([]string, 0)
+		for k := range s {
+			if !strings.HasPrefix(k, key) {
+				continue
+			}
+			// keys in folders below the separator collapse into the folder
+			if i := strings.Index(k[len(key):], separator); len(separator) > 0 && i >= 0 {
+				k = k[:len(key)+i+1]
+			}
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
+		if len(keys) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		sort.Strings(keys)
+		json.NewEncoder(w).Encode(keys)
+		return
+	}
+
+	value, ok := s[key]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode([]*api.KVPair{{Key: key, Value: []byte(value)}})
+}
+
+func newClient(t *testing.T, s kvServer) (*api.Client, *httptest.Server) {
+	server := httptest.NewServer(s)
+	config := api.DefaultConfig()
+	config.Address = server.Listener.Addr().String()
+	client, err := api.NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+var migrations = kvServer{
+	"staging/migrations/1_foobar.up.sql":          "1 up",
+	"staging/migrations/1_foobar.down.sql":        "1 down",
+	"prod/migrations/1_foobar.up.sql":             "1 up",
+	"prod/migrations/1_foobar.down.sql":           "1 down",
+	"prod/migrations/3_foobar.up.sql":             "3 up",
+	"prod/migrations/4_foobar.up.sql":             "4 up",
+	"prod/migrations/4_foobar.down.sql":           "4 down",
+	"prod/migrations/5_foobar.down.sql":           "5 down",
+	"prod/migrations/7_foobar.up.sql":             "7 up",
+	"prod/migrations/7_foobar.down.sql":           "7 down",
+	"prod/migrations/not-a-migration.txt":         "",
+	"prod/migrations/0-random-stuff/whatever.txt": "",
+	"prod/migrations/8_nested/9_foobar.up.sql":    "9 up",
+}
+
+func Test(t *testing.T) {
+	client, server := newClient(t, migrations)
+	defer server.Close()
+
+	d, err := WithInstance(client, &Config{Prefix: "prod/migrations"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Test(t, d)
+
+	r, identifier, err := d.ReadUp(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "7 up" || identifier != "foobar" {
+		t.Fatalf("expected body 7 up of foobar, got %q of %q", body, identifier)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	_, server := newClient(t, migrations)
+	defer server.Close()
+
+	c := &Consul{}
+	d, err := c.Open("consul://" + server.Listener.Addr().String() + "/prod/migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Test(t, d)
+}
+
+func TestDeletedKey(t *testing.T) {
+	kv := kvServer{"prod/1_foobar.up.sql": "1 up"}
+	client, server := newClient(t, kv)
+	defer server.Close()
+
+	d, err := WithInstance(client, &Config{Prefix: "prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(kv, "prod/1_foobar.up.sql")
+	if _, _, err := d.ReadUp(1); !os.IsNotExist(err) {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+}
+
+func TestEmptyPrefix(t *testing.T) {
+	client, server := newClient(t, kvServer{})
+	defer server.Close()
+
+	d, err := WithInstance(client, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.First(); !os.IsNotExist(err) {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+}
+
+func TestNilClient(t *testing.T) {
+	if _, err := WithInstance(nil, nil); err != ErrNilClient {
+		t.Fatalf("expected ErrNilClient, got %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+package source
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Encodings drivers can transcode migrations from, see Transcode.
+const (
+	EncodingUTF8        = "utf-8"
+	EncodingUTF16LE     = "utf-16le"
+	EncodingUTF16BE     = "utf-16be"
+	EncodingLatin1      = "iso-8859-1"
+	EncodingWindows1252 = "windows-1252"
+)
+
+// ErrUnknownEncoding is returned for an encoding Transcode doesn't support.
+type ErrUnknownEncoding struct {
+	Encoding string
+}
+
+func (e ErrUnknownEncoding) Error() string {
+	return fmt.Sprintf("unknown encoding %q, expected one of %v", e.Encoding,
+		strings.Join([]string{EncodingUTF8, EncodingUTF16LE, EncodingUTF16BE, EncodingLatin1, EncodingWindows1252}, ", "))
+}
+
+// ValidateEncoding returns ErrUnknownEncoding if Transcode doesn't support
+// encoding. Encoding names are case insensitive.
+func ValidateEncoding(encoding string) error {
+	switch strings.ToLower(encoding) {
+	case EncodingUTF8, EncodingUTF16LE, EncodingUTF16BE, EncodingLatin1, EncodingWindows1252:
+		return nil
+	}
+	return ErrUnknownEncoding{encoding}
+}
+
+// Transcode returns the body r of a migration converted from encoding to
+// UTF-8, i.e. for drivers with an `x-encoding` URL query. The body is read
+// completely and r is closed. UTF-8 bodies are passed through.
+func Transcode(r io.ReadCloser, encoding string) (io.ReadCloser, error) {
+	encoding = strings.ToLower(encoding)
+	if err := ValidateEncoding(encoding); err != nil {
+		return nil, err
+	}
+	if encoding == EncodingUTF8 {
+		return r, nil
+	}
+
+	defer r.Close()
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var runes []rune
+	switch encoding {
+	case EncodingUTF16LE:
+		runes = decodeUTF16(body, binary.LittleEndian)
+	case EncodingUTF16BE:
+		runes = decodeUTF16(body, binary.BigEndian)
+	case EncodingLatin1:
+		runes = decodeSingleByte(body, nil)
+	case EncodingWindows1252:
+		runes = decodeSingleByte(body, &windows1252)
+	}
+
+	var buf bytes.Buffer
+	for _, c := range runes {
+		buf.WriteRune(c)
+	}
+	return ioutil.NopCloser(&buf), nil
+}
+
+// decodeUTF16 decodes body as UTF-16 with the given byte order.
+// A trailing odd byte is replaced with utf8.RuneError.
+func decodeUTF16(body []byte, order binary.ByteOrder) []rune {
+	units := make([]uint16, 0, len(body)/2)
+	for i := 0; i+1 < len(body); i += 2 {
+		units = append(units, order.Uint16(body[i:]))
+	}
+	runes := utf16.Decode(units)
+	if len(body)%2 == 1 {
+		runes = append(runes, utf8.RuneError)
+	}
+	return runes
+}
+
+// decodeSingleByte decodes body as ISO-8859-1, where each byte is the
+// code point of the same value, except for the bytes 0x80 to 0x9F,
+// which high maps to different code points if set.
+func decodeSingleByte(body []byte, high *[32]rune) []rune {
+	runes := make([]rune, 0, len(body))
+	for _, b := range body {
+		if high != nil && b >= 0x80 && b <= 0x9F {
+			runes = append(runes, high[b-0x80])
+		} else {
+			runes = append(runes, rune(b))
+		}
+	}
+	return runes
+}
+
+// windows1252 maps the bytes 0x80 to 0x9F of Windows-1252, in which
+// it differs from ISO-8859-1. Undefined bytes map to utf8.RuneError.
+var windows1252 = [32]rune{
+	'€', utf8.RuneError, '‚', 'ƒ', '„', '…', '†', '‡',
+	'ˆ', '‰', 'Š', '‹', 'Œ', utf8.RuneError, 'Ž', utf8.RuneError,
+	utf8.RuneError, '‘', '’', '“', '”', '•', '–', '—',
+	'˜', '™', 'š', '›', 'œ', utf8.RuneError, 'ž', 'Ÿ',
+}
@@ -0,0 +1,44 @@
+package source
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestTranscode(t *testing.T) {
+	tt := []struct {
+		body     string
+		encoding string
+		expect   string
+	}{
+		{body: "SELECT 'é'", encoding: "utf-8", expect: "SELECT 'é'"},
+		{body: "S\x00E\x00L\x00\xe9\x00", encoding: "utf-16le", expect: "SELé"},
+		{body: "\x00S\x00E\x00L\x00\xe9", encoding: "UTF-16BE", expect: "SELé"},
+		{body: "\xff\xfeS\x00", encoding: "utf-16le", expect: "\uFEFFS"},
+		{body: "\x00S\x00", encoding: "utf-16be", expect: "S\uFFFD"},
+		{body: "caf\xe9 \x80", encoding: "iso-8859-1", expect: "café \u0080"},
+		{body: "caf\xe9 \x80 \x81", encoding: "windows-1252", expect: "café € \uFFFD"},
+	}
+
+	for i, v := range tt {
+		r, err := Transcode(ioutil.NopCloser(strings.NewReader(v.body)), v.encoding)
+		if err != nil {
+			t.Fatalf("%v, in %v", err, i)
+		}
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != v.expect {
+			t.Errorf("expected %q, got %q, in %v", v.expect, body, i)
+		}
+	}
+}
+
+func TestTranscodeUnknownEncoding(t *testing.T) {
+	_, err := Transcode(ioutil.NopCloser(strings.NewReader("")), "ebcdic")
+	if _, ok := err.(ErrUnknownEncoding); !ok {
+		t.Fatalf("expected ErrUnknownEncoding, got %v", err)
+	}
+}
@@ -20,6 +20,9 @@ type File struct {
 	url        string
 	path       string
 	migrations *source.Migrations
+
+	// encoding of the migration files, transcoded to UTF-8 unless empty
+	encoding string
 }
 
 func (f *File) Open(url string) (source.Driver, error) {
@@ -49,6 +52,13 @@ func (f *File) Open(url string) (source.Driver, error) {
 		p = abs
 	}
 
+	encoding := u.Query().Get("x-encoding")
+	if len(encoding) > 0 {
+		if err := source.ValidateEncoding(encoding); err != nil {
+			return nil, err
+		}
+	}
+
 	// scan directory
 	files, err := ioutil.ReadDir(p)
 	if err != nil {
@@ -59,6 +69,7 @@ func (f *File) Open(url string) (source.Driver, error) {
 		url:        url,
 		path:       p,
 		migrations: source.NewMigrations(),
+		encoding:   encoding,
 	}
 
 	for _, fi := range files {
@@ -68,13 +79,28 @@ func (f *File) Open(url string) (source.Driver, error) {
 				continue // ignore files that we can't parse
 			}
 			if !nf.migrations.Append(m) {
-				return nil, fmt.Errorf("unable to parse file %v", fi.Name())
+				return nil, nf.duplicateErr(m)
 			}
 		}
 	}
 	return nf, nil
 }
 
+// duplicateErr returns an error naming both files that claim
+// the version and direction of m.
+func (f *File) duplicateErr(m *source.Migration) error {
+	var dup *source.Migration
+	if m.Direction == source.Up {
+		dup, _ = f.migrations.Up(m.Version)
+	} else {
+		dup, _ = f.migrations.Down(m.Version)
+	}
+	if dup == nil {
+		return fmt.Errorf("unable to parse file %v", m.Raw)
+	}
+	return fmt.Errorf("duplicate migration version %v (%v): %v and %v", m.Version, m.Direction, dup.Raw, m.Raw)
+}
+
 func (f *File) Close() error {
 	// nothing do to here
 	return nil
@@ -106,7 +132,7 @@ func (f *File) Next(version uint) (nextVersion uint, err error) {
 
 func (f *File) ReadUp(version uint) (r io.ReadCloser, identifier string, err error) {
 	if m, ok := f.migrations.Up(version); ok {
-		r, err := os.Open(path.Join(f.path, m.Raw))
+		r, err := f.open(m)
 		if err != nil {
 			return nil, "", err
 		}
@@ -117,7 +143,7 @@ func (f *File) ReadUp(version uint) (r io.ReadCloser, identifier string, err err
 
 func (f *File) ReadDown(version uint) (r io.ReadCloser, identifier string, err error) {
 	if m, ok := f.migrations.Down(version); ok {
-		r, err := os.Open(path.Join(f.path, m.Raw))
+		r, err := f.open(m)
 		if err != nil {
 			return nil, "", err
 		}
@@ -125,3 +151,15 @@ func (f *File) ReadDown(version uint) (r io.ReadCloser, identifier string, err e
 	}
 	return nil, "", &os.PathError{fmt.Sprintf("read version %v", version), f.path, os.ErrNotExist}
 }
+
+// open opens the file of m, transcoded to UTF-8 if an encoding is set.
+func (f *File) open(m *source.Migration) (io.ReadCloser, error) {
+	r, err := os.Open(path.Join(f.path, m.Raw))
+	if err != nil {
+		return nil, err
+	}
+	if len(f.encoding) == 0 {
+		return r, nil
+	}
+	return source.Transcode(r, f.encoding)
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	st "github.com/vickxxx/migrate/source/testing"
@@ -142,6 +143,28 @@ func TestOpenWithDuplicateVersion(t *testing.T) {
 	}
 }
 
+func TestOpenWithDuplicateVersionNamesFiles(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "TestOpenWithDuplicateVersionNamesFiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	mustWriteFile(t, tmpDir, "3_foo.up.sql", "")
+	mustWriteFile(t, tmpDir, "3_bar.up.sql", "")
+
+	f := &File{}
+	_, err = f.Open("file://" + tmpDir)
+	if err == nil {
+		t.Fatal("expected err")
+	}
+	for _, name := range []string{"3_foo.up.sql", "3_bar.up.sql"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Errorf("expected err to name %v, got %v", name, err)
+		}
+	}
+}
+
 func TestClose(t *testing.T) {
 	tmpDir, err := ioutil.TempDir("", "TestOpen")
 	if err != nil {
@@ -205,3 +228,45 @@ func BenchmarkNext(b *testing.B) {
 	}
 	b.StopTimer()
 }
+
+func TestOpenWithEncoding(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "TestOpenWithEncoding")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// 'café' and '€' in Windows-1252
+	mustWriteFile(t, tmpDir, "1_foobar.up.sql", "INSERT INTO t VALUES ('caf\xe9', '\x80')")
+
+	f := &File{}
+	d, err := f.Open("file://" + tmpDir + "?x-encoding=windows-1252")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, _, err := d.ReadUp(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "INSERT INTO t VALUES ('café', '€')" {
+		t.Fatalf("unexpected body %q", body)
+	}
+}
+
+func TestOpenWithUnknownEncoding(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "TestOpenWithUnknownEncoding")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	f := &File{}
+	if _, err := f.Open("file://" + tmpDir + "?x-encoding=ebcdic"); err == nil {
+		t.Fatal("expected err for unknown encoding")
+	}
+}
@@ -6,10 +6,13 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	nurl "net/url"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/google/go-github/github"
 	"github.com/vickxxx/migrate/source"
@@ -27,6 +30,10 @@ var (
 	ErrNoDir               = fmt.Errorf("no directory")
 )
 
+// DefaultMaxRetries is the number of times a request is retried
+// after hitting GitHub's rate limit.
+var DefaultMaxRetries = 3
+
 type Github struct {
 	client *github.Client
 	url    string
@@ -35,9 +42,22 @@ type Github struct {
 	pathRepo   string
 	path       string
 	migrations *source.Migrations
+	// shas are the blob SHAs of the migration files, by name
+	shas map[string]string
+
+	config *Config
 }
 
 type Config struct {
+	// MaxRetries is the number of times a request is retried after
+	// waiting for the rate limit to reset. Zero defaults to
+	// DefaultMaxRetries, a negative value disables retries.
+	MaxRetries int
+
+	// MaxSize is the maximum size of a single migration in bytes,
+	// larger ones fail with source.ErrMigrationTooLarge. Zero means
+	// no limit.
+	MaxSize int64
 }
 
 func (g *Github) Open(url string) (source.Driver, error) {
@@ -60,10 +80,27 @@ func (g *Github) Open(url string) (source.Driver, error) {
 		Password: password,
 	}
 
+	var maxRetries int
+	if s := u.Query().Get("x-max-retries"); len(s) > 0 {
+		maxRetries, err = strconv.Atoi(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x-max-retries %q: %v", s, err)
+		}
+	}
+	if maxRetries == 0 {
+		maxRetries = DefaultMaxRetries
+	}
+
+	maxSize, err := source.ParseMaxSize(u.Query().Get("x-max-size"))
+	if err != nil {
+		return nil, err
+	}
+
 	gn := &Github{
 		client:     github.NewClient(tr.Client()),
 		url:        url,
 		migrations: source.NewMigrations(),
+		config:     &Config{MaxRetries: maxRetries, MaxSize: maxSize},
 	}
 
 	// set owner, repo and path in repo
@@ -85,9 +122,17 @@ func (g *Github) Open(url string) (source.Driver, error) {
 }
 
 func WithInstance(client *github.Client, config *Config) (source.Driver, error) {
+	if config == nil {
+		config = &Config{}
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = DefaultMaxRetries
+	}
+
 	gn := &Github{
 		client:     client,
 		migrations: source.NewMigrations(),
+		config:     config,
 	}
 	if err := gn.readDirectory(); err != nil {
 		return nil, err
@@ -96,7 +141,7 @@ func WithInstance(client *github.Client, config *Config) (source.Driver, error)
 }
 
 func (g *Github) readDirectory() error {
-	fileContent, dirContents, _, err := g.client.Repositories.GetContents(context.Background(), g.pathOwner, g.pathRepo, g.path, &github.RepositoryContentGetOptions{})
+	fileContent, dirContents, err := g.getContents(g.path)
 	if err != nil {
 		return err
 	}
@@ -104,6 +149,7 @@ func (g *Github) readDirectory() error {
 		return ErrNoDir
 	}
 
+	g.shas = make(map[string]string, len(dirContents))
 	for _, fi := range dirContents {
 		m, err := source.DefaultParse(*fi.Name)
 		if err != nil {
@@ -112,11 +158,72 @@ func (g *Github) readDirectory() error {
 		if !g.migrations.Append(m) {
 			return fmt.Errorf("unable to parse file %v", *fi.Name)
 		}
+		g.shas[*fi.Name] = fi.GetSHA()
 	}
 
 	return nil
 }
 
+// getContents gets the file or directory at p, waiting for the rate limit
+// to reset and retrying up to MaxRetries times if it's exceeded.
+func (g *Github) getContents(p string) (*github.RepositoryContent, []*github.RepositoryContent, error) {
+	for retries := 0; ; retries++ {
+		fileContent, dirContents, _, err := g.client.Repositories.GetContents(context.Background(), g.pathOwner, g.pathRepo, p, &github.RepositoryContentGetOptions{})
+		if err == nil {
+			return fileContent, dirContents, nil
+		}
+
+		wait, limited := rateLimitWait(err)
+		if !limited || retries >= g.config.MaxRetries {
+			return nil, nil, err
+		}
+		time.Sleep(wait)
+	}
+}
+
+// rateLimitWait returns how long to wait before retrying a request that
+// failed with err, and whether it failed because of a rate limit.
+// GitHub sets Retry-After on secondary rate limits, and
+// X-RateLimit-Remaining and X-RateLimit-Reset on the primary one.
+func rateLimitWait(err error) (time.Duration, bool) {
+	var resp *http.Response
+	switch e := err.(type) {
+	case *github.RateLimitError:
+		return untilReset(e.Rate.Reset.Time), true
+	case *github.AbuseRateLimitError:
+		if e.RetryAfter != nil {
+			return *e.RetryAfter, true
+		}
+		resp = e.Response
+	case *github.ErrorResponse:
+		resp = e.Response
+	}
+	if resp == nil || (resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests) {
+		return 0, false
+	}
+
+	if s := resp.Header.Get("Retry-After"); len(s) > 0 {
+		if seconds, err := strconv.Atoi(s); err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+		if err != nil {
+			return 0, true
+		}
+		return untilReset(time.Unix(reset, 0)), true
+	}
+	return 0, false
+}
+
+func untilReset(reset time.Time) time.Duration {
+	if d := time.Until(reset); d > 0 {
+		return d
+	}
+	return 0
+}
+
 func (g *Github) Close() error {
 	return nil
 }
@@ -147,16 +254,12 @@ func (g *Github) Next(version uint) (nextVersion uint, err error) {
 
 func (g *Github) ReadUp(version uint) (r io.ReadCloser, identifier string, err error) {
 	if m, ok := g.migrations.Up(version); ok {
-		file, _, _, err := g.client.Repositories.GetContents(context.Background(), g.pathOwner, g.pathRepo, path.Join(g.path, m.Raw), &github.RepositoryContentGetOptions{})
+		r, err := g.readFile(m)
 		if err != nil {
 			return nil, "", err
 		}
-		if file != nil {
-			r, err := file.GetContent()
-			if err != nil {
-				return nil, "", err
-			}
-			return ioutil.NopCloser(bytes.NewReader([]byte(r))), m.Identifier, nil
+		if r != nil {
+			return r, m.Identifier, nil
 		}
 	}
 	return nil, "", &os.PathError{fmt.Sprintf("read version %v", version), g.path, os.ErrNotExist}
@@ -164,17 +267,41 @@ func (g *Github) ReadUp(version uint) (r io.ReadCloser, identifier string, err e
 
 func (g *Github) ReadDown(version uint) (r io.ReadCloser, identifier string, err error) {
 	if m, ok := g.migrations.Down(version); ok {
-		file, _, _, err := g.client.Repositories.GetContents(context.Background(), g.pathOwner, g.pathRepo, path.Join(g.path, m.Raw), &github.RepositoryContentGetOptions{})
+		r, err := g.readFile(m)
 		if err != nil {
 			return nil, "", err
 		}
-		if file != nil {
-			r, err := file.GetContent()
-			if err != nil {
-				return nil, "", err
-			}
-			return ioutil.NopCloser(bytes.NewReader([]byte(r))), m.Identifier, nil
+		if r != nil {
+			return r, m.Identifier, nil
 		}
 	}
 	return nil, "", &os.PathError{fmt.Sprintf("read version %v", version), g.path, os.ErrNotExist}
 }
+
+// ETag implements source.ETagger with the blob SHAs listed on open,
+// which change with the content of a file.
+func (g *Github) ETag(version uint, direction source.Direction) (string, error) {
+	if m, ok := g.migrations.Get(version, direction); ok {
+		return g.shas[m.Raw], nil
+	}
+	return "", &os.PathError{fmt.Sprintf("read version %v", version), g.path, os.ErrNotExist}
+}
+
+// readFile returns the content of the file of m, or nil if it's not a file.
+// Files larger than Config.MaxSize fail with source.ErrMigrationTooLarge
+// before their content is decoded.
+func (g *Github) readFile(m *source.Migration) (io.ReadCloser, error) {
+	p := path.Join(g.path, m.Raw)
+	file, _, err := g.getContents(p)
+	if err != nil || file == nil {
+		return nil, err
+	}
+	if g.config.MaxSize > 0 && int64(file.GetSize()) > g.config.MaxSize {
+		return nil, source.ErrMigrationTooLarge{Name: p, MaxSize: g.config.MaxSize}
+	}
+	content, err := file.GetContent()
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader([]byte(content))), nil
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"path"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/vickxxx/migrate/source"
@@ -22,6 +23,13 @@ type gcs struct {
 	bucket     *storage.BucketHandle
 	prefix     string
 	migrations *source.Migrations
+	// etags are the ETags of the migration files, by name
+	etags map[string]string
+
+	// readTimeout bounds fetching a single migration, if set
+	readTimeout time.Duration
+	// maxSize bounds the size of a single migration in bytes, if set
+	maxSize int64
 }
 
 func (g *gcs) Open(folder string) (source.Driver, error) {
@@ -29,14 +37,27 @@ func (g *gcs) Open(folder string) (source.Driver, error) {
 	if err != nil {
 		return nil, err
 	}
+	var readTimeout time.Duration
+	if s := u.Query().Get("x-read-timeout"); len(s) > 0 {
+		readTimeout, err = time.ParseDuration(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x-read-timeout %q: %v", s, err)
+		}
+	}
+	maxSize, err := source.ParseMaxSize(u.Query().Get("x-max-size"))
+	if err != nil {
+		return nil, err
+	}
 	client, err := storage.NewClient(context.Background())
 	if err != nil {
 		return nil, err
 	}
 	driver := gcs{
-		bucket:     client.Bucket(u.Host),
-		prefix:     strings.Trim(u.Path, "/") + "/",
-		migrations: source.NewMigrations(),
+		bucket:      client.Bucket(u.Host),
+		prefix:      strings.Trim(u.Path, "/") + "/",
+		migrations:  source.NewMigrations(),
+		readTimeout: readTimeout,
+		maxSize:     maxSize,
 	}
 	err = driver.loadMigrations()
 	if err != nil {
@@ -50,6 +71,7 @@ func (g *gcs) loadMigrations() error {
 		Prefix:    g.prefix,
 		Delimiter: "/",
 	})
+	g.etags = make(map[string]string)
 	object, err := iter.Next()
 	for ; err == nil; object, err = iter.Next() {
 		_, fileName := path.Split(object.Name)
@@ -60,6 +82,7 @@ func (g *gcs) loadMigrations() error {
 		if !g.migrations.Append(m) {
 			return fmt.Errorf("unable to parse file %v", object.Name)
 		}
+		g.etags[fileName] = object.Etag
 	}
 	if err != iterator.Done {
 		return err
@@ -109,9 +132,23 @@ func (g *gcs) ReadDown(version uint) (io.ReadCloser, string, error) {
 	return nil, "", os.ErrNotExist
 }
 
+// ETag implements source.ETagger with the ETags listed on open.
+func (g *gcs) ETag(version uint, direction source.Direction) (string, error) {
+	if m, ok := g.migrations.Get(version, direction); ok {
+		return g.etags[m.Raw], nil
+	}
+	return "", os.ErrNotExist
+}
+
 func (g *gcs) open(m *source.Migration) (io.ReadCloser, string, error) {
 	objectPath := path.Join(g.prefix, m.Raw)
-	reader, err := g.bucket.Object(objectPath).NewReader(context.Background())
+	reader, err := source.ReadWithTimeout(objectPath, g.readTimeout, func(ctx context.Context) (io.ReadCloser, error) {
+		r, err := g.bucket.Object(objectPath).NewReader(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return source.LimitSize(objectPath, g.maxSize, r), nil
+	})
 	if err != nil {
 		return nil, "", err
 	}
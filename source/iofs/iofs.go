@@ -0,0 +1,133 @@
+//go:build go1.16
+// +build go1.16
+
+package iofs
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+
+	"github.com/vickxxx/migrate/source"
+)
+
+func init() {
+	source.Register("iofs", &IOFS{})
+}
+
+var (
+	ErrNotSupported = fmt.Errorf("iofs source can only be used with WithInstance")
+)
+
+// IOFS reads migrations from a directory of an fs.FS, i.e. migrations
+// embedded in the binary with go:embed.
+type IOFS struct {
+	fsys       fs.FS
+	path       string
+	migrations *source.Migrations
+}
+
+// Open always fails, an fs.FS can't be referred to by URL.
+// Use WithInstance instead.
+func (f *IOFS) Open(url string) (source.Driver, error) {
+	return nil, ErrNotSupported
+}
+
+// WithInstance returns a driver reading the migration files in the
+// directory dir of fsys, i.e. "." or the directory embedded with go:embed.
+// Files are named like for the file source.
+func WithInstance(fsys fs.FS, dir string) (source.Driver, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	nf := &IOFS{
+		fsys:       fsys,
+		path:       dir,
+		migrations: source.NewMigrations(),
+	}
+
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		m, err := source.DefaultParse(e.Name())
+		if err != nil {
+			continue // ignore files that we can't parse
+		}
+		m.Raw = path.Join(dir, e.Name())
+		if !nf.migrations.Append(m) {
+			return nil, nf.duplicateErr(m)
+		}
+	}
+	return nf, nil
+}
+
+// duplicateErr returns an error naming both files that claim
+// the version and direction of m.
+func (f *IOFS) duplicateErr(m *source.Migration) error {
+	var dup *source.Migration
+	if m.Direction == source.Up {
+		dup, _ = f.migrations.Up(m.Version)
+	} else {
+		dup, _ = f.migrations.Down(m.Version)
+	}
+	if dup == nil {
+		return fmt.Errorf("unable to parse file %v", m.Raw)
+	}
+	return fmt.Errorf("duplicate migration version %v (%v): %v and %v", m.Version, m.Direction, dup.Raw, m.Raw)
+}
+
+// Close closes nothing, fsys is owned by the caller.
+func (f *IOFS) Close() error {
+	return nil
+}
+
+func (f *IOFS) First() (version uint, err error) {
+	if v, ok := f.migrations.First(); !ok {
+		return 0, &os.PathError{"first", f.path, os.ErrNotExist}
+	} else {
+		return v, nil
+	}
+}
+
+func (f *IOFS) Prev(version uint) (prevVersion uint, err error) {
+	if v, ok := f.migrations.Prev(version); !ok {
+		return 0, &os.PathError{fmt.Sprintf("prev for version %v", version), f.path, os.ErrNotExist}
+	} else {
+		return v, nil
+	}
+}
+
+func (f *IOFS) Next(version uint) (nextVersion uint, err error) {
+	if v, ok := f.migrations.Next(version); !ok {
+		return 0, &os.PathError{fmt.Sprintf("next for version %v", version), f.path, os.ErrNotExist}
+	} else {
+		return v, nil
+	}
+}
+
+func (f *IOFS) ReadUp(version uint) (r io.ReadCloser, identifier string, err error) {
+	if m, ok := f.migrations.Up(version); ok {
+		r, err := f.fsys.Open(m.Raw)
+		if err != nil {
+			return nil, "", err
+		}
+		return r, m.Identifier, nil
+	}
+	return nil, "", &os.PathError{fmt.Sprintf("read version %v", version), f.path, os.ErrNotExist}
+}
+
+func (f *IOFS) ReadDown(version uint) (r io.ReadCloser, identifier string, err error) {
+	if m, ok := f.migrations.Down(version); ok {
+		r, err := f.fsys.Open(m.Raw)
+		if err != nil {
+			return nil, "", err
+		}
+		return r, m.Identifier, nil
+	}
+	return nil, "", &os.PathError{fmt.Sprintf("read version %v", version), f.path, os.ErrNotExist}
+}
@@ -0,0 +1,77 @@
+//go:build go1.16
+// +build go1.16
+
+package iofs
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	st "github.com/vickxxx/migrate/source/testing"
+)
+
+// testFS meets the driver test requirements
+var testFS = fstest.MapFS{
+	"migrations/1_foobar.up.sql":        {Data: []byte("1 up")},
+	"migrations/1_foobar.down.sql":      {Data: []byte("1 down")},
+	"migrations/3_foobar.up.sql":        {Data: []byte("3 up")},
+	"migrations/4_foobar.up.sql":        {Data: []byte("4 up")},
+	"migrations/4_foobar.down.sql":      {Data: []byte("4 down")},
+	"migrations/5_foobar.down.sql":      {Data: []byte("5 down")},
+	"migrations/7_foobar.up.sql":        {Data: []byte("7 up")},
+	"migrations/7_foobar.down.sql":      {Data: []byte("7 down")},
+	"migrations/README.md":              {Data: []byte("not a migration")},
+	"migrations/nested/8_foobar.up.sql": {Data: []byte("not in the directory")},
+	"other/2_foobar.up.sql":             {Data: []byte("not in the directory either")},
+}
+
+func Test(t *testing.T) {
+	d, err := WithInstance(testFS, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Test(t, d)
+}
+
+func TestReadUp(t *testing.T) {
+	d, err := WithInstance(testFS, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, identifier, err := d.ReadUp(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "4 up" || identifier != "foobar" {
+		t.Fatalf("expected 4 up of foobar, got %q of %q", body, identifier)
+	}
+}
+
+func TestWithInstanceDuplicate(t *testing.T) {
+	_, err := WithInstance(fstest.MapFS{
+		"1_a.up.sql": {Data: []byte("a")},
+		"1_b.up.sql": {Data: []byte("b")},
+	}, ".")
+	if err == nil || !strings.Contains(err.Error(), "1_a.up.sql and 1_b.up.sql") {
+		t.Fatalf("expected duplicate error naming both files, got %v", err)
+	}
+}
+
+func TestWithInstanceNoDirectory(t *testing.T) {
+	if _, err := WithInstance(testFS, "missing"); err == nil {
+		t.Fatal("expected error for missing directory")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	if _, err := (&IOFS{}).Open("iofs://"); err != ErrNotSupported {
+		t.Fatalf("expected ErrNotSupported, got %v", err)
+	}
+}
@@ -0,0 +1,115 @@
+package memory
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/vickxxx/migrate"
+	"github.com/vickxxx/migrate/source"
+)
+
+func init() {
+	source.Register("memory", &Memory{})
+}
+
+var (
+	ErrNotSupported = fmt.Errorf("memory source can only be used with WithInstance")
+)
+
+// Memory reads migrations defined in code, i.e. to set up a schema
+// in unit tests without shipping migration files.
+type Memory struct {
+	path       string
+	migrations *source.Migrations
+	bodies     map[uint]map[source.Direction]string
+}
+
+// Open always fails, there is nothing to read from a URL.
+// Use WithInstance instead.
+func (m *Memory) Open(url string) (source.Driver, error) {
+	return nil, ErrNotSupported
+}
+
+// WithInstance returns a driver reading the given migrations:
+//
+//   d, err := memory.WithInstance([]migrate.MemoryMigration{
+//     {Version: 1, Direction: source.Up, Body: "CREATE TABLE users (id INTEGER);"},
+//     {Version: 1, Direction: source.Down, Body: "DROP TABLE users;"},
+//   })
+//   m, err := migrate.NewWithSourceInstance("memory", d, "sqlite3://...")
+func WithInstance(migrations []migrate.MemoryMigration) (source.Driver, error) {
+	mm := &Memory{
+		path:       "<memory>",
+		migrations: source.NewMigrations(),
+		bodies:     make(map[uint]map[source.Direction]string),
+	}
+
+	for _, mig := range migrations {
+		if mig.Direction != source.Up && mig.Direction != source.Down {
+			return nil, fmt.Errorf("invalid direction %q for migration version %v", mig.Direction, mig.Version)
+		}
+
+		m := &source.Migration{
+			Version:    mig.Version,
+			Identifier: fmt.Sprintf("%v.%v.memory", mig.Version, mig.Direction),
+			Direction:  mig.Direction,
+		}
+		if !mm.migrations.Append(m) {
+			return nil, fmt.Errorf("duplicate migration version %v (%v)", mig.Version, mig.Direction)
+		}
+
+		if mm.bodies[mig.Version] == nil {
+			mm.bodies[mig.Version] = make(map[source.Direction]string)
+		}
+		mm.bodies[mig.Version][mig.Direction] = mig.Body
+	}
+
+	return mm, nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+func (m *Memory) First() (version uint, err error) {
+	if v, ok := m.migrations.First(); !ok {
+		return 0, &os.PathError{"first", m.path, os.ErrNotExist}
+	} else {
+		return v, nil
+	}
+}
+
+func (m *Memory) Prev(version uint) (prevVersion uint, err error) {
+	if v, ok := m.migrations.Prev(version); !ok {
+		return 0, &os.PathError{fmt.Sprintf("prev for version %v", version), m.path, os.ErrNotExist}
+	} else {
+		return v, nil
+	}
+}
+
+func (m *Memory) Next(version uint) (nextVersion uint, err error) {
+	if v, ok := m.migrations.Next(version); !ok {
+		return 0, &os.PathError{fmt.Sprintf("next for version %v", version), m.path, os.ErrNotExist}
+	} else {
+		return v, nil
+	}
+}
+
+func (m *Memory) ReadUp(version uint) (r io.ReadCloser, identifier string, err error) {
+	if mig, ok := m.migrations.Up(version); ok {
+		body := m.bodies[version][source.Up]
+		return ioutil.NopCloser(bytes.NewBufferString(body)), mig.Identifier, nil
+	}
+	return nil, "", &os.PathError{fmt.Sprintf("read up version %v", version), m.path, os.ErrNotExist}
+}
+
+func (m *Memory) ReadDown(version uint) (r io.ReadCloser, identifier string, err error) {
+	if mig, ok := m.migrations.Down(version); ok {
+		body := m.bodies[version][source.Down]
+		return ioutil.NopCloser(bytes.NewBufferString(body)), mig.Identifier, nil
+	}
+	return nil, "", &os.PathError{fmt.Sprintf("read down version %v", version), m.path, os.ErrNotExist}
+}
@@ -0,0 +1,107 @@
+package memory
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/vickxxx/migrate"
+	"github.com/vickxxx/migrate/database/sqlite3"
+	"github.com/vickxxx/migrate/source"
+	st "github.com/vickxxx/migrate/source/testing"
+)
+
+func Test(t *testing.T) {
+	d, err := WithInstance([]migrate.MemoryMigration{
+		{Version: 1, Direction: source.Up, Body: "1 up"},
+		{Version: 1, Direction: source.Down, Body: "1 down"},
+		{Version: 3, Direction: source.Up, Body: "3 up"},
+		{Version: 4, Direction: source.Up, Body: "4 up"},
+		{Version: 4, Direction: source.Down, Body: "4 down"},
+		{Version: 5, Direction: source.Down, Body: "5 down"},
+		{Version: 7, Direction: source.Up, Body: "7 up"},
+		{Version: 7, Direction: source.Down, Body: "7 down"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Test(t, d)
+}
+
+func TestOpen(t *testing.T) {
+	m := &Memory{}
+	if _, err := m.Open("memory://"); err != ErrNotSupported {
+		t.Fatalf("expected ErrNotSupported, got %v", err)
+	}
+}
+
+func TestWithInstanceDuplicate(t *testing.T) {
+	_, err := WithInstance([]migrate.MemoryMigration{
+		{Version: 1, Direction: source.Up, Body: "a"},
+		{Version: 1, Direction: source.Up, Body: "b"},
+	})
+	if err == nil {
+		t.Fatal("expected err for duplicate migration")
+	}
+}
+
+func TestWithInstanceInvalidDirection(t *testing.T) {
+	_, err := WithInstance([]migrate.MemoryMigration{
+		{Version: 1, Direction: "sideways", Body: "a"},
+	})
+	if err == nil {
+		t.Fatal("expected err for invalid direction")
+	}
+}
+
+func TestUpDownSqlite(t *testing.T) {
+	s, err := WithInstance([]migrate.MemoryMigration{
+		{Version: 1, Direction: source.Up, Body: "CREATE TABLE users (id INTEGER PRIMARY KEY, name TEXT);"},
+		{Version: 1, Direction: source.Down, Body: "DROP TABLE users;"},
+		{Version: 2, Direction: source.Up, Body: "ALTER TABLE users ADD COLUMN email TEXT;"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every connection to :memory: is a database of its own
+	db.SetMaxOpenConns(1)
+	defer db.Close()
+
+	d, err := sqlite3.WithInstance(db, &sqlite3.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := migrate.NewWithInstance("memory", s, "sqlite3", d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Up(); err != nil {
+		t.Fatal(err)
+	}
+	version, dirty, err := m.Version()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 2 || dirty {
+		t.Fatalf("expected version 2, not dirty, got %v, %v", version, dirty)
+	}
+	if _, err := db.Exec("INSERT INTO users (name, email) VALUES ('foo', 'foo@example.com')"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Steps(-1); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Steps(-1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("SELECT 1 FROM users"); err == nil {
+		t.Fatal("expected table users to be dropped")
+	}
+}
@@ -114,6 +114,14 @@ func (i *Migrations) Down(version uint) (m *Migration, ok bool) {
 	return nil, false
 }
 
+// Get returns the migration of version in direction.
+func (i *Migrations) Get(version uint, direction Direction) (m *Migration, ok bool) {
+	if direction == Down {
+		return i.Down(version)
+	}
+	return i.Up(version)
+}
+
 func (i *Migrations) findPos(version uint) int {
 	if len(i.index) > 0 {
 		ix := i.index.Search(version)
@@ -0,0 +1,44 @@
+package source
+
+import (
+	"io"
+	"os"
+)
+
+// MissingDowns returns the versions of drv that have an up migration but
+// no down migration, in the order of drv, i.e. to flag them in code review.
+func MissingDowns(drv Driver) ([]uint, error) {
+	missing := make([]uint, 0)
+	version, err := drv.First()
+	for err == nil {
+		hasUp, upErr := exists(drv.ReadUp, version)
+		if upErr != nil {
+			return nil, upErr
+		}
+		hasDown, downErr := exists(drv.ReadDown, version)
+		if downErr != nil {
+			return nil, downErr
+		}
+		if hasUp && !hasDown {
+			missing = append(missing, version)
+		}
+		version, err = drv.Next(version)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return missing, nil
+}
+
+// exists returns true if read finds a migration for version.
+func exists(read func(uint) (r io.ReadCloser, identifier string, err error), version uint) (bool, error) {
+	r, _, err := read(version)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	r.Close()
+	return true, nil
+}
@@ -0,0 +1,57 @@
+package source_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/vickxxx/migrate/source"
+	_ "github.com/vickxxx/migrate/source/file"
+)
+
+func TestMissingDowns(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "TestMissingDowns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, name := range []string{
+		"1_create_users.up.sql",
+		"1_create_users.down.sql",
+		"2_backfill_users.up.sql",
+		"3_drop_legacy.down.sql",
+		"4_add_index.up.sql",
+		"4_add_index.down.sql",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(tmpDir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	d, err := source.Open("file://" + tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	missing, err := source.MissingDowns(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(missing, []uint{2}) {
+		t.Fatalf("expected version 2 to miss its down migration, got %v", missing)
+	}
+}
+
+func TestMissingDownsEmpty(t *testing.T) {
+	missing, err := source.MissingDowns(stub())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(missing) != 0 {
+		t.Fatalf("expected no versions, got %v", missing)
+	}
+}
@@ -0,0 +1,132 @@
+package source
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// ErrOverlayOpen is returned by the Open method of an Overlay,
+// which is composed of other drivers instead.
+var ErrOverlayOpen = fmt.Errorf("overlay source can only be created with Overlay")
+
+// overlay is the Driver returned by Overlay.
+type overlay struct {
+	base     Driver
+	override Driver
+
+	// versions of both drivers, in ascending order
+	versions []uint
+	// overridden reports the versions read from override
+	overridden map[uint]bool
+}
+
+// Overlay returns a driver merging the migrations of base and override,
+// i.e. of `migrations/common` and `migrations/prod`. Versions of both
+// drivers are merged in ascending order. Override wins: if override has
+// a migration at a version, its up and down migrations replace those of
+// base at that version entirely, even if override only has one of them.
+// Close closes both drivers.
+func Overlay(base, override Driver) (Driver, error) {
+	baseVersions, err := versions(base)
+	if err != nil {
+		return nil, err
+	}
+	overrideVersions, err := versions(override)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &overlay{
+		base:       base,
+		override:   override,
+		versions:   make([]uint, 0, len(baseVersions)+len(overrideVersions)),
+		overridden: make(map[uint]bool, len(overrideVersions)),
+	}
+	for _, v := range overrideVersions {
+		o.overridden[v] = true
+		o.versions = append(o.versions, v)
+	}
+	for _, v := range baseVersions {
+		if !o.overridden[v] {
+			o.versions = append(o.versions, v)
+		}
+	}
+	sort.Slice(o.versions, func(i, j int) bool { return o.versions[i] < o.versions[j] })
+	return o, nil
+}
+
+// versions returns all versions of d in ascending order.
+func versions(d Driver) ([]uint, error) {
+	versions := make([]uint, 0)
+	v, err := d.First()
+	for err == nil {
+		versions = append(versions, v)
+		v, err = d.Next(v)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return versions, nil
+}
+
+func (o *overlay) Open(url string) (Driver, error) {
+	return nil, ErrOverlayOpen
+}
+
+func (o *overlay) Close() error {
+	baseErr := o.base.Close()
+	if err := o.override.Close(); err != nil {
+		return err
+	}
+	return baseErr
+}
+
+func (o *overlay) First() (version uint, err error) {
+	if len(o.versions) == 0 {
+		return 0, &os.PathError{Op: "first", Path: "<overlay>", Err: os.ErrNotExist}
+	}
+	return o.versions[0], nil
+}
+
+func (o *overlay) Prev(version uint) (prevVersion uint, err error) {
+	if i, ok := o.position(version); ok && i > 0 {
+		return o.versions[i-1], nil
+	}
+	return 0, &os.PathError{Op: fmt.Sprintf("prev for version %v", version), Path: "<overlay>", Err: os.ErrNotExist}
+}
+
+func (o *overlay) Next(version uint) (nextVersion uint, err error) {
+	if i, ok := o.position(version); ok && i+1 < len(o.versions) {
+		return o.versions[i+1], nil
+	}
+	return 0, &os.PathError{Op: fmt.Sprintf("next for version %v", version), Path: "<overlay>", Err: os.ErrNotExist}
+}
+
+func (o *overlay) ReadUp(version uint) (r io.ReadCloser, identifier string, err error) {
+	return o.driver(version).ReadUp(version)
+}
+
+func (o *overlay) ReadDown(version uint) (r io.ReadCloser, identifier string, err error) {
+	return o.driver(version).ReadDown(version)
+}
+
+// Capabilities reports UpOnly if both drivers are up only.
+func (o *overlay) Capabilities() Capabilities {
+	return Capabilities{UpOnly: CapabilitiesOf(o.base).UpOnly && CapabilitiesOf(o.override).UpOnly}
+}
+
+// position returns the index of version in o.versions.
+func (o *overlay) position(version uint) (int, bool) {
+	i := sort.Search(len(o.versions), func(i int) bool { return o.versions[i] >= version })
+	return i, i < len(o.versions) && o.versions[i] == version
+}
+
+// driver returns the driver to read the migrations at version from.
+func (o *overlay) driver(version uint) Driver {
+	if o.overridden[version] {
+		return o.override
+	}
+	return o.base
+}
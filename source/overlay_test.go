@@ -0,0 +1,114 @@
+package source_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/vickxxx/migrate/source"
+	sStub "github.com/vickxxx/migrate/source/stub"
+	st "github.com/vickxxx/migrate/source/testing"
+)
+
+func stub(migrations ...*source.Migration) source.Driver {
+	d, _ := sStub.WithInstance(nil, &sStub.Config{})
+	for _, m := range migrations {
+		d.(*sStub.Stub).Migrations.Append(m)
+	}
+	return d
+}
+
+func TestOverlay(t *testing.T) {
+	base := stub(
+		&source.Migration{Version: 1, Direction: source.Up, Identifier: "1 up"},
+		&source.Migration{Version: 1, Direction: source.Down, Identifier: "1 down"},
+		&source.Migration{Version: 4, Direction: source.Up, Identifier: "4 up"},
+		&source.Migration{Version: 4, Direction: source.Down, Identifier: "4 down"},
+		&source.Migration{Version: 7, Direction: source.Up, Identifier: "7 up"},
+		&source.Migration{Version: 7, Direction: source.Down, Identifier: "7 down"},
+	)
+	override := stub(
+		&source.Migration{Version: 3, Direction: source.Up, Identifier: "3 up"},
+		&source.Migration{Version: 5, Direction: source.Down, Identifier: "5 down"},
+	)
+	d, err := source.Overlay(base, override)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Test(t, d)
+}
+
+func TestOverlayOverrideWins(t *testing.T) {
+	base := stub(
+		&source.Migration{Version: 1, Direction: source.Up, Identifier: "common 1 up"},
+		&source.Migration{Version: 1, Direction: source.Down, Identifier: "common 1 down"},
+		&source.Migration{Version: 2, Direction: source.Up, Identifier: "common 2 up"},
+		&source.Migration{Version: 2, Direction: source.Down, Identifier: "common 2 down"},
+	)
+	override := stub(
+		&source.Migration{Version: 2, Direction: source.Up, Identifier: "prod 2 up"},
+		&source.Migration{Version: 3, Direction: source.Up, Identifier: "prod 3 up"},
+	)
+	d, err := source.Overlay(base, override)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		version    uint
+		direction  source.Direction
+		expectBody string
+	}{
+		{version: 1, direction: source.Up, expectBody: "common 1 up"},
+		{version: 1, direction: source.Down, expectBody: "common 1 down"},
+		{version: 2, direction: source.Up, expectBody: "prod 2 up"},
+		// override replaces version 2 entirely
+		{version: 2, direction: source.Down, expectBody: ""},
+		{version: 3, direction: source.Up, expectBody: "prod 3 up"},
+	}
+	for i, v := range tt {
+		read := d.ReadUp
+		if v.direction == source.Down {
+			read = d.ReadDown
+		}
+		r, _, err := read(v.version)
+		if len(v.expectBody) == 0 {
+			if !os.IsNotExist(err) {
+				t.Errorf("expected os.ErrNotExist, got %v, in %v", err, i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v, in %v", err, i)
+		}
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != v.expectBody {
+			t.Errorf("expected %q, got %q, in %v", v.expectBody, body, i)
+		}
+	}
+
+	// versions are merged
+	version, err := d.First()
+	for _, expected := range []uint{1, 2, 3} {
+		if err != nil || version != expected {
+			t.Fatalf("expected version %v, got %v, %v", expected, version, err)
+		}
+		version, err = d.Next(version)
+	}
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected os.ErrNotExist after version 3, got %v", err)
+	}
+}
+
+func TestOverlayEmpty(t *testing.T) {
+	d, err := source.Overlay(stub(), stub())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.First(); !os.IsNotExist(err) {
+		t.Fatalf("expected os.ErrNotExist, got %v", err)
+	}
+}
@@ -20,7 +20,9 @@ var (
 //  123_name.down.ext
 var Regex = regexp.MustCompile(`^([0-9]+)_(.*)\.(` + string(Down) + `|` + string(Up) + `)\.(.*)$`)
 
-// Parse returns Migration for matching Regex pattern.
+// Parse returns Migration for matching Regex pattern, i.e. to check
+// filenames in tooling outside of a source driver. It returns ErrParse
+// if raw doesn't match.
 func Parse(raw string) (*Migration, error) {
 	m := Regex.FindStringSubmatch(raw)
 	if len(m) == 5 {
@@ -90,6 +90,21 @@ func TestParse(t *testing.T) {
 			expectErr:       ErrParse,
 			expectMigration: nil,
 		},
+		{
+			name:            "1_foobar.sideways.sql",
+			expectErr:       ErrParse,
+			expectMigration: nil,
+		},
+		{
+			name:            "1_foobar.UP.sql",
+			expectErr:       ErrParse,
+			expectMigration: nil,
+		},
+		{
+			name:            "v1_foobar.up.sql",
+			expectErr:       ErrParse,
+			expectMigration: nil,
+		},
 	}
 
 	for i, v := range tt {
@@ -104,3 +119,9 @@ func TestParse(t *testing.T) {
 		}
 	}
 }
+
+func TestParseVersionOverflow(t *testing.T) {
+	if _, err := Parse("99999999999999999999999_foobar.up.sql"); err == nil {
+		t.Fatal("expected err for version out of range")
+	}
+}
@@ -0,0 +1,255 @@
+package sftp
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	nurl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"github.com/vickxxx/migrate/source"
+	st "github.com/vickxxx/migrate/source/testing"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testFiles meet the driver test requirements
+var testFiles = map[string]string{
+	"1_foobar.up.sql":   "1 up",
+	"1_foobar.down.sql": "1 down",
+	"3_foobar.up.sql":   "3 up",
+	"4_foobar.up.sql":   "4 up",
+	"4_foobar.down.sql": "4 down",
+	"5_foobar.down.sql": "5 down",
+	"7_foobar.up.sql":   "7 up",
+	"7_foobar.down.sql": "7 down",
+	"README.md":         "not a migration",
+}
+
+// server is an in-process SFTP server serving the local file system,
+// accepting the user "migrate" with the password "secret" or clientKey.
+type server struct {
+	addr       string
+	tmp        string
+	dir        string
+	knownHosts string
+	clientKey  string
+	listener   net.Listener
+}
+
+func newServer(t *testing.T, files map[string]string) *server {
+	t.Helper()
+	tmp, err := ioutil.TempDir("", "sftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(tmp, "migrations")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, body := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hostSigner := newSigner(t)
+	clientPEM, clientSigner := newKey(t)
+	clientKey := filepath.Join(tmp, "id_rsa")
+	if err := ioutil.WriteFile(clientKey, clientPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == "migrate" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %v", c.User())
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() == "migrate" && string(key.Marshal()) == string(clientSigner.PublicKey().Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("key rejected for %v", c.User())
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn, config)
+		}
+	}()
+
+	knownHosts := filepath.Join(tmp, "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(l.Addr().String())}, hostSigner.PublicKey())
+	if err := ioutil.WriteFile(knownHosts, []byte(line+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return &server{addr: l.Addr().String(), tmp: tmp, dir: dir, knownHosts: knownHosts, clientKey: clientKey, listener: l}
+}
+
+// close stops accepting connections and removes the files.
+func (s *server) close() {
+	s.listener.Close()
+	os.RemoveAll(s.tmp)
+}
+
+// serve runs the sftp subsystem on the sessions of conn.
+func serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					if s, err := sftp.NewServer(channel, sftp.ReadOnly()); err == nil {
+						s.Serve()
+					}
+					channel.Close()
+				}
+			}
+		}()
+	}
+}
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, signer := newKey(t)
+	return signer
+}
+
+// newKey returns a new private key in PEM and as signer.
+func newKey(t *testing.T) ([]byte, ssh.Signer) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}), signer
+}
+
+func (s *server) url(userinfo string, query string) string {
+	return fmt.Sprintf("sftp://%v@%v%v?x-known-hosts=%v%v", userinfo, s.addr, s.dir, nurl.QueryEscape(s.knownHosts), query)
+}
+
+func Test(t *testing.T) {
+	s := newServer(t, testFiles)
+	defer s.close()
+	d, err := (&SFTP{}).Open(s.url("migrate:secret", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	st.Test(t, d)
+}
+
+func TestOpenWithKey(t *testing.T) {
+	s := newServer(t, testFiles)
+	defer s.close()
+	d, err := (&SFTP{}).Open(s.url("migrate", "&x-key-file="+nurl.QueryEscape(s.clientKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	r, identifier, err := d.ReadUp(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "4 up" || identifier != "foobar" {
+		t.Fatalf("expected 4 up of foobar, got %q of %q", body, identifier)
+	}
+}
+
+func TestOpenRejected(t *testing.T) {
+	s := newServer(t, testFiles)
+	defer s.close()
+
+	if _, err := (&SFTP{}).Open(s.url("migrate:wrong", "")); err == nil {
+		t.Fatal("expected wrong password to be rejected")
+	}
+	if _, err := (&SFTP{}).Open(s.url("migrate", "")); err != ErrNoAuth {
+		t.Fatalf("expected ErrNoAuth, got %v", err)
+	}
+	if _, err := (&SFTP{}).Open(strings.Replace(s.url("migrate:secret", ""), "migrate:secret@", "", 1)); err != ErrNoUserInfo {
+		t.Fatalf("expected ErrNoUserInfo, got %v", err)
+	}
+
+	// a server with another host key
+	other := newServer(t, testFiles)
+	defer other.close()
+	url := s.url("migrate:secret", "")
+	url = strings.Replace(url, nurl.QueryEscape(s.knownHosts), nurl.QueryEscape(other.knownHosts), 1)
+	if _, err := (&SFTP{}).Open(url); err == nil || !strings.Contains(err.Error(), "knownhosts") {
+		t.Fatalf("expected unknown host key to be rejected, got %v", err)
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	s := newServer(t, map[string]string{"1_large.up.sql": strings.Repeat("x", 100)})
+	defer s.close()
+	d, err := (&SFTP{}).Open(s.url("migrate:secret", "&x-max-size=10"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	r, _, err := d.ReadUp(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Fatal("expected migration to be too large")
+	} else if _, ok := err.(source.ErrMigrationTooLarge); !ok {
+		t.Fatalf("expected ErrMigrationTooLarge, got %v", err)
+	}
+}
+
+func TestOpenMissingDirectory(t *testing.T) {
+	s := newServer(t, testFiles)
+	defer s.close()
+	url := strings.Replace(s.url("migrate:secret", ""), s.dir, s.dir+"-missing", 1)
+	if _, err := (&SFTP{}).Open(url); !os.IsNotExist(err) {
+		t.Fatalf("expected not exist error, got %v", err)
+	}
+}
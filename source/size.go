@@ -0,0 +1,65 @@
+package source
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// ErrMigrationTooLarge is returned by drivers reading migrations from
+// remote storage if migration Name is larger than MaxSize bytes.
+type ErrMigrationTooLarge struct {
+	Name    string
+	MaxSize int64
+}
+
+func (e ErrMigrationTooLarge) Error() string {
+	return fmt.Sprintf("migration %v is larger than %v bytes", e.Name, e.MaxSize)
+}
+
+// ParseMaxSize parses the x-max-size URL query parameter of a driver,
+// a number of bytes. Empty means no limit.
+func ParseMaxSize(s string) (int64, error) {
+	if len(s) == 0 {
+		return 0, nil
+	}
+	maxSize, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || maxSize <= 0 {
+		return 0, fmt.Errorf("invalid x-max-size %q, expected a number of bytes", s)
+	}
+	return maxSize, nil
+}
+
+// LimitSize returns a reader of the migration name read from r, which
+// fails with ErrMigrationTooLarge as soon as more than maxSize bytes are
+// read, so that a huge object served as migration can't exhaust memory.
+// Without maxSize, r is returned unchanged.
+func LimitSize(name string, maxSize int64, r io.ReadCloser) io.ReadCloser {
+	if maxSize <= 0 {
+		return r
+	}
+	return &sizeLimiter{ReadCloser: r, name: name, maxSize: maxSize}
+}
+
+type sizeLimiter struct {
+	io.ReadCloser
+	name    string
+	maxSize int64
+	read    int64
+}
+
+func (l *sizeLimiter) Read(p []byte) (int, error) {
+	if l.read > l.maxSize {
+		return 0, ErrMigrationTooLarge{l.name, l.maxSize}
+	}
+	// read a byte beyond the limit to tell a body of exactly maxSize apart
+	if rest := l.maxSize - l.read + 1; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.read += int64(n)
+	if l.read > l.maxSize {
+		return n - 1, ErrMigrationTooLarge{l.name, l.maxSize}
+	}
+	return n, err
+}
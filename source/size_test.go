@@ -0,0 +1,54 @@
+package source
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestLimitSize(t *testing.T) {
+	tt := []struct {
+		body     string
+		maxSize  int64
+		tooLarge bool
+	}{
+		{body: "1 up", maxSize: 0},
+		{body: "1 up", maxSize: 4},
+		{body: "1 up", maxSize: 100},
+		{body: "1 up", maxSize: 3, tooLarge: true},
+		{body: strings.Repeat("x", 64*1024), maxSize: 1024, tooLarge: true},
+	}
+	for i, v := range tt {
+		body, err := ioutil.ReadAll(LimitSize("1_foobar.up.sql", v.maxSize, ioutil.NopCloser(strings.NewReader(v.body))))
+		if v.tooLarge {
+			expected := ErrMigrationTooLarge{Name: "1_foobar.up.sql", MaxSize: v.maxSize}
+			if err != expected {
+				t.Fatalf("%v: expected %v, got %v", i, expected, err)
+			}
+			if int64(len(body)) != v.maxSize {
+				t.Fatalf("%v: expected to read %v bytes, got %v", i, v.maxSize, len(body))
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+		if string(body) != v.body {
+			t.Fatalf("%v: expected %q, got %q", i, v.body, body)
+		}
+	}
+}
+
+func TestParseMaxSize(t *testing.T) {
+	if maxSize, err := ParseMaxSize(""); err != nil || maxSize != 0 {
+		t.Fatalf("expected no limit, got %v, %v", maxSize, err)
+	}
+	if maxSize, err := ParseMaxSize("1048576"); err != nil || maxSize != 1048576 {
+		t.Fatalf("expected 1048576, got %v, %v", maxSize, err)
+	}
+	for _, s := range []string{"1MB", "-1", "0"} {
+		if _, err := ParseMaxSize(s); err == nil {
+			t.Fatalf("expected error for %q", s)
+		}
+	}
+}
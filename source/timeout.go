@@ -0,0 +1,65 @@
+package source
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+// ErrReadTimeout is returned by drivers reading migrations from remote
+// storage if fetching the migration Name took longer than Timeout.
+type ErrReadTimeout struct {
+	Name    string
+	Timeout time.Duration
+}
+
+func (e ErrReadTimeout) Error() string {
+	return fmt.Sprintf("reading migration %v timed out after %v", e.Name, e.Timeout)
+}
+
+// ReadWithTimeout fetches the migration name with open, which has to
+// pass ctx on to the request, and reads its body completely within
+// timeout. It returns ErrReadTimeout if the deadline is exceeded, so that
+// a hung connection can't stall the migrations. Without a timeout, the
+// body returned by open is passed through.
+func ReadWithTimeout(name string, timeout time.Duration, open func(ctx context.Context) (io.ReadCloser, error)) (io.ReadCloser, error) {
+	if timeout <= 0 {
+		return open(context.Background())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	type result struct {
+		body []byte
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		r, err := open(ctx)
+		if err != nil {
+			done <- result{err: err}
+			return
+		}
+		defer r.Close()
+		body, err := ioutil.ReadAll(r)
+		done <- result{body, err}
+	}()
+
+	// a client that doesn't return once ctx is done is abandoned
+	select {
+	case res := <-done:
+		if res.err != nil {
+			if ctx.Err() == context.DeadlineExceeded {
+				return nil, ErrReadTimeout{name, timeout}
+			}
+			return nil, res.err
+		}
+		return ioutil.NopCloser(bytes.NewReader(res.body)), nil
+	case <-ctx.Done():
+		return nil, ErrReadTimeout{name, timeout}
+	}
+}
@@ -0,0 +1,92 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// slowServer responds with "1 up" after delaying the headers by
+// headerDelay and the body by bodyDelay.
+func slowServer(headerDelay, bodyDelay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(headerDelay)
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(bodyDelay)
+		fmt.Fprint(w, "1 up")
+	}))
+}
+
+func httpOpen(url string) func(ctx context.Context) (io.ReadCloser, error) {
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	}
+}
+
+func TestReadWithTimeout(t *testing.T) {
+	tt := []struct {
+		name        string
+		timeout     time.Duration
+		headerDelay time.Duration
+		bodyDelay   time.Duration
+		expectErr   bool
+	}{
+		{name: "no timeout", timeout: 0, bodyDelay: 50 * time.Millisecond},
+		{name: "fast", timeout: time.Second},
+		{name: "slow headers", timeout: 50 * time.Millisecond, headerDelay: time.Second, expectErr: true},
+		{name: "slow body", timeout: 50 * time.Millisecond, bodyDelay: time.Second, expectErr: true},
+	}
+
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			server := slowServer(v.headerDelay, v.bodyDelay)
+			defer server.Close()
+
+			start := time.Now()
+			r, err := ReadWithTimeout("1_foobar.up.sql", v.timeout, httpOpen(server.URL))
+			if v.expectErr {
+				if _, ok := err.(ErrReadTimeout); !ok {
+					t.Fatalf("expected ErrReadTimeout, got %v", err)
+				}
+				if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+					t.Fatalf("expected to time out early, took %v", elapsed)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			body, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != "1 up" {
+				t.Fatalf("expected body %q, got %q", "1 up", body)
+			}
+		})
+	}
+}
+
+func TestReadWithTimeoutErr(t *testing.T) {
+	_, err := ReadWithTimeout("1_foobar.up.sql", time.Second, func(ctx context.Context) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("not found")
+	})
+	if err == nil || err.Error() != "not found" {
+		t.Fatalf("expected err of open, got %v", err)
+	}
+}
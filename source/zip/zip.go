@@ -0,0 +1,167 @@
+package zip
+
+import (
+	archivezip "archive/zip"
+	"fmt"
+	"io"
+	nurl "net/url"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/vickxxx/migrate/source"
+)
+
+func init() {
+	source.Register("zip", &Zip{})
+}
+
+// Zip reads migrations from a zip archive. Migration files may be
+// placed in any directory within the archive.
+type Zip struct {
+	url        string
+	path       string
+	archive    *archivezip.Reader
+	closer     io.Closer
+	files      map[string]*archivezip.File
+	migrations *source.Migrations
+}
+
+func (z *Zip) Open(url string) (source.Driver, error) {
+	u, err := nurl.Parse(url)
+	if err != nil {
+		return nil, err
+	}
+
+	// concat host and path to restore full path
+	// host might be `.`
+	p := u.Host + u.Path
+	if len(p) == 0 {
+		return nil, fmt.Errorf("no path to zip archive in %v", url)
+	}
+	if p[0:1] != "/" {
+		// make path absolute if relative
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		p = abs
+	}
+
+	rc, err := archivezip.OpenReader(p)
+	if err != nil {
+		return nil, err
+	}
+
+	nz, err := newZip(&rc.Reader, p)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	nz.url = url
+	nz.closer = rc
+	return nz, nil
+}
+
+// WithArchive returns a driver reading the zip archive in r,
+// i.e. a *bytes.Reader or an *os.File, of size bytes.
+func WithArchive(r io.ReaderAt, size int64) (source.Driver, error) {
+	archive, err := archivezip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	return newZip(archive, "<zip>")
+}
+
+func newZip(archive *archivezip.Reader, p string) (*Zip, error) {
+	nz := &Zip{
+		path:       p,
+		archive:    archive,
+		files:      make(map[string]*archivezip.File),
+		migrations: source.NewMigrations(),
+	}
+
+	for _, f := range archive.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		m, err := source.DefaultParse(path.Base(f.Name))
+		if err != nil {
+			continue // ignore files that we can't parse
+		}
+		m.Raw = f.Name
+		if !nz.migrations.Append(m) {
+			return nil, nz.duplicateErr(m)
+		}
+		nz.files[f.Name] = f
+	}
+	return nz, nil
+}
+
+// duplicateErr returns an error naming both files that claim
+// the version and direction of m.
+func (z *Zip) duplicateErr(m *source.Migration) error {
+	var dup *source.Migration
+	if m.Direction == source.Up {
+		dup, _ = z.migrations.Up(m.Version)
+	} else {
+		dup, _ = z.migrations.Down(m.Version)
+	}
+	if dup == nil {
+		return fmt.Errorf("unable to parse file %v", m.Raw)
+	}
+	return fmt.Errorf("duplicate migration version %v (%v): %v and %v", m.Version, m.Direction, dup.Raw, m.Raw)
+}
+
+func (z *Zip) Close() error {
+	if z.closer != nil {
+		return z.closer.Close()
+	}
+	return nil
+}
+
+func (z *Zip) First() (version uint, err error) {
+	if v, ok := z.migrations.First(); !ok {
+		return 0, &os.PathError{"first", z.path, os.ErrNotExist}
+	} else {
+		return v, nil
+	}
+}
+
+func (z *Zip) Prev(version uint) (prevVersion uint, err error) {
+	if v, ok := z.migrations.Prev(version); !ok {
+		return 0, &os.PathError{fmt.Sprintf("prev for version %v", version), z.path, os.ErrNotExist}
+	} else {
+		return v, nil
+	}
+}
+
+func (z *Zip) Next(version uint) (nextVersion uint, err error) {
+	if v, ok := z.migrations.Next(version); !ok {
+		return 0, &os.PathError{fmt.Sprintf("next for version %v", version), z.path, os.ErrNotExist}
+	} else {
+		return v, nil
+	}
+}
+
+func (z *Zip) ReadUp(version uint) (r io.ReadCloser, identifier string, err error) {
+	if m, ok := z.migrations.Up(version); ok {
+		r, err := z.files[m.Raw].Open()
+		if err != nil {
+			return nil, "", err
+		}
+		return r, m.Identifier, nil
+	}
+	return nil, "", &os.PathError{fmt.Sprintf("read version %v", version), z.path, os.ErrNotExist}
+}
+
+func (z *Zip) ReadDown(version uint) (r io.ReadCloser, identifier string, err error) {
+	if m, ok := z.migrations.Down(version); ok {
+		r, err := z.files[m.Raw].Open()
+		if err != nil {
+			return nil, "", err
+		}
+		return r, m.Identifier, nil
+	}
+	return nil, "", &os.PathError{fmt.Sprintf("read version %v", version), z.path, os.ErrNotExist}
+}
@@ -0,0 +1,129 @@
+package zip
+
+import (
+	archivezip "archive/zip"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	st "github.com/vickxxx/migrate/source/testing"
+)
+
+// testFiles meet the driver test requirements
+var testFiles = map[string]string{
+	"1_foobar.up.sql":           "1 up",
+	"1_foobar.down.sql":         "1 down",
+	"3_foobar.up.sql":           "3 up",
+	"nested/4_foobar.up.sql":    "4 up",
+	"nested/4_foobar.down.sql":  "4 down",
+	"nested/5_foobar.down.sql":  "5 down",
+	"a/b/c/7_foobar.up.sql":     "7 up",
+	"a/b/c/7_foobar.down.sql":   "7 down",
+	"README.md":                 "not a migration",
+	"nested/ignored_foobar.sql": "not a migration either",
+}
+
+func mustZip(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	w := archivezip.NewWriter(&buf)
+	for name, body := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func Test(t *testing.T) {
+	archive := mustZip(t, testFiles)
+	d, err := WithArchive(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Test(t, d)
+}
+
+func TestReadNested(t *testing.T) {
+	archive := mustZip(t, testFiles)
+	d, err := WithArchive(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, identifier, err := d.ReadUp(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "7 up" {
+		t.Fatalf("expected body %q, got %q", "7 up", body)
+	}
+	if identifier != "foobar" {
+		t.Fatalf("expected identifier foobar, got %v", identifier)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "TestOpen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	p := filepath.Join(tmpDir, "migrations.zip")
+	if err := ioutil.WriteFile(p, mustZip(t, testFiles), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	z := &Zip{}
+	d, err := z.Open("zip://" + p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Test(t, d)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenWithoutPath(t *testing.T) {
+	z := &Zip{}
+	if _, err := z.Open("zip://"); err == nil {
+		t.Fatal("expected err for missing path")
+	}
+}
+
+func TestWithArchiveDuplicateVersion(t *testing.T) {
+	archive := mustZip(t, map[string]string{
+		"1_foo.up.sql":        "",
+		"nested/1_bar.up.sql": "",
+	})
+	_, err := WithArchive(bytes.NewReader(archive), int64(len(archive)))
+	if err == nil {
+		t.Fatal("expected err for duplicate version")
+	}
+	if !strings.Contains(err.Error(), "duplicate migration version 1") {
+		t.Fatalf("expected duplicate version err, got %v", err)
+	}
+}
+
+func TestWithArchiveInvalid(t *testing.T) {
+	archive := []byte("not a zip archive")
+	if _, err := WithArchive(bytes.NewReader(archive), int64(len(archive))); err == nil {
+		t.Fatal("expected err for invalid archive")
+	}
+}
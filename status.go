@@ -0,0 +1,178 @@
+package migrate
+
+import (
+	"sort"
+
+	"github.com/vickxxx/migrate/database"
+)
+
+// Status is the state of the database compared with the source, see
+// Status. It's meant to be encoded as JSON, i.e. for CI to fail a deploy
+// with unexpected pending migrations.
+type Status struct {
+	// Version is the current version, or database.NilVersion
+	// if no migration has been applied.
+	Version int  `json:"version"`
+	Dirty   bool `json:"dirty"`
+
+	// Applied are the versions of the source the database applied, in
+	// the order Up applies them. With database.Historian these are the
+	// versions it recorded, otherwise all up to the current version.
+	Applied []uint `json:"applied"`
+
+	// Pending are the versions of the source the database hasn't applied.
+	Pending []uint `json:"pending"`
+
+	// Orphans are applied versions missing from the source, i.e. of a
+	// migration that was deleted or of a newer release.
+	Orphans []uint `json:"orphans"`
+
+	// Checksums of the migrations that led to applied versions, if the
+	// database driver implements database.Checksummer.
+	Checksums map[uint]string `json:"checksums,omitempty"`
+
+	// Gaps are the versions between the lowest and highest applied ones
+	// that were never applied, see Gaps. Only with database.Historian,
+	// and not for versions that aren't sequential.
+	Gaps []uint `json:"gaps,omitempty"`
+}
+
+// Status returns the state of the database compared with the source,
+// the machine readable superset of Version and Plan. It neither locks
+// nor changes the database.
+func (m *Migrate) Status() (*Status, error) {
+	steps, err := m.Plan()
+	if err != nil {
+		return nil, err
+	}
+	curVersion, dirty, err := m.databaseDrv.Version()
+	if err != nil {
+		return nil, err
+	}
+
+	status := &Status{
+		Version: curVersion,
+		Dirty:   dirty,
+		Applied: make([]uint, 0),
+		Pending: make([]uint, 0),
+		Orphans: make([]uint, 0),
+	}
+
+	// the versions the database applied, as far as it knows
+	applied := make(map[uint]bool)
+	historian, ok := m.databaseDrv.(database.Historian)
+	var versions []int
+	if ok {
+		versions, err = historian.AppliedVersions()
+		if err == ErrNoHistory {
+			ok = false
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if ok {
+		for _, v := range versions {
+			if v >= 0 {
+				applied[uint(v)] = true
+			}
+		}
+		if status.Gaps, err = gaps(versions); err != nil && err != ErrTooManyGaps {
+			return nil, err
+		}
+	} else {
+		for _, s := range steps {
+			applied[s.Version] = s.Applied
+		}
+		if curVersion >= 0 {
+			applied[uint(curVersion)] = true
+		}
+	}
+
+	inSource := make(map[uint]bool, len(steps))
+	for _, s := range steps {
+		inSource[s.Version] = true
+		if applied[s.Version] {
+			status.Applied = append(status.Applied, s.Version)
+		} else {
+			status.Pending = append(status.Pending, s.Version)
+		}
+	}
+	for v, ok := range applied {
+		if ok && !inSource[v] {
+			status.Orphans = append(status.Orphans, v)
+		}
+	}
+	sort.Slice(status.Orphans, func(i, j int) bool { return status.Orphans[i] < status.Orphans[j] })
+
+	if c, ok := m.databaseDrv.(database.Checksummer); ok {
+		checksums, err := c.Checksums()
+		if err != nil {
+			return nil, err
+		}
+		if len(checksums) > 0 {
+			status.Checksums = make(map[uint]string, len(checksums))
+			for v, sum := range checksums {
+				if v >= 0 {
+					status.Checksums[uint(v)] = sum
+				}
+			}
+		}
+	}
+	return status, nil
+}
+
+// maxGaps is the number of gaps Gaps reports at most. Timestamp versions
+// leave huge gaps by design, which aren't worth listing.
+const maxGaps = 10000
+
+// Gaps returns the versions between the lowest and highest applied version
+// that were never applied, in ascending order, whether they are in the
+// source or not, i.e. 3 and 4 if 1, 2 and 5 were applied after a migration
+// was applied out of order. It's meant for sequential versions and returns
+// ErrTooManyGaps if there are more than 10000, i.e. for timestamp versions.
+// It returns ErrNoHistory if the database driver doesn't keep track of
+// applied versions with database.Historian.
+func (m *Migrate) Gaps() ([]uint, error) {
+	historian, ok := m.databaseDrv.(database.Historian)
+	if !ok {
+		return nil, ErrNoHistory
+	}
+	versions, err := historian.AppliedVersions()
+	if err != nil {
+		return nil, err
+	}
+	return gaps(versions)
+}
+
+// gaps returns the versions missing from the applied versions
+// between the lowest and highest one.
+func gaps(versions []int) ([]uint, error) {
+	applied := make(map[uint]bool, len(versions))
+	var min, max uint
+	for _, v := range versions {
+		if v < 0 {
+			continue
+		}
+		if len(applied) == 0 || uint(v) < min {
+			min = uint(v)
+		}
+		if len(applied) == 0 || uint(v) > max {
+			max = uint(v)
+		}
+		applied[uint(v)] = true
+	}
+
+	missing := make([]uint, 0)
+	if len(applied) == 0 {
+		return missing, nil
+	}
+	if max-min+1-uint(len(applied)) > maxGaps {
+		return nil, ErrTooManyGaps
+	}
+	for v := min + 1; v < max; v++ {
+		if !applied[v] {
+			missing = append(missing, v)
+		}
+	}
+	return missing, nil
+}
@@ -0,0 +1,151 @@
+package migrate
+
+import (
+	"encoding/json"
+	"testing"
+
+	dStub "github.com/vickxxx/migrate/database/stub"
+	"github.com/vickxxx/migrate/source"
+	sStub "github.com/vickxxx/migrate/source/stub"
+)
+
+// checksumStub records the applied versions and their checksums.
+type checksumStub struct {
+	historyStub
+	checksums map[int]string
+}
+
+func (s *checksumStub) Checksums() (map[int]string, error) {
+	return s.checksums, nil
+}
+
+func (s *checksumStub) RecordsChecksums() bool {
+	return true
+}
+
+func TestStatus(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	for _, v := range []uint{1, 3, 4} {
+		migrations.Append(&source.Migration{Version: v, Direction: source.Up, Identifier: "CREATE"})
+	}
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	dbDrv := m.databaseDrv.(*dStub.Stub)
+
+	status, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectJSON(t, status, `{"version":-1,"dirty":false,"applied":[],"pending":[1,3,4],"orphans":[]}`)
+
+	dbDrv.CurrentVersion = 3
+	dbDrv.IsDirty = true
+	status, err = m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectJSON(t, status, `{"version":3,"dirty":true,"applied":[1,3],"pending":[4],"orphans":[]}`)
+
+	// version 2 was deleted from the source after it was applied
+	dbDrv.CurrentVersion = 2
+	dbDrv.IsDirty = false
+	status, err = m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectJSON(t, status, `{"version":2,"dirty":false,"applied":[1],"pending":[3,4],"orphans":[2]}`)
+}
+
+func TestStatusHistory(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	migrations := source.NewMigrations()
+	for _, v := range []uint{1, 3, 4} {
+		migrations.Append(&source.Migration{Version: v, Direction: source.Up, Identifier: "CREATE"})
+	}
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+
+	// version 3 is applied out of order, version 5 is of a newer release
+	dbDrv := &checksumStub{
+		historyStub: historyStub{Stub: m.databaseDrv.(*dStub.Stub), applied: []int{1, 4, 5}},
+		checksums:   map[int]string{1: "a1", 4: "b4", 5: "c5"},
+	}
+	dbDrv.CurrentVersion = 5
+	m.databaseDrv = dbDrv
+
+	status, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectJSON(t, status, `{"version":5,"dirty":false,"applied":[1,4],"pending":[3],"orphans":[5],"checksums":{"1":"a1","4":"b4","5":"c5"},"gaps":[2,3]}`)
+}
+
+func TestGaps(t *testing.T) {
+	m, _ := New("stub://", "stub://")
+	if _, err := m.Gaps(); err != ErrNoHistory {
+		t.Fatalf("expected ErrNoHistory, got %v", err)
+	}
+
+	// 3 and 4 were deleted from the source after 5 was applied out of order
+	migrations := source.NewMigrations()
+	for _, v := range []uint{1, 2, 5, 6} {
+		migrations.Append(&source.Migration{Version: v, Direction: source.Up, Identifier: "CREATE"})
+	}
+	m.sourceDrv.(*sStub.Stub).Migrations = migrations
+	dbDrv := &historyStub{Stub: m.databaseDrv.(*dStub.Stub), applied: []int{1, 2, 5}}
+	dbDrv.CurrentVersion = 5
+	m.databaseDrv = dbDrv
+
+	gaps, err := m.Gaps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectJSON(t, gaps, `[3,4]`)
+
+	status, err := m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectJSON(t, status, `{"version":5,"dirty":false,"applied":[1,2,5],"pending":[6],"orphans":[],"gaps":[3,4]}`)
+
+	tt := []struct {
+		applied []int
+		expect  string
+	}{
+		{applied: []int{}, expect: `[]`},
+		{applied: []int{3}, expect: `[]`},
+		{applied: []int{-1, 0, 1, 2}, expect: `[]`},
+		{applied: []int{7, 2, 4}, expect: `[3,5,6]`},
+	}
+	for _, v := range tt {
+		dbDrv.applied = v.applied
+		gaps, err := m.Gaps()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectJSON(t, gaps, v.expect)
+	}
+
+	// timestamp versions aren't sequential
+	dbDrv.applied = []int{20230501120000, 20230602080000}
+	if _, err := m.Gaps(); err != ErrTooManyGaps {
+		t.Fatalf("expected ErrTooManyGaps, got %v", err)
+	}
+	status, err = m.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Gaps != nil {
+		t.Fatalf("expected no gaps in status, got %v", status.Gaps)
+	}
+}
+
+func expectJSON(t *testing.T, v interface{}, expected string) {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != expected {
+		t.Fatalf("expected %v, got %s", expected, b)
+	}
+}
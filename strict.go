@@ -0,0 +1,83 @@
+package migrate
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/vickxxx/migrate/database"
+)
+
+// ErrChecksumMismatch is returned in strict mode, see SetStrict, when the
+// up migration of an applied version changed since it was applied.
+type ErrChecksumMismatch struct {
+	Version    uint
+	Identifier string
+
+	// Recorded is the checksum the database recorded,
+	// Actual the one of the migration in the source.
+	Recorded string
+	Actual   string
+}
+
+// Error implements the error interface.
+func (e ErrChecksumMismatch) Error() string {
+	return fmt.Sprintf("applied migration %v (%v) was changed: checksum %v was recorded, the source has %v",
+		e.Version, e.Identifier, e.Recorded, e.Actual)
+}
+
+// checkChecksums compares the checksums the database recorded with the
+// ones of the up migrations in the source, in ascending version order.
+// Versions after the current one were rolled back and aren't checked, even
+// if the driver still has their checksums.
+func (m *Migrate) checkChecksums() error {
+	checksums, err := m.databaseDrv.(database.Checksummer).Checksums()
+	if err != nil {
+		return err
+	}
+	curVersion, _, err := m.databaseDrv.Version()
+	if err != nil {
+		return err
+	}
+
+	versions := make([]int, 0, len(checksums))
+	for v := range checksums {
+		if v >= 0 && !m.before(curVersion, v) {
+			versions = append(versions, v)
+		}
+	}
+	sort.Ints(versions)
+
+	for _, v := range versions {
+		actual, identifier, err := m.upChecksum(uint(v))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if actual != checksums[v] {
+			return ErrChecksumMismatch{Version: uint(v), Identifier: identifier, Recorded: checksums[v], Actual: actual}
+		}
+	}
+	return nil
+}
+
+// upChecksum returns the hex encoded SHA-256 of the up migration of
+// version in the source, the checksum database drivers record. Like the
+// migration that runs, it's without a leading byte order mark.
+func (m *Migrate) upChecksum(version uint) (sum string, identifier string, err error) {
+	rc, identifier, err := m.sourceDrv.ReadUp(version)
+	if err != nil {
+		return "", "", err
+	}
+	r := newBOMReader(rc)
+	defer r.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), identifier, nil
+}
@@ -2,6 +2,7 @@ package migrate
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	nurl "net/url"
@@ -75,6 +76,39 @@ func (b *slowReader) Close() error {
 	return b.rx.Close()
 }
 
+// utf8BOM is the UTF-8 byte order mark, which editors on Windows
+// put at the start of files.
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// newBOMReader turns an io.ReadCloser into one without a leading
+// UTF-8 byte order mark, which databases reject as part of a statement.
+func newBOMReader(r io.ReadCloser) io.ReadCloser {
+	return &bomReader{
+		rx:     r,
+		reader: bufio.NewReader(r),
+	}
+}
+
+type bomReader struct {
+	rx      io.ReadCloser
+	reader  *bufio.Reader
+	checked bool
+}
+
+func (b *bomReader) Read(p []byte) (n int, err error) {
+	if !b.checked {
+		b.checked = true
+		if start, _ := b.reader.Peek(len(utf8BOM)); bytes.Equal(start, utf8BOM) {
+			b.reader.Discard(len(utf8BOM))
+		}
+	}
+	return b.reader.Read(p)
+}
+
+func (b *bomReader) Close() error {
+	return b.rx.Close()
+}
+
 var errNoScheme = fmt.Errorf("no scheme")
 
 // schemeFromUrl returns the scheme from a URL string